@@ -0,0 +1,147 @@
+package water
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/refraction-networking/water/configbuilder"
+)
+
+// ErrChainNoNetworkListener is returned when creating a Listener or a Relay
+// from a Config with a Chain but no NetworkListener.
+var ErrChainNoNetworkListener = errors.New("water: chain needs a network listener")
+
+// chainNetworkDialerFunc creates a Dialer for every layer of layers,
+// outermost first, the outermost dialing with dial. It returns a
+// NetworkDialerFunc dialing through all of them.
+func chainNetworkDialerFunc(ctx context.Context, layers []*Config, dial func(network, address string) (net.Conn, error)) (func(network, address string) (net.Conn, error), error) {
+	for i, layer := range layers {
+		layer = layer.Clone()
+		layer.NetworkDialerFunc = dial
+
+		dialer, err := NewDialerWithContext(ctx, layer)
+		if err != nil {
+			return nil, fmt.Errorf("water: chain layer %d: %w", i, err)
+		}
+
+		i := i
+		dial = func(network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, fmt.Errorf("water: chain layer %d: %w", i, err)
+			}
+			return conn, nil
+		}
+	}
+	return dial, nil
+}
+
+// chainNetworkListener creates a Listener for every layer of layers,
+// outermost first, the outermost accepting from lis. It returns the
+// innermost one.
+func chainNetworkListener(ctx context.Context, layers []*Config, lis net.Listener) (net.Listener, error) {
+	for i, layer := range layers {
+		layer = layer.Clone()
+		layer.NetworkListener = lis
+
+		listener, err := NewListenerWithContext(ctx, layer)
+		if err != nil {
+			return nil, fmt.Errorf("water: chain layer %d: %w", i, err)
+		}
+		lis = listener
+	}
+	return lis, nil
+}
+
+// innermostDialing returns the Config of the innermost layer of the chain
+// of c, dialing through the other layers.
+func innermostDialing(ctx context.Context, c *Config) (*Config, error) {
+	n := len(c.Chain)
+	dial, err := chainNetworkDialerFunc(ctx, c.Chain[:n-1], c.NetworkDialerFuncOrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	inner := c.Chain[n-1].Clone()
+	inner.NetworkDialerFunc = dial
+	inner.NetworkListener = c.NetworkListener
+	return inner, nil
+}
+
+func newChainDialer(ctx context.Context, c *Config) (Dialer, error) {
+	inner, err := innermostDialing(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return NewDialerWithContext(ctx, inner)
+}
+
+func newChainFixedDialer(ctx context.Context, c *Config) (FixedDialer, error) {
+	inner, err := innermostDialing(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return NewFixedDialerWithContext(ctx, inner)
+}
+
+// newChainRelay creates a Relay from the innermost layer, accepting
+// through the other layers as a Listener would and relaying to remote
+// addresses through them as a Dialer would.
+func newChainRelay(ctx context.Context, c *Config) (Relay, error) {
+	if c.NetworkListener == nil {
+		return nil, ErrChainNoNetworkListener
+	}
+
+	inner, err := innermostDialing(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	inner.NetworkListener, err = chainNetworkListener(ctx, c.Chain[:len(c.Chain)-1], c.NetworkListener)
+	if err != nil {
+		return nil, err
+	}
+	return NewRelayWithContext(ctx, inner)
+}
+
+func newChainListener(ctx context.Context, c *Config) (Listener, error) {
+	if c.NetworkListener == nil {
+		return nil, ErrChainNoNetworkListener
+	}
+
+	n := len(c.Chain)
+	lis, err := chainNetworkListener(ctx, c.Chain[:n-1], c.NetworkListener)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := c.Chain[n-1].Clone()
+	inner.NetworkListener = lis
+	inner.NetworkDialerFunc = c.NetworkDialerFunc
+	return NewListenerWithContext(ctx, inner)
+}
+
+func chainFromJSON(confJson *configbuilder.ConfigJSON) ([]*Config, error) {
+	chain := make([]*Config, 0, len(confJson.Chain))
+	for i := range confJson.Chain {
+		layer := &Config{}
+		if err := layer.unmarshalConfigJSON(&confJson.Chain[i]); err != nil {
+			return nil, fmt.Errorf("water: chain layer %d: %w", i, err)
+		}
+		chain = append(chain, layer)
+	}
+	return chain, nil
+}
+
+func chainFromProto(confProto *configbuilder.ConfigProtoBuf) ([]*Config, error) {
+	chain := make([]*Config, 0, len(confProto.GetChain()))
+	for i, layerProto := range confProto.GetChain() {
+		layer := &Config{}
+		if err := layer.unmarshalConfigProto(layerProto); err != nil {
+			return nil, fmt.Errorf("water: chain layer %d: %w", i, err)
+		}
+		chain = append(chain, layer)
+	}
+	return chain, nil
+}
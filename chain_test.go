@@ -0,0 +1,339 @@
+package water_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/configbuilder/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func init() {
+	err := water.RegisterNativeTransport("chain-xor", func(config []byte) (water.NativeTransport, error) {
+		return wrapFunc(func(conn net.Conn) (net.Conn, error) {
+			return &xorConn{Conn: conn, key: config[0]}, nil
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = water.RegisterNativeTransport("chain-inc", func([]byte) (water.NativeTransport, error) {
+		return wrapFunc(func(conn net.Conn) (net.Conn, error) {
+			return &incConn{Conn: conn}, nil
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// incConn increments every byte written on the wire.
+type incConn struct {
+	net.Conn
+}
+
+func (c *incConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for i := range b[:n] {
+		b[i]--
+	}
+	return n, err
+}
+
+func (c *incConn) Write(b []byte) (int, error) {
+	buf := bytes.Clone(b)
+	for i := range buf {
+		buf[i]++
+	}
+	return c.Conn.Write(buf)
+}
+
+type xorConn struct {
+	net.Conn
+	key byte
+}
+
+func (c *xorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for i := range b[:n] {
+		b[i] ^= c.key
+	}
+	return n, err
+}
+
+func (c *xorConn) Write(b []byte) (int, error) {
+	buf := bytes.Clone(b)
+	for i := range buf {
+		buf[i] ^= c.key
+	}
+	return c.Conn.Write(buf)
+}
+
+// chainXorReverse is a chain with the reverse WATM, reversing the order of
+// the bytes of every write, over a native transport incrementing every
+// byte, over a native transport XORing them with 0x42.
+func chainXorReverse() []*water.Config {
+	return []*water.Config{
+		{NativeTransport: "chain-xor", TransportModuleConfig: water.TransportModuleConfigFromBytes([]byte{0x42})},
+		{NativeTransport: "chain-inc"},
+		{TransportModuleBin: wasmReverse},
+	}
+}
+
+func TestChain(t *testing.T) {
+	t.Run("dialer layer order", testChainDialerOrder)
+	t.Run("dialer and listener", testChainDialerListener)
+	t.Run("close propagation", testChainClose)
+	t.Run("relay", testChainRelay)
+	t.Run("without network listener", testChainNoListener)
+	t.Run("JSON", testChainJSON)
+	t.Run("Protobuf", testChainProto)
+}
+
+func testChainDialerOrder(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	msg := []byte("hello, chain")
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		buf := make([]byte, len(msg))
+		_, _ = io.ReadFull(conn, buf)
+		received <- buf
+	}()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{Chain: chainXorReverse()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wire := <-received:
+		for i := range wire {
+			if wire[i] != (msg[len(msg)-1-i]+1)^0x42 {
+				t.Fatalf("wire = %x, want %q reversed, incremented, then XORed with 0x42", wire, msg)
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func chainRoundTrip(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, msg) {
+		t.Fatalf("echoed %q, want %q", echoed, msg)
+	}
+}
+
+func testChainDialerListener(t *testing.T) {
+	config := &water.Config{Chain: chainXorReverse()}
+
+	lis, err := config.ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	chainRoundTrip(t, conn, []byte("hello, layers"))
+	chainRoundTrip(t, conn, bytes.Repeat([]byte{0xAB}, 1<<16))
+}
+
+func testChainClose(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.Copy(io.Discard, conn)
+		closed <- err
+	}()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{Chain: chainXorReverse()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the innermost layer reaches the network connection
+	if err := <-closed; err != nil {
+		t.Errorf("network connection not closed: %v", err)
+	}
+}
+
+func testChainRelay(t *testing.T) {
+	// the remote end unwraps the layers of the relay
+	config := &water.Config{Chain: chainXorReverse()}
+	lis, err := config.ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(conn, buf)
+		received <- buf
+	}()
+
+	relayLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayConfig := &water.Config{Chain: chainXorReverse(), NetworkListener: relayLis}
+	relay, err := water.NewRelayWithContext(context.Background(), relayConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close() // skipcq: GO-S2307
+	go func() {
+		_ = relay.RelayTo("tcp", lis.Addr().String())
+	}()
+
+	// the source wraps the outer layers the relay accepts through
+	sourceDialer, err := water.NewDialerWithContext(context.Background(), &water.Config{Chain: chainXorReverse()[:2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := sourceDialer.Dial("tcp", relayLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close() // skipcq: GO-S2307
+
+	if _, err := source.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received:
+		if string(b) != "hello" {
+			t.Errorf("received %q through the relay, want %q", b, "hello")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func testChainNoListener(t *testing.T) {
+	if _, err := water.NewListenerWithContext(context.Background(), &water.Config{Chain: chainXorReverse()}); err != water.ErrChainNoNetworkListener {
+		t.Errorf("err = %v, want %v", err, water.ErrChainNoNetworkListener)
+	}
+	if _, err := water.NewRelayWithContext(context.Background(), &water.Config{Chain: chainXorReverse()}); err != water.ErrChainNoNetworkListener {
+		t.Errorf("relay err = %v, want %v", err, water.ErrChainNoNetworkListener)
+	}
+}
+
+func testChainJSON(t *testing.T) {
+	var c water.Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {},
+		"chain": [
+			{"transport_module": {"native": "chain-xor"}},
+			{"transport_module": {"native": "multi-ok"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Chain) != 2 || c.Chain[0].NativeTransport != "chain-xor" || c.Chain[1].NativeTransport != "multi-ok" {
+		t.Errorf("Chain = %v, want chain-xor then multi-ok", c.Chain)
+	}
+}
+
+func testChainProto(t *testing.T) {
+	b, err := proto.Marshal(&pb.Config{
+		Chain: []*pb.Config{
+			{TransportModule: &pb.TransportModule{Native: "chain-xor", Config: []byte{0x42}}},
+			{TransportModule: &pb.TransportModule{Native: "multi-ok"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c water.Config
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Chain) != 2 || c.Chain[0].NativeTransport != "chain-xor" || c.Chain[1].NativeTransport != "multi-ok" {
+		t.Fatalf("Chain = %v, want chain-xor then multi-ok", c.Chain)
+	}
+	if !bytes.Equal(c.Chain[0].TransportModuleConfig.AsBytes(), []byte{0x42}) {
+		t.Errorf("layer 0 config = %x, want 42", c.Chain[0].TransportModuleConfig.AsBytes())
+	}
+}
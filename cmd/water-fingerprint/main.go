@@ -0,0 +1,121 @@
+// Command water-fingerprint runs a workload through a WATM and prints a
+// JSON report of what its traffic looks like on the wire.
+//
+// If -baseline is given, the report is compared to a previously saved one
+// and the command exits with status 1 if they differ.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/refraction-networking/water"
+	_ "github.com/refraction-networking/water/transport/v0"
+	_ "github.com/refraction-networking/water/transport/v1"
+	"github.com/refraction-networking/water/watertest/fingerprint"
+)
+
+var (
+	wasmPath         = flag.String("wasm", "", "path to wasm file")
+	listenerWasmPath = flag.String("listener-wasm", "", "path to wasm file for the listener, defaults to -wasm")
+	connections      = flag.Int("conns", 1, "number of connections")
+	messages         = flag.Int("messages", 16, "number of messages per connection")
+	sizes            = flag.String("sizes", "", "comma separated message sizes, used in turn")
+	interval         = flag.Duration("interval", 0, "pause between messages")
+	echo             = flag.Bool("echo", true, "echo every message back")
+	payload          = flag.String("payload", string(fingerprint.PayloadRandom), "payload: random, text or zero")
+	seed             = flag.Int64("seed", 0, "payload generator seed")
+	baselinePath     = flag.String("baseline", "", "path to a baseline report to compare against")
+	outPath          = flag.String("o", "", "write the report to this file instead of stdout")
+	timeout          = flag.Duration("timeout", time.Minute, "overall timeout")
+)
+
+func main() {
+	flag.Parse()
+
+	wasm, err := os.ReadFile(*wasmPath)
+	if err != nil {
+		fatalf("failed to read wasm file: %v", err)
+	}
+
+	r := &fingerprint.Runner{
+		DialerConfig: &water.Config{TransportModuleBin: wasm},
+		Workload: fingerprint.Workload{
+			Connections: *connections,
+			Messages:    *messages,
+			Interval:    *interval,
+			Echo:        *echo,
+			Payload:     fingerprint.Payload(*payload),
+			Seed:        *seed,
+		},
+	}
+	if *listenerWasmPath != "" {
+		listenerWasm, err := os.ReadFile(*listenerWasmPath)
+		if err != nil {
+			fatalf("failed to read listener wasm file: %v", err)
+		}
+		r.ListenerConfig = &water.Config{TransportModuleBin: listenerWasm}
+	}
+	if *sizes != "" {
+		for _, s := range strings.Split(*sizes, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || size <= 0 {
+				fatalf("invalid message size %q", s)
+			}
+			r.Workload.Sizes = append(r.Workload.Sizes, size)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report, err := r.Run(ctx)
+	if err != nil {
+		fatalf("failed to run workload: %v", err)
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fatalf("failed to marshal report: %v", err)
+	}
+	out = append(out, '\n')
+	if *outPath != "" {
+		err = os.WriteFile(*outPath, out, 0o644) // skipcq: GSC-G306
+	} else {
+		_, err = os.Stdout.Write(out)
+	}
+	if err != nil {
+		fatalf("failed to write report: %v", err)
+	}
+
+	if *baselinePath == "" {
+		return
+	}
+
+	b, err := os.ReadFile(*baselinePath)
+	if err != nil {
+		fatalf("failed to read baseline: %v", err)
+	}
+	var baseline fingerprint.Report
+	if err := json.Unmarshal(b, &baseline); err != nil {
+		fatalf("failed to parse baseline: %v", err)
+	}
+
+	if diffs := report.Diff(&baseline); len(diffs) > 0 {
+		for _, d := range diffs {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
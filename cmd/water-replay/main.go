@@ -0,0 +1,60 @@
+// Command water-replay replays a session recorded with
+// [water.Config.SessionRecorder] against a WATM and reports where the
+// WATM's behavior diverges from the recording.
+//
+// It exits with status 1 if the replay diverges.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/refraction-networking/water/recording"
+	"github.com/refraction-networking/water/recording/replay"
+)
+
+var (
+	wasmPath    = flag.String("wasm", "", "path to wasm file")
+	recPath     = flag.String("rec", "", "path to recording file")
+	idleTimeout = flag.Duration("idle", replay.DefaultIdleTimeout, "how long a stream may stay silent before it is considered done")
+	timeout     = flag.Duration("timeout", time.Minute, "overall replay timeout")
+)
+
+func main() {
+	flag.Parse()
+
+	wasm, err := os.ReadFile(*wasmPath)
+	if err != nil {
+		fatalf("failed to read wasm file: %v", err)
+	}
+
+	rec, err := recording.Open(*recPath)
+	if err != nil {
+		fatalf("failed to open recording: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	r := &replay.Replayer{
+		ModuleBin:   wasm,
+		IdleTimeout: *idleTimeout,
+	}
+	report, err := r.Run(ctx, rec)
+	if err != nil {
+		fatalf("failed to replay: %v", err)
+	}
+
+	fmt.Print(report)
+	if report.Diverged() {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
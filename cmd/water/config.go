@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/refraction-networking/water"
+)
+
+// commonFlags are the flags shared by all commands.
+type commonFlags struct {
+	configPath string
+	format     string
+	grace      time.Duration
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.configPath, "config", "", "path to the config file")
+	fs.StringVar(&c.format, "format", "", "config format: json or proto, detected from the file if unset")
+	fs.DurationVar(&c.grace, "grace", 10*time.Second, "how long live connections may take to finish on shutdown")
+}
+
+// loadConfig reads the config file.
+func (c *commonFlags) loadConfig() (*water.Config, error) {
+	if c.configPath == "" {
+		return nil, fmt.Errorf("-config is required")
+	}
+
+	b, err := os.ReadFile(c.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	format := c.format
+	if format == "" {
+		format = detectFormat(c.configPath, b)
+	}
+
+	config := &water.Config{}
+	switch format {
+	case "json":
+		err = config.UnmarshalJSON(b)
+	case "proto":
+		err = config.UnmarshalProto(b)
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s config: %w", format, err)
+	}
+
+	return config, nil
+}
+
+// detectFormat guesses the format of a config file from its extension,
+// falling back to its content.
+func detectFormat(path string, b []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".pb", ".binpb", ".bin":
+		return "proto"
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return "json"
+	}
+	return "proto"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/log"
+	"github.com/refraction-networking/water/proxy/httpproxy"
+	"github.com/refraction-networking/water/proxy/socks5"
+)
+
+func runDial(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := flag.NewFlagSet("water dial", flag.ExitOnError)
+	common.register(fs)
+	listen := fs.String("listen", "127.0.0.1:1080", "local address to accept plain TCP, SOCKS5 or HTTP proxy connections on")
+	remote := fs.String("remote", "", "address the Dialer dials for every local connection")
+	socks := fs.Bool("socks", false, "speak SOCKS5 on the local address and dial the requested destinations, over TCP only")
+	httpProxy := fs.Bool("http", false, "serve as an HTTP proxy on the local address and dial the requested destinations")
+	auth := fs.String("auth", "", "require SOCKS5 or HTTP proxy clients to authenticate as user:password")
+	validate := fs.Bool("validate", false, "check SOCKS5 or HTTP proxy destinations against the address validation of the config")
+	idleTimeout := fs.Duration("idle-timeout", 0, "close HTTP proxy tunnels and client connections idle for that long")
+	_ = fs.Parse(args)
+
+	modes := 0
+	for _, set := range []bool{*remote != "", *socks, *httpProxy} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return errors.New("exactly one of -remote, -socks and -http is required")
+	}
+	if *remote != "" && (*auth != "" || *validate) {
+		return errors.New("-auth and -validate require -socks or -http")
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	if config.NetworkListener != nil { // only used by listen and relay
+		_ = config.NetworkListener.Close()
+		config.NetworkListener = nil
+	}
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		return fmt.Errorf("failed to create dialer: %w", err)
+	}
+
+	var credentials map[string]string
+	if *auth != "" {
+		username, password, ok := strings.Cut(*auth, ":")
+		if !ok {
+			return errors.New("-auth must be user:password")
+		}
+		credentials = map[string]string{username: password}
+	}
+	var validator func(network, address string) error
+	if *validate {
+		validator = config.DialedAddressValidator
+	}
+
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+
+	if *httpProxy {
+		log.Infof("accepting HTTP proxy connections on %s", lis.Addr())
+		return serveHTTPProxy(ctx, lis, &httpproxy.Server{
+			Dial:             water.NetDialContextFunc(dialer),
+			Credentials:      credentials,
+			AddressValidator: validator,
+			IdleTimeout:      *idleTimeout,
+			AccessLog: func(entry *httpproxy.AccessLogEntry) {
+				log.Infof("%s", entry)
+			},
+		}, common.grace)
+	}
+
+	handle := func(conn net.Conn) {
+		tunnel, err := dialer.DialContext(context.Background(), "tcp", *remote)
+		if err != nil {
+			log.Warnf("failed to dial %s: %v", *remote, err)
+			_ = conn.Close()
+			return
+		}
+		pipe(conn, tunnel)
+	}
+	if *socks {
+		log.Infof("accepting SOCKS5 connections on %s", lis.Addr())
+		server := &socks5.Server{
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			},
+			Credentials:      credentials,
+			AddressValidator: validator,
+		}
+		handle = func(conn net.Conn) {
+			if err := server.ServeConn(conn); err != nil {
+				log.Warnf("SOCKS5: %v", err)
+			}
+		}
+	} else {
+		log.Infof("accepting connections on %s, tunneling to %s", lis.Addr(), *remote)
+	}
+
+	s := &session{}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.serve(lis, handle)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down")
+	_ = lis.Close()
+	<-errCh
+	s.drain(common.grace)
+	return nil
+}
+
+// serveHTTPProxy serves proxy on lis until ctx is done, then gives live
+// requests up to grace to finish. Open tunnels are closed on exit.
+func serveHTTPProxy(ctx context.Context, lis net.Listener, proxy *httpproxy.Server, grace time.Duration) error {
+	server := &http.Server{
+		Handler:           proxy,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       proxy.IdleTimeout,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(lis)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Warnf("closing requests still running after %v", grace)
+		_ = server.Close()
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/refraction-networking/water"
+)
+
+func runInspect(_ context.Context, args []string) error {
+	fs := flag.NewFlagSet("water inspect", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: water inspect [-json] <file.wasm>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	bin, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	info, err := water.InspectModule(bin)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(info)
+	} else {
+		_, err = fmt.Print(info)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Make problems visible to scripts through the exit status.
+	if len(info.Versions) == 0 {
+		return errors.New("no known WATM version detected")
+	}
+	for _, v := range info.Versions {
+		if !v.Complete() {
+			return fmt.Errorf("WATM %s is missing required exports", v.Version)
+		}
+	}
+	if u := info.Unsatisfied(); len(u) > 0 {
+		return fmt.Errorf("%d imports cannot be satisfied", len(u))
+	}
+	return nil
+}
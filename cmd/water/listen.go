@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/log"
+)
+
+func runListen(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := flag.NewFlagSet("water listen", flag.ExitOnError)
+	common.register(fs)
+	listen := fs.String("listen", "", "address to accept connections on, overrides the listener in the config")
+	forward := fs.String("forward", "", "local address to forward accepted connections to")
+	_ = fs.Parse(args)
+
+	if *forward == "" {
+		return errors.New("-forward is required")
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var lis water.Listener
+	switch {
+	case *listen != "":
+		if config.NetworkListener != nil {
+			_ = config.NetworkListener.Close()
+			config.NetworkListener = nil
+		}
+		lis, err = config.ListenContext(context.Background(), "tcp", *listen)
+	case config.NetworkListener != nil:
+		lis, err = water.NewListenerWithContext(context.Background(), config)
+	default:
+		return errors.New("no listener in the config, -listen is required")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create listener: %w", err)
+	}
+	log.Infof("listening on %s, forwarding to %s", lis.Addr(), *forward)
+
+	s := &session{}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.serve(lis, func(conn net.Conn) {
+			target, err := net.Dial("tcp", *forward)
+			if err != nil {
+				log.Warnf("failed to dial %s: %v", *forward, err)
+				_ = conn.Close()
+				return
+			}
+			pipe(conn, target)
+		})
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down")
+	_ = lis.Close()
+	<-errCh
+	s.drain(common.grace)
+	return nil
+}
@@ -0,0 +1,75 @@
+// Command water runs a WATER Dialer, Listener or Relay from a config file.
+//
+// The config file is either a JSON encoded [configbuilder.ConfigJSON] or a
+// protobuf encoded Config as defined in configbuilder/pb/config.proto.
+//
+// Usage:
+//
+//	water relay  -config <file> [-listen <addr>] -target <addr>
+//	water listen -config <file> [-listen <addr>] -forward <addr>
+//	water dial   -config <file> -listen <addr> (-remote <addr> | (-socks | -http) [-auth <user:password>] [-validate])
+//	water inspect [-json] <file.wasm>
+//
+// With -socks, only CONNECT is served: a WATER Dialer carries no
+// datagrams, so UDP ASSOCIATE is refused.
+//
+// SIGINT and SIGTERM stop accepting new connections and give live ones
+// up to -grace to finish.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	_ "github.com/refraction-networking/water/transport/v0"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"relay", "relay connections accepted through the WATM to a target", runRelay},
+	{"listen", "accept connections through the WATM and forward them to a local target", runListen},
+	{"dial", "expose a local plain TCP, SOCKS5 or HTTP proxy port tunneled through the WATM", runDial},
+	{"inspect", "report the versions, exports, imports, memories and custom sections of a WATM", runInspect},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != os.Args[1] {
+			continue
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := cmd.run(ctx, os.Args[2:])
+		stop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "water %s: %v\n", cmd.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: water <command> [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'water <command> -h' for the flags of a command\n")
+}
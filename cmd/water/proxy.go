@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water/internal/log"
+)
+
+// session tracks the connections being proxied so they can be given time
+// to finish on shutdown.
+type session struct {
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// serve accepts connections from lis until it is closed and hands each of
+// them to handle in its own goroutine.
+func (s *session) serve(lis net.Listener, handle func(net.Conn)) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.track(conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			handle(conn)
+		}()
+	}
+}
+
+func (s *session) track(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *session) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, conn)
+}
+
+// drain waits up to grace for the live connections to finish, then closes
+// the remaining ones.
+func (s *session) drain(grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	s.mutex.Lock()
+	log.Warnf("closing %d connections still open after %v", len(s.conns), grace)
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mutex.Unlock()
+	<-done
+}
+
+// pipe copies data between a and b in both directions until both are
+// done, then closes them.
+func pipe(a, b net.Conn) {
+	defer a.Close() // skipcq: GO-S2307
+	defer b.Close() // skipcq: GO-S2307
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(b, a)
+	}()
+	wg.Wait()
+}
+
+func copyAndCloseWrite(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/log"
+)
+
+func runRelay(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := flag.NewFlagSet("water relay", flag.ExitOnError)
+	common.register(fs)
+	listen := fs.String("listen", "", "address to accept connections on, overrides the listener in the config")
+	target := fs.String("target", "", "address to relay connections to")
+	_ = fs.Parse(args)
+
+	if *target == "" {
+		return errors.New("-target is required")
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	if *listen != "" && config.NetworkListener != nil {
+		_ = config.NetworkListener.Close()
+		config.NetworkListener = nil
+	}
+	if *listen == "" && config.NetworkListener == nil {
+		return errors.New("no listener in the config, -listen is required")
+	}
+
+	relay, err := water.NewRelayWithContext(context.Background(), config)
+	if err != nil {
+		return fmt.Errorf("failed to create relay: %w", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if *listen != "" {
+			errCh <- relay.ListenAndRelayTo("tcp", *listen, "tcp", *target)
+		} else {
+			errCh <- relay.RelayTo("tcp", *target)
+		}
+	}()
+	log.Infof("relaying to %s", *target)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), common.grace)
+	defer cancel()
+	err = relay.Shutdown(shutdownCtx)
+	switch {
+	case errors.Is(err, water.ErrUnimplementedRelay): // the relay cannot drain
+		err = relay.Close()
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Warnf("closed connections still open after %v", common.grace)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return <-errCh
+}
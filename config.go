@@ -4,11 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"slices"
 
 	"github.com/refraction-networking/water/configbuilder"
 	"github.com/refraction-networking/water/internal/log"
+	"github.com/refraction-networking/water/pcapng"
+	"github.com/refraction-networking/water/recording"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -25,10 +30,22 @@ type Config struct {
 	// the WASM Transport Module.
 	TransportModuleConfig TransportModuleConfig
 
+	// NativeTransport optionally names a [NativeTransport] registered with
+	// [RegisterNativeTransport] to be used instead of a WebAssembly
+	// Transport Module, in which case TransportModuleBin is ignored and
+	// TransportModuleConfig is passed to the NativeTransport.
+	//
+	// The driver of native transports must be enabled by importing
+	// `transport/native`.
+	NativeTransport string
+
 	// NetworkDialerFunc specifies a func that dials the specified address on the
 	// named network. This optional field can be set to override the Go
 	// default dialer func:
 	// 	net.Dial(network, address)
+	//
+	// An upstream proxy set in a JSON or protobuf config wraps this func,
+	// see [UpstreamProxyDialerFunc].
 	NetworkDialerFunc func(network, address string) (net.Conn, error)
 
 	// DialedAddressValidator is an optional field that can be set to validate
@@ -47,6 +64,45 @@ type Config struct {
 	// Calling (*Config).Listen will override this field.
 	NetworkListener net.Listener
 
+	// FallbackAddresses optionally lists, in order of preference, other
+	// addresses of the remote end for a [Tunnel] to dial with a [Dialer]
+	// when its [FixedDialer] fails.
+	FallbackAddresses []FallbackAddress
+
+	// AcceptProxyProtocol, if set, makes a v1 Listener or Relay read a
+	// PROXY protocol header, of either version, at the start of every
+	// connection accepted from NetworkListener before handing it to the
+	// WATM, so that its RemoteAddr is the one of the client behind a load
+	// balancer. Connections without a valid header are closed.
+	//
+	// Anyone able to connect to NetworkListener can then claim any client
+	// address, so set TrustedProxyNetworks unless only the load balancer
+	// can reach it.
+	AcceptProxyProtocol bool
+
+	// TrustedProxyNetworks, if set, restricts AcceptProxyProtocol to the
+	// connections from these networks, e.g., of the load balancer. Other
+	// connections are closed.
+	TrustedProxyNetworks []netip.Prefix
+
+	// SendProxyProtocol, if set to 1 or 2, makes a v1 Relay send a PROXY
+	// protocol header of that version at the start of every connection it
+	// dials, carrying the addresses of the connection it relays.
+	SendProxyProtocol byte
+
+	// DynamicRelay, if set, lets the WATM of a v1 Relay pick the
+	// destination of every relayed connection, e.g., from a header of its
+	// protocol, and dial it with water_dial, subject to
+	// DialedAddressValidator. Every destination dialed is logged with the
+	// relay session. The address passed to RelayTo or ListenAndRelayTo is
+	// then only dialed by water_dial_fixed, and may be empty.
+	DynamicRelay bool
+
+	// UpstreamPool, if set, makes a v1 Relay relay every connection to an
+	// upstream of the pool instead of the address passed to RelayTo or
+	// ListenAndRelayTo, which may then be empty.
+	UpstreamPool *UpstreamPool
+
 	// ModuleConfigFactory is used to configure the system resource of
 	// each WASM instance created. This field is for advanced use cases
 	// and/or debugging purposes only.
@@ -70,9 +126,53 @@ type Config struct {
 	// of the WATER API. If this field is unset, the default logger from the slog
 	// package will be used.
 	OverrideLogger *log.Logger
+
+	// SessionRecorder, if set, records every WATM session created with
+	// this Config to a file for offline replay. See package recording.
+	//
+	// Recordings contain all plaintext exchanged with the caller and are
+	// meant for debugging only. While recording, the addresses reported by
+	// network connections handed to the WATM are local ones.
+	SessionRecorder *recording.Recorder
+
+	// PacketCapture, if set, writes the network traffic of every WATM
+	// instance created with this Config to pcapng files, optionally
+	// along with the plaintext exchanged with the caller. See package
+	// pcapng.
+	//
+	// As with SessionRecorder, the addresses reported by network
+	// connections handed to the WATM are local ones while capturing.
+	PacketCapture *pcapng.Capture
+
+	// Routing, if set, is the routing table used by a [RoutingDialer] to
+	// pick a transport per destination. It is loaded from the "routing"
+	// section of a JSON or protobuf config, in which case the transport
+	// module of the config itself is optional.
+	Routing *RoutingTable
+
+	// Chain, if set, stacks the transports of its Configs on a single
+	// connection, from the outermost one, on the network, to the
+	// innermost one, talking to the caller. The transport of this Config
+	// is then ignored, but its NetworkDialerFunc and NetworkListener are
+	// used by the outermost layer.
+	//
+	//	       +-----------+     +-----------+     +-----------+
+	//	Caller | Chain[2]  |---->| Chain[1]  |---->| Chain[0]  |----> Network
+	//	       | innermost |     |           |     | outermost |
+	//	       +-----------+     +-----------+     +-----------+
+	//
+	// The innermost layer is created as the requested Dialer,
+	// FixedDialer, Listener or Relay, and the others as Dialers, or
+	// Listeners for a Listener. A Relay accepts through the outer layers
+	// as Listeners and relays through them as Dialers, and needs a
+	// NetworkListener like a Listener does. UpdateTransportConfig applies
+	// to the innermost layer.
+	Chain []*Config
 }
 
-// Clone creates a deep copy of the Config.
+// Clone creates a deep copy of the Config, down to the layers of its Chain
+// and the Configs of its Routing. Listeners, functions, pools, recorders
+// and captures are shared with the copy.
 func (c *Config) Clone() *Config {
 	if c == nil {
 		return nil
@@ -84,15 +184,38 @@ func (c *Config) Clone() *Config {
 	return &Config{
 		TransportModuleBin:     wasmClone,
 		TransportModuleConfig:  c.TransportModuleConfig,
+		NativeTransport:        c.NativeTransport,
 		NetworkDialerFunc:      c.NetworkDialerFunc,
 		DialedAddressValidator: c.DialedAddressValidator,
 		NetworkListener:        c.NetworkListener,
+		FallbackAddresses:      c.FallbackAddresses,
+		AcceptProxyProtocol:    c.AcceptProxyProtocol,
+		TrustedProxyNetworks:   slices.Clone(c.TrustedProxyNetworks),
+		SendProxyProtocol:      c.SendProxyProtocol,
+		DynamicRelay:           c.DynamicRelay,
+		UpstreamPool:           c.UpstreamPool,
 		ModuleConfigFactory:    c.ModuleConfigFactory.Clone(),
 		RuntimeConfigFactory:   c.RuntimeConfigFactory.Clone(),
 		OverrideLogger:         c.OverrideLogger,
+		SessionRecorder:        c.SessionRecorder,
+		PacketCapture:          c.PacketCapture,
+		Routing:                c.Routing.Clone(),
+		Chain:                  cloneChain(c.Chain),
 	}
 }
 
+func cloneChain(chain []*Config) []*Config {
+	if chain == nil {
+		return nil
+	}
+
+	clone := make([]*Config, len(chain))
+	for i, layer := range chain {
+		clone[i] = layer.Clone()
+	}
+	return clone
+}
+
 // NetworkDialerFuncOrDefault returns the DialerFunc if it is not nil, otherwise
 // returns the default net.Dial function.
 func (c *Config) NetworkDialerFuncOrDefault() func(network, address string) (net.Conn, error) {
@@ -187,8 +310,18 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	// Load TMBin if not already set
-	if c.TransportModuleBin == nil {
+	return c.unmarshalConfigJSON(&confJson)
+}
+
+func (c *Config) unmarshalConfigJSON(confJson *configbuilder.ConfigJSON) (err error) {
+	if c.NativeTransport == "" {
+		c.NativeTransport = confJson.TransportModule.Native
+	}
+
+	// Load TMBin if not already set, unless a native transport is used, or
+	// the config only serves to route to or chain other transports
+	routingOnly := (hasRoutingJSON(confJson) || len(confJson.Chain) > 0) && confJson.TransportModule.BinPath == ""
+	if c.TransportModuleBin == nil && c.NativeTransport == "" && !routingOnly {
 		tmBin, err := os.ReadFile(confJson.TransportModule.BinPath)
 		if err != nil {
 			return err
@@ -214,13 +347,55 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		c.DialedAddressValidator = a.validate
 	}
 
-	if len(confJson.Network.Listener.Network) > 0 && len(confJson.Network.Listener.Address) > 0 {
-		c.NetworkListener, err = net.Listen(confJson.Network.Listener.Network, confJson.Network.Listener.Address)
+	listenerJson := &confJson.Network.Listener
+	lis, err := listen(listenerJson.Network, listenerJson.Address, listenerJson.Fd, listenerJson.Systemd, listenerJson.SystemdName)
+	if err != nil {
+		return err
+	}
+	if lis != nil {
+		c.NetworkListener = lis
+	}
+
+	if len(confJson.Network.UpstreamProxy) > 0 {
+		if err := c.upstreamProxyDialerFunc(confJson.Network.UpstreamProxy); err != nil {
+			return err
+		}
+	}
+
+	if !c.AcceptProxyProtocol {
+		c.AcceptProxyProtocol = confJson.Network.ProxyProtocol.Accept
+	}
+	if len(c.TrustedProxyNetworks) == 0 {
+		if err := c.setTrustedProxyNetworks(confJson.Network.ProxyProtocol.TrustedNetworks); err != nil {
+			return err
+		}
+	}
+	if c.SendProxyProtocol == 0 {
+		if err := c.setSendProxyProtocol(confJson.Network.ProxyProtocol.Send); err != nil {
+			return err
+		}
+	}
+
+	if !c.DynamicRelay {
+		c.DynamicRelay = confJson.Network.DynamicRelay
+	}
+
+	if c.UpstreamPool == nil && len(confJson.Network.UpstreamPool.Upstreams) > 0 {
+		c.UpstreamPool, err = upstreamPoolFromJSON(confJson)
 		if err != nil {
 			return err
 		}
 	}
 
+	if c.FallbackAddresses == nil {
+		for _, fallback := range confJson.Network.FallbackAddresses {
+			c.FallbackAddresses = append(c.FallbackAddresses, FallbackAddress{
+				Network: fallback.Network,
+				Address: fallback.Address,
+			})
+		}
+	}
+
 	c.ModuleConfigFactory = NewWazeroModuleConfigFactory()
 	if len(confJson.Module.Argv) > 0 {
 		c.ModuleConfigFactory.SetArgv(confJson.Module.Argv)
@@ -261,6 +436,20 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		c.RuntimeConfig().SetCloseOnContextDone(false)
 	}
 
+	if c.Routing == nil && hasRoutingJSON(confJson) {
+		c.Routing, err = routingTableFromJSON(confJson)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Chain == nil && len(confJson.Chain) > 0 {
+		c.Chain, err = chainFromJSON(confJson)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -278,8 +467,18 @@ func (c *Config) UnmarshalProto(b []byte) error {
 		return err
 	}
 
-	// Parse TransportModuleBin if not already set
-	if c.TransportModuleBin == nil {
+	return c.unmarshalConfigProto(&confProto)
+}
+
+func (c *Config) unmarshalConfigProto(confProto *configbuilder.ConfigProtoBuf) (err error) {
+	if c.NativeTransport == "" {
+		c.NativeTransport = confProto.GetTransportModule().GetNative()
+	}
+
+	// Parse TransportModuleBin if not already set, unless a native transport is used,
+	// or the config only serves to route to or chain other transports
+	routingOnly := (hasRoutingProto(confProto) || len(confProto.GetChain()) > 0) && len(confProto.GetTransportModule().GetBin()) == 0
+	if c.TransportModuleBin == nil && c.NativeTransport == "" && !routingOnly {
 		c.TransportModuleBin = confProto.GetTransportModule().GetBin()
 		if len(c.TransportModuleBin) == 0 {
 			return errors.New("water: transport module binary is not provided in config")
@@ -317,14 +516,64 @@ func (c *Config) UnmarshalProto(b []byte) error {
 	}
 
 	// Parse NetworkListener
-	listenerNetwork, listenerAddress := confProto.GetNetwork().GetListener().GetNetwork(), confProto.GetNetwork().GetListener().GetAddress()
-	if len(listenerNetwork) > 0 && len(listenerAddress) > 0 {
-		c.NetworkListener, err = net.Listen(listenerNetwork, listenerAddress)
+	listenerProto := confProto.GetNetwork().GetListener()
+	var fd *uint32
+	if listenerProto != nil {
+		fd = listenerProto.Fd
+	}
+	lis, err := listen(listenerProto.GetNetwork(), listenerProto.GetAddress(), fd, listenerProto.GetSystemd(), listenerProto.GetSystemdName())
+	if err != nil {
+		return err
+	}
+	if lis != nil {
+		c.NetworkListener = lis
+	}
+
+	// Parse UpstreamProxy, wrapping NetworkDialerFunc
+	if upstreamProxy := confProto.GetNetwork().GetUpstreamProxy(); len(upstreamProxy) > 0 {
+		if err := c.upstreamProxyDialerFunc(upstreamProxy); err != nil {
+			return err
+		}
+	}
+
+	// Parse ProxyProtocol if not already set
+	if !c.AcceptProxyProtocol {
+		c.AcceptProxyProtocol = confProto.GetNetwork().GetProxyProtocol().GetAccept()
+	}
+	if len(c.TrustedProxyNetworks) == 0 {
+		if err := c.setTrustedProxyNetworks(confProto.GetNetwork().GetProxyProtocol().GetTrustedNetworks()); err != nil {
+			return err
+		}
+	}
+	if c.SendProxyProtocol == 0 {
+		if err := c.setSendProxyProtocol(confProto.GetNetwork().GetProxyProtocol().GetSend()); err != nil {
+			return err
+		}
+	}
+
+	// Parse DynamicRelay if not already set
+	if !c.DynamicRelay {
+		c.DynamicRelay = confProto.GetNetwork().GetDynamicRelay()
+	}
+
+	// Parse UpstreamPool if not already set
+	if c.UpstreamPool == nil && len(confProto.GetNetwork().GetUpstreamPool().GetUpstreams()) > 0 {
+		c.UpstreamPool, err = upstreamPoolFromProto(confProto)
 		if err != nil {
 			return err
 		}
 	}
 
+	// Parse FallbackAddresses if not already set
+	if c.FallbackAddresses == nil {
+		for _, fallback := range confProto.GetNetwork().GetFallbackAddresses() {
+			c.FallbackAddresses = append(c.FallbackAddresses, FallbackAddress{
+				Network: fallback.GetNetwork(),
+				Address: fallback.GetAddress(),
+			})
+		}
+	}
+
 	// Parse ModuleConfigFactory
 	c.ModuleConfigFactory = NewWazeroModuleConfigFactory()
 	if len(confProto.GetModule().GetArgv()) > 0 {
@@ -365,5 +614,40 @@ func (c *Config) UnmarshalProto(b []byte) error {
 		c.RuntimeConfig().SetCloseOnContextDone(false)
 	}
 
+	if c.Routing == nil && hasRoutingProto(confProto) {
+		c.Routing, err = routingTableFromProto(confProto)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Chain == nil && len(confProto.GetChain()) > 0 {
+		c.Chain, err = chainFromProto(confProto)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setTrustedProxyNetworks sets TrustedProxyNetworks to the networks in
+// CIDR notation of cidrs.
+func (c *Config) setTrustedProxyNetworks(cidrs []string) error {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return fmt.Errorf("water: trusted proxy networks: %w", err)
+	}
+	c.TrustedProxyNetworks = prefixes
+	return nil
+}
+
+// setSendProxyProtocol sets SendProxyProtocol to version, if it is a
+// version of the PROXY protocol, or 0.
+func (c *Config) setSendProxyProtocol(version uint32) error {
+	if version > 2 {
+		return fmt.Errorf("water: unsupported PROXY protocol version %d", version)
+	}
+	c.SendProxyProtocol = byte(version)
 	return nil
 }
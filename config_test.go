@@ -3,12 +3,18 @@ package water_test
 import (
 	"crypto/rand"
 	"net"
+	"net/netip"
 	"reflect"
+	"slices"
 	"testing"
 
 	"github.com/refraction-networking/water/internal/log"
+	"github.com/refraction-networking/water/pcapng"
+	"github.com/refraction-networking/water/recording"
 
 	"github.com/refraction-networking/water"
+	pb "github.com/refraction-networking/water/configbuilder/pb"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestConfig_Clone(t *testing.T) {
@@ -38,14 +44,36 @@ func testConfigCloneValid(t *testing.T) {
 			f.Set(reflect.ValueOf(make([]byte, 256)))
 		case "TransportModuleConfig":
 			f.Set(reflect.ValueOf(water.TransportModuleConfigFromBytes([]byte("foo"))))
+		case "NativeTransport":
+			f.SetString("plain")
 		case "NetworkDialerFunc", "DialedAddressValidator": // functions aren't deeply equal unless nil
 			continue
 		case "NetworkListener":
 			f.Set(reflect.ValueOf(&net.TCPListener{}))
+		case "FallbackAddresses":
+			f.Set(reflect.ValueOf([]water.FallbackAddress{{Network: "tcp", Address: "192.0.2.1:443"}}))
+		case "AcceptProxyProtocol":
+			f.SetBool(true)
+		case "TrustedProxyNetworks":
+			f.Set(reflect.ValueOf([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+		case "SendProxyProtocol":
+			f.SetUint(2)
+		case "DynamicRelay":
+			f.SetBool(true)
+		case "UpstreamPool":
+			f.Set(reflect.ValueOf(water.NewUpstreamPool(water.UpstreamPoolOptions{})))
 		case "ModuleConfigFactory", "RuntimeConfigFactory":
 			continue
 		case "OverrideLogger":
 			f.Set(reflect.ValueOf(log.DefaultLogger()))
+		case "SessionRecorder":
+			f.Set(reflect.ValueOf(&recording.Recorder{}))
+		case "PacketCapture":
+			f.Set(reflect.ValueOf(&pcapng.Capture{}))
+		case "Routing":
+			f.Set(reflect.ValueOf(&water.RoutingTable{}))
+		case "Chain":
+			f.Set(reflect.ValueOf([]*water.Config{{TransportModuleBin: []byte{0}, NativeTransport: "plain"}}))
 		default:
 			t.Fatalf("unhandled field: %s", fn)
 		}
@@ -60,6 +88,9 @@ func testConfigCloneValid(t *testing.T) {
 	if !reflect.DeepEqual(&c1, c2) {
 		t.Errorf("Clone() = %v, want %v", c2, &c1)
 	}
+	if c2.Chain[0] == c1.Chain[0] || c2.Routing == c1.Routing {
+		t.Errorf("Clone() shares the Chain or Routing of the original")
+	}
 }
 
 func TestConfig_NetworkDialerFuncOrDefault(t *testing.T) {
@@ -128,3 +159,97 @@ func testConfigNetworkListenerValid(t *testing.T) {
 		t.Errorf("NetworkListenerOrPanic() = %v, want %v", l, &net.TCPListener{})
 	}
 }
+
+func TestConfig_ProxyProtocol(t *testing.T) {
+	t.Run("JSON", testConfigProxyProtocolJSON)
+	t.Run("Protobuf", testConfigProxyProtocolProto)
+	t.Run("Unsupported version", testConfigProxyProtocolUnsupported)
+}
+
+func testConfigProxyProtocolJSON(t *testing.T) {
+	var c water.Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"proxy_protocol": {"accept": true, "send": 2, "trusted_networks": ["10.0.0.0/8", "2001:db8::1/32"]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.AcceptProxyProtocol || c.SendProxyProtocol != 2 {
+		t.Errorf("AcceptProxyProtocol = %v, SendProxyProtocol = %d, want true, 2", c.AcceptProxyProtocol, c.SendProxyProtocol)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	if !slices.Equal(c.TrustedProxyNetworks, want) {
+		t.Errorf("TrustedProxyNetworks = %v, want %v", c.TrustedProxyNetworks, want)
+	}
+}
+
+func testConfigProxyProtocolProto(t *testing.T) {
+	b, err := proto.Marshal(&pb.Config{
+		TransportModule: &pb.TransportModule{Native: "plain"},
+		Network: &pb.Network{
+			ProxyProtocol: &pb.ProxyProtocol{Accept: true, Send: 1, TrustedNetworks: []string{"192.0.2.0/24"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c water.Config
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	if !c.AcceptProxyProtocol || c.SendProxyProtocol != 1 {
+		t.Errorf("AcceptProxyProtocol = %v, SendProxyProtocol = %d, want true, 1", c.AcceptProxyProtocol, c.SendProxyProtocol)
+	}
+	if want := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}; !slices.Equal(c.TrustedProxyNetworks, want) {
+		t.Errorf("TrustedProxyNetworks = %v, want %v", c.TrustedProxyNetworks, want)
+	}
+}
+
+func testConfigProxyProtocolUnsupported(t *testing.T) {
+	err := (&water.Config{}).UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"proxy_protocol": {"send": 3}}
+	}`))
+	if err == nil {
+		t.Error("PROXY protocol version 3 accepted")
+	}
+
+	err = (&water.Config{}).UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"proxy_protocol": {"accept": true, "trusted_networks": ["10.0.0.1"]}}
+	}`))
+	if err == nil {
+		t.Error("trusted network without prefix length accepted")
+	}
+}
+
+func TestConfig_DynamicRelay(t *testing.T) {
+	var c water.Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"dynamic_relay": true}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.DynamicRelay {
+		t.Error("JSON: DynamicRelay not set")
+	}
+
+	b, err := proto.Marshal(&pb.Config{
+		TransportModule: &pb.TransportModule{Native: "plain"},
+		Network:         &pb.Network{DynamicRelay: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = water.Config{}
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	if !c.DynamicRelay {
+		t.Error("protobuf: DynamicRelay not set")
+	}
+}
@@ -85,6 +85,9 @@ type Core interface {
 	// Module and returns the key of the inserted connection as a
 	// file descriptor accessible from the WebAssembly instance.
 	//
+	// Connections other than *net.TCPConn are bridged through a pair of
+	// local TCP connections.
+	//
 	// This function SHOULD be called only if the WebAssembly instance
 	// execution is blocked/halted/stopped. Otherwise, race conditions
 	// or undefined behaviors may occur.
@@ -134,8 +137,26 @@ type Core interface {
 	Logger() *log.Logger
 }
 
+// TransportModuleConfigUpdater is an optional interface of a [Core] able
+// to update the TransportModuleConfig of a live WebAssembly instance. The
+// Core returned by [NewCoreWithContext] implements it.
+type TransportModuleConfigUpdater interface {
+	// UpdateTransportModuleConfig rewrites the config file mounted
+	// into the WebAssembly instance at /conf/watm.cfg, such that a
+	// WebAssembly Transport Module re-reading the file sees the
+	// updated content.
+	//
+	// This function can be called ONLY AFTER calling Instantiate(),
+	// and only if a TransportModuleConfig was set in the Config at
+	// the time of instantiation.
+	UpdateTransportModuleConfig(config TransportModuleConfig) error
+}
+
 // type guard
-var _ Core = (*core)(nil)
+var (
+	_ Core                         = (*core)(nil)
+	_ TransportModuleConfigUpdater = (*core)(nil)
+)
 
 // core provides the WASM runtime base and is an internal struct
 // that every RuntimeXxx implementation will embed.
@@ -168,6 +189,10 @@ type core struct {
 
 	importModules map[string]wazero.HostModuleBuilder
 
+	// mounted at /conf/ if TransportModuleConfig is set
+	confFS      *memfs.MemFS
+	confFSMutex sync.Mutex
+
 	closeOnce sync.Once
 }
 
@@ -267,10 +292,10 @@ func (c *core) Close() error {
 		}
 
 		if c.module != nil {
-			if err := c.module.Close(c.ctx); err != nil {
-				closeErr = fmt.Errorf("water: (*wazero.CompiledModule).Close returned error: %w", err)
-				return
-			}
+			// The module is not closed: the runtime always uses a
+			// CompilationCache, whose engine is shared by every core
+			// compiling the same WATM. Closing the module would delete
+			// the compiled code from under cores still instantiating it.
 			c.module = nil // TODO: force dropped
 			log.LDebugf(c.config.Logger(), "MODULE DROPPED")
 		}
@@ -399,6 +424,7 @@ func (c *core) Instantiate() (err error) {
 		if expFsCfg, ok := fsCfg.(expsysfs.FSConfig); ok {
 			fsCfg = expFsCfg.WithSysFSMount(memFS, "/conf/")
 			mc.SetFSConfig(fsCfg)
+			c.confFS = memFS
 		}
 	} else {
 		log.LWarnf(c.config.Logger(), "water: TransportModuleConfig is not set, skipping...")
@@ -414,6 +440,33 @@ func (c *core) Instantiate() (err error) {
 	return nil
 }
 
+// UpdateTransportModuleConfig implements TransportModuleConfigUpdater.
+func (c *core) UpdateTransportModuleConfig(config TransportModuleConfig) error {
+	if c.instance == nil {
+		return fmt.Errorf("water: cannot update TransportModuleConfig before instantiation")
+	}
+
+	if c.confFS == nil {
+		return fmt.Errorf("water: no TransportModuleConfig was mounted at instantiation")
+	}
+
+	c.confFSMutex.Lock()
+	defer c.confFSMutex.Unlock()
+
+	// memfs does not truncate on write, so remove the old file first
+	err := c.confFS.Unlink("watm.cfg")
+	if !errors.Is(err, nil) && !errors.Is(err, sys.Errno(0)) && !errors.Is(err, sys.ENOENT) {
+		return fmt.Errorf("water: memFS.Unlink returned error: %w", err)
+	}
+
+	err = c.confFS.WriteFile("watm.cfg", config.AsBytes())
+	if !errors.Is(err, nil) && !errors.Is(err, sys.Errno(0)) {
+		return fmt.Errorf("water: memFS.WriteFile returned error: %w", err)
+	}
+
+	return nil
+}
+
 // Invoke implements Core.
 func (c *core) Invoke(funcName string, params ...uint64) (results []uint64, err error) {
 	if c.instance == nil {
@@ -0,0 +1,36 @@
+package water_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/refraction-networking/water"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+// TestCoreSharedCompilationCache checks that closing a Core leaves the
+// compiled WATM usable by the other Cores sharing the global
+// CompilationCache.
+func TestCoreSharedCompilationCache(t *testing.T) {
+	config := &water.Config{TransportModuleBin: wasmPlain}
+	closed, err := water.NewCoreWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, err := water.NewCoreWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := v1.UpgradeCore(core)
+	defer tm.Close() // skipcq: GO-S2307
+	if err := tm.LinkNetworkInterface(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+}
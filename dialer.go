@@ -29,6 +29,11 @@ type Dialer interface {
 	// and returns a superset of net.Conn.
 	DialContext(ctx context.Context, network, address string) (Conn, error)
 
+	// UpdateTransportConfig replaces the TransportModuleConfig used for
+	// connections created from now on, and pushes the new config to the
+	// live connections so WATMs that opt in can apply it in place.
+	UpdateTransportConfig(config []byte) error
+
 	mustEmbedUnimplementedDialer()
 }
 
@@ -59,6 +64,11 @@ func (*UnimplementedDialer) DialContext(_ context.Context, _, _ string) (Conn, e
 	return nil, ErrUnimplementedDialer
 }
 
+// UpdateTransportConfig implements Dialer.UpdateTransportConfig().
+func (*UnimplementedDialer) UpdateTransportConfig(_ []byte) error {
+	return ErrUnimplementedDialer
+}
+
 // mustEmbedUnimplementedDialer is a function that developers cannot
 // manually implement. It is used to ensure forward compatibility of
 // the Dialer interface.
@@ -92,7 +102,8 @@ func NewDialer(c *Config) (Dialer, error) {
 // the given [context.Context].
 //
 // It automatically detects the version of the WebAssembly Transport
-// Module specified in the config.
+// Module specified in the config, unless [Config.NativeTransport] selects
+// a native transport or [Config.Chain] stacks several transports.
 //
 // The context is passed to [NewCoreWithContext] and the registered versioned
 // dialer creation function to control the lifetime of the call to function
@@ -105,6 +116,17 @@ func NewDialer(c *Config) (Dialer, error) {
 // The context SHOULD be used as the default context for call to [Dialer.Dial]
 // by the dialer implementation.
 func NewDialerWithContext(ctx context.Context, c *Config) (Dialer, error) {
+	if c != nil && len(c.Chain) > 0 {
+		return newChainDialer(ctx, c)
+	}
+
+	if c != nil && c.NativeTransport != "" {
+		if f, ok := knownDialerVersions[NativeVersion]; ok {
+			return f(ctx, c)
+		}
+		return nil, ErrDialerVersionNotFound
+	}
+
 	core, err := NewCoreWithContext(ctx, c)
 	if err != nil {
 		return nil, err
@@ -141,6 +163,11 @@ type FixedDialer interface {
 	// with the given context and returns a superset of net.Conn.
 	DialFixedContext(ctx context.Context) (Conn, error)
 
+	// UpdateTransportConfig replaces the TransportModuleConfig used for
+	// connections created from now on, and pushes the new config to the
+	// live connections so WATMs that opt in can apply it in place.
+	UpdateTransportConfig(config []byte) error
+
 	mustEmbedUnimplementedFixedDialer()
 }
 
@@ -171,6 +198,11 @@ func (*UnimplementedFixedDialer) DialFixedContext(_ context.Context) (Conn, erro
 	return nil, ErrUnimplementedFixedDialer
 }
 
+// UpdateTransportConfig implements FixedDialer.UpdateTransportConfig().
+func (*UnimplementedFixedDialer) UpdateTransportConfig(_ []byte) error {
+	return ErrUnimplementedFixedDialer
+}
+
 func (*UnimplementedFixedDialer) mustEmbedUnimplementedFixedDialer() {} //nolint:unused
 
 func RegisterWATMFixedDialer(name string, dialer newFixedDialerFunc) error {
@@ -182,6 +214,17 @@ func RegisterWATMFixedDialer(name string, dialer newFixedDialerFunc) error {
 }
 
 func NewFixedDialerWithContext(ctx context.Context, cfg *Config) (FixedDialer, error) {
+	if cfg != nil && len(cfg.Chain) > 0 {
+		return newChainFixedDialer(ctx, cfg)
+	}
+
+	if cfg != nil && cfg.NativeTransport != "" {
+		if f, ok := knownFixedDialerVersions[NativeVersion]; ok {
+			return f(ctx, cfg)
+		}
+		return nil, ErrFixedDialerVersionNotFound
+	}
+
 	core, err := NewCoreWithContext(ctx, cfg)
 	if err != nil {
 		return nil, err
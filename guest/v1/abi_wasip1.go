@@ -0,0 +1,266 @@
+//go:build wasip1
+
+package v1
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Imports provided by the host, see transport/v1.(*TransportModule).LinkNetworkInterface.
+
+//go:wasmimport env water_dial
+func _water_dial(networkIovs unsafe.Pointer, networkIovsLen int32, addressIovs unsafe.Pointer, addressIovsLen int32) int32
+
+//go:wasmimport env water_dial_fixed
+func _water_dial_fixed() int32
+
+//go:wasmimport env water_accept
+func _water_accept() int32
+
+// Exports called by the host, see transport/v1.(*TransportModule).Initialize.
+
+//go:wasmexport watm_init_v1
+func _watm_init_v1() int32 {
+	config, err := os.ReadFile(ConfigPath)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.ENOTCAPABLE) {
+		return 0 // no config, or nothing mounted at /conf/ at all
+	} else if err != nil {
+		return encodeError(err)
+	}
+	return encodeError(configure(config))
+}
+
+//go:wasmexport watm_ctrlpipe_v1
+func _watm_ctrlpipe_v1(fd int32) int32 {
+	conn, err := fdConn(fd)
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeError(ctrl.attach(conn))
+}
+
+//go:wasmexport watm_dial_v1
+func _watm_dial_v1(callerFd int32) int32 {
+	module.mutex.Lock()
+	wt := module.dialer
+	module.mutex.Unlock()
+	if wt == nil {
+		return encodeError(syscall.ENOTSUP)
+	}
+
+	return wrapAndPair(callerFd, _water_dial_fixed(), wt)
+}
+
+//go:wasmexport watm_accept_v1
+func _watm_accept_v1(callerFd int32) int32 {
+	module.mutex.Lock()
+	wt := module.listener
+	module.mutex.Unlock()
+	if wt == nil {
+		return encodeError(syscall.ENOTSUP)
+	}
+
+	return wrapAndPair(callerFd, _water_accept(), wt)
+}
+
+//go:wasmexport watm_dial_fixed_v1
+func _watm_dial_fixed_v1(callerFd int32) int32 {
+	module.mutex.Lock()
+	fdt := module.fixedDialer
+	module.mutex.Unlock()
+	if fdt == nil {
+		return encodeError(syscall.ENOTSUP)
+	}
+
+	caller, err := fdConn(callerFd)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	var remoteFd int32 = -1
+	conn, err := fdt.DialFixed(func(network, address string) (net.Conn, error) {
+		fd, err := dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		remoteFd = fd
+		return fdConn(fd)
+	})
+	if err != nil {
+		_ = caller.Close()
+		return encodeError(err)
+	}
+	if remoteFd < 0 {
+		_ = caller.Close()
+		_ = conn.Close()
+		return encodeError(syscall.ENOTCONN) // the transport did not dial through the host
+	}
+
+	addPair(caller, conn)
+	return remoteFd
+}
+
+//go:wasmexport watm_associate_v1
+func _watm_associate_v1() int32 {
+	module.mutex.Lock()
+	wt, wrap, drt := module.relay, module.relayWrap, module.dynamic
+	module.mutex.Unlock()
+	if wt == nil && drt == nil {
+		return encodeError(syscall.ENOTSUP)
+	}
+
+	srcFd := _water_accept()
+	if srcFd < 0 {
+		return srcFd
+	}
+	src, err := fdConn(srcFd)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	// the destination is picked by the worker, not to hold back the host
+	// while the source sends it
+	if drt != nil {
+		addDynamicRelay(src, drt, dialConn)
+		return 0
+	}
+
+	dstFd := _water_dial_fixed()
+	if dstFd < 0 {
+		_ = src.Close()
+		return dstFd
+	}
+	dst, err := fdConn(dstFd)
+	if err != nil {
+		_ = src.Close()
+		return encodeError(err)
+	}
+
+	if wrap == RelayWrapSource {
+		src, err = wt.Wrap(src)
+	} else {
+		dst, err = wt.Wrap(dst)
+	}
+	if err != nil {
+		_ = src.Close()
+		_ = dst.Close()
+		return encodeError(err)
+	}
+
+	addPair(src, dst)
+	return 0
+}
+
+//go:wasmexport watm_start_v1
+func _watm_start_v1() int32 {
+	if err := serve(); err != nil {
+		if errors.Is(err, errExit) {
+			return encodeError(syscall.ECANCELED)
+		}
+		return encodeError(err)
+	}
+	return 0
+}
+
+// wrapAndPair wraps the network connection netFd obtained from the host
+// with wt and pairs it with the caller connection. It returns netFd, or an
+// error code.
+func wrapAndPair(callerFd, netFd int32, wt WrappingTransport) int32 {
+	if netFd < 0 {
+		return netFd
+	}
+
+	caller, err := fdConn(callerFd)
+	if err != nil {
+		return encodeError(err)
+	}
+	netConn, err := fdConn(netFd)
+	if err != nil {
+		_ = caller.Close()
+		return encodeError(err)
+	}
+
+	wrapped, err := wt.Wrap(netConn)
+	if err != nil {
+		_ = caller.Close()
+		_ = netConn.Close()
+		return encodeError(err)
+	}
+
+	addPair(caller, wrapped)
+	return netFd
+}
+
+// iovec is the WASI iovec: a 32-bit pointer and length.
+type iovec struct {
+	buf    uint32
+	bufLen uint32
+}
+
+// dial asks the host to dial address, subject to the validation of the
+// host, and returns the file descriptor of the connection.
+func dial(network, address string) (int32, error) {
+	nb, ab := []byte(network), []byte(address)
+	if len(nb) == 0 || len(ab) == 0 {
+		return 0, syscall.EINVAL
+	}
+
+	networkIov := iovec{buf: uint32(uintptr(unsafe.Pointer(&nb[0]))), bufLen: uint32(len(nb))}
+	addressIov := iovec{buf: uint32(uintptr(unsafe.Pointer(&ab[0]))), bufLen: uint32(len(ab))}
+	fd := _water_dial(unsafe.Pointer(&networkIov), 1, unsafe.Pointer(&addressIov), 1)
+	runtime.KeepAlive(nb)
+	runtime.KeepAlive(ab)
+
+	if fd < 0 {
+		return 0, syscall.Errno(-fd)
+	}
+	return fd, nil
+}
+
+// dialConn asks the host to dial address, subject to the validation of the
+// host, and returns the connection.
+func dialConn(network, address string) (net.Conn, error) {
+	fd, err := dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return fdConn(fd)
+}
+
+// fdConn returns a net.Conn for a socket file descriptor pushed by the
+// host.
+func fdConn(fd int32) (net.Conn, error) {
+	if fd < 0 {
+		return nil, syscall.Errno(-fd)
+	}
+
+	// The WATM runs on a single thread, so a blocking read would stall
+	// every other goroutine. os.NewFile only hands the fd to the poller
+	// if it is already non-blocking.
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close() // skipcq: GO-S2307
+	return net.FileConn(f)
+}
+
+// encodeError converts err into the negative errno understood by the host.
+// A nil error is encoded as 0.
+func encodeError(err error) int32 {
+	if err == nil {
+		return 0
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) && errno != 0 {
+		return -int32(errno)
+	}
+	return -int32(syscall.EIO)
+}
@@ -0,0 +1,121 @@
+package v1
+
+import (
+	"reflect"
+	"sync"
+)
+
+// module holds the transports and handlers registered by the WATM.
+var module struct {
+	mutex sync.Mutex
+
+	dialer      WrappingTransport
+	listener    WrappingTransport
+	relay       WrappingTransport
+	relayWrap   RelayWrapSelection
+	dynamic     DynamicRelayingTransport
+	fixedDialer FixedDialingTransport
+
+	drainHandler func()
+	statsHandler func() []byte
+}
+
+// BuildDialerWithWrappingTransport makes the WATM usable as a water.Dialer:
+// connections dialed by the host to the address passed to Dial are wrapped
+// with wt.
+func BuildDialerWithWrappingTransport(wt WrappingTransport) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.dialer = wt
+}
+
+// BuildListenerWithWrappingTransport makes the WATM usable as a
+// water.Listener: connections accepted by the host are wrapped with wt.
+func BuildListenerWithWrappingTransport(wt WrappingTransport) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.listener = wt
+}
+
+// BuildRelayWithWrappingTransport makes the WATM usable as a water.Relay:
+// either the connection accepted from the source or the one dialed to the
+// remote destination, as selected by wrap, is wrapped with wt.
+func BuildRelayWithWrappingTransport(wt WrappingTransport, wrap RelayWrapSelection) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.relay = wt
+	module.relayWrap = wrap
+}
+
+// BuildRelayWithDynamicRelayingTransport makes the WATM usable as a
+// water.Relay with DynamicRelay set: drt picks the destination of every
+// connection accepted from the source. It takes precedence over a
+// transport registered with BuildRelayWithWrappingTransport.
+func BuildRelayWithDynamicRelayingTransport(drt DynamicRelayingTransport) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.dynamic = drt
+}
+
+// BuildFixedDialerWithFixedDialingTransport makes the WATM usable as a
+// water.FixedDialer, with fdt picking the remote address.
+func BuildFixedDialerWithFixedDialingTransport(fdt FixedDialingTransport) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.fixedDialer = fdt
+}
+
+// HandleDrain registers f to be called when the host asks the WATM to stop
+// taking on new work and flush what it has, ahead of an exit.
+func HandleDrain(f func()) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.drainHandler = f
+}
+
+// HandleStatsRequest registers f to answer the stats requests of the host.
+// The format of the returned bytes is up to the WATM.
+func HandleStatsRequest(f func() []byte) {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+	module.statsHandler = f
+}
+
+// configurables returns the registered transports implementing
+// ConfigurableTransport, each one once.
+func configurables() []ConfigurableTransport {
+	module.mutex.Lock()
+	defer module.mutex.Unlock()
+
+	var cts []ConfigurableTransport
+	for _, t := range []any{module.dialer, module.listener, module.relay, module.dynamic, module.fixedDialer} {
+		ct, ok := t.(ConfigurableTransport)
+		if !ok || containsTransport(cts, ct) {
+			continue
+		}
+		cts = append(cts, ct)
+	}
+	return cts
+}
+
+func containsTransport(cts []ConfigurableTransport, ct ConfigurableTransport) bool {
+	if !reflect.TypeOf(ct).Comparable() {
+		return false
+	}
+	for _, c := range cts {
+		if reflect.TypeOf(c) == reflect.TypeOf(ct) && c == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// configure passes config to every registered ConfigurableTransport.
+func configure(config []byte) error {
+	for _, ct := range configurables() {
+		if err := ct.Configure(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
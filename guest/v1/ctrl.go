@@ -0,0 +1,144 @@
+package v1
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The control pipe protocol spoken with the host. It must be kept in sync
+// with transport/v1/ctrl_pipe.go.
+//
+// The host stops the worker by writing the single byte 0x00 to the pipe.
+// Every other message, in both directions, is a frame (multi-byte integers
+// are big-endian):
+//
+//	+-------+---------+------+----------------+-----------------+
+//	| magic | version | type | payload length |     payload     |
+//	|  1B   |   1B    |  1B  |       4B       | 0..MaxPayload B |
+//	+-------+---------+------+----------------+-----------------+
+//
+// The host only sends frames once the WATM wrote a CtrlMsgHello, which this
+// package does as soon as it receives the pipe.
+const (
+	ctrlExitByte       byte = 0x00
+	ctrlFrameMagic     byte = 0xCE
+	ctrlFrameHeaderLen      = 7
+
+	// CtrlProtocolVersion is the version of the framed control protocol
+	// spoken by this package.
+	CtrlProtocolVersion byte = 0x01
+
+	// CtrlMaxPayloadLen is the largest payload a single control frame
+	// may carry.
+	CtrlMaxPayloadLen = 1 << 20
+)
+
+// CtrlMsgType identifies the kind of a [CtrlMessage].
+type CtrlMsgType uint8
+
+// Host-to-WATM messages.
+const (
+	CtrlMsgExit         CtrlMsgType = 0x00
+	CtrlMsgDrain        CtrlMsgType = 0x01
+	CtrlMsgConfigUpdate CtrlMsgType = 0x02
+	CtrlMsgStatsRequest CtrlMsgType = 0x03
+)
+
+// WATM-to-host messages.
+const (
+	CtrlMsgHello             CtrlMsgType = 0x80
+	CtrlMsgHandshakeComplete CtrlMsgType = 0x81
+	CtrlMsgFatalError        CtrlMsgType = 0x82
+	CtrlMsgStatsReply        CtrlMsgType = 0x83
+	CtrlMsgLog               CtrlMsgType = 0x84
+)
+
+// LogLevel is the severity of a message passed to [Log].
+type LogLevel uint8
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var (
+	ErrCtrlFrameBadMagic      = errors.New("watm: bad control frame magic")
+	ErrCtrlFrameBadVersion    = errors.New("watm: unsupported control frame version")
+	ErrCtrlFramePayloadTooBig = errors.New("watm: control frame payload too large")
+)
+
+// CtrlMessage is a single message exchanged over the control pipe.
+type CtrlMessage struct {
+	Type    CtrlMsgType
+	Payload []byte
+}
+
+// MarshalBinary encodes the message as a control frame.
+//
+// Implements [encoding.BinaryMarshaler].
+func (m *CtrlMessage) MarshalBinary() ([]byte, error) {
+	if len(m.Payload) > CtrlMaxPayloadLen {
+		return nil, ErrCtrlFramePayloadTooBig
+	}
+
+	buf := make([]byte, ctrlFrameHeaderLen+len(m.Payload))
+	buf[0] = ctrlFrameMagic
+	buf[1] = CtrlProtocolVersion
+	buf[2] = byte(m.Type)
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(m.Payload)))
+	copy(buf[ctrlFrameHeaderLen:], m.Payload)
+
+	return buf, nil
+}
+
+// ReadCtrlMessage reads the next message sent by the host, which is either
+// the exit byte, returned as a CtrlMsgExit, or a frame.
+func ReadCtrlMessage(r io.Reader) (*CtrlMessage, error) {
+	var hdr [ctrlFrameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return nil, err
+	}
+
+	switch hdr[0] {
+	case ctrlExitByte:
+		return &CtrlMessage{Type: CtrlMsgExit}, nil
+	case ctrlFrameMagic:
+	default:
+		return nil, ErrCtrlFrameBadMagic
+	}
+
+	if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[1] == 0 || hdr[1] > CtrlProtocolVersion {
+		return nil, fmt.Errorf("%w: %d", ErrCtrlFrameBadVersion, hdr[1])
+	}
+
+	payloadLen := binary.BigEndian.Uint32(hdr[3:])
+	if payloadLen > CtrlMaxPayloadLen {
+		return nil, ErrCtrlFramePayloadTooBig
+	}
+
+	msg := &CtrlMessage{
+		Type:    CtrlMsgType(hdr[2]),
+		Payload: make([]byte, payloadLen),
+	}
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func helloMessage() *CtrlMessage {
+	return &CtrlMessage{Type: CtrlMsgHello, Payload: []byte{CtrlProtocolVersion}}
+}
+
+func logMessage(level LogLevel, msg string) *CtrlMessage {
+	return &CtrlMessage{Type: CtrlMsgLog, Payload: append([]byte{byte(level)}, msg...)}
+}
@@ -0,0 +1,59 @@
+//go:build wasip1
+
+// Command dynamic is a WATM relaying every connection to the destination
+// named by its first line, built with the guest SDK.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o dynamic.wasm .
+//
+// As a Relay with DynamicRelay set, it reads a line such as
+// "tcp 192.0.2.1:443\n" from every connection it accepts, dials that
+// address through the host, then forwards data as-is.
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	v1 "github.com/refraction-networking/water/guest/v1"
+)
+
+// maxHeaderLength bounds the first line of a connection.
+const maxHeaderLength = 256
+
+type dynamic struct{}
+
+// Relay implements v1.DynamicRelayingTransport.
+func (dynamic) Relay(src net.Conn, dial v1.DialFunc) (net.Conn, net.Conn, error) {
+	// the line is read byte by byte, not to read past it
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := src.Read(b); err != nil {
+			return nil, nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == maxHeaderLength {
+			return nil, nil, errors.New("destination line too long")
+		}
+		line = append(line, b[0])
+	}
+
+	network, address, ok := strings.Cut(strings.TrimSpace(string(line)), " ")
+	if !ok {
+		return nil, nil, errors.New("malformed destination line")
+	}
+	dst, err := dial(network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func init() {
+	v1.BuildRelayWithDynamicRelayingTransport(dynamic{})
+}
+
+func main() {}
@@ -0,0 +1,60 @@
+//go:build wasip1
+
+// Command plain is a WATM forwarding data as-is, built with the guest SDK.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o plain.wasm .
+//
+// As a FixedDialer it dials the address in its transport module config, or
+// localhost:7700 if there is none.
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	v1 "github.com/refraction-networking/water/guest/v1"
+)
+
+// DefaultFixedAddress is dialed by the FixedDialer without a config.
+const DefaultFixedAddress = "localhost:7700"
+
+type plain struct {
+	mutex        sync.Mutex
+	fixedAddress string
+}
+
+// Wrap implements v1.WrappingTransport.
+func (*plain) Wrap(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+// DialFixed implements v1.FixedDialingTransport.
+func (p *plain) DialFixed(dial v1.DialFunc) (net.Conn, error) {
+	p.mutex.Lock()
+	address := p.fixedAddress
+	p.mutex.Unlock()
+	if address == "" {
+		address = DefaultFixedAddress
+	}
+	return dial("tcp", address)
+}
+
+// Configure implements v1.ConfigurableTransport. The config is the address
+// dialed by the FixedDialer.
+func (p *plain) Configure(config []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.fixedAddress = strings.TrimSpace(string(config))
+	return nil
+}
+
+func init() {
+	p := &plain{}
+	v1.BuildDialerWithWrappingTransport(p)
+	v1.BuildListenerWithWrappingTransport(p)
+	v1.BuildRelayWithWrappingTransport(p, v1.RelayWrapRemote)
+	v1.BuildFixedDialerWithFixedDialingTransport(p)
+}
+
+func main() {}
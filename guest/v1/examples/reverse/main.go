@@ -0,0 +1,72 @@
+//go:build wasip1
+
+// Command reverse is a WATM reversing the bit order of every byte it sends
+// and receives, built with the guest SDK. Unlike plain, its traffic is
+// visibly different on the wire, yet it survives any segmentation.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o reverse.wasm .
+package main
+
+import (
+	"math/bits"
+	"net"
+
+	v1 "github.com/refraction-networking/water/guest/v1"
+)
+
+type reverse struct{}
+
+// Wrap implements v1.WrappingTransport.
+func (reverse) Wrap(conn net.Conn) (net.Conn, error) {
+	return &reverseConn{Conn: conn}, nil
+}
+
+// DialFixed implements v1.FixedDialingTransport.
+func (r reverse) DialFixed(dial v1.DialFunc) (net.Conn, error) {
+	conn, err := dial("tcp", "localhost:7700")
+	if err != nil {
+		return nil, err
+	}
+	return r.Wrap(conn)
+}
+
+type reverseConn struct {
+	net.Conn
+}
+
+func (c *reverseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	reverseBits(b[:n])
+	return n, err
+}
+
+func (c *reverseConn) Write(b []byte) (int, error) {
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	reverseBits(buf)
+	return c.Conn.Write(buf)
+}
+
+// CloseWrite closes the write side of the underlying connection if it
+// supports it.
+func (c *reverseConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func reverseBits(b []byte) {
+	for i := range b {
+		b[i] = bits.Reverse8(b[i])
+	}
+}
+
+func init() {
+	v1.BuildDialerWithWrappingTransport(reverse{})
+	v1.BuildListenerWithWrappingTransport(reverse{})
+	v1.BuildRelayWithWrappingTransport(reverse{}, v1.RelayWrapRemote)
+	v1.BuildFixedDialerWithFixedDialingTransport(reverse{})
+}
+
+func main() {}
@@ -0,0 +1,83 @@
+// Package v1 is a guest-side SDK for writing WebAssembly Transport Modules
+// (WATM) implementing the WATM API version 1 in Go.
+//
+// A WATM built with this package registers its transports from an init
+// function, and is compiled with the standard Go toolchain (1.24 or later)
+// as a WASI reactor:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o plain.wasm .
+//
+// The package exports watm_init_v1, watm_ctrlpipe_v1, watm_start_v1 and the
+// watm_dial_v1, watm_dial_fixed_v1, watm_accept_v1 and watm_associate_v1
+// entry points backed by the registered transports, and imports
+// env.water_dial, env.water_dial_fixed and env.water_accept from the host.
+//
+// Only the interfaces and the control protocol are available outside of
+// GOOS=wasip1, so that the host side may share them in tests.
+package v1
+
+import (
+	"net"
+)
+
+// WrappingTransport wraps a network connection into a connection carrying
+// the application data of the caller.
+//
+// Wrap is called once per connection, with the network connection dialed
+// or accepted by the host. Reading from the returned net.Conn returns the
+// application data sent by the peer, and writing to it sends application
+// data to the peer.
+type WrappingTransport interface {
+	Wrap(conn net.Conn) (net.Conn, error)
+}
+
+// DialFunc dials a network connection through the host.
+type DialFunc func(network, address string) (net.Conn, error)
+
+// FixedDialingTransport picks the remote address by itself, for use with a
+// water.FixedDialer.
+//
+// DialFixed is called once per connection and must use dial to reach the
+// network. The returned net.Conn carries the application data of the
+// caller.
+type FixedDialingTransport interface {
+	DialFixed(dial DialFunc) (net.Conn, error)
+}
+
+// DynamicRelayingTransport picks the destination of every connection of a
+// water.Relay with DynamicRelay set, e.g., from a header of its protocol.
+//
+// Relay is called once per connection, with the connection accepted from
+// the source, and must dial the destination with dial, subject to the
+// address validation of the host. The two returned connections, e.g., the
+// source unwrapped and the destination, are relayed to each other.
+type DynamicRelayingTransport interface {
+	Relay(src net.Conn, dial DialFunc) (net.Conn, net.Conn, error)
+}
+
+// ConfigurableTransport is implemented by transports accepting the
+// transport module config, i.e. the content of ConfigPath.
+//
+// Configure is called from watm_init_v1 if the config file exists, and
+// again with the new config on every config update sent by the host. It may
+// be called while connections are being relayed.
+type ConfigurableTransport interface {
+	Configure(config []byte) error
+}
+
+// RelayWrapSelection selects the connection wrapped by a relay.
+type RelayWrapSelection uint8
+
+const (
+	// RelayWrapRemote wraps the connection dialed to the remote
+	// destination, i.e. the relay receives plain traffic and sends it
+	// wrapped.
+	RelayWrapRemote RelayWrapSelection = iota
+
+	// RelayWrapSource wraps the connection accepted from the source, i.e.
+	// the relay receives wrapped traffic and sends it plain.
+	RelayWrapSource
+)
+
+// ConfigPath is where the host mounts the transport module config.
+const ConfigPath = "/conf/watm.cfg"
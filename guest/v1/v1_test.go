@@ -0,0 +1,353 @@
+package v1_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/bits"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	guest "github.com/refraction-networking/water/guest/v1"
+	"github.com/refraction-networking/water/internal/watmbuild"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+func TestCtrlMessage(t *testing.T) {
+	t.Run("guest to host", testCtrlGuestToHost)
+	t.Run("host to guest", testCtrlHostToGuest)
+	t.Run("exit byte", testCtrlExit)
+}
+
+func testCtrlGuestToHost(t *testing.T) {
+	frame, err := (&guest.CtrlMessage{Type: guest.CtrlMsgLog, Payload: []byte{byte(guest.LogWarn), 'h', 'i'}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := v1.ReadCtrlMessage(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	level, text, ok := msg.LogEvent()
+	if !ok || level != v1.CtrlLogWarn || text != "hi" {
+		t.Errorf("LogEvent() = %v, %q, %v, want %v, %q, true", level, text, ok, v1.CtrlLogWarn, "hi")
+	}
+}
+
+func testCtrlHostToGuest(t *testing.T) {
+	frame, err := (&v1.CtrlMessage{Type: v1.CtrlMsgConfigUpdate, Payload: []byte("new config")}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := guest.ReadCtrlMessage(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != guest.CtrlMsgConfigUpdate || string(msg.Payload) != "new config" {
+		t.Errorf("message = %+v, want config update", msg)
+	}
+
+	if _, err := guest.ReadCtrlMessage(bytes.NewReader([]byte{0x42})); err != guest.ErrCtrlFrameBadMagic {
+		t.Errorf("bad magic: err = %v, want %v", err, guest.ErrCtrlFrameBadMagic)
+	}
+}
+
+func testCtrlExit(t *testing.T) {
+	msg, err := guest.ReadCtrlMessage(bytes.NewReader([]byte{0x00, 0xCE}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != guest.CtrlMsgExit {
+		t.Errorf("type = %v, want exit", msg.Type)
+	}
+}
+
+func TestExamples(t *testing.T) {
+	t.Run("plain dialer and listener", testPlainEcho)
+	t.Run("plain fixed dialer reads config", testPlainFixedDialer)
+	t.Run("plain answers stats request", testPlainStats)
+	t.Run("reverse on the wire", testReverseOnTheWire)
+	t.Run("dynamic relay", testDynamicRelay)
+}
+
+func echoServer(t *testing.T, lis net.Listener) {
+	t.Helper()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, msg) {
+		t.Fatalf("echoed %q, want %q", echoed, msg)
+	}
+}
+
+func testPlainEcho(t *testing.T) {
+	config := &water.Config{TransportModuleBin: watmbuild.Require(t, watmbuild.Plain)}
+
+	lis, err := config.ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	echoServer(t, lis)
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	roundTrip(t, conn, []byte("hello, guest"))
+	roundTrip(t, conn, bytes.Repeat([]byte{0xAB}, 1<<16))
+}
+
+func testPlainFixedDialer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	echoServer(t, lis)
+
+	dialed := make(chan string, 1)
+	config := &water.Config{
+		TransportModuleBin:    watmbuild.Require(t, watmbuild.Plain),
+		TransportModuleConfig: water.TransportModuleConfigFromBytes([]byte(lis.Addr().String())),
+		DialedAddressValidator: func(network, address string) error {
+			dialed <- address
+			return nil
+		},
+	}
+
+	fixedDialer, err := water.NewFixedDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := fixedDialer.DialFixed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if address := <-dialed; address != lis.Addr().String() {
+		t.Errorf("WATM dialed %s, want %s from its config", address, lis.Addr())
+	}
+	roundTrip(t, conn, []byte("hello, fixed"))
+}
+
+func testPlainStats(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	echoServer(t, lis)
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{
+		TransportModuleBin: watmbuild.Require(t, watmbuild.Plain),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	v1Conn, ok := conn.(*v1.Conn)
+	if !ok {
+		t.Fatalf("conn is %T, want *v1.Conn", conn)
+	}
+
+	// the hello is sent as soon as the pipe is set up, but handled
+	// asynchronously by the host
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		_, err = v1Conn.TransportModule().RequestStats(ctx)
+		if err != v1.ErrCtrlPipeNotFramed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("RequestStats: %v", err)
+	}
+}
+
+func testReverseOnTheWire(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	msg := []byte("hello, reverse")
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		buf := make([]byte, len(msg))
+		_, _ = io.ReadFull(conn, buf)
+		received <- buf
+	}()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{
+		TransportModuleBin: watmbuild.Require(t, watmbuild.Reverse),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case wire := <-received:
+		for i := range wire {
+			if wire[i] != bits.Reverse8(msg[i]) {
+				t.Fatalf("wire = %x, want the bits of every byte of %q reversed", wire, msg)
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func testDynamicRelay(t *testing.T) {
+	allowed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close() // skipcq: GO-S2307
+	echoServer(t, allowed)
+	denied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close() // skipcq: GO-S2307
+	echoServer(t, denied)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &syncBuffer{}
+	relay, err := water.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: watmbuild.Require(t, watmbuild.Dynamic),
+		NetworkListener:    lis,
+		DynamicRelay:       true,
+		DialedAddressValidator: func(network, address string) error {
+			if address != allowed.Addr().String() {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+		OverrideLogger: slog.New(slog.NewTextHandler(logs, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close() // skipcq: GO-S2307
+	go func() {
+		_ = relay.RelayTo("", "") // no fixed destination
+	}()
+
+	// connections are relayed to the destination they name, as long as
+	// the host allows it
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		if _, err := conn.Write([]byte("tcp " + allowed.Addr().String() + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, []byte("hello, dynamic relay"))
+	}
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("tcp " + denied.Addr().String() + "\nhello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection relayed to a denied destination")
+	}
+
+	for _, line := range []string{
+		"relay session 1: dialing tcp " + allowed.Addr().String(),
+		"relay session 2: dialing tcp " + allowed.Addr().String(),
+		"relay session 3: dialing tcp " + denied.Addr().String() + " denied",
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("log does not contain %q:\n%s", line, logs)
+		}
+	}
+}
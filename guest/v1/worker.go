@@ -0,0 +1,288 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxPendingCtrlMessages bounds the messages queued before the control
+// pipe is set up. Older messages are dropped first.
+const maxPendingCtrlMessages = 64
+
+// ctrlPipe is the WATM end of the control pipe.
+type ctrlPipe struct {
+	mutex   sync.Mutex
+	conn    net.Conn
+	pending []*CtrlMessage
+}
+
+var ctrl ctrlPipe
+
+// attach sets the control pipe, announces framed messages with a
+// CtrlMsgHello and flushes the messages sent before.
+func (c *ctrlPipe) attach(conn net.Conn) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn = conn
+	if err := c.write(helloMessage()); err != nil {
+		return err
+	}
+	for _, msg := range c.pending {
+		if err := c.write(msg); err != nil {
+			return err
+		}
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *ctrlPipe) send(msg *CtrlMessage) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if len(c.pending) == maxPendingCtrlMessages {
+			c.pending = c.pending[1:]
+		}
+		c.pending = append(c.pending, msg)
+		return nil
+	}
+	return c.write(msg)
+}
+
+func (c *ctrlPipe) write(msg *CtrlMessage) error {
+	frame, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *ctrlPipe) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+// HandshakeComplete tells the host that the transport handshake has
+// finished and application data is flowing.
+func HandshakeComplete() error {
+	return ctrl.send(&CtrlMessage{Type: CtrlMsgHandshakeComplete})
+}
+
+// FatalError tells the host why the WATM is about to fail. The reason is
+// attached to the error returned by the worker.
+func FatalError(reason string) error {
+	return ctrl.send(&CtrlMessage{Type: CtrlMsgFatalError, Payload: []byte(reason)})
+}
+
+// Log sends a log event to the host, which logs it with its own logger.
+func Log(level LogLevel, format string, args ...any) error {
+	return ctrl.send(logMessage(level, fmt.Sprintf(format, args...)))
+}
+
+// connPair is a connection of the caller and the connection its data is
+// relayed to.
+type connPair struct {
+	a, b net.Conn
+}
+
+// dynamicRelay is a connection accepted from the source whose destination
+// is yet to be picked by drt.
+type dynamicRelay struct {
+	src  net.Conn
+	drt  DynamicRelayingTransport
+	dial DialFunc
+}
+
+var (
+	pairsMutex    sync.Mutex
+	pairs         []connPair
+	dynamicRelays []dynamicRelay
+)
+
+func addPair(a, b net.Conn) {
+	pairsMutex.Lock()
+	defer pairsMutex.Unlock()
+	pairs = append(pairs, connPair{a, b})
+}
+
+func addDynamicRelay(src net.Conn, drt DynamicRelayingTransport, dial DialFunc) {
+	pairsMutex.Lock()
+	defer pairsMutex.Unlock()
+	dynamicRelays = append(dynamicRelays, dynamicRelay{src, drt, dial})
+}
+
+// errExit is returned by serve when the host asked the worker to exit.
+var errExit = errors.New("watm: exit requested by host")
+
+// relayedConns are the connections relayed by serve, closed all at once
+// on exit.
+type relayedConns struct {
+	mutex  sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+// add adds conn, or closes it if the connections were closed already.
+func (r *relayedConns) add(conn net.Conn) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		_ = conn.Close()
+		return false
+	}
+	r.conns = append(r.conns, conn)
+	return true
+}
+
+func (r *relayedConns) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	for _, conn := range r.conns {
+		_ = conn.Close()
+	}
+}
+
+// serve relays data between every pair of connections until they are all
+// closed, or until the host writes the exit message to the control pipe.
+// The destination of dynamic relays is picked first.
+func serve() error {
+	pairsMutex.Lock()
+	ps, drs := pairs, dynamicRelays
+	pairs, dynamicRelays = nil, nil
+	pairsMutex.Unlock()
+
+	var wg sync.WaitGroup
+	var conns relayedConns
+	relay := func(p connPair) {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			relayHalf(p.b, p.a)
+		}()
+		go func() {
+			defer wg.Done()
+			relayHalf(p.a, p.b)
+		}()
+	}
+	for _, p := range ps {
+		conns.add(p.a)
+		conns.add(p.b)
+		relay(p)
+	}
+	for _, dr := range drs {
+		conns.add(dr.src)
+		wg.Add(1)
+		go func(dr dynamicRelay) {
+			defer wg.Done()
+			src, dst, err := dr.drt.Relay(dr.src, dr.dial)
+			if err != nil {
+				_ = Log(LogError, "dynamic relay: %v", err)
+				closeConn(dr.src)
+				return
+			}
+			if conns.add(src) && conns.add(dst) {
+				relay(connPair{src, dst})
+			} else {
+				_ = src.Close()
+				_ = dst.Close()
+			}
+		}(dr)
+	}
+
+	relayed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(relayed)
+	}()
+
+	ctrl.mutex.Lock()
+	conn := ctrl.conn
+	ctrl.mutex.Unlock()
+
+	exited := make(chan error, 1)
+	if conn != nil {
+		go func() {
+			exited <- serveCtrl(conn)
+		}()
+	}
+
+	var err error
+	select {
+	case <-relayed:
+	case err = <-exited:
+	}
+
+	conns.close()
+	ctrl.close()
+	<-relayed
+	return err
+}
+
+// closeConn closes conn, closing its write side first so that the peer
+// sees the end of the stream even if the host keeps the connection open.
+func closeConn(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_ = conn.Close()
+}
+
+// relayHalf copies src to dst, then closes the write side of dst so that
+// the peer sees the end of the stream, or dst entirely if it can't be half
+// closed.
+func relayHalf(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+	_ = dst.Close()
+}
+
+// serveCtrl handles the messages sent by the host until the exit message.
+// It returns errExit on exit, or nil if the pipe is closed.
+func serveCtrl(conn net.Conn) error {
+	for {
+		msg, err := ReadCtrlMessage(conn)
+		if err != nil {
+			return nil
+		}
+
+		switch msg.Type {
+		case CtrlMsgExit:
+			return errExit
+		case CtrlMsgDrain:
+			module.mutex.Lock()
+			f := module.drainHandler
+			module.mutex.Unlock()
+			if f != nil {
+				f()
+			}
+		case CtrlMsgConfigUpdate:
+			if err := configure(msg.Payload); err != nil {
+				_ = Log(LogError, "config update rejected: %v", err)
+			}
+		case CtrlMsgStatsRequest:
+			module.mutex.Lock()
+			f := module.statsHandler
+			module.mutex.Unlock()
+			var stats []byte
+			if f != nil {
+				stats = f()
+			}
+			_ = ctrl.send(&CtrlMessage{Type: CtrlMsgStatsReply, Payload: stats})
+		}
+	}
+}
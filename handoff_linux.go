@@ -0,0 +1,247 @@
+//go:build linux
+
+package water
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// HandoffFdEnv is the environment variable telling a process started by
+// [HandOffTo] the file descriptor of its end of the handoff Unix socket.
+const HandoffFdEnv = "WATER_HANDOFF_FD"
+
+// maxHandoffPayload bounds the size of the sessions in a handoff.
+const maxHandoffPayload = 16 << 20
+
+var (
+	ErrNoHandoff     = errors.New("water: no handoff from a parent process")
+	ErrHandoffFailed = errors.New("water: handoff not acknowledged")
+)
+
+// Handoff is what a process hands off to the process replacing it, e.g.,
+// a newer version of its binary, for a zero-downtime upgrade.
+//
+// Only the listener is taken over: live sessions keep being relayed by
+// the old process, which drains them with [Relay.Shutdown], and are
+// only described in Sessions.
+type Handoff struct {
+	// Listener is the listener handed off, e.g., the NetworkListener of
+	// a Config. It must be a [net.TCPListener] or a [net.UnixListener].
+	Listener net.Listener
+
+	// Sessions optionally describes the sessions live in the old process.
+	Sessions []RelaySession
+}
+
+type handoffPayload struct {
+	Sessions []RelaySession `json:"sessions,omitempty"`
+}
+
+// SendHandoff sends h over conn, a stream Unix socket, passing the file
+// descriptor of its listener, then waits for the other end to acknowledge
+// it from [ReceiveHandoff].
+//
+// Once it returns, both processes accept connections from the listener
+// until the sender closes its own, e.g., with [Relay.Shutdown].
+func SendHandoff(conn *net.UnixConn, h *Handoff) error {
+	sc, ok := h.Listener.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("water: cannot hand off listener %T without file descriptor", h.Listener)
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&handoffPayload{Sessions: h.Sessions})
+	if err != nil {
+		return err
+	}
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	msg = append(msg, payload...)
+
+	var n int
+	var writeErr error
+	err = rawConn.Control(func(fd uintptr) {
+		n, _, writeErr = conn.WriteMsgUnix(msg, syscall.UnixRights(int(fd)), nil)
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr == nil && n < len(msg) { // the file descriptor went with the first bytes
+		_, writeErr = conn.Write(msg[n:])
+	}
+	if writeErr != nil {
+		return fmt.Errorf("water: sending handoff: %w", writeErr)
+	}
+
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("%w: %v", ErrHandoffFailed, err)
+	}
+
+	// the path of a Unix socket must outlive the listener of this process
+	if lis, ok := h.Listener.(*net.UnixListener); ok {
+		lis.SetUnlinkOnClose(false)
+	}
+	return nil
+}
+
+// ReceiveHandoff receives a handoff sent over conn by [SendHandoff], and
+// acknowledges it.
+func ReceiveHandoff(conn *net.UnixConn) (*Handoff, error) {
+	header := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, fmt.Errorf("water: receiving handoff: %w", err)
+	}
+	lis, err := listenerFromRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handoff{Listener: lis}
+	if err := h.readPayload(conn, header, n); err != nil {
+		_ = lis.Close()
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{1}); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("water: acknowledging handoff: %w", err)
+	}
+	return h, nil
+}
+
+// readPayload reads the rest of the length-prefixed payload, of which the
+// first n bytes were read into header.
+func (h *Handoff) readPayload(r io.Reader, header []byte, n int) error {
+	if _, err := io.ReadFull(r, header[n:]); err != nil {
+		return fmt.Errorf("water: receiving handoff: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxHandoffPayload {
+		return fmt.Errorf("water: handoff of %d bytes is too large", size)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("water: receiving handoff: %w", err)
+	}
+	var payload handoffPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return fmt.Errorf("water: parsing handoff: %w", err)
+	}
+	h.Sessions = payload.Sessions
+	return nil
+}
+
+func listenerFromRights(oob []byte) (net.Listener, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("water: parsing handoff: %w", err)
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("water: handoff carried %d file descriptors, expected 1", len(fds))
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "water-handoff-listener")
+	defer f.Close() // skipcq: GO-S2307
+	return net.FileListener(f)
+}
+
+// HandOffTo starts cmd, typically a newer version of the running binary,
+// and hands h off to it over a Unix socket inherited as an extra file,
+// whose file descriptor is in the environment variable [HandoffFdEnv]. The
+// started process receives it with [InheritedHandoff].
+//
+// HandOffTo returns once the started process acknowledged the handoff.
+// The caller should then drain with [Relay.Shutdown], and may wait for cmd.
+// If the handoff fails after cmd started, the process is killed and waited
+// for, and the caller keeps serving alone.
+func HandOffTo(cmd *exec.Cmd, h *Handoff) (err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("water: creating handoff socket: %w", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "water-handoff")
+	child := os.NewFile(uintptr(fds[1]), "water-handoff")
+	defer parent.Close() // skipcq: GO-S2307
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, HandoffFdEnv+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+
+	err = cmd.Start()
+	_ = child.Close() // the started process has its own copy, if any
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			err = fmt.Errorf("water: handoff failed, started process killed: %w", err)
+		}
+	}()
+
+	conn, err := net.FileConn(parent)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	return SendHandoff(conn.(*net.UnixConn), h)
+}
+
+// InheritedHandoff receives the handoff from the process which started
+// this one with [HandOffTo], e.g., to set it as the NetworkListener of a
+// Config. It returns ErrNoHandoff if this process was not started so.
+func InheritedHandoff() (*Handoff, error) {
+	env, ok := os.LookupEnv(HandoffFdEnv)
+	if !ok {
+		return nil, ErrNoHandoff
+	}
+	fd, err := strconv.Atoi(env)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("water: invalid %s %q", HandoffFdEnv, env)
+	}
+	_ = os.Unsetenv(HandoffFdEnv) // not to be inherited further
+
+	f := os.NewFile(uintptr(fd), "water-handoff")
+	defer f.Close() // skipcq: GO-S2307
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("water: %s %d is not a Unix socket", HandoffFdEnv, fd)
+	}
+	return ReceiveHandoff(unixConn)
+}
@@ -0,0 +1,192 @@
+//go:build linux
+
+package water_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+// handoffBackendEnv tells the test binary re-exec'd by TestHandoff to take
+// over the relay, relaying to the address in it.
+const handoffBackendEnv = "WATER_TEST_HANDOFF_BACKEND"
+
+// namedBackend serves connections by writing name, then echoing.
+func namedBackend(t *testing.T, name string) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				if _, err := conn.Write([]byte(name)); err == nil {
+					_, _ = io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// relayedBackend dials the relay at address and returns the connection
+// and the name of the backend it reached.
+func relayedBackend(t *testing.T, address string) (net.Conn, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	name := make([]byte, 3)
+	if _, err := io.ReadFull(conn, name); err != nil {
+		t.Fatal(err)
+	}
+	return conn, string(name)
+}
+
+// takeOverRelay runs in the re-exec'd test binary, relaying from the
+// listener handed off to the backend in handoffBackendEnv until killed.
+// Only the number of sessions handed off is written to stdout, which
+// TestHandoff reads.
+func takeOverRelay() {
+	h, err := water.InheritedHandoff()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "taking over the relay:", err)
+		os.Exit(1)
+	}
+	fmt.Println("sessions", len(h.Sessions))
+
+	relay, err := water.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    h.Listener,
+	})
+	if err == nil {
+		err = relay.RelayTo("tcp", os.Getenv(handoffBackendEnv))
+	}
+	fmt.Fprintln(os.Stderr, "relaying:", err)
+	os.Exit(1)
+}
+
+func TestHandoff(t *testing.T) {
+	if os.Getenv(handoffBackendEnv) != "" {
+		takeOverRelay()
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := water.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    lis,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = relay.RelayTo("tcp", namedBackend(t, "old"))
+	}()
+
+	live, name := relayedBackend(t, lis.Addr().String())
+	defer live.Close() // skipcq: GO-S2307
+	if name != "old" {
+		t.Fatalf("reached %s before handoff", name)
+	}
+	if sessions := relay.Sessions(); len(sessions) != 1 || sessions[0].RemoteAddr != live.LocalAddr().String() {
+		t.Fatalf("Sessions() = %v", sessions)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoff$")
+	cmd.Env = append(os.Environ(), handoffBackendEnv+"="+namedBackend(t, "new"))
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := water.HandOffTo(cmd, &water.Handoff{Listener: lis, Sessions: relay.Sessions()}); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()         // skipcq: GO-S2307
+	defer cmd.Process.Kill() // skipcq: GO-S2307
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("new process exited before reporting the sessions handed off (see its stderr above): %v", err)
+	}
+	if line != "sessions 1\n" {
+		t.Fatalf("new process reported %q, want %q", line, "sessions 1\n")
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- relay.Shutdown(ctx)
+	}()
+
+	// new connections go to the new process once the old one stops
+	// accepting, while the live session is still relayed by the old one
+	for name != "new" {
+		var conn net.Conn
+		conn, name = relayedBackend(t, lis.Addr().String())
+		_ = conn.Close()
+	}
+	if _, err := live.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(live, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("live session read %q, %v", echo, err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with a live session: %v", err)
+	default:
+	}
+
+	_ = live.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown did not return after the last session ended")
+	}
+}
+
+func TestHandOffToFailure(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	// the started process runs no test, exiting without taking over
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := water.HandOffTo(cmd, &water.Handoff{Listener: lis}); err == nil {
+		t.Fatal("handed off to a process not taking over")
+	}
+	if cmd.ProcessState == nil {
+		t.Error("started process not waited for")
+	}
+}
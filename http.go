@@ -0,0 +1,62 @@
+package water
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// NetDialContextFunc returns a func dialing with dialer, returning its
+// connections as [net.Conn], for use with the many APIs expecting one,
+// e.g., [http.Transport.DialContext].
+//
+// The context only bounds the dial: as the context passed to
+// [Dialer.DialContext] bounds the lifetime of the connection, the
+// connection is dialed with a context never canceled, and must be closed
+// by the caller.
+func NetDialContextFunc(dialer Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		type result struct {
+			conn Conn
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			conn, err := dialer.DialContext(context.WithoutCancel(ctx), network, address)
+			done <- result{conn, err}
+		}()
+
+		select {
+		case res := <-done:
+			if res.err != nil {
+				return nil, res.err
+			}
+			return res.conn, nil
+		case <-ctx.Done():
+			go func() { // close the connection dialed too late
+				if res := <-done; res.err == nil {
+					_ = res.conn.Close()
+				}
+			}()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// NewHTTPTransport returns an [http.Transport] dialing every connection
+// with dialer, so that an [http.Client] sends its requests through the
+// transport of dialer. It has the settings of [http.DefaultTransport],
+// except that proxies set in the environment are ignored.
+//
+// Connections are kept alive across requests as usual, and closed by
+// [http.Transport.CloseIdleConnections].
+func NewHTTPTransport(dialer Dialer) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = NetDialContextFunc(dialer)
+	return transport
+}
@@ -0,0 +1,109 @@
+package water_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{TransportModuleBin: wasmPlain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := water.NewHTTPTransport(dialer)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		var reused bool
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		})
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin.URL+"/page", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello from /page" {
+			t.Errorf("body = %q, want %q", body, "hello from /page")
+		}
+
+		// canceling the context of a request does not close the
+		// connection kept alive for the next one
+		if i > 0 && !reused {
+			t.Error("connection not reused")
+		}
+	}
+}
+
+func TestNetDialContextFunc(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{TransportModuleBin: wasmPlain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := water.NetDialContextFunc(dialer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := dial(ctx, "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	// the connection outlives the context it was dialed with
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := dial(ctx, "tcp", lis.Addr().String()); err != context.Canceled {
+		t.Errorf("dial with a canceled context: err = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,415 @@
+package water
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// ErrEmptyModule is returned by InspectModule when given no bytes.
+var ErrEmptyModule = errors.New("water: empty WebAssembly module")
+
+// watmABI describes what a version of the WATM API expects from a WATM
+// and provides to it.
+type watmABI struct {
+	version string
+
+	// marker is an export whose presence identifies the version.
+	marker string
+
+	required []string
+	optional []string
+
+	// imports are the functions the host provides in the "env" module.
+	imports []string
+}
+
+// knownABIs lists every WATM API version InspectModule knows about. It
+// mirrors the exports and imports used by the drivers under transport/.
+var knownABIs = []watmABI{
+	{
+		version:  "v0",
+		marker:   "_water_v0",
+		required: []string{"_water_init", "_water_cancel_with", "_water_worker"},
+		optional: []string{"_water_dial", "_water_accept", "_water_associate"},
+		imports:  []string{"host_dial", "host_accept", "host_defer", "pull_config"},
+	},
+	{
+		version:  "v1",
+		marker:   "watm_init_v1",
+		required: []string{"watm_init_v1", "watm_ctrlpipe_v1", "watm_start_v1"},
+		optional: []string{"watm_dial_v1", "watm_dial_fixed_v1", "watm_accept_v1", "watm_associate_v1"},
+		imports:  []string{"water_dial", "water_dial_fixed", "water_accept"},
+	},
+}
+
+// ModuleInfo describes a WATM as reported by InspectModule.
+type ModuleInfo struct {
+	// Versions are the WATM API versions the module implements,
+	// detected from its exports.
+	Versions []VersionInfo `json:"versions"`
+
+	Exports        []ExportInfo        `json:"exports"`
+	Imports        []ImportInfo        `json:"imports"`
+	Memories       []MemoryInfo        `json:"memories"`
+	CustomSections []CustomSectionInfo `json:"custom_sections"`
+}
+
+// VersionInfo describes how completely a module implements a WATM API
+// version.
+type VersionInfo struct {
+	Version  string         `json:"version"`
+	Required []ExportStatus `json:"required"`
+	Optional []ExportStatus `json:"optional"`
+}
+
+// Complete reports whether all the required exports are present.
+func (v *VersionInfo) Complete() bool {
+	for _, e := range v.Required {
+		if !e.Present {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportStatus tells whether an export expected by a WATM API version is
+// present.
+type ExportStatus struct {
+	Name    string `json:"name"`
+	Present bool   `json:"present"`
+}
+
+// ExportInfo describes an export of the module.
+type ExportInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "func", "memory", "global" or "table"
+
+	// Params and Results are only set for functions.
+	Params  []string `json:"params,omitempty"`
+	Results []string `json:"results,omitempty"`
+}
+
+// Export returns the export with the given name, or nil if the module does
+// not export it.
+func (m *ModuleInfo) Export(name string) *ExportInfo {
+	for i := range m.Exports {
+		if m.Exports[i].Name == name {
+			return &m.Exports[i]
+		}
+	}
+	return nil
+}
+
+// ImportStatus tells whether WATER can satisfy an import.
+type ImportStatus string
+
+const (
+	// ImportWATER is provided by the driver of a detected version.
+	ImportWATER ImportStatus = "water"
+
+	// ImportWASI is provided by wasi_snapshot_preview1.
+	ImportWASI ImportStatus = "wasi"
+
+	// ImportOtherVersion is only provided by the driver of a version the
+	// module does not implement, e.g. env.host_dial in a v1 WATM.
+	ImportOtherVersion ImportStatus = "other_version"
+
+	// ImportSignatureMismatch is provided under this name, but with a
+	// different signature.
+	ImportSignatureMismatch ImportStatus = "signature_mismatch"
+
+	// ImportUnknown is not provided by WATER.
+	ImportUnknown ImportStatus = "unknown"
+)
+
+// Satisfied reports whether WATER provides the import.
+func (s ImportStatus) Satisfied() bool {
+	return s == ImportWATER || s == ImportWASI
+}
+
+// ImportInfo describes a function imported by the module.
+type ImportInfo struct {
+	Module  string       `json:"module"`
+	Name    string       `json:"name"`
+	Params  []string     `json:"params"`
+	Results []string     `json:"results"`
+	Status  ImportStatus `json:"status"`
+}
+
+// MemoryInfo describes a memory imported or exported by the module, in
+// 64 KiB pages.
+type MemoryInfo struct {
+	Name     string `json:"name"` // export name, or module.name if imported
+	Imported bool   `json:"imported"`
+	Min      uint32 `json:"min_pages"`
+	Max      uint32 `json:"max_pages,omitempty"`
+	HasMax   bool   `json:"has_max"`
+}
+
+// CustomSectionInfo describes a custom section of the module.
+type CustomSectionInfo struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// Unsatisfied returns the imports WATER cannot provide. A module with any
+// of those will fail to instantiate.
+func (m *ModuleInfo) Unsatisfied() []ImportInfo {
+	var unsatisfied []ImportInfo
+	for _, imp := range m.Imports {
+		if !imp.Status.Satisfied() {
+			unsatisfied = append(unsatisfied, imp)
+		}
+	}
+	return unsatisfied
+}
+
+// String implements fmt.Stringer.
+func (m *ModuleInfo) String() string {
+	var b strings.Builder
+
+	if len(m.Versions) == 0 {
+		b.WriteString("versions: none detected\n")
+	}
+	for _, v := range m.Versions {
+		fmt.Fprintf(&b, "version %s", v.Version)
+		if !v.Complete() {
+			b.WriteString(" (incomplete)")
+		}
+		b.WriteString("\n")
+		for _, e := range v.Required {
+			fmt.Fprintf(&b, "  required %-24s %s\n", e.Name, presence(e.Present))
+		}
+		for _, e := range v.Optional {
+			fmt.Fprintf(&b, "  optional %-24s %s\n", e.Name, presence(e.Present))
+		}
+	}
+
+	fmt.Fprintf(&b, "exports (%d):\n", len(m.Exports))
+	for _, e := range m.Exports {
+		if e.Type == api.ExternTypeFuncName {
+			fmt.Fprintf(&b, "  %-6s %s(%s) -> (%s)\n", e.Type, e.Name, strings.Join(e.Params, ", "), strings.Join(e.Results, ", "))
+		} else {
+			fmt.Fprintf(&b, "  %-6s %s\n", e.Type, e.Name)
+		}
+	}
+
+	fmt.Fprintf(&b, "imports (%d):\n", len(m.Imports))
+	for _, imp := range m.Imports {
+		flag := " "
+		if !imp.Status.Satisfied() {
+			flag = "!"
+		}
+		fmt.Fprintf(&b, "%s %s.%s(%s) -> (%s) [%s]\n", flag, imp.Module, imp.Name,
+			strings.Join(imp.Params, ", "), strings.Join(imp.Results, ", "), imp.Status)
+	}
+
+	fmt.Fprintf(&b, "memories (%d):\n", len(m.Memories))
+	for _, mem := range m.Memories {
+		maxPages := "unbounded"
+		if mem.HasMax {
+			maxPages = fmt.Sprintf("%d", mem.Max)
+		}
+		kind := "exported"
+		if mem.Imported {
+			kind = "imported"
+		}
+		fmt.Fprintf(&b, "  %s %s: min %d pages, max %s\n", kind, mem.Name, mem.Min, maxPages)
+	}
+
+	fmt.Fprintf(&b, "custom sections (%d):\n", len(m.CustomSections))
+	for _, s := range m.CustomSections {
+		fmt.Fprintf(&b, "  %s (%d bytes)\n", s.Name, s.Size)
+	}
+
+	return b.String()
+}
+
+func presence(present bool) string {
+	if present {
+		return "present"
+	}
+	return "missing"
+}
+
+// InspectModule reports the WATM API versions, exports, imports, memory
+// limits and custom sections of a WATM. The module is compiled but never
+// instantiated, so none of its code runs.
+func InspectModule(bin []byte) (*ModuleInfo, error) {
+	if len(bin) == 0 {
+		return nil, ErrEmptyModule
+	}
+
+	ctx := context.Background()
+
+	// A private compilation cache keeps the custom sections, which are
+	// otherwise dropped, out of the one shared with regular Cores.
+	cache := wazero.NewCompilationCache()
+	defer cache.Close(ctx)
+
+	rcf := NewWazeroRuntimeConfigFactory()
+	rcf.runtimeConfig = wazero.NewRuntimeConfigInterpreter().WithCustomSections(true)
+	rcf.SetCompilationCache(cache)
+
+	c, err := NewCoreWithContext(ctx, &Config{
+		TransportModuleBin:   bin,
+		RuntimeConfigFactory: rcf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Function signatures, memories and custom sections are not exposed
+	// by Core.
+	var module wazero.CompiledModule
+	var exportedFuncs map[string]api.FunctionDefinition
+	if cc, ok := c.(*core); ok {
+		module = cc.module
+		exportedFuncs = module.ExportedFunctions()
+	}
+
+	info := &ModuleInfo{}
+	exports := c.Exports()
+	for name, typ := range exports {
+		export := ExportInfo{Name: name, Type: api.ExternTypeName(typ)}
+		if def, ok := exportedFuncs[name]; ok {
+			export.Params = valueTypeNames(def.ParamTypes())
+			export.Results = valueTypeNames(def.ResultTypes())
+		}
+		info.Exports = append(info.Exports, export)
+	}
+	sort.Slice(info.Exports, func(i, j int) bool { return info.Exports[i].Name < info.Exports[j].Name })
+
+	var detected []watmABI
+	for _, abi := range knownABIs {
+		if _, ok := exports[abi.marker]; !ok {
+			continue
+		}
+		detected = append(detected, abi)
+
+		v := VersionInfo{Version: abi.version}
+		for _, name := range abi.required {
+			_, ok := exports[name]
+			v.Required = append(v.Required, ExportStatus{Name: name, Present: ok})
+		}
+		for _, name := range abi.optional {
+			_, ok := exports[name]
+			v.Optional = append(v.Optional, ExportStatus{Name: name, Present: ok})
+		}
+		info.Versions = append(info.Versions, v)
+	}
+
+	wasi, err := wasiFunctions()
+	if err != nil {
+		return nil, err
+	}
+	for module, funcs := range c.ImportedFunctions() {
+		for name, def := range funcs {
+			imp := ImportInfo{
+				Module:  module,
+				Name:    name,
+				Params:  valueTypeNames(def.ParamTypes()),
+				Results: valueTypeNames(def.ResultTypes()),
+			}
+			imp.Status = importStatus(module, name, def, detected, wasi)
+			info.Imports = append(info.Imports, imp)
+		}
+	}
+	sort.Slice(info.Imports, func(i, j int) bool {
+		if info.Imports[i].Module != info.Imports[j].Module {
+			return info.Imports[i].Module < info.Imports[j].Module
+		}
+		return info.Imports[i].Name < info.Imports[j].Name
+	})
+
+	if module != nil {
+		for _, mem := range module.ImportedMemories() {
+			module, name, _ := mem.Import()
+			info.Memories = append(info.Memories, newMemoryInfo(module+"."+name, true, mem))
+		}
+		for name, mem := range module.ExportedMemories() {
+			info.Memories = append(info.Memories, newMemoryInfo(name, false, mem))
+		}
+		sort.Slice(info.Memories, func(i, j int) bool { return info.Memories[i].Name < info.Memories[j].Name })
+
+		for _, s := range module.CustomSections() {
+			info.CustomSections = append(info.CustomSections, CustomSectionInfo{Name: s.Name(), Size: len(s.Data())})
+		}
+	}
+
+	return info, nil
+}
+
+func newMemoryInfo(name string, imported bool, mem api.MemoryDefinition) MemoryInfo {
+	maxPages, hasMax := mem.Max()
+	return MemoryInfo{
+		Name:     name,
+		Imported: imported,
+		Min:      mem.Min(),
+		Max:      maxPages,
+		HasMax:   hasMax,
+	}
+}
+
+func importStatus(module, name string, def api.FunctionDefinition, detected []watmABI, wasi map[string]api.FunctionDefinition) ImportStatus {
+	switch module {
+	case wasi_snapshot_preview1.ModuleName:
+		host, ok := wasi[name]
+		if !ok {
+			return ImportUnknown
+		}
+		if !sameSignature(def, host) {
+			return ImportSignatureMismatch
+		}
+		return ImportWASI
+	case "env":
+		for _, abi := range detected {
+			for _, n := range abi.imports {
+				if n == name {
+					return ImportWATER
+				}
+			}
+		}
+		for _, abi := range knownABIs {
+			for _, n := range abi.imports {
+				if n == name {
+					return ImportOtherVersion
+				}
+			}
+		}
+	}
+	return ImportUnknown
+}
+
+func sameSignature(a, b api.FunctionDefinition) bool {
+	return string(a.ParamTypes()) == string(b.ParamTypes()) &&
+		string(a.ResultTypes()) == string(b.ResultTypes())
+}
+
+func valueTypeNames(types []api.ValueType) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = api.ValueTypeName(t)
+	}
+	return names
+}
+
+var wasiFunctions = sync.OnceValues(func() (map[string]api.FunctionDefinition, error) {
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer r.Close(ctx)
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		return nil, fmt.Errorf("water: wazero/imports/wasi_snapshot_preview1.Instantiate returned error: %w", err)
+	}
+	return r.Module(wasi_snapshot_preview1.ModuleName).ExportedFunctionDefinitions(), nil
+})
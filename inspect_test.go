@@ -0,0 +1,124 @@
+package water_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/refraction-networking/water"
+)
+
+func TestInspectModule(t *testing.T) {
+	t.Run("v0 WATM", testInspectModuleV0)
+	t.Run("v1 WATM", testInspectModuleV1)
+	t.Run("unsatisfied imports", testInspectModuleUnsatisfied)
+	t.Run("empty module", testInspectModuleEmpty)
+}
+
+func inspect(t *testing.T, path string) *water.ModuleInfo {
+	t.Helper()
+
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := water.InspectModule(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + info.String())
+	return info
+}
+
+func testInspectModuleV0(t *testing.T) {
+	info := inspect(t, "examples/v0/watm/plain.go.wasm")
+
+	if len(info.Versions) != 1 || info.Versions[0].Version != "v0" {
+		t.Fatalf("versions = %+v, want v0 only", info.Versions)
+	}
+	if !info.Versions[0].Complete() {
+		t.Errorf("v0 = %+v, want complete", info.Versions[0])
+	}
+	if u := info.Unsatisfied(); len(u) != 0 {
+		t.Errorf("unsatisfied imports = %+v, want none", u)
+	}
+}
+
+func testInspectModuleV1(t *testing.T) {
+	info := inspect(t, "transport/v1/testdata/plain.wasm")
+
+	if len(info.Versions) != 1 || info.Versions[0].Version != "v1" {
+		t.Fatalf("versions = %+v, want v1 only", info.Versions)
+	}
+	v1 := info.Versions[0]
+	if !v1.Complete() {
+		t.Errorf("v1 = %+v, want complete", v1)
+	}
+	for _, e := range v1.Optional {
+		if e.Name == "watm_dial_v1" && !e.Present {
+			t.Errorf("watm_dial_v1 reported missing")
+		}
+	}
+
+	if u := info.Unsatisfied(); len(u) != 0 {
+		t.Errorf("unsatisfied imports = %+v, want none", u)
+	}
+	found := false
+	for _, imp := range info.Imports {
+		if imp.Module == "env" && imp.Name == "water_dial" {
+			found = imp.Status == water.ImportWATER
+		}
+	}
+	if !found {
+		t.Errorf("env.water_dial not reported as provided by WATER")
+	}
+
+	if len(info.Memories) == 0 {
+		t.Errorf("no memory reported")
+	}
+}
+
+// wrongImportsWATM is a v1 WATM, as far as its exports go, importing the
+// v0 env.host_dial and an unknown env.mystery. It has no memory.
+var wrongImportsWATM = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, // magic and version
+	0x01, 0x08, 0x02, 0x60, 0x00, 0x01, 0x7f, 0x60, 0x00, 0x00, // types: () -> i32, () -> ()
+	0x02, 0x1f, 0x02, // imports
+	0x03, 'e', 'n', 'v', 0x09, 'h', 'o', 's', 't', '_', 'd', 'i', 'a', 'l', 0x00, 0x00,
+	0x03, 'e', 'n', 'v', 0x07, 'm', 'y', 's', 't', 'e', 'r', 'y', 0x00, 0x00,
+	0x03, 0x02, 0x01, 0x01, // functions: one of type () -> ()
+	0x07, 0x10, 0x01, 0x0c, 'w', 'a', 't', 'm', '_', 'i', 'n', 'i', 't', '_', 'v', '1', 0x00, 0x02, // exports
+	0x0a, 0x04, 0x01, 0x02, 0x00, 0x0b, // code
+}
+
+func testInspectModuleUnsatisfied(t *testing.T) {
+	info, err := water.InspectModule(wrongImportsWATM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + info.String())
+
+	if len(info.Versions) != 1 || info.Versions[0].Complete() {
+		t.Errorf("versions = %+v, want an incomplete v1", info.Versions)
+	}
+
+	want := map[string]water.ImportStatus{
+		"host_dial": water.ImportOtherVersion,
+		"mystery":   water.ImportUnknown,
+	}
+	unsatisfied := info.Unsatisfied()
+	if len(unsatisfied) != len(want) {
+		t.Fatalf("unsatisfied imports = %+v, want %d", unsatisfied, len(want))
+	}
+	for _, imp := range unsatisfied {
+		if imp.Status != want[imp.Name] {
+			t.Errorf("env.%s status = %q, want %q", imp.Name, imp.Status, want[imp.Name])
+		}
+	}
+}
+
+func testInspectModuleEmpty(t *testing.T) {
+	if _, err := water.InspectModule(nil); !errors.Is(err, water.ErrEmptyModule) {
+		t.Errorf("InspectModule(nil) error = %v, want %v", err, water.ErrEmptyModule)
+	}
+}
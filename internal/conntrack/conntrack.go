@@ -0,0 +1,69 @@
+package conntrack
+
+import (
+	"errors"
+	"sync"
+)
+
+// Tracker keeps track of the connections handed out by a Dialer,
+// FixedDialer, Listener or Relay which are not yet closed, so they could
+// still be reached by their creator, e.g., to push an updated transport
+// config.
+//
+// A connection is removed from the Tracker once closed. Connections that
+// are never closed by the caller are kept alive by the Tracker for as long
+// as the Tracker itself is.
+//
+// The zero value is ready to use.
+type Tracker[C comparable] struct {
+	mutex sync.Mutex
+	conns map[C]struct{}
+}
+
+// Track adds c to the Tracker, then hands the func removing it to
+// setUntrack, for c to call once closed. setUntrack returns false if c is
+// already closed, in which case c is removed right away.
+func (t *Tracker[C]) Track(c C, setUntrack func(untrack func()) bool) {
+	t.mutex.Lock()
+	if t.conns == nil {
+		t.conns = make(map[C]struct{})
+	}
+	t.conns[c] = struct{}{}
+	t.mutex.Unlock()
+
+	if !setUntrack(func() { t.Untrack(c) }) { // closed before we got here
+		t.Untrack(c)
+	}
+}
+
+// Untrack removes c from the Tracker.
+func (t *Tracker[C]) Untrack(c C) {
+	t.mutex.Lock()
+	delete(t.conns, c)
+	t.mutex.Unlock()
+}
+
+// Tracked returns the tracked connections.
+func (t *Tracker[C]) Tracked() []C {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	conns := make([]C, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Each calls f with every tracked connection, outside of the lock of the
+// Tracker, and returns the errors joined.
+func (t *Tracker[C]) Each(f func(C) error) error {
+	var errs []error
+	for _, c := range t.Tracked() {
+		if err := f(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,76 @@
+package conntrack_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/refraction-networking/water/internal/conntrack"
+)
+
+type conn struct {
+	closed  bool
+	untrack func()
+}
+
+func (c *conn) setUntrack(untrack func()) bool {
+	if c.closed {
+		return false
+	}
+	c.untrack = untrack
+	return true
+}
+
+func (c *conn) close() {
+	c.closed = true
+	if c.untrack != nil {
+		c.untrack()
+	}
+}
+
+func TestTracker(t *testing.T) {
+	var tracker conntrack.Tracker[*conn]
+
+	t.Run("track and untrack on close", func(t *testing.T) {
+		a, b := &conn{}, &conn{}
+		tracker.Track(a, a.setUntrack)
+		tracker.Track(b, b.setUntrack)
+		if tracked := tracker.Tracked(); len(tracked) != 2 {
+			t.Fatalf("Tracked() = %v, want 2 conns", tracked)
+		}
+
+		a.close()
+		if tracked := tracker.Tracked(); len(tracked) != 1 || tracked[0] != b {
+			t.Fatalf("Tracked() = %v, want [%p]", tracked, b)
+		}
+		b.close()
+	})
+
+	t.Run("closed before tracked", func(t *testing.T) {
+		c := &conn{closed: true}
+		tracker.Track(c, c.setUntrack)
+		if tracked := tracker.Tracked(); len(tracked) != 0 {
+			t.Fatalf("Tracked() = %v, want none", tracked)
+		}
+	})
+
+	t.Run("Each", func(t *testing.T) {
+		a, b := &conn{}, &conn{}
+		tracker.Track(a, a.setUntrack)
+		tracker.Track(b, b.setUntrack)
+		defer a.close()
+		defer b.close()
+
+		errA := errors.New("a")
+		calls := 0
+		err := tracker.Each(func(c *conn) error {
+			calls++
+			if c == a {
+				return errA
+			}
+			return nil
+		})
+		if calls != 2 || !errors.Is(err, errA) {
+			t.Errorf("Each() called %d times, returned %v", calls, err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// protocolVersion is the version of the framing below.
+const protocolVersion uint8 = 0
+
+// headerSize is the size of a frame header:
+//
+//	+---------+------+-------+----------+--------+
+//	| version | type | flags | streamID | length |
+//	|    1    |  1   |   2   |    4     |   4    |
+//	+---------+------+-------+----------+--------+
+//
+// All integers are big-endian. Only Data frames carry a payload of length
+// bytes; the length of other frames is a value of their own.
+const headerSize = 12
+
+// maxDataFrame is the largest payload of a Data frame sent.
+const maxDataFrame = 16 << 10
+
+type frameType uint8
+
+const (
+	// typeData carries stream data. length is the size of the payload.
+	typeData frameType = iota
+
+	// typeWindowUpdate grants the peer length more bytes to send on the
+	// stream. It also opens (SYN) and closes (FIN, RST) streams without
+	// data. A stream starts with no window in either direction: the SYN
+	// and its ACK grant the whole window of their sender.
+	typeWindowUpdate
+
+	// typePing is a keepalive request (SYN) or reply (ACK). length is an
+	// opaque value echoed in the reply.
+	typePing
+
+	// typeGoAway tells the peer no more streams are accepted. length is
+	// an error code.
+	typeGoAway
+)
+
+type frameFlags uint16
+
+const (
+	flagSYN frameFlags = 1 << iota // opens a stream, or requests a ping reply
+	flagACK                        // acknowledges a stream, or replies to a ping
+	flagFIN                        // half-closes a stream
+	flagRST                        // resets a stream
+)
+
+var (
+	ErrBadVersion   = errors.New("mux: unsupported protocol version")
+	ErrBadFrameType = errors.New("mux: unknown frame type")
+)
+
+type header struct {
+	version  uint8
+	typ      frameType
+	flags    frameFlags
+	streamID uint32
+	length   uint32
+}
+
+func (h *header) encode(b []byte) {
+	b[0] = h.version
+	b[1] = uint8(h.typ)
+	binary.BigEndian.PutUint16(b[2:4], uint16(h.flags))
+	binary.BigEndian.PutUint32(b[4:8], h.streamID)
+	binary.BigEndian.PutUint32(b[8:12], h.length)
+}
+
+func readHeader(r io.Reader, b []byte) (header, error) {
+	if _, err := io.ReadFull(r, b[:headerSize]); err != nil {
+		return header{}, err
+	}
+
+	h := header{
+		version:  b[0],
+		typ:      frameType(b[1]),
+		flags:    frameFlags(binary.BigEndian.Uint16(b[2:4])),
+		streamID: binary.BigEndian.Uint32(b[4:8]),
+		length:   binary.BigEndian.Uint32(b[8:12]),
+	}
+	if h.version != protocolVersion {
+		return h, ErrBadVersion
+	}
+	if h.typ > typeGoAway {
+		return h, ErrBadFrameType
+	}
+	return h, nil
+}
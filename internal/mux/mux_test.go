@@ -0,0 +1,283 @@
+package mux_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water/internal/mux"
+	"github.com/refraction-networking/water/internal/socket"
+)
+
+func sessionPair(t *testing.T, config mux.Config) (client, server *mux.Session) {
+	t.Helper()
+
+	c1, c2, err := socket.TCPConnPair()
+	if err != nil && (c1 == nil || c2 == nil) {
+		t.Fatal(err)
+	}
+	client, server = mux.Client(c1, config), mux.Server(c2, config)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestSession(t *testing.T) {
+	t.Run("streams", testStreams)
+	t.Run("flow control", testFlowControl)
+	t.Run("mismatched windows", testMismatchedWindows)
+	t.Run("half close", testHalfClose)
+	t.Run("stream limit", testStreamLimit)
+	t.Run("read deadline", testReadDeadline)
+	t.Run("keepalive", testKeepAlive)
+	t.Run("carrier closed", testCarrierClosed)
+}
+
+func testStreams(t *testing.T) {
+	client, server := sessionPair(t, mux.Config{})
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- echo(client, 1<<20)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// echo opens a stream, writes size random bytes and checks they are
+// echoed back.
+func echo(session *mux.Session, size int) error {
+	stream, err := session.Open()
+	if err != nil {
+		return err
+	}
+	defer stream.Close() // skipcq: GO-S2307
+	_ = stream.SetDeadline(time.Now().Add(10 * time.Second))
+
+	msg := make([]byte, size)
+	_, _ = rand.Read(msg)
+	go func() {
+		_, _ = stream.Write(msg)
+	}()
+
+	echoed := make([]byte, size)
+	if _, err := io.ReadFull(stream, echoed); err != nil {
+		return err
+	}
+	if !bytes.Equal(echoed, msg) {
+		return errors.New("echoed data differs")
+	}
+	return nil
+}
+
+func testFlowControl(t *testing.T) {
+	client, server := sessionPair(t, mux.Config{StreamWindow: 1024})
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close() // skipcq: GO-S2307
+
+	// nothing is read on the other end, so only a window is written
+	_ = stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 4096))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 1024 {
+		t.Fatalf("Write = %d, %v, want 1024, %v", n, err, os.ErrDeadlineExceeded)
+	}
+
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close() // skipcq: GO-S2307
+
+	// reading grants the window back
+	go func() {
+		_, _ = io.Copy(io.Discard, accepted)
+	}()
+	_ = stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := stream.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMismatchedWindows(t *testing.T) {
+	c1, c2, err := socket.TCPConnPair()
+	if err != nil && (c1 == nil || c2 == nil) {
+		t.Fatal(err)
+	}
+	client, server := mux.Client(c1, mux.Config{StreamWindow: 1024}), mux.Server(c2, mux.Config{StreamWindow: 1 << 20})
+	defer client.Close() // skipcq: GO-S2307
+	defer server.Close() // skipcq: GO-S2307
+
+	// each end sends no more than the window of the other
+	go func() {
+		stream, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close() // skipcq: GO-S2307
+		_, _ = io.Copy(stream, stream)
+	}()
+	if err := echo(client, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Errorf("session closed: %v, %v", client.Err(), server.Err())
+	}
+}
+
+func testHalfClose(t *testing.T) {
+	client, server := sessionPair(t, mux.Config{})
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close() // skipcq: GO-S2307
+	if _, err := stream.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := io.ReadAll(accepted)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("ReadAll = %q, %v, want %q", request, err, "request")
+	}
+	_, _ = accepted.Write([]byte("response"))
+	_ = accepted.Close()
+
+	response, err := io.ReadAll(stream)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("ReadAll = %q, %v, want %q", response, err, "response")
+	}
+}
+
+func testStreamLimit(t *testing.T) {
+	client, server := sessionPair(t, mux.Config{MaxStreams: 1})
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.Full() {
+		t.Error("session with MaxStreams streams is not full")
+	}
+	if _, err := client.Open(); err != mux.ErrStreamLimit {
+		t.Errorf("Open beyond MaxStreams: err = %v, want %v", err, mux.ErrStreamLimit)
+	}
+
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+	_ = accepted.Close()
+
+	for start := time.Now(); client.Full(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("closed stream still counted")
+		}
+	}
+	if _, err := client.Open(); err != nil {
+		t.Errorf("Open after closing a stream: %v", err)
+	}
+}
+
+func testReadDeadline(t *testing.T) {
+	client, _ := sessionPair(t, mux.Config{})
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close() // skipcq: GO-S2307
+
+	_ = stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func testKeepAlive(t *testing.T) {
+	client, _ := sessionPair(t, mux.Config{})
+	if _, err := client.Ping(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer not running the protocol never replies
+	c1, c2, err := socket.TCPConnPair()
+	if err != nil && (c1 == nil || c2 == nil) {
+		t.Fatal(err)
+	}
+	defer c2.Close() // skipcq: GO-S2307
+	go func() {
+		_, _ = io.Copy(io.Discard, c2)
+	}()
+
+	session := mux.Client(c1, mux.Config{KeepAliveInterval: 20 * time.Millisecond})
+	select {
+	case <-session.Done():
+		if err := session.Err(); err != mux.ErrKeepAliveTimeout {
+			t.Errorf("Err() = %v, want %v", err, mux.ErrKeepAliveTimeout)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("session not closed by keepalive")
+	}
+}
+
+func testCarrierClosed(t *testing.T) {
+	c1, c2, err := socket.TCPConnPair()
+	if err != nil && (c1 == nil || c2 == nil) {
+		t.Fatal(err)
+	}
+	client, server := mux.Client(c1, mux.Config{}), mux.Server(c2, mux.Config{})
+	defer server.Close() // skipcq: GO-S2307
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.Close()
+
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read on a dead carrier: err = %v", err)
+	}
+	if !client.IsClosed() {
+		t.Error("session not closed with its carrier")
+	}
+	var _ net.Conn = stream
+}
@@ -0,0 +1,412 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures a Session.
+type Config struct {
+	// KeepAliveInterval is the interval between pings sent to the peer.
+	// Zero disables keepalive.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout is how long to wait for a ping reply before
+	// closing the session. Zero means KeepAliveInterval.
+	KeepAliveTimeout time.Duration
+
+	// MaxStreams is the maximum number of streams open at once on the
+	// session, in both directions. Zero means no limit.
+	MaxStreams int
+
+	// StreamWindow is the number of bytes the peer may send on a stream
+	// before it is read. Zero means 256 KiB. It is granted to the peer
+	// when a stream is opened, so both ends need not agree on it.
+	StreamWindow uint32
+
+	// AcceptBacklog is the number of streams opened by the peer waiting
+	// for Accept. Further streams are reset. Zero means 256.
+	AcceptBacklog int
+}
+
+const (
+	defaultStreamWindow  = 256 << 10
+	defaultAcceptBacklog = 256
+)
+
+var (
+	ErrSessionClosed    = errors.New("mux: session closed")
+	ErrStreamLimit      = errors.New("mux: too many streams")
+	ErrKeepAliveTimeout = errors.New("mux: keepalive timeout")
+	ErrGoneAway         = errors.New("mux: peer does not accept new streams")
+	ErrProtocol         = errors.New("mux: protocol error")
+)
+
+// Session multiplexes streams over a single connection.
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	nextID atomic.Uint32
+
+	streamsMutex sync.Mutex
+	streams      map[uint32]*Stream
+	goneAway     bool
+
+	acceptCh chan *Stream
+
+	writeMutex sync.Mutex
+	writeBuf   [headerSize]byte
+
+	pingMutex sync.Mutex
+	pingID    uint32
+	pings     map[uint32]chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Client starts a Session over conn on the side opening odd stream IDs.
+func Client(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server starts a Session over conn on the side opening even stream IDs.
+func Server(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config Config, firstID uint32) *Session {
+	if config.StreamWindow == 0 {
+		config.StreamWindow = defaultStreamWindow
+	}
+	if config.AcceptBacklog == 0 {
+		config.AcceptBacklog = defaultAcceptBacklog
+	}
+	if config.KeepAliveTimeout == 0 {
+		config.KeepAliveTimeout = config.KeepAliveInterval
+	}
+
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, config.AcceptBacklog),
+		pings:    make(map[uint32]chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	s.nextID.Store(firstID)
+
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// Open opens a new stream.
+func (s *Session) Open() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, s.err()
+	}
+
+	s.streamsMutex.Lock()
+	if s.goneAway {
+		s.streamsMutex.Unlock()
+		return nil, ErrGoneAway
+	}
+	if s.config.MaxStreams > 0 && len(s.streams) >= s.config.MaxStreams {
+		s.streamsMutex.Unlock()
+		return nil, ErrStreamLimit
+	}
+	id := s.nextID.Add(2) - 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.streamsMutex.Unlock()
+
+	if err := s.writeFrame(typeWindowUpdate, flagSYN, id, s.config.StreamWindow, nil); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.err()
+	}
+}
+
+// NumStreams returns the number of streams open on the session.
+func (s *Session) NumStreams() int {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	return len(s.streams)
+}
+
+// Full tells whether no stream may be opened until one is closed.
+func (s *Session) Full() bool {
+	return s.config.MaxStreams > 0 && s.NumStreams() >= s.config.MaxStreams
+}
+
+// Ping sends a ping and waits for the reply, returning the round-trip
+// time.
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	reply := make(chan struct{})
+	s.pingMutex.Lock()
+	s.pingID++
+	id := s.pingID
+	s.pings[id] = reply
+	s.pingMutex.Unlock()
+
+	defer func() {
+		s.pingMutex.Lock()
+		delete(s.pings, id)
+		s.pingMutex.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(typePing, flagSYN, 0, id, nil); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-reply:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, ErrKeepAliveTimeout
+	case <-s.closed:
+		return 0, s.err()
+	}
+}
+
+// GoAway tells the peer that no more streams are accepted. Streams
+// already open are not affected.
+func (s *Session) GoAway() error {
+	return s.writeFrame(typeGoAway, 0, 0, 0, nil)
+}
+
+// Close closes the session, its streams and its connection.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// IsClosed tells whether the session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the reason the session was closed, or nil if it is not.
+func (s *Session) Err() error {
+	if !s.IsClosed() {
+		return nil
+	}
+	return s.closeErr
+}
+
+func (s *Session) err() error {
+	<-s.closed
+	return s.closeErr
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.closeErr = err
+		close(s.closed)
+		_ = s.conn.Close()
+
+		s.streamsMutex.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.streamsMutex.Unlock()
+		for _, stream := range streams {
+			stream.notifyAll()
+		}
+	})
+}
+
+func (s *Session) forget(id uint32) {
+	s.streamsMutex.Lock()
+	delete(s.streams, id)
+	s.streamsMutex.Unlock()
+}
+
+func (s *Session) writeFrame(typ frameType, flags frameFlags, id, length uint32, payload []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.IsClosed() {
+		return s.err()
+	}
+
+	h := header{version: protocolVersion, typ: typ, flags: flags, streamID: id, length: length}
+	h.encode(s.writeBuf[:])
+	if _, err := s.conn.Write(s.writeBuf[:]); err != nil {
+		s.closeWithError(fmt.Errorf("mux: writing to connection: %w", err))
+		return s.err()
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.closeWithError(fmt.Errorf("mux: writing to connection: %w", err))
+			return s.err()
+		}
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	var b [headerSize]byte
+	for {
+		h, err := readHeader(s.conn, b[:])
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrSessionClosed
+			}
+			s.closeWithError(err)
+			return
+		}
+
+		switch h.typ {
+		case typeData, typeWindowUpdate:
+			err = s.handleStreamFrame(h)
+		case typePing:
+			err = s.handlePing(h)
+		case typeGoAway:
+			s.streamsMutex.Lock()
+			s.goneAway = true
+			s.streamsMutex.Unlock()
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleStreamFrame(h header) error {
+	if h.flags&flagSYN != 0 {
+		if err := s.incomingStream(h.streamID); err != nil {
+			return err
+		}
+	}
+
+	s.streamsMutex.Lock()
+	stream := s.streams[h.streamID]
+	s.streamsMutex.Unlock()
+
+	if h.typ == typeData {
+		if h.length > s.config.StreamWindow {
+			return fmt.Errorf("%w: data frame of %d bytes exceeds the window", ErrProtocol, h.length)
+		}
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+		if stream != nil {
+			grant, err := stream.received(payload)
+			if err != nil {
+				return err
+			}
+			if grant > 0 {
+				if err := s.writeFrame(typeWindowUpdate, 0, h.streamID, grant, nil); err != nil {
+					return err
+				}
+			}
+		}
+	} else if stream != nil && h.length > 0 {
+		stream.windowUpdated(h.length)
+	}
+
+	if stream != nil {
+		if h.flags&flagFIN != 0 {
+			stream.remoteClosed()
+		}
+		if h.flags&flagRST != 0 {
+			stream.reset()
+		}
+	}
+	return nil
+}
+
+// incomingStream registers a stream opened by the peer.
+func (s *Session) incomingStream(id uint32) error {
+	if id%2 == s.nextID.Load()%2 {
+		return fmt.Errorf("%w: peer opened stream %d with our parity", ErrProtocol, id)
+	}
+
+	s.streamsMutex.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.streamsMutex.Unlock()
+		return fmt.Errorf("%w: stream %d opened twice", ErrProtocol, id)
+	}
+	if s.config.MaxStreams > 0 && len(s.streams) >= s.config.MaxStreams {
+		s.streamsMutex.Unlock()
+		return s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+	}
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.streamsMutex.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+		return s.writeFrame(typeWindowUpdate, flagACK, id, s.config.StreamWindow, nil)
+	default:
+		s.forget(id)
+		return s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+	}
+}
+
+func (s *Session) handlePing(h header) error {
+	if h.flags&flagSYN != 0 {
+		return s.writeFrame(typePing, flagACK, 0, h.length, nil)
+	}
+
+	s.pingMutex.Lock()
+	reply, ok := s.pings[h.length]
+	delete(s.pings, h.length)
+	s.pingMutex.Unlock()
+	if ok {
+		close(reply)
+	}
+	return nil
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Ping(s.config.KeepAliveTimeout); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrStreamReset = errors.New("mux: stream reset by peer")
+
+// Stream is a logical connection multiplexed over a Session.
+//
+// Implements [net.Conn].
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mutex         sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32 // bytes the peer may still send
+	consumed      uint32 // bytes read but not yet granted back to the peer
+	sendWindow    uint32 // bytes we may still send
+	readDeadline  time.Time
+	writeDeadline time.Time
+	localFIN      bool // we will not write anymore
+	remoteFIN     bool // the peer will not write anymore
+	closed        bool // we will not read anymore
+	rst           bool
+
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+
+	writeMutex sync.Mutex
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		session:     session,
+		id:          id,
+		recvWindow:  session.config.StreamWindow,
+		sendWindow:  0, // granted by the SYN or ACK of the peer
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the ID of the stream in its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read implements [net.Conn].
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mutex.Lock()
+		switch {
+		case st.closed:
+			st.mutex.Unlock()
+			return 0, net.ErrClosed
+		case st.recvBuf.Len() > 0:
+			n, _ := st.recvBuf.Read(b)
+			grant := st.consume(uint32(n))
+			st.mutex.Unlock()
+			if grant > 0 {
+				_ = st.session.writeFrame(typeWindowUpdate, 0, st.id, grant, nil)
+			}
+			return n, nil
+		case st.rst:
+			st.mutex.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteFIN:
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mutex.Unlock()
+
+		if err := st.wait(st.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// consume records n bytes read and returns how many bytes to grant back
+// to the peer, once at least half of the window is consumed.
+func (st *Stream) consume(n uint32) uint32 {
+	st.consumed += n
+	if st.consumed < st.session.config.StreamWindow/2 {
+		return 0
+	}
+	grant := st.consumed
+	st.consumed = 0
+	st.recvWindow += grant
+	return grant
+}
+
+// Write implements [net.Conn].
+func (st *Stream) Write(b []byte) (int, error) {
+	st.writeMutex.Lock()
+	defer st.writeMutex.Unlock()
+
+	var written int
+	for written < len(b) {
+		st.mutex.Lock()
+		switch {
+		case st.closed, st.localFIN:
+			st.mutex.Unlock()
+			return written, net.ErrClosed
+		case st.rst:
+			st.mutex.Unlock()
+			return written, ErrStreamReset
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mutex.Unlock()
+			if err := st.wait(st.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b)-written, int(st.sendWindow), maxDataFrame)
+		st.sendWindow -= uint32(n)
+		st.mutex.Unlock()
+
+		if err := st.session.writeFrame(typeData, 0, st.id, uint32(n), b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// wait blocks until notify is signaled, deadline is reached or the
+// session is closed.
+func (st *Stream) wait(notify <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.closed:
+		return st.session.err()
+	}
+}
+
+// CloseWrite half-closes the stream: the peer reads io.EOF once it has
+// read everything written before.
+func (st *Stream) CloseWrite() error {
+	st.writeMutex.Lock()
+	defer st.writeMutex.Unlock()
+
+	st.mutex.Lock()
+	if st.localFIN || st.rst {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.localFIN = true
+	done := st.remoteFIN
+	st.mutex.Unlock()
+
+	err := st.session.writeFrame(typeWindowUpdate, flagFIN, st.id, 0, nil)
+	if done {
+		st.session.forget(st.id)
+	}
+	return err
+}
+
+// Close closes both directions of the stream. As with TCP, the stream is
+// reset if data received is left unread. Otherwise the peer reads io.EOF
+// after everything written before, and data it sends afterwards is
+// discarded.
+//
+// Implements [net.Conn].
+func (st *Stream) Close() error {
+	st.mutex.Lock()
+	st.closed = true
+	unread := st.recvBuf.Len() > 0
+	st.recvBuf.Reset()
+	done := st.localFIN || st.rst
+	st.mutex.Unlock()
+	st.notifyAll()
+
+	if unread && !done {
+		st.reset()
+		return st.session.writeFrame(typeWindowUpdate, flagRST, st.id, 0, nil)
+	}
+	return st.CloseWrite()
+}
+
+// LocalAddr implements [net.Conn].
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr implements [net.Conn].
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline implements [net.Conn].
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	st.notifyAll()
+	return nil
+}
+
+// SetReadDeadline implements [net.Conn].
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.mutex.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+// SetWriteDeadline implements [net.Conn].
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
+
+// received appends the payload of a Data frame from the peer. It returns
+// how many bytes to grant back to the peer right away, if the stream is
+// closed and the payload discarded.
+func (st *Stream) received(payload []byte) (uint32, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	n := uint32(len(payload))
+	if n > st.recvWindow {
+		return 0, fmt.Errorf("%w: stream %d exceeded its window", ErrProtocol, st.id)
+	}
+	if st.closed {
+		return n, nil
+	}
+	st.recvWindow -= n
+	st.recvBuf.Write(payload)
+	notify(st.readNotify)
+	return 0, nil
+}
+
+func (st *Stream) windowUpdated(delta uint32) {
+	st.mutex.Lock()
+	st.sendWindow += delta
+	st.mutex.Unlock()
+	notify(st.writeNotify)
+}
+
+func (st *Stream) remoteClosed() {
+	st.mutex.Lock()
+	st.remoteFIN = true
+	done := st.localFIN
+	st.mutex.Unlock()
+	notify(st.readNotify)
+
+	if done {
+		st.session.forget(st.id)
+	}
+}
+
+func (st *Stream) reset() {
+	st.mutex.Lock()
+	st.rst = true
+	st.mutex.Unlock()
+	st.notifyAll()
+	st.session.forget(st.id)
+}
+
+func (st *Stream) notifyAll() {
+	notify(st.readNotify)
+	notify(st.writeNotify)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,114 @@
+// Package watmbuild builds WATMs from Go source with the standard Go
+// toolchain, targeting GOOS=wasip1 as a WASI reactor.
+package watmbuild
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Reference modules built with the guest SDK.
+const (
+	Plain   = "github.com/refraction-networking/water/guest/v1/examples/plain"
+	Reverse = "github.com/refraction-networking/water/guest/v1/examples/reverse"
+	Dynamic = "github.com/refraction-networking/water/guest/v1/examples/dynamic"
+)
+
+// ErrNoToolchain is returned by Build if no Go toolchain recent enough to
+// build a WATM (Go 1.24, for go:wasmexport) is found in PATH.
+var ErrNoToolchain = errors.New("watmbuild: no Go 1.24+ toolchain found")
+
+var (
+	cacheMutex sync.Mutex
+	cache      = map[string][]byte{}
+)
+
+// Build compiles the main package pkg into a WATM and returns the binary.
+// Binaries are cached for the lifetime of the process.
+func Build(pkg string) ([]byte, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if bin, ok := cache[pkg]; ok {
+		return bin, nil
+	}
+
+	goBin, err := toolchain()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "watmbuild")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) // skipcq: GO-S2307
+
+	out := filepath.Join(dir, "watm.wasm")
+	cmd := exec.Command(goBin, "build", "-buildmode=c-shared", "-o", out, pkg) // skipcq: GSC-G204
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("watmbuild: building %s: %w\n%s", pkg, err, stderr.Bytes())
+	}
+
+	bin, err := os.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	cache[pkg] = bin
+	return bin, nil
+}
+
+// Require is like Build, but skips t if no suitable toolchain is found and
+// fails it on any other error.
+func Require(t testing.TB, pkg string) []byte {
+	t.Helper()
+
+	bin, err := Build(pkg)
+	if errors.Is(err, ErrNoToolchain) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func toolchain() (string, error) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		return "", ErrNoToolchain
+	}
+
+	out, err := exec.Command(goBin, "env", "GOVERSION").Output() // skipcq: GSC-G204
+	if err != nil {
+		return "", ErrNoToolchain
+	}
+	if !atLeastGo124(strings.TrimSpace(string(out))) {
+		return "", fmt.Errorf("%w: have %s", ErrNoToolchain, bytes.TrimSpace(out))
+	}
+	return goBin, nil
+}
+
+// atLeastGo124 reports whether the GOVERSION v, such as go1.24.1 or
+// go1.25rc1, is Go 1.24 or later. Development versions are assumed to be.
+func atLeastGo124(v string) bool {
+	if !strings.HasPrefix(v, "go1.") {
+		return strings.HasPrefix(v, "devel")
+	}
+	minor := strings.TrimPrefix(v, "go1.")
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	n, err := strconv.Atoi(minor)
+	return err == nil && n >= 24
+}
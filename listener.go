@@ -33,6 +33,11 @@ type Listener interface {
 	// as a water.Conn.
 	AcceptWATER() (Conn, error)
 
+	// UpdateTransportConfig replaces the TransportModuleConfig used for
+	// connections accepted from now on, and pushes the new config to the
+	// live connections so WATMs that opt in can apply it in place.
+	UpdateTransportConfig(config []byte) error
+
 	mustEmbedUnimplementedListener()
 }
 
@@ -56,6 +61,11 @@ func (*UnimplementedListener) AcceptWATER() (Conn, error) {
 	return nil, ErrUnimplementedListener
 }
 
+// UpdateTransportConfig implements water.Listener.UpdateTransportConfig().
+func (*UnimplementedListener) UpdateTransportConfig(_ []byte) error {
+	return ErrUnimplementedListener
+}
+
 // mustEmbedUnimplementedListener is a function that developers cannot
 func (*UnimplementedListener) mustEmbedUnimplementedListener() {} //nolint:unused
 
@@ -87,7 +97,8 @@ func NewListener(c *Config) (Listener, error) {
 // the given [context.Context].
 //
 // It automatically detects the version of the WebAssembly Transport
-// Module specified in the config.
+// Module specified in the config, unless [Config.NativeTransport] selects
+// a native transport or [Config.Chain] stacks several transports.
 //
 // The context is passed to [NewCoreWithContext] and the registered versioned
 // listener creation function to control the lifetime of the call to function
@@ -97,6 +108,17 @@ func NewListener(c *Config) (Listener, error) {
 // Call [WazeroRuntimeConfigFactory.SetCloseOnContextDone] with false to disable
 // this behavior.
 func NewListenerWithContext(ctx context.Context, c *Config) (Listener, error) {
+	if c != nil && len(c.Chain) > 0 {
+		return newChainListener(ctx, c)
+	}
+
+	if c != nil && c.NativeTransport != "" {
+		if f, ok := knownListenerVersions[NativeVersion]; ok {
+			return f(ctx, c)
+		}
+		return nil, ErrListenerVersionNotFound
+	}
+
 	core, err := NewCoreWithContext(ctx, c)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,334 @@
+package water
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MultiDialerOptions configures a [MultiDialer].
+type MultiDialerOptions struct {
+	// AttemptTimeout bounds every attempt to dial with one of the
+	// transports. Zero means an attempt is only bounded by the context
+	// given to DialContext.
+	AttemptTimeout time.Duration
+
+	// RememberTTL is how long the transport which last succeeded for a
+	// destination is tried first for that destination. Zero means the
+	// configured order is always used.
+	RememberTTL time.Duration
+
+	// Race is the number of transports, at the head of the order, which
+	// are dialed in parallel. The first connection established wins and
+	// the others are canceled. Zero or one means every transport is tried
+	// in sequence.
+	Race int
+
+	// RaceDelay is the delay before starting the next raced attempt while
+	// the previous ones are still pending, in the spirit of Happy Eyeballs
+	// (RFC 8305). An attempt failing starts the next one immediately. Zero
+	// starts all raced attempts at once.
+	RaceDelay time.Duration
+}
+
+// MultiDialer is a [Dialer] trying an ordered list of transports until one
+// of them succeeds, so that a client keeps working when some of them are
+// blocked.
+//
+// The connections returned are [MultiDialerConn]s telling which transport
+// was chosen.
+type MultiDialer struct {
+	dialers []Dialer
+	opts    MultiDialerOptions
+	ctx     context.Context
+
+	rememberedMutex sync.Mutex
+	remembered      map[string]rememberedTransport
+
+	UnimplementedDialer // embedded to ensure forward compatibility
+}
+
+type rememberedTransport struct {
+	index   int
+	expires time.Time
+}
+
+var (
+	ErrMultiDialerNoConfig = errors.New("water: multi dialer needs at least one config")
+
+	_ Dialer = (*MultiDialer)(nil) // type guard
+)
+
+// NewMultiDialerWithContext creates a new [MultiDialer] trying the
+// transports of configs in order, as configured by opts.
+//
+// A [Dialer] is created for every config with [NewDialerWithContext], to
+// which ctx is passed. The context SHOULD be used as the default context
+// for call to [MultiDialer.Dial].
+func NewMultiDialerWithContext(ctx context.Context, configs []*Config, opts MultiDialerOptions) (*MultiDialer, error) {
+	if len(configs) == 0 {
+		return nil, ErrMultiDialerNoConfig
+	}
+
+	dialers := make([]Dialer, 0, len(configs))
+	for i, c := range configs {
+		dialer, err := NewDialerWithContext(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("water: creating dialer for config %d: %w", i, err)
+		}
+		dialers = append(dialers, dialer)
+	}
+
+	return &MultiDialer{
+		dialers:    dialers,
+		opts:       opts,
+		ctx:        ctx,
+		remembered: make(map[string]rememberedTransport),
+	}, nil
+}
+
+// Dial implements [Dialer].
+func (d *MultiDialer) Dial(network, address string) (Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+// DialContext dials the remote network address with every transport in
+// order, starting with the one remembered for the destination if any, and
+// returns the first connection established as a [*MultiDialerConn].
+//
+// If every transport fails, the returned error joins the error of every
+// attempt.
+//
+// Implements [Dialer].
+func (d *MultiDialer) DialContext(ctx context.Context, network, address string) (Conn, error) {
+	key := network + " " + address
+	order := d.order(key)
+
+	var errs []error
+	for start := 0; start < len(order); {
+		n := 1
+		if start == 0 && d.opts.Race > 1 {
+			n = min(d.opts.Race, len(order))
+		}
+
+		conn, err := d.race(ctx, network, address, order[start:start+n], &errs)
+		if err == nil {
+			d.remember(key, conn.index)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Join(append(errs, ctx.Err())...)
+		}
+		start += n
+	}
+
+	d.forget(key)
+	return nil, errors.Join(errs...)
+}
+
+// UpdateTransportConfig is not supported by a MultiDialer since every
+// transport expects a config of its own. Use
+// [MultiDialer.UpdateTransportConfigAt] instead.
+//
+// Implements [Dialer].
+func (*MultiDialer) UpdateTransportConfig(_ []byte) error {
+	return fmt.Errorf("water: multi dialer needs UpdateTransportConfigAt: %w", ErrUnimplementedDialer)
+}
+
+// UpdateTransportConfigAt calls [Dialer.UpdateTransportConfig] on the
+// Dialer of the transport at index.
+func (d *MultiDialer) UpdateTransportConfigAt(index int, config []byte) error {
+	if index < 0 || index >= len(d.dialers) {
+		return fmt.Errorf("water: no transport at index %d", index)
+	}
+	return d.dialers[index].UpdateTransportConfig(config)
+}
+
+// order returns the indices of the transports in the order they are
+// tried for the destination key.
+func (d *MultiDialer) order(key string) []int {
+	order := make([]int, 0, len(d.dialers))
+
+	first := -1
+	if d.opts.RememberTTL > 0 {
+		d.rememberedMutex.Lock()
+		if r, ok := d.remembered[key]; ok {
+			if time.Now().Before(r.expires) {
+				first = r.index
+			} else {
+				delete(d.remembered, key)
+			}
+		}
+		d.rememberedMutex.Unlock()
+	}
+
+	if first >= 0 {
+		order = append(order, first)
+	}
+	for i := range d.dialers {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (d *MultiDialer) remember(key string, index int) {
+	if d.opts.RememberTTL <= 0 {
+		return
+	}
+
+	d.rememberedMutex.Lock()
+	defer d.rememberedMutex.Unlock()
+	d.remembered[key] = rememberedTransport{
+		index:   index,
+		expires: time.Now().Add(d.opts.RememberTTL),
+	}
+}
+
+func (d *MultiDialer) forget(key string) {
+	d.rememberedMutex.Lock()
+	defer d.rememberedMutex.Unlock()
+	delete(d.remembered, key)
+}
+
+type multiDialAttempt struct {
+	index  int
+	conn   Conn
+	cancel context.CancelFunc
+	err    error
+}
+
+// race dials with the transports at indices in parallel, staggered by
+// RaceDelay, and returns the first connection established. The errors of
+// failed attempts are appended to errs.
+func (d *MultiDialer) race(ctx context.Context, network, address string, indices []int, errs *[]error) (*MultiDialerConn, error) {
+	results := make(chan multiDialAttempt, len(indices))
+	cancels := make(map[int]context.CancelFunc, len(indices))
+
+	var launched, pending int
+	launch := func() {
+		index := indices[launched]
+		launched++
+		pending++
+
+		// The context of an attempt outlives it if it succeeds: transports
+		// may bind the lifetime of the connection to it.
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[index] = cancel
+		go func() {
+			results <- d.attempt(attemptCtx, cancel, index, network, address)
+		}()
+	}
+
+	var next <-chan time.Time
+	launchNext := func() {
+		launch()
+		if launched < len(indices) && d.opts.RaceDelay > 0 {
+			next = time.After(d.opts.RaceDelay)
+		} else {
+			next = nil
+		}
+	}
+
+	launchNext()
+	for d.opts.RaceDelay <= 0 && launched < len(indices) {
+		launch()
+	}
+
+	for pending > 0 {
+		select {
+		case <-next:
+			launchNext()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				*errs = append(*errs, r.err)
+				if pending == 0 && launched < len(indices) {
+					launchNext()
+				}
+				continue
+			}
+
+			for index, cancel := range cancels {
+				if index != r.index {
+					cancel()
+				}
+			}
+			go func(pending int) { // close connections established too late
+				for ; pending > 0; pending-- {
+					if late := <-results; late.err == nil {
+						_ = late.conn.Close()
+						late.cancel()
+					}
+				}
+			}(pending)
+
+			return &MultiDialerConn{
+				Conn:   r.conn,
+				index:  r.index,
+				cancel: r.cancel,
+			}, nil
+		}
+	}
+
+	return nil, errors.New("water: every attempt failed")
+}
+
+// attempt dials with the transport at index, canceling ctx if
+// AttemptTimeout is reached first.
+func (d *MultiDialer) attempt(ctx context.Context, cancel context.CancelFunc, index int, network, address string) multiDialAttempt {
+	var timer *time.Timer
+	if d.opts.AttemptTimeout > 0 {
+		timer = time.AfterFunc(d.opts.AttemptTimeout, cancel)
+	}
+
+	conn, err := d.dialers[index].DialContext(ctx, network, address)
+	if timer != nil && !timer.Stop() { // timed out, conn is bound to a canceled context
+		if err == nil {
+			_ = conn.Close()
+		}
+		err = fmt.Errorf("attempt timed out after %v", d.opts.AttemptTimeout)
+	}
+	if err != nil {
+		cancel()
+		return multiDialAttempt{index: index, err: fmt.Errorf("water: transport %d: %w", index, err)}
+	}
+
+	return multiDialAttempt{index: index, conn: conn, cancel: cancel}
+}
+
+// MultiDialerConn is a connection established by a [MultiDialer].
+type MultiDialerConn struct {
+	Conn
+
+	index  int
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// TransportIndex returns the index, in the configs given to
+// [NewMultiDialerWithContext], of the transport carrying the connection.
+func (c *MultiDialerConn) TransportIndex() int {
+	return c.index
+}
+
+// Unwrap returns the connection created by the Dialer of the transport.
+func (c *MultiDialerConn) Unwrap() Conn {
+	return c.Conn
+}
+
+// Close closes the connection.
+//
+// Implements [net.Conn].
+func (c *MultiDialerConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.cancel()
+	})
+	return c.closeErr
+}
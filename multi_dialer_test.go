@@ -0,0 +1,222 @@
+package water_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	_ "github.com/refraction-networking/water/transport/native"
+)
+
+var multiToggleFails atomic.Bool
+
+func init() {
+	transports := map[string]func(conn net.Conn) (net.Conn, error){
+		"multi-ok": func(conn net.Conn) (net.Conn, error) {
+			return conn, nil
+		},
+		"multi-fail": func(net.Conn) (net.Conn, error) {
+			return nil, errors.New("blocked")
+		},
+		"multi-slow": func(conn net.Conn) (net.Conn, error) {
+			time.Sleep(5 * time.Second)
+			return conn, nil
+		},
+		"multi-toggle": func(conn net.Conn) (net.Conn, error) {
+			if multiToggleFails.Load() {
+				return nil, errors.New("blocked")
+			}
+			return conn, nil
+		},
+	}
+
+	for name, wrap := range transports {
+		wrap := wrap
+		err := water.RegisterNativeTransport(name, func([]byte) (water.NativeTransport, error) {
+			return wrapFunc(wrap), nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+type wrapFunc func(conn net.Conn) (net.Conn, error)
+
+func (f wrapFunc) Wrap(conn net.Conn, _ water.NativeRole) (net.Conn, error) {
+	return f(conn)
+}
+
+func TestMultiDialer(t *testing.T) {
+	t.Run("fallback", testMultiDialerFallback)
+	t.Run("all failing", testMultiDialerAllFailing)
+	t.Run("attempt timeout", testMultiDialerAttemptTimeout)
+	t.Run("race", testMultiDialerRace)
+	t.Run("remember", testMultiDialerRemember)
+}
+
+func multiConfigs(names ...string) []*water.Config {
+	configs := make([]*water.Config, 0, len(names))
+	for _, name := range names {
+		configs = append(configs, &water.Config{NativeTransport: name})
+	}
+	return configs
+}
+
+func multiEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis
+}
+
+// multiDial dials lis with d and checks the transport chosen and that the
+// connection works.
+func multiDial(t *testing.T, d *water.MultiDialer, lis net.Listener, wantIndex int) {
+	t.Helper()
+
+	conn, err := d.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if index := conn.(*water.MultiDialerConn).TransportIndex(); index != wantIndex {
+		t.Errorf("TransportIndex() = %d, want %d", index, wantIndex)
+	}
+
+	msg := []byte("hello, multi")
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMultiDialerFallback(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	d, err := water.NewMultiDialerWithContext(context.Background(), multiConfigs("multi-fail", "multi-ok"), water.MultiDialerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiDial(t, d, lis, 1)
+}
+
+func testMultiDialerAllFailing(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	d, err := water.NewMultiDialerWithContext(context.Background(), multiConfigs("multi-fail", "multi-fail"), water.MultiDialerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err == nil {
+		t.Fatal("DialContext succeeded with every transport failing")
+	}
+	for _, want := range []string{"transport 0", "transport 1"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+
+	if _, err := water.NewMultiDialerWithContext(context.Background(), nil, water.MultiDialerOptions{}); err != water.ErrMultiDialerNoConfig {
+		t.Errorf("no config: err = %v, want %v", err, water.ErrMultiDialerNoConfig)
+	}
+}
+
+func testMultiDialerAttemptTimeout(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	d, err := water.NewMultiDialerWithContext(context.Background(), multiConfigs("multi-slow", "multi-ok"), water.MultiDialerOptions{
+		AttemptTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	multiDial(t, d, lis, 1)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fell back after %v, want about 100ms", elapsed)
+	}
+}
+
+func testMultiDialerRace(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	d, err := water.NewMultiDialerWithContext(context.Background(), multiConfigs("multi-slow", "multi-ok"), water.MultiDialerOptions{
+		Race:      2,
+		RaceDelay: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	multiDial(t, d, lis, 1)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("raced attempt won after %v, want about 50ms", elapsed)
+	}
+}
+
+func testMultiDialerRemember(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	configs := multiConfigs("multi-toggle", "multi-ok")
+	defer multiToggleFails.Store(false)
+
+	t.Run("remembered", func(t *testing.T) {
+		d, err := water.NewMultiDialerWithContext(context.Background(), configs, water.MultiDialerOptions{RememberTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		multiToggleFails.Store(true)
+		multiDial(t, d, lis, 1)
+		multiToggleFails.Store(false)
+		multiDial(t, d, lis, 1)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		d, err := water.NewMultiDialerWithContext(context.Background(), configs, water.MultiDialerOptions{RememberTTL: time.Nanosecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		multiToggleFails.Store(true)
+		multiDial(t, d, lis, 1)
+		multiToggleFails.Store(false)
+		time.Sleep(time.Millisecond)
+		multiDial(t, d, lis, 0)
+	})
+}
@@ -0,0 +1,446 @@
+package water
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water/internal/log"
+	"github.com/refraction-networking/water/internal/mux"
+)
+
+// MuxOptions configures a [MuxDialer] or a [MuxListener].
+type MuxOptions struct {
+	// MaxStreamsPerConn is the maximum number of streams open at once over
+	// a single underlying connection. Zero means no limit.
+	MaxStreamsPerConn int
+
+	// MaxConns is the maximum number of underlying connections a
+	// MuxDialer opens to a single destination. New ones are opened once
+	// every other one reaches MaxStreamsPerConn. Zero means one.
+	MaxConns int
+
+	// KeepAliveInterval is the interval between pings sent over every
+	// underlying connection. Zero disables keepalive.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout is how long to wait for a ping reply before
+	// closing the underlying connection with all of its streams. Zero
+	// means KeepAliveInterval.
+	KeepAliveTimeout time.Duration
+
+	// StreamWindow is the number of bytes the peer may send on a stream
+	// before it is read, for flow control. Zero means 256 KiB. Every end
+	// grants its own window to the other when a stream is opened, so the
+	// MuxDialer and the MuxListener may differ.
+	StreamWindow uint32
+}
+
+func (o *MuxOptions) sessionConfig() mux.Config {
+	return mux.Config{
+		KeepAliveInterval: o.KeepAliveInterval,
+		KeepAliveTimeout:  o.KeepAliveTimeout,
+		MaxStreams:        o.MaxStreamsPerConn,
+		StreamWindow:      o.StreamWindow,
+	}
+}
+
+var (
+	ErrMuxStreamLimit    = errors.New("water: every mux connection reached MaxStreamsPerConn")
+	ErrMuxDialerClosed   = errors.New("water: mux dialer closed")
+	ErrMuxListenerClosed = errors.New("water: mux listener closed")
+
+	_ Dialer   = (*MuxDialer)(nil)   // type guard
+	_ Listener = (*MuxListener)(nil) // type guard
+)
+
+// MuxDialer is a [Dialer] opening logical streams over a few connections
+// of another Dialer, instead of a connection with a transport handshake of
+// its own for every call. The other end must be a [MuxListener].
+//
+// Underlying connections closed, e.g., after a keepalive timeout, are
+// replaced on the next dial. The streams they carried fail.
+type MuxDialer struct {
+	dialer Dialer
+	opts   MuxOptions
+	ctx    context.Context
+
+	poolsMutex sync.Mutex
+	pools      map[string]*muxPool
+	closed     bool
+
+	UnimplementedDialer // embedded to ensure forward compatibility
+}
+
+// muxPool is the sessions of a MuxDialer to a destination.
+type muxPool struct {
+	sessions []*mux.Session
+	dialing  int
+	dialed   chan struct{} // closed, then replaced, once a dial completes
+}
+
+// NewMuxDialerWithContext creates a new [MuxDialer] over dialer.
+//
+// The context is used to dial the underlying connections, and thus
+// bounds their lifetime. It SHOULD be used as the default context for
+// call to [MuxDialer.Dial].
+func NewMuxDialerWithContext(ctx context.Context, dialer Dialer, opts MuxOptions) *MuxDialer {
+	return &MuxDialer{
+		dialer: dialer,
+		opts:   opts,
+		ctx:    ctx,
+		pools:  make(map[string]*muxPool),
+	}
+}
+
+// Dial implements [Dialer].
+func (d *MuxDialer) Dial(network, address string) (Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+// DialContext opens a stream to the MuxListener at address, over an
+// underlying connection with room for it, dialing one if needed. If ctx is
+// done while waiting for that dial, it returns, but the dial goes on for
+// later calls.
+//
+// Implements [Dialer].
+func (d *MuxDialer) DialContext(ctx context.Context, network, address string) (Conn, error) {
+	key := network + " " + address
+
+	// A session may die between being picked and opening the stream, in
+	// which case a new one is dialed.
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		session, err := d.session(ctx, key, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := session.Open()
+		if err == nil {
+			return &muxConn{Stream: stream}, nil
+		}
+		if !session.IsClosed() || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// session returns the session to key with the fewest streams and room for
+// one more, dialing a new one if none has room. While every session is
+// full and more are being dialed, it waits for those dials to complete.
+func (d *MuxDialer) session(ctx context.Context, key, network, address string) (*mux.Session, error) {
+	maxConns := max(d.opts.MaxConns, 1)
+
+	d.poolsMutex.Lock()
+	for {
+		if d.closed {
+			d.poolsMutex.Unlock()
+			return nil, ErrMuxDialerClosed
+		}
+		pool, ok := d.pools[key]
+		if !ok {
+			pool = &muxPool{dialed: make(chan struct{})}
+			d.pools[key] = pool
+		}
+
+		if best := pool.pick(); best != nil {
+			d.poolsMutex.Unlock()
+			return best, nil
+		}
+		if len(pool.sessions)+pool.dialing < maxConns {
+			pool.dialing++
+			d.poolsMutex.Unlock()
+			return d.dial(ctx, pool, network, address)
+		}
+		if pool.dialing == 0 {
+			d.poolsMutex.Unlock()
+			return nil, ErrMuxStreamLimit
+		}
+
+		dialed := pool.dialed
+		d.poolsMutex.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		d.poolsMutex.Lock()
+	}
+}
+
+// dial dials a new session for pool. The underlying connection is dialed
+// with the context of the MuxDialer, as it outlives the call, and added to
+// pool even if ctx is done first.
+func (d *MuxDialer) dial(ctx context.Context, pool *muxPool, network, address string) (*mux.Session, error) {
+	type result struct {
+		session *mux.Session
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := d.dialer.DialContext(d.ctx, network, address)
+
+		d.poolsMutex.Lock()
+		defer d.poolsMutex.Unlock()
+		pool.dialing--
+		pool.wake()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		session := mux.Client(conn, d.opts.sessionConfig())
+		if d.closed {
+			_ = session.Close()
+			done <- result{err: ErrMuxDialerClosed}
+			return
+		}
+		pool.sessions = append(pool.sessions, session)
+		done <- result{session: session}
+	}()
+
+	select {
+	case r := <-done:
+		return r.session, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pick returns the live session with the fewest streams and room for one
+// more, or nil, dropping the closed ones.
+func (p *muxPool) pick() *mux.Session {
+	var best *mux.Session
+	alive := p.sessions[:0]
+	for _, session := range p.sessions {
+		if session.IsClosed() {
+			continue
+		}
+		alive = append(alive, session)
+		if !session.Full() && (best == nil || session.NumStreams() < best.NumStreams()) {
+			best = session
+		}
+	}
+	p.sessions = alive
+	return best
+}
+
+// wake wakes up the callers waiting for a dial of p to complete.
+func (p *muxPool) wake() {
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+}
+
+// UpdateTransportConfig passes config to the underlying Dialer.
+//
+// Implements [Dialer].
+func (d *MuxDialer) UpdateTransportConfig(config []byte) error {
+	return d.dialer.UpdateTransportConfig(config)
+}
+
+// Close closes every underlying connection, and thus all streams. Dials
+// afterwards fail with ErrMuxDialerClosed.
+func (d *MuxDialer) Close() error {
+	d.poolsMutex.Lock()
+	defer d.poolsMutex.Unlock()
+
+	d.closed = true
+	for key, pool := range d.pools {
+		for _, session := range pool.sessions {
+			_ = session.Close()
+		}
+		pool.wake()
+		delete(d.pools, key)
+	}
+	return nil
+}
+
+// MuxListener is a [Listener] accepting the logical streams opened by
+// [MuxDialer]s over the connections accepted by another Listener.
+type MuxListener struct {
+	listener Listener
+	opts     MuxOptions
+
+	streams chan *mux.Stream
+
+	sessionsMutex sync.Mutex
+	sessions      map[*mux.Session]struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	errMutex  sync.Mutex
+	err       error
+
+	UnimplementedListener // embedded to ensure forward compatibility
+}
+
+// NewMuxListener creates a new [MuxListener] over listener and starts
+// accepting connections from it. A connection failing to be accepted,
+// e.g., with a bad handshake, is logged and skipped, after a backoff if
+// the error is temporary. Once listener is closed, the MuxListener is
+// closed with its error.
+func NewMuxListener(listener Listener, opts MuxOptions) *MuxListener {
+	l := &MuxListener{
+		listener: listener,
+		opts:     opts,
+		streams:  make(chan *mux.Stream),
+		sessions: make(map[*mux.Session]struct{}),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptConns()
+	return l
+}
+
+// maxAcceptBackoff bounds the backoff of a MuxListener after temporary
+// errors, as in net/http.Server.Serve.
+const maxAcceptBackoff = time.Second
+
+func (l *MuxListener) acceptConns() {
+	var backoff time.Duration
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				l.closeWithError(err)
+				return
+			}
+
+			log.Warnf("water: MuxListener: accepting a connection: %v", err)
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Temporary() { //nolint:staticcheck // as net/http
+				continue
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-l.closed:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		session := mux.Server(conn, l.opts.sessionConfig())
+		l.sessionsMutex.Lock()
+		select {
+		case <-l.closed:
+			l.sessionsMutex.Unlock()
+			_ = session.Close()
+			return
+		default:
+		}
+		l.sessions[session] = struct{}{}
+		l.sessionsMutex.Unlock()
+
+		go l.acceptStreams(session)
+	}
+}
+
+func (l *MuxListener) acceptStreams(session *mux.Session) {
+	defer func() {
+		l.sessionsMutex.Lock()
+		delete(l.sessions, session)
+		l.sessionsMutex.Unlock()
+	}()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		select {
+		case l.streams <- stream:
+		case <-l.closed:
+			_ = stream.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for and returns the next stream.
+//
+// Implements [net.Listener].
+func (l *MuxListener) Accept() (net.Conn, error) {
+	return l.AcceptWATER()
+}
+
+// AcceptWATER waits for and returns the next stream as a water.Conn.
+//
+// Implements [Listener].
+func (l *MuxListener) AcceptWATER() (Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return &muxConn{Stream: stream}, nil
+	case <-l.closed:
+		l.errMutex.Lock()
+		defer l.errMutex.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying Listener and connections, and thus all
+// streams.
+//
+// Implements [net.Listener].
+func (l *MuxListener) Close() error {
+	l.closeWithError(ErrMuxListenerClosed)
+	return l.listener.Close()
+}
+
+func (l *MuxListener) closeWithError(err error) {
+	l.closeOnce.Do(func() {
+		l.errMutex.Lock()
+		l.err = err
+		l.errMutex.Unlock()
+		close(l.closed)
+
+		l.sessionsMutex.Lock()
+		for session := range l.sessions {
+			_ = session.Close()
+		}
+		l.sessionsMutex.Unlock()
+	})
+}
+
+// Addr returns the address of the underlying Listener.
+//
+// Implements [net.Listener].
+func (l *MuxListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// UpdateTransportConfig passes config to the underlying Listener.
+//
+// Implements [Listener].
+func (l *MuxListener) UpdateTransportConfig(config []byte) error {
+	return l.listener.UpdateTransportConfig(config)
+}
+
+// muxConn is a stream opened by a MuxDialer or accepted by a
+// MuxListener.
+type muxConn struct {
+	*mux.Stream
+
+	UnimplementedConn // embedded to ensure forward compatibility
+}
@@ -0,0 +1,351 @@
+package water_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+)
+
+// countingListener records the connections it accepts.
+type countingListener struct {
+	net.Listener
+
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mutex.Lock()
+		l.conns = append(l.conns, conn)
+		l.mutex.Unlock()
+	}
+	return conn, err
+}
+
+func (l *countingListener) accepted() []net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]net.Conn(nil), l.conns...)
+}
+
+// muxPair starts a MuxListener echoing every stream and returns a
+// MuxDialer to it, both over the "multi-ok" native transport.
+func muxPair(t *testing.T, opts water.MuxOptions) (*water.MuxDialer, *countingListener, string) {
+	t.Helper()
+
+	counting, addr := muxListener(t, opts)
+	return muxDialer(t, opts, nil), counting, addr
+}
+
+// muxListener starts a MuxListener echoing every stream over the
+// "multi-ok" native transport.
+func muxListener(t *testing.T, opts water.MuxOptions) (*countingListener, string) {
+	t.Helper()
+
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: tcpLis}
+
+	config := &water.Config{NativeTransport: "multi-ok", NetworkListener: counting}
+	lis, err := water.NewListenerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxLis := water.NewMuxListener(lis, opts)
+	t.Cleanup(func() { _ = muxLis.Close() })
+
+	go func() {
+		for {
+			conn, err := muxLis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return counting, tcpLis.Addr().String()
+}
+
+// muxDialer returns a MuxDialer over the "multi-ok" native transport,
+// dialing the network with dial if set.
+func muxDialer(t *testing.T, opts water.MuxOptions, dial func(network, address string) (net.Conn, error)) *water.MuxDialer {
+	t.Helper()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{NativeTransport: "multi-ok", NetworkDialerFunc: dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxDialer := water.NewMuxDialerWithContext(context.Background(), dialer, opts)
+	t.Cleanup(func() { _ = muxDialer.Close() })
+	return muxDialer
+}
+
+func muxRoundTrip(t *testing.T, conn net.Conn, msg string) error {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		return err
+	}
+	if string(echoed) != msg {
+		t.Errorf("echoed %q, want %q", echoed, msg)
+	}
+	return nil
+}
+
+func TestMux(t *testing.T) {
+	t.Run("one connection", testMuxOneConn)
+	t.Run("stream limit", testMuxStreamLimit)
+	t.Run("reconnect", testMuxReconnect)
+	t.Run("listener closed", testMuxListenerClosed)
+	t.Run("bad client", testMuxListenerBadClient)
+	t.Run("concurrent dials", testMuxConcurrentDials)
+	t.Run("dial context", testMuxDialContext)
+	t.Run("dialer closed", testMuxDialerClosed)
+}
+
+func testMuxOneConn(t *testing.T) {
+	d, counting, addr := muxPair(t, water.MuxOptions{})
+
+	var conns []water.Conn
+	for i := 0; i < 16; i++ {
+		conn, err := d.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		if err := muxRoundTrip(t, conn, "hello, mux"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(counting.accepted()); n != 1 {
+		t.Errorf("%d underlying connections, want 1", n)
+	}
+}
+
+func testMuxStreamLimit(t *testing.T) {
+	d, counting, addr := muxPair(t, water.MuxOptions{MaxStreamsPerConn: 2, MaxConns: 2})
+
+	for i := 0; i < 4; i++ {
+		conn, err := d.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		if err := muxRoundTrip(t, conn, "hello, mux"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(counting.accepted()); n != 2 {
+		t.Errorf("%d underlying connections, want 2", n)
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp", addr); err != water.ErrMuxStreamLimit {
+		t.Errorf("err = %v, want %v", err, water.ErrMuxStreamLimit)
+	}
+}
+
+func testMuxReconnect(t *testing.T) {
+	d, counting, addr := muxPair(t, water.MuxOptions{})
+
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if err := muxRoundTrip(t, conn, "hello, mux"); err != nil {
+		t.Fatal(err)
+	}
+
+	// streams of a dead underlying connection fail
+	_ = counting.accepted()[0].Close()
+	if err := muxRoundTrip(t, conn, "hello, mux"); err == nil {
+		t.Fatal("stream survived its underlying connection")
+	}
+
+	conn, err = d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if err := muxRoundTrip(t, conn, "hello, mux"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(counting.accepted()); n != 2 {
+		t.Errorf("%d underlying connections, want 2", n)
+	}
+}
+
+func testMuxListenerClosed(t *testing.T) {
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := water.NewListenerWithContext(context.Background(), &water.Config{NativeTransport: "multi-ok", NetworkListener: tcpLis})
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxLis := water.NewMuxListener(lis, water.MuxOptions{})
+	if err := muxLis.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := muxLis.Accept(); !errors.Is(err, water.ErrMuxListenerClosed) {
+		t.Errorf("err = %v, want %v", err, water.ErrMuxListenerClosed)
+	}
+}
+
+func testMuxListenerBadClient(t *testing.T) {
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := water.NewListenerWithContext(context.Background(), &water.Config{NativeTransport: "multi-toggle", NetworkListener: tcpLis})
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxLis := water.NewMuxListener(lis, water.MuxOptions{})
+	defer muxLis.Close() // skipcq: GO-S2307
+	go func() {
+		for {
+			conn, err := muxLis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// the handshake of a garbage client fails, closing its connection
+	multiToggleFails.Store(true)
+	defer multiToggleFails.Store(false)
+	garbage, err := net.Dial("tcp", tcpLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer garbage.Close() // skipcq: GO-S2307
+	_, _ = garbage.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_ = garbage.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := garbage.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("garbage client not closed: %v", err)
+	}
+	multiToggleFails.Store(false)
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{NativeTransport: "multi-toggle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxDialer := water.NewMuxDialerWithContext(context.Background(), dialer, water.MuxOptions{})
+	defer muxDialer.Close() // skipcq: GO-S2307
+	conn, err := muxDialer.DialContext(context.Background(), "tcp", tcpLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if err := muxRoundTrip(t, conn, "hello, mux"); err != nil {
+		t.Fatalf("after a garbage client: %v", err)
+	}
+}
+
+func testMuxConcurrentDials(t *testing.T) {
+	counting, addr := muxListener(t, water.MuxOptions{})
+	d := muxDialer(t, water.MuxOptions{}, func(network, address string) (net.Conn, error) {
+		time.Sleep(100 * time.Millisecond) // every call arrives during the first dial
+		return net.Dial(network, address)
+	})
+
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			conn, err := d.DialContext(context.Background(), "tcp", addr)
+			if err == nil {
+				defer conn.Close() // skipcq: GO-S2307
+				err = muxRoundTrip(t, conn, "hello, mux")
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(counting.accepted()); n != 1 {
+		t.Errorf("%d underlying connections, want 1", n)
+	}
+}
+
+func testMuxDialContext(t *testing.T) {
+	counting, addr := muxListener(t, water.MuxOptions{})
+	release := make(chan struct{})
+	d := muxDialer(t, water.MuxOptions{}, func(network, address string) (net.Conn, error) {
+		<-release
+		return net.Dial(network, address)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", addr); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the abandoned dial completes for the next call
+	close(release)
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if err := muxRoundTrip(t, conn, "hello, mux"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(counting.accepted()); n != 1 {
+		t.Errorf("%d underlying connections, want 1", n)
+	}
+}
+
+func testMuxDialerClosed(t *testing.T) {
+	d, _, addr := muxPair(t, water.MuxOptions{})
+
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := muxRoundTrip(t, conn, "hello, mux"); err == nil {
+		t.Error("stream survived closing its MuxDialer")
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", addr); !errors.Is(err, water.ErrMuxDialerClosed) {
+		t.Errorf("err = %v, want %v", err, water.ErrMuxDialerClosed)
+	}
+}
@@ -0,0 +1,113 @@
+package water
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// NativeVersion is the version under which the driver of native
+// transports (`transport/native`) registers its Dialer, FixedDialer,
+// Listener and Relay. It is selected by setting [Config.NativeTransport]
+// instead of looking at the exports of a WATM.
+const NativeVersion = "native"
+
+// NativeRole tells a [NativeTransport] which end of a connection it is
+// wrapping.
+type NativeRole uint8
+
+const (
+	// NativeRoleClient wraps a connection dialed to a remote address, by
+	// a Dialer, a FixedDialer or a Relay.
+	NativeRoleClient NativeRole = iota
+
+	// NativeRoleServer wraps a connection accepted by a Listener.
+	NativeRoleServer
+)
+
+// String implements fmt.Stringer.
+func (r NativeRole) String() string {
+	switch r {
+	case NativeRoleClient:
+		return "client"
+	case NativeRoleServer:
+		return "server"
+	default:
+		return "unknown"
+	}
+}
+
+// NativeTransport is a transport implemented in Go, running in place of a
+// WebAssembly Transport Module. It is useful for trusted transports which
+// do not need the isolation of WebAssembly, or to run a pure-Go reference
+// implementation side by side with a WATM.
+//
+// Like a WATM instance, a NativeTransport is created for every connection,
+// from the TransportModuleConfig at the time.
+type NativeTransport interface {
+	// Wrap wraps conn, a network connection to the peer, into a
+	// connection carrying the application data of the caller.
+	Wrap(conn net.Conn, role NativeRole) (net.Conn, error)
+}
+
+// NativeFixedDialingTransport is a NativeTransport picking the remote
+// address by itself, for use with a [FixedDialer]. As for WATMs, the
+// address is checked with [Config.DialedAddressValidator] before being
+// dialed.
+type NativeFixedDialingTransport interface {
+	NativeTransport
+
+	// FixedAddress returns the network and address to dial.
+	FixedAddress() (network, address string)
+}
+
+// NativeConfigurableTransport is a NativeTransport accepting updates of
+// its config on a live connection, see [Dialer.UpdateTransportConfig].
+type NativeConfigurableTransport interface {
+	NativeTransport
+
+	// Configure applies a new TransportModuleConfig. It may be called
+	// while the connection is in use.
+	Configure(config []byte) error
+}
+
+// NewNativeTransportFunc creates a NativeTransport from the
+// TransportModuleConfig, which is nil if none is set.
+type NewNativeTransportFunc func(config []byte) (NativeTransport, error)
+
+var (
+	knownNativeTransports      = make(map[string]NewNativeTransportFunc)
+	knownNativeTransportsMutex sync.RWMutex
+
+	ErrNativeTransportAlreadyRegistered = errors.New("water: native transport already registered")
+	ErrNativeTransportNotFound          = errors.New("water: native transport not found")
+)
+
+// RegisterNativeTransport registers a NativeTransport under name, to be
+// selected by setting [Config.NativeTransport] to name.
+func RegisterNativeTransport(name string, newTransport NewNativeTransportFunc) error {
+	knownNativeTransportsMutex.Lock()
+	defer knownNativeTransportsMutex.Unlock()
+
+	if _, ok := knownNativeTransports[name]; ok {
+		return ErrNativeTransportAlreadyRegistered
+	}
+	knownNativeTransports[name] = newTransport
+	return nil
+}
+
+// NewNativeTransport creates the NativeTransport registered under name with
+// the given config.
+//
+// This is not a part of WATER API and should not be used by developers
+// wishing to integrate WATER into their applications.
+func NewNativeTransport(name string, config []byte) (NativeTransport, error) {
+	knownNativeTransportsMutex.RLock()
+	newTransport, ok := knownNativeTransports[name]
+	knownNativeTransportsMutex.RUnlock()
+
+	if !ok {
+		return nil, ErrNativeTransportNotFound
+	}
+	return newTransport(config)
+}
@@ -6,7 +6,7 @@ import (
 
 var (
 	//go:embed transport/v1/testdata/plain.wasm
-	wasmPlain []byte //nolint:unused
+	wasmPlain []byte
 
 	//go:embed transport/v1/testdata/reverse.wasm
 	wasmReverse []byte
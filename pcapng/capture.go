@@ -0,0 +1,323 @@
+// Package pcapng writes the traffic of WATER connections to pcapng files
+// readable by Wireshark, tcpdump and other standard tools.
+//
+// WATER does not see the packets a connection is made of, only the bytes
+// read from and written to it. The captured packets are therefore
+// synthesized: every read and write becomes a TCP segment, preceded by a
+// handshake and followed by a FIN once the connection is closed.
+package pcapng
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture interfaces
+const (
+	// InterfaceNetwork carries the traffic between the WATM and the network.
+	InterfaceNetwork uint32 = iota
+
+	// InterfaceCaller carries the plaintext exchanged between the WATM and
+	// the caller. Only present if Options.IncludeCaller is set.
+	InterfaceCaller
+)
+
+// Options configures a Capture.
+type Options struct {
+	// Dir is the directory capture files are written to. It is created if
+	// it does not exist.
+	Dir string
+
+	// PerConnection writes every WATM instance to a file of its own.
+	// Otherwise all instances share a file, rotated at MaxFileSize.
+	PerConnection bool
+
+	// MaxFileSize is the size in bytes after which the shared file is
+	// rotated. Zero means never. Ignored if PerConnection is set.
+	MaxFileSize int64
+
+	// IncludeCaller adds a second interface carrying the plaintext
+	// exchanged with the caller.
+	IncludeCaller bool
+}
+
+// Capture writes synthesized packets for WATM connections into pcapng
+// files.
+type Capture struct {
+	opts Options
+
+	files atomic.Uint64
+	flows atomic.Uint32
+
+	sharedMutex sync.Mutex
+	shared      *file
+}
+
+// NewCapture creates a Capture writing files as configured by opts.
+func NewCapture(opts Options) (*Capture, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("water: pcapng: no directory given")
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("water: pcapng: creating directory: %w", err)
+	}
+
+	return &Capture{opts: opts}, nil
+}
+
+// Options returns the options the Capture was created with.
+func (c *Capture) Options() Options {
+	return c.opts
+}
+
+// Close closes the shared file, if any. Sessions started afterwards open
+// a new one.
+func (c *Capture) Close() error {
+	c.sharedMutex.Lock()
+	defer c.sharedMutex.Unlock()
+
+	if c.shared == nil {
+		return nil
+	}
+	err := c.shared.close()
+	c.shared = nil
+	return err
+}
+
+// NewSession starts capturing a new WATM instance.
+func (c *Capture) NewSession() (*Session, error) {
+	s := &Session{c: c}
+
+	if c.opts.PerConnection {
+		f, err := c.openFile()
+		if err != nil {
+			return nil, err
+		}
+		s.own = f
+	}
+
+	return s, nil
+}
+
+func (c *Capture) openFile() (*file, error) {
+	name := fmt.Sprintf("water-%s-%d.pcapng", time.Now().UTC().Format("20060102T150405.000000000"), c.files.Add(1))
+
+	f, err := os.OpenFile(filepath.Join(c.opts.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("water: pcapng: creating file: %w", err)
+	}
+
+	interfaces := []Interface{{Name: "network", LinkType: LinkTypeRaw}}
+	if c.opts.IncludeCaller {
+		interfaces = append(interfaces, Interface{Name: "caller", LinkType: LinkTypeRaw})
+	}
+
+	cf := &file{f: f}
+	if cf.w, err = NewWriter(cf, interfaces...); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("water: pcapng: writing file header: %w", err)
+	}
+
+	return cf, nil
+}
+
+// writeShared writes packets to the shared file, rotating it if needed.
+func (c *Capture) writeShared(iface uint32, t time.Time, packets [][]byte) {
+	c.sharedMutex.Lock()
+	defer c.sharedMutex.Unlock()
+
+	if c.shared != nil && c.opts.MaxFileSize > 0 && c.shared.size >= c.opts.MaxFileSize {
+		_ = c.shared.close() // unsafe: error is ignored
+		c.shared = nil
+	}
+
+	if c.shared == nil {
+		f, err := c.openFile()
+		if err != nil {
+			return // best effort: a capture must never break the connection
+		}
+		c.shared = f
+	}
+
+	c.shared.writePackets(iface, t, packets)
+}
+
+// file is a pcapng file being written.
+type file struct {
+	f    *os.File
+	w    *Writer
+	size int64
+}
+
+// Write implements io.Writer for the pcapng Writer, counting the size.
+func (f *file) Write(b []byte) (int, error) {
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *file) writePackets(iface uint32, t time.Time, packets [][]byte) {
+	for _, p := range packets {
+		_ = f.w.WritePacket(iface, t, p) // best effort
+	}
+}
+
+func (f *file) close() error {
+	return f.f.Close()
+}
+
+// Session captures the connections of a single WATM instance. All
+// methods are safe for concurrent use.
+type Session struct {
+	c *Capture
+
+	mutex  sync.Mutex
+	own    *file // set if Options.PerConnection
+	closed bool
+}
+
+// Close stops capturing. In per-connection mode, the file is closed.
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.own != nil {
+		return s.own.close()
+	}
+	return nil
+}
+
+func (s *Session) write(iface uint32, packets ...[]byte) {
+	t := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.own != nil {
+		s.own.writePackets(iface, t, packets)
+		return
+	}
+	s.c.writeShared(iface, t, packets)
+}
+
+// DialedConn wraps a connection dialed by the host on behalf of the WATM.
+func (s *Session) DialedConn(conn net.Conn) net.Conn {
+	return s.wrap(InterfaceNetwork, conn, true)
+}
+
+// AcceptedConn wraps a connection accepted by the host on behalf of the
+// WATM.
+func (s *Session) AcceptedConn(conn net.Conn) net.Conn {
+	return s.wrap(InterfaceNetwork, conn, false)
+}
+
+// CallerConn wraps the connection handed to the caller. It is returned
+// unchanged unless Options.IncludeCaller is set.
+func (s *Session) CallerConn(conn net.Conn) net.Conn {
+	if !s.c.opts.IncludeCaller {
+		return conn
+	}
+	return s.wrap(InterfaceCaller, conn, true)
+}
+
+func (s *Session) wrap(iface uint32, conn net.Conn, outbound bool) net.Conn {
+	n := s.c.flows.Add(1)
+	port := uint16(49152 + n%16384)
+	f := newFlow(conn.LocalAddr(), conn.RemoteAddr(),
+		netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, 1}), port),
+		netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, 2}), port),
+		n*0x9E3779B9,
+	)
+
+	s.write(iface, f.handshake(outbound)...)
+
+	return &capturedConn{
+		Conn:    conn,
+		session: s,
+		iface:   iface,
+		flow:    f,
+	}
+}
+
+// capturedConn synthesizes packets for everything read from and written
+// to the wrapped net.Conn.
+type capturedConn struct {
+	net.Conn
+	session *Session
+	iface   uint32
+
+	mutex      sync.Mutex // protects flow
+	flow       *flow
+	remoteDone bool
+	localDone  bool
+}
+
+func (c *capturedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if n > 0 && !c.remoteDone {
+		c.session.write(c.iface, c.flow.data(false, b[:n])...)
+	}
+	if err != nil && !c.remoteDone {
+		switch {
+		case errors.Is(err, io.EOF):
+			c.remoteDone = true
+			c.session.write(c.iface, c.flow.fin(false))
+		case errors.Is(err, net.ErrClosed), isTimeout(err):
+			// local conditions, nothing happened on the wire
+		default:
+			c.remoteDone = true
+			c.session.write(c.iface, c.flow.rst(false))
+		}
+	}
+	return n, err
+}
+
+func (c *capturedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if n > 0 && !c.localDone {
+		c.session.write(c.iface, c.flow.data(true, b[:n])...)
+	}
+	return n, err
+}
+
+func (c *capturedConn) Close() error {
+	c.mutex.Lock()
+	if !c.localDone {
+		c.localDone = true
+		c.session.write(c.iface, c.flow.fin(true))
+	}
+	c.mutex.Unlock()
+
+	return c.Conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,275 @@
+package pcapng_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/pcapng"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+type packet struct {
+	iface   uint32
+	flags   byte
+	payload []byte
+}
+
+// readPackets parses a pcapng file written by this package, verifying the
+// IPv4 and TCP checksums of every packet.
+func readPackets(t *testing.T, path string) (interfaces []string, packets []packet) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block")
+		}
+		blockType := binary.LittleEndian.Uint32(b)
+		blockLen := binary.LittleEndian.Uint32(b[4:])
+		if int(blockLen) > len(b) || blockLen%4 != 0 || binary.LittleEndian.Uint32(b[blockLen-4:]) != blockLen {
+			t.Fatalf("bad block length %d", blockLen)
+		}
+		body := b[8 : blockLen-4]
+		b = b[blockLen:]
+
+		switch blockType {
+		case 0x0A0D0D0A:
+			if binary.LittleEndian.Uint32(body) != 0x1A2B3C4D {
+				t.Fatalf("bad byte-order magic")
+			}
+		case 1:
+			if lt := binary.LittleEndian.Uint16(body); lt != pcapng.LinkTypeRaw {
+				t.Fatalf("link type = %d, want %d", lt, pcapng.LinkTypeRaw)
+			}
+			opts := body[8:]
+			for len(opts) >= 4 {
+				code, l := binary.LittleEndian.Uint16(opts), binary.LittleEndian.Uint16(opts[2:])
+				if code == 2 {
+					interfaces = append(interfaces, string(opts[4:4+l]))
+				}
+				opts = opts[4+(int(l)+3)&^3:]
+			}
+		case 6:
+			iface := binary.LittleEndian.Uint32(body)
+			capLen := binary.LittleEndian.Uint32(body[12:])
+			pkt := body[20 : 20+capLen]
+			if pkt[0]>>4 != 4 {
+				t.Fatalf("not an IPv4 packet")
+			}
+			if sum(0, pkt[:20]) != 0xffff {
+				t.Errorf("bad IPv4 checksum")
+			}
+			tcp := pkt[20:]
+			pseudo := append(append([]byte{}, pkt[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+			if sum(sum(0, pseudo), tcp) != 0xffff {
+				t.Errorf("bad TCP checksum")
+			}
+			packets = append(packets, packet{iface: iface, flags: tcp[13], payload: tcp[20:]})
+		default:
+			t.Fatalf("unexpected block type %d", blockType)
+		}
+	}
+
+	return interfaces, packets
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	for s > 0xffff {
+		s = (s >> 16) + (s & 0xffff)
+	}
+	return s
+}
+
+func payloads(packets []packet, iface uint32) []byte {
+	var buf bytes.Buffer
+	for _, p := range packets {
+		if p.iface == iface {
+			buf.Write(p.payload)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestCapture(t *testing.T) {
+	t.Run("per connection", testCapturePerConnection)
+	t.Run("rotating", testCaptureRotating)
+	t.Run("Dialer", testCaptureDialer)
+}
+
+func testCapturePerConnection(t *testing.T) {
+	dir := t.TempDir()
+	capture, err := pcapng.NewCapture(pcapng.Options{Dir: dir, PerConnection: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := capture.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	conn := session.DialedConn(c1)
+	go func() {
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(c2, buf)
+		_, _ = c2.Write([]byte("world"))
+		c2.Close()
+	}()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "world" {
+		t.Fatalf("ReadAll = %q, %v", b, err)
+	}
+	conn.Close()
+	session.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+
+	interfaces, packets := readPackets(t, files[0])
+	if len(interfaces) != 1 || interfaces[0] != "network" {
+		t.Errorf("interfaces = %v", interfaces)
+	}
+
+	// SYN, SYN-ACK, ACK, hello, world, FIN (remote), FIN (local)
+	wantFlags := []byte{0x02, 0x12, 0x10, 0x18, 0x18, 0x11, 0x11}
+	if len(packets) != len(wantFlags) {
+		t.Fatalf("got %d packets, want %d", len(packets), len(wantFlags))
+	}
+	for i, p := range packets {
+		if p.flags != wantFlags[i] {
+			t.Errorf("packet %d: flags = %#x, want %#x", i, p.flags, wantFlags[i])
+		}
+	}
+	if got := payloads(packets, pcapng.InterfaceNetwork); string(got) != "helloworld" {
+		t.Errorf("payloads = %q", got)
+	}
+}
+
+func testCaptureRotating(t *testing.T) {
+	dir := t.TempDir()
+	capture, err := pcapng.NewCapture(pcapng.Options{Dir: dir, MaxFileSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close() // skipcq: GO-S2307
+
+	for i := 0; i < 4; i++ {
+		session, err := capture.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, c2 := net.Pipe()
+		conn := session.AcceptedConn(c1)
+		go func() { _, _ = io.Copy(io.Discard, c2) }()
+		if _, err := conn.Write(make([]byte, 256)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		session.Close()
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(files) < 2 {
+		t.Fatalf("got %d files, want the capture to rotate", len(files))
+	}
+
+	var total int
+	for _, f := range files {
+		_, packets := readPackets(t, f)
+		total += len(payloads(packets, pcapng.InterfaceNetwork))
+	}
+	if total != 4*256 {
+		t.Errorf("captured %d bytes of payload, want %d", total, 4*256)
+	}
+}
+
+func testCaptureDialer(t *testing.T) {
+	wasm, err := os.ReadFile("../transport/v1/testdata/reverse.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpLis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLis.Close() // skipcq: GO-S2307
+
+	go func() {
+		conn, err := tcpLis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	dir := t.TempDir()
+	capture, err := pcapng.NewCapture(pcapng.Options{Dir: dir, PerConnection: true, IncludeCaller: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := v1.NewDialerWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasm,
+		PacketCapture:      capture,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", tcpLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+
+	interfaces, packets := readPackets(t, files[0])
+	if len(interfaces) != 2 || interfaces[0] != "network" || interfaces[1] != "caller" {
+		t.Errorf("interfaces = %v", interfaces)
+	}
+	if got := payloads(packets, pcapng.InterfaceNetwork); string(got) != "olleholleh" {
+		t.Errorf("network payloads = %q, want %q", got, "olleholleh")
+	}
+	if got := payloads(packets, pcapng.InterfaceCaller); string(got) != "hellohello" {
+		t.Errorf("caller payloads = %q, want %q", got, "hellohello")
+	}
+}
@@ -0,0 +1,199 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+)
+
+// TCP flags
+const (
+	tcpFIN byte = 0x01
+	tcpSYN byte = 0x02
+	tcpRST byte = 0x04
+	tcpPSH byte = 0x08
+	tcpACK byte = 0x10
+)
+
+// maxSegmentSize keeps every synthesized packet below the 64 KiB IP limit.
+const maxSegmentSize = 65535 - 60 - 20
+
+// endpoint is one side of a synthesized TCP flow.
+type endpoint struct {
+	addr netip.AddrPort
+	seq  uint32
+}
+
+// flow synthesizes the packets of a TCP connection.
+type flow struct {
+	local, remote endpoint
+}
+
+// newFlow creates a flow between local and remote. Addresses that are not
+// TCP or UDP addresses are replaced by fallback ones.
+func newFlow(local, remote net.Addr, fallbackLocal, fallbackRemote netip.AddrPort, isn uint32) *flow {
+	l, ok := addrPort(local)
+	if !ok {
+		l = fallbackLocal
+	}
+	r, ok := addrPort(remote)
+	if !ok {
+		r = fallbackRemote
+	}
+
+	// a flow can only be either IPv4 or IPv6
+	if l.Addr().Is4() != r.Addr().Is4() {
+		l = netip.AddrPortFrom(netip.AddrFrom16(l.Addr().As16()), l.Port())
+		r = netip.AddrPortFrom(netip.AddrFrom16(r.Addr().As16()), r.Port())
+	}
+
+	return &flow{
+		local:  endpoint{addr: l, seq: isn},
+		remote: endpoint{addr: r, seq: ^isn},
+	}
+}
+
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var ap netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ap = addr.AddrPort()
+	case *net.UDPAddr:
+		ap = addr.AddrPort()
+	default:
+		return netip.AddrPort{}, false
+	}
+
+	if !ap.Addr().IsValid() || ap.Addr().IsUnspecified() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// handshake returns the three packets opening the flow. If outbound, the
+// local side sends the SYN.
+func (f *flow) handshake(outbound bool) [][]byte {
+	client, server := &f.local, &f.remote
+	if !outbound {
+		client, server = server, client
+	}
+
+	syn := f.segment(client, server, tcpSYN, nil)
+	client.seq++
+	synAck := f.segment(server, client, tcpSYN|tcpACK, nil)
+	server.seq++
+	ack := f.segment(client, server, tcpACK, nil)
+
+	return [][]byte{syn, synAck, ack}
+}
+
+// data returns the packets carrying payload. If outbound, the payload is
+// sent by the local side.
+func (f *flow) data(outbound bool, payload []byte) [][]byte {
+	src, dst := f.direction(outbound)
+
+	var packets [][]byte
+	for len(payload) > 0 {
+		n := min(len(payload), maxSegmentSize)
+		packets = append(packets, f.segment(src, dst, tcpPSH|tcpACK, payload[:n]))
+		src.seq += uint32(n)
+		payload = payload[n:]
+	}
+	return packets
+}
+
+// fin returns the packet closing one direction of the flow.
+func (f *flow) fin(outbound bool) []byte {
+	src, dst := f.direction(outbound)
+	packet := f.segment(src, dst, tcpFIN|tcpACK, nil)
+	src.seq++
+	return packet
+}
+
+// rst returns a packet resetting the flow.
+func (f *flow) rst(outbound bool) []byte {
+	src, dst := f.direction(outbound)
+	return f.segment(src, dst, tcpRST|tcpACK, nil)
+}
+
+func (f *flow) direction(outbound bool) (src, dst *endpoint) {
+	if outbound {
+		return &f.local, &f.remote
+	}
+	return &f.remote, &f.local
+}
+
+// segment builds an IP packet carrying a TCP segment from src to dst.
+func (*flow) segment(src, dst *endpoint, flags byte, payload []byte) []byte {
+	tcpLen := 20 + len(payload)
+
+	tcp := make([]byte, tcpLen)
+	binary.BigEndian.PutUint16(tcp[0:], src.addr.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.addr.Port())
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4 // data offset: 5 words, no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[20:], payload)
+
+	srcIP, dstIP := src.addr.Addr(), dst.addr.Addr()
+
+	// pseudo header for the checksum
+	var pseudo []byte
+	pseudo = append(pseudo, srcIP.AsSlice()...)
+	pseudo = append(pseudo, dstIP.AsSlice()...)
+	if srcIP.Is4() {
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(tcpLen))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(tcpLen))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(checksumAdd(0, pseudo), tcp))
+
+	if srcIP.Is4() {
+		ip := make([]byte, 20, 20+tcpLen)
+		ip[0] = 0x45 // version 4, IHL 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+tcpLen))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64                                 // TTL
+		ip[9] = 6                                  // TCP
+		copy(ip[12:16], srcIP.AsSlice())
+		copy(ip[16:20], dstIP.AsSlice())
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+		return append(ip, tcp...)
+	}
+
+	ip := make([]byte, 40, 40+tcpLen)
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:], uint16(tcpLen))
+	ip[6] = 6  // next header: TCP
+	ip[7] = 64 // hop limit
+	copy(ip[8:24], srcIP.AsSlice())
+	copy(ip[24:40], dstIP.AsSlice())
+	return append(ip, tcp...)
+}
+
+// checksumAdd adds b to the one's complement sum.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksum returns the Internet checksum of b, starting from sum.
+func checksum(sum uint32, b []byte) uint16 {
+	sum = checksumAdd(sum, b)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,113 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Block types, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	blockTypeSHB uint32 = 0x0A0D0D0A // Section Header Block
+	blockTypeIDB uint32 = 0x00000001 // Interface Description Block
+	blockTypeEPB uint32 = 0x00000006 // Enhanced Packet Block
+
+	byteOrderMagic uint32 = 0x1A2B3C4D
+
+	// LinkTypeRaw is LINKTYPE_RAW: packets start with an IPv4 or IPv6 header.
+	LinkTypeRaw uint16 = 101
+
+	optEndOfOpt uint16 = 0
+	optIfName   uint16 = 2
+	optTsResol  uint16 = 9
+	optUserAppl uint16 = 4 // shb_userappl
+)
+
+// Interface describes a capture interface written to a pcapng section.
+type Interface struct {
+	Name     string
+	LinkType uint16
+}
+
+// Writer writes pcapng sections. It is not safe for concurrent use.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes a section header and the interface descriptions to w
+// and returns a Writer for packets on these interfaces. Interfaces are
+// numbered in the order given.
+func NewWriter(w io.Writer, interfaces ...Interface) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	// Section Header Block
+	body := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major version
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor version
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0))
+	body = appendOption(body, optUserAppl, []byte("water"))
+	body = appendOption(body, optEndOfOpt, nil)
+	if err := pw.writeBlock(blockTypeSHB, body); err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		body = binary.LittleEndian.AppendUint16(body[:0], iface.LinkType)
+		body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+		body = binary.LittleEndian.AppendUint32(body, 0) // snaplen: no limit
+		if iface.Name != "" {
+			body = appendOption(body, optIfName, []byte(iface.Name))
+		}
+		body = appendOption(body, optTsResol, []byte{9}) // nanoseconds
+		body = appendOption(body, optEndOfOpt, nil)
+		if err := pw.writeBlock(blockTypeIDB, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return pw, nil
+}
+
+// WritePacket writes a packet captured at t on the given interface.
+func (pw *Writer) WritePacket(iface uint32, t time.Time, packet []byte) error {
+	ts := uint64(t.UnixNano())
+
+	body := binary.LittleEndian.AppendUint32(pw.buf[:0], iface)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet))) // captured length
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet))) // original length
+	body = append(body, packet...)
+	body = pad32(body)
+	pw.buf = body
+
+	return pw.writeBlock(blockTypeEPB, body)
+}
+
+func (pw *Writer) writeBlock(blockType uint32, body []byte) error {
+	totalLen := uint32(12 + len(body))
+
+	block := make([]byte, 0, totalLen)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, totalLen)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, totalLen)
+
+	_, err := pw.w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pad32(b)
+}
+
+func pad32(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
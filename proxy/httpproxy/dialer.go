@@ -0,0 +1,124 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Dialer dials addresses through an HTTP proxy with CONNECT requests.
+// Domain names are resolved by the proxy.
+type Dialer struct {
+	// ProxyAddress is the address of the proxy, as host:port.
+	ProxyAddress string
+
+	// Username and Password, if Username is set, authenticate with the
+	// proxy with Basic proxy authentication.
+	Username, Password string
+
+	// Forward, if set, dials the proxy instead of a [net.Dialer].
+	Forward func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dial dials address through the proxy.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext dials address through the proxy. The context bounds the
+// dial and the CONNECT request.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("httpproxy: unsupported network %q", network)
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		var nd net.Dialer
+		forward = nd.DialContext
+	}
+	conn, err := forward(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("httpproxy: dialing proxy: %w", err)
+	}
+
+	var tunnel net.Conn
+	err = withContext(ctx, conn, func() (err error) {
+		tunnel, err = d.connect(conn, address)
+		return err
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connect sends a CONNECT request for address and returns the tunnel.
+func (d *Dialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req, err := http.NewRequest(http.MethodConnect, "http://"+address, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = address
+	req.URL.Scheme, req.URL.Path = "", ""
+	req.URL.Opaque = address // written as the request target
+	if d.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("httpproxy: proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	// bytes sent by the destination right after the response were
+	// buffered
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into a
+// buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// withContext runs f, interrupting I/O on conn once ctx is done.
+func withContext(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := f()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
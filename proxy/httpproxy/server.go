@@ -0,0 +1,421 @@
+// Package httpproxy implements an HTTP proxy serving CONNECT tunnels and
+// forwarding plain HTTP requests through arbitrary dialers, e.g., a
+// water.Dialer.
+package httpproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHeaderTimeout = 30 * time.Second
+
+// Server is an HTTP proxy. It tunnels CONNECT requests and forwards
+// requests for absolute http URLs, as sent by browsers for plain HTTP.
+//
+// Implements [http.Handler].
+type Server struct {
+	// Dial dials the destinations of requests, given as host:port. The
+	// context bounds the lifetime of the connection, as for a
+	// water.Dialer. It must be set.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Credentials, if set, requires clients to authenticate with Basic
+	// proxy authentication as one of its username: password pairs.
+	Credentials map[string]string
+
+	// AddressValidator, if set, checks the destination of every request,
+	// as for water.Config.DialedAddressValidator. Requests to a denied
+	// destination are answered with 403 Forbidden.
+	AddressValidator func(network, address string) error
+
+	// IdleTimeout, if set, closes tunnels without traffic in either
+	// direction and idle client connections for that long.
+	IdleTimeout time.Duration
+
+	// HeaderTimeout bounds reading the headers of a request. Zero means
+	// 30s.
+	HeaderTimeout time.Duration
+
+	// AccessLog, if set, is called once every request is done.
+	AccessLog func(entry *AccessLogEntry)
+
+	forwarderOnce sync.Once
+	forwarder     *httputil.ReverseProxy
+}
+
+// AccessLogEntry describes a request served by a [Server].
+type AccessLogEntry struct {
+	Time     time.Time     // when the request was received
+	Duration time.Duration // how long it was served
+	Client   string        // address of the client
+	Username string        // authenticated username, if any
+	Method   string
+	Target   string // host:port of the destination
+	Status   int    // status code sent to the client
+
+	// BytesIn and BytesOut count bytes of tunnels and bodies received
+	// from and sent to the client.
+	BytesIn, BytesOut int64
+
+	Err error // why the request failed, if it did
+}
+
+// String formats the entry as a single line.
+func (e *AccessLogEntry) String() string {
+	username := e.Username
+	if username == "" {
+		username = "-"
+	}
+	line := fmt.Sprintf("%s %s %s %s %d in=%d out=%d %v",
+		e.Client, username, e.Method, e.Target, e.Status, e.BytesIn, e.BytesOut, e.Duration.Round(time.Millisecond))
+	if e.Err != nil {
+		line += " err=" + e.Err.Error()
+	}
+	return line
+}
+
+// Serve accepts connections from lis and serves them until lis fails to
+// accept one.
+func (s *Server) Serve(lis net.Listener) error {
+	headerTimeout := s.HeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = defaultHeaderTimeout
+	}
+
+	server := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: headerTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+	return server.Serve(lis)
+}
+
+// ServeHTTP implements [http.Handler].
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := &AccessLogEntry{
+		Time:   time.Now(),
+		Client: r.RemoteAddr,
+		Method: r.Method,
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		if s.AccessLog != nil {
+			entry.Duration = time.Since(entry.Time)
+			if entry.Status == 0 {
+				entry.Status = sw.status
+			}
+			if entry.BytesOut == 0 {
+				entry.BytesOut = sw.written
+			}
+			s.AccessLog(entry)
+		}
+	}()
+
+	var ok bool
+	if entry.Username, ok = s.authenticate(r); !ok {
+		sw.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		entry.Err = errors.New("proxy authentication required")
+		http.Error(sw, entry.Err.Error(), http.StatusProxyAuthRequired)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodConnect:
+		entry.Target = r.Host
+		s.connect(sw, r, entry)
+	case r.URL.IsAbs() && r.URL.Scheme == "http":
+		entry.Target = hostPort(r.URL.Host, "80")
+		s.forward(sw, r, entry)
+	default:
+		entry.Err = fmt.Errorf("unsupported request for %q", r.URL)
+		http.Error(sw, "only CONNECT and absolute http URLs are supported", http.StatusBadRequest)
+	}
+}
+
+// authenticate checks the Basic proxy credentials of r, if required, and
+// returns the username.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	if len(s.Credentials) == 0 {
+		return "", true
+	}
+
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+
+	want, ok := s.Credentials[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(password)) != 1 {
+		return "", false
+	}
+	return username, true
+}
+
+// validate checks a destination with the AddressValidator.
+func (s *Server) validate(network, address string) error {
+	if s.AddressValidator == nil {
+		return nil
+	}
+	if err := s.AddressValidator(network, address); err != nil {
+		return fmt.Errorf("httpproxy: %s %s: %w", network, address, err)
+	}
+	return nil
+}
+
+func (s *Server) connect(w *statusWriter, r *http.Request, entry *AccessLogEntry) {
+	if _, _, err := net.SplitHostPort(entry.Target); err != nil {
+		entry.Err = err
+		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+		return
+	}
+	if err := s.validate("tcp", entry.Target); err != nil {
+		entry.Err = err
+		http.Error(w, "destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		entry.Err = errors.New("connection cannot be hijacked")
+		http.Error(w, entry.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	remote, err := s.Dial(ctx, "tcp", entry.Target)
+	if err != nil {
+		entry.Err = err
+		http.Error(w, "failed to reach destination", dialErrorStatus(err))
+		return
+	}
+	defer remote.Close() // skipcq: GO-S2307
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		entry.Err = err
+		return
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	entry.Status = http.StatusOK
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		entry.Err = err
+		return
+	}
+
+	// bytes sent by the client right after its request were buffered
+	if n := buffered.Reader.Buffered(); n > 0 {
+		early, _ := buffered.Reader.Peek(n)
+		if _, err := remote.Write(early); err != nil {
+			entry.Err = err
+			return
+		}
+		entry.BytesIn += int64(n)
+	}
+
+	in, out := s.pipe(conn, remote)
+	entry.BytesIn += in
+	entry.BytesOut = out
+}
+
+// dialErrorStatus returns the status code best describing a dial error.
+func dialErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (s *Server) forward(w *statusWriter, r *http.Request, entry *AccessLogEntry) {
+	if err := s.validate("tcp", entry.Target); err != nil {
+		entry.Err = err
+		http.Error(w, "destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	s.forwarderOnce.Do(func() {
+		s.forwarder = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.Out.Header.Del("Proxy-Authorization")
+				pr.Out.Header.Del("Proxy-Connection")
+			},
+			Transport: &http.Transport{
+				DialContext:     s.dialDetached,
+				IdleConnTimeout: s.IdleTimeout,
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				if entry, ok := r.Context().Value(entryKey{}).(*AccessLogEntry); ok {
+					entry.Err = err
+				}
+				http.Error(w, "failed to reach destination", dialErrorStatus(err))
+			},
+		}
+	})
+
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	r = r.WithContext(context.WithValue(r.Context(), entryKey{}, entry))
+	s.forwarder.ServeHTTP(w, r)
+	entry.BytesIn = body.n.Load()
+}
+
+type entryKey struct{}
+
+// dialDetached dials with a context only bounding the dial, as
+// connections of an http.Transport outlive the request they were dialed
+// for.
+func (s *Server) dialDetached(ctx context.Context, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := s.Dial(context.WithoutCancel(ctx), network, address)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				_ = res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// pipe copies data between the client and remote in both directions until
+// both are done, or nothing is copied for IdleTimeout, and returns how
+// many bytes were copied from and to the client.
+func (s *Server) pipe(client, remote net.Conn) (in, out int64) {
+	activity := func() {}
+	if s.IdleTimeout > 0 {
+		var lastActive atomic.Int64
+		lastActive.Store(time.Now().UnixNano())
+		activity = func() { lastActive.Store(time.Now().UnixNano()) }
+
+		var idle *time.Timer
+		idle = time.AfterFunc(s.IdleTimeout, func() {
+			if left := s.IdleTimeout - time.Since(time.Unix(0, lastActive.Load())); left > 0 {
+				idle.Reset(left)
+				return
+			}
+			_ = client.Close()
+			_ = remote.Close()
+		})
+		defer idle.Stop()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		in = copyAndCloseWrite(remote, client, activity)
+	}()
+	go func() {
+		defer wg.Done()
+		out = copyAndCloseWrite(client, remote, activity)
+	}()
+	wg.Wait()
+	return in, out
+}
+
+func copyAndCloseWrite(dst, src net.Conn, activity func()) int64 {
+	var n int64
+	buf := make([]byte, 32<<10)
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			activity()
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+	return n
+}
+
+// hostPort returns host with port if it has none.
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// statusWriter records the status and the size of the body of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush implements [http.Flusher], for streamed responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
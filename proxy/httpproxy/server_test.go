@@ -0,0 +1,291 @@
+package httpproxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/proxy/httpproxy"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+// accessLog collects the entries of a Server.
+type accessLog struct {
+	mutex   sync.Mutex
+	entries []httpproxy.AccessLogEntry
+}
+
+func (l *accessLog) record(entry *httpproxy.AccessLogEntry) {
+	l.mutex.Lock()
+	l.entries = append(l.entries, *entry)
+	l.mutex.Unlock()
+}
+
+// entry waits for and returns the i-th entry.
+func (l *accessLog) entry(t *testing.T, i int) httpproxy.AccessLogEntry {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		l.mutex.Lock()
+		if len(l.entries) > i {
+			entry := l.entries[i]
+			l.mutex.Unlock()
+			return entry
+		}
+		l.mutex.Unlock()
+	}
+	t.Fatal("no access log entry")
+	return httpproxy.AccessLogEntry{}
+}
+
+func startServer(t *testing.T, s *httpproxy.Server) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String()
+}
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// connect sends a CONNECT request for target to the proxy and returns the
+// connection and the status code.
+func connect(t *testing.T, proxy, target, username, password string) (net.Conn, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp.StatusCode
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != msg {
+		t.Errorf("echoed %q, want %q", echoed, msg)
+	}
+}
+
+func directDial(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func TestServer(t *testing.T) {
+	t.Run("connect through WATM", testConnectWATM)
+	t.Run("authentication", testAuthentication)
+	t.Run("address validator", testAddressValidator)
+	t.Run("idle timeout", testIdleTimeout)
+	t.Run("forward", testForward)
+}
+
+func testConnectWATM(t *testing.T) {
+	wasmPlain, err := os.ReadFile("../../transport/v1/testdata/plain.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{TransportModuleBin: wasmPlain})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := &accessLog{}
+	proxy := startServer(t, &httpproxy.Server{
+		Dial:      water.NetDialContextFunc(dialer),
+		AccessLog: log.record,
+	})
+	target := echoServer(t)
+
+	conn, status := connect(t, proxy, target, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	roundTrip(t, conn, "hello, proxy")
+	_ = conn.Close()
+
+	entry := log.entry(t, 0)
+	if entry.Method != http.MethodConnect || entry.Target != target || entry.Status != http.StatusOK {
+		t.Errorf("entry = %s", &entry)
+	}
+	if entry.BytesIn != int64(len("hello, proxy")) || entry.BytesOut != int64(len("hello, proxy")) {
+		t.Errorf("entry counted in=%d out=%d bytes, want %d", entry.BytesIn, entry.BytesOut, len("hello, proxy"))
+	}
+}
+
+func testAuthentication(t *testing.T) {
+	log := &accessLog{}
+	proxy := startServer(t, &httpproxy.Server{
+		Dial:        directDial,
+		Credentials: map[string]string{"user": "secret"},
+		AccessLog:   log.record,
+	})
+	target := echoServer(t)
+
+	if _, status := connect(t, proxy, target, "", ""); status != http.StatusProxyAuthRequired {
+		t.Errorf("unauthenticated: status = %d, want %d", status, http.StatusProxyAuthRequired)
+	}
+	if _, status := connect(t, proxy, target, "user", "wrong"); status != http.StatusProxyAuthRequired {
+		t.Errorf("wrong password: status = %d, want %d", status, http.StatusProxyAuthRequired)
+	}
+
+	conn, status := connect(t, proxy, target, "user", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	roundTrip(t, conn, "hello, proxy")
+	_ = conn.Close()
+	if entry := log.entry(t, 2); entry.Username != "user" {
+		t.Errorf("Username = %q, want %q", entry.Username, "user")
+	}
+}
+
+func testAddressValidator(t *testing.T) {
+	allowed := echoServer(t)
+	proxy := startServer(t, &httpproxy.Server{
+		Dial: directDial,
+		AddressValidator: func(network, address string) error {
+			if network == "tcp" && address == allowed {
+				return nil
+			}
+			return errors.New("denied")
+		},
+	})
+
+	if _, status := connect(t, proxy, echoServer(t), "", ""); status != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", status, http.StatusForbidden)
+	}
+	conn, status := connect(t, proxy, allowed, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	roundTrip(t, conn, "hello, proxy")
+}
+
+func testIdleTimeout(t *testing.T) {
+	proxy := startServer(t, &httpproxy.Server{
+		Dial:        directDial,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+
+	conn, status := connect(t, proxy, echoServer(t), "", "")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	// traffic keeps the tunnel open past the timeout
+	for i := 0; i < 4; i++ {
+		roundTrip(t, conn, "hello, proxy")
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read on an idle tunnel: err = %v, want %v", err, io.EOF)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("idle tunnel closed after %v", elapsed)
+	}
+}
+
+func testForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization forwarded to the origin")
+		}
+		_, _ = io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	log := &accessLog{}
+	proxy := startServer(t, &httpproxy.Server{
+		Dial:        directDial,
+		Credentials: map[string]string{"user": "secret"},
+		AccessLog:   log.record,
+	})
+
+	proxyURL := &url.URL{Scheme: "http", Host: proxy, User: url.UserPassword("user", "secret")}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(origin.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello from /page" {
+		t.Errorf("body = %q, want %q", body, "hello from /page")
+	}
+
+	entry := log.entry(t, 0)
+	if entry.Method != http.MethodGet || entry.Status != http.StatusOK || entry.BytesOut != int64(len(body)) {
+		t.Errorf("entry = %s", &entry)
+	}
+}
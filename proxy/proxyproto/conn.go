@@ -0,0 +1,71 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// Conn is a connection whose PROXY protocol header was read. Its
+// RemoteAddr and LocalAddr are the addresses carried by the header, if
+// any.
+type Conn struct {
+	net.Conn
+	r      io.Reader
+	header *Header
+}
+
+// NewConn reads the header at the start of conn and returns a Conn
+// reading the data following it.
+//
+// The deadline of conn, if any, bounds the read.
+func NewConn(conn net.Conn) (*Conn, error) {
+	br := bufio.NewReader(conn)
+	header, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, r: conn, header: header}
+	if br.Buffered() > 0 {
+		c.r = io.MultiReader(io.LimitReader(br, int64(br.Buffered())), conn)
+	}
+	return c, nil
+}
+
+// Header returns the header read from the connection.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// Read implements [net.Conn].
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address carried by the header, or the
+// remote address of the connection if there is none.
+//
+// Implements [net.Conn].
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address carried by the header, or
+// the local address of the connection if there is none.
+//
+// Implements [net.Conn].
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Unwrap returns the underlying connection.
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
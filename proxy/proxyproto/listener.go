@@ -0,0 +1,187 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout bounds the time a [Listener] waits for the header
+// of a connection if no other timeout is set.
+const DefaultHeaderTimeout = 10 * time.Second
+
+// maxAcceptBackoff bounds the backoff of a Listener after temporary
+// errors, as in net/http.Server.Serve.
+const maxAcceptBackoff = time.Second
+
+// Listener is a [net.Listener] reading the PROXY protocol header of every
+// connection it accepts, and returning them as [Conn].
+//
+// Headers are read concurrently, so that a slow client does not hold back
+// the others. Connections without a valid header in time are closed.
+// Temporary errors of the underlying listener, e.g., running out of file
+// descriptors, are retried after a backoff, and others are returned by
+// Accept from then on.
+type Listener struct {
+	// TrustedNetworks, if not empty, lists the networks of the load
+	// balancers or proxies allowed to send headers. Connections from other
+	// addresses, which could spoof the address of any client, are closed
+	// without reading anything. It must be set before the first Accept.
+	TrustedNetworks []netip.Prefix
+
+	lis           net.Listener
+	headerTimeout time.Duration
+
+	startOnce sync.Once
+	conns     chan *Conn
+	failed    chan struct{} // closed with err set once the listener fails
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*Listener)(nil) // type guard
+
+// NewListener returns a Listener accepting connections from lis, waiting
+// at most headerTimeout for each header, or [DefaultHeaderTimeout] if
+// headerTimeout is 0.
+func NewListener(lis net.Listener, headerTimeout time.Duration) *Listener {
+	if headerTimeout == 0 {
+		headerTimeout = DefaultHeaderTimeout
+	}
+	return &Listener{
+		lis:           lis,
+		headerTimeout: headerTimeout,
+		conns:         make(chan *Conn),
+		failed:        make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection whose header was
+// read.
+//
+// Implements [net.Listener].
+func (l *Listener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() { go l.acceptLoop() })
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.failed:
+		return nil, l.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections whose header is being read are
+// closed.
+//
+// Implements [net.Listener].
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.lis.Close()
+	})
+	return err
+}
+
+// Addr implements [net.Listener].
+func (l *Listener) Addr() net.Addr {
+	return l.lis.Addr()
+}
+
+func (l *Listener) acceptLoop() {
+	var backoff time.Duration
+	for {
+		conn, err := l.lis.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.Is(err, net.ErrClosed) || !errors.As(err, &ne) || !ne.Temporary() { //nolint:staticcheck // as net/http
+				l.err = err
+				close(l.failed)
+				return
+			}
+
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-l.closed:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if !l.trusted(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+		go l.readHeader(conn)
+	}
+}
+
+// trusted reports whether headers sent from addr are trusted.
+func (l *Listener) trusted(addr net.Addr) bool {
+	if len(l.TrustedNetworks) == 0 {
+		return true
+	}
+
+	var ip netip.Addr
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(addr.IP)
+	default:
+		if addrPort, err := netip.ParseAddrPort(addr.String()); err == nil {
+			ip = addrPort.Addr()
+		}
+	}
+	ip = ip.Unmap()
+	for _, prefix := range l.TrustedNetworks {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) readHeader(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(l.headerTimeout))
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() { // interrupt the read once the listener is closed
+		defer close(stopped)
+		select {
+		case <-l.closed:
+			_ = conn.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	proxyConn, err := NewConn(conn)
+	close(stop)
+	<-stopped
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	select {
+	case l.conns <- proxyConn:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
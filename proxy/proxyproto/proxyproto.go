@@ -0,0 +1,312 @@
+// Package proxyproto implements versions 1 and 2 of the PROXY protocol,
+// with which a proxy or load balancer conveys the addresses of the
+// connection it forwards in a header sent before any data.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Command tells whether a header carries the addresses of a forwarded
+// connection.
+type Command byte
+
+const (
+	// CommandLocal is sent for connections established by the proxy
+	// itself, e.g., for health checks: the header carries no addresses.
+	CommandLocal Command = 0x0
+
+	// CommandProxy is sent for forwarded connections.
+	CommandProxy Command = 0x1
+)
+
+var (
+	// ErrNoHeader is returned when a connection does not start with a
+	// PROXY protocol header.
+	ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+	// ErrInvalidHeader is returned when a PROXY protocol header is
+	// malformed.
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // including the CRLF
+
+	v2VersionCommand = 0x20
+	v2AddrLengthIPv4 = 12
+	v2AddrLengthIPv6 = 36
+	v2AddrLengthUnix = 216
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Version is 1 for the human-readable format, 2 for the binary one.
+	Version byte
+
+	// Command tells whether Source and Destination are set.
+	Command Command
+
+	// Source and Destination are the addresses of the client and of the
+	// proxy of a forwarded connection, as [net.TCPAddr] or [net.UDPAddr].
+	// They are nil for CommandLocal, or for addresses the header cannot
+	// represent.
+	Source, Destination net.Addr
+}
+
+// NewHeader returns a header of the given version for a connection from
+// source to destination. If the addresses are not both IP addresses, the
+// header is sent with CommandLocal.
+func NewHeader(version byte, source, destination net.Addr) *Header {
+	h := &Header{Version: version, Command: CommandLocal}
+	if _, _, ok := addrPorts(source, destination); ok {
+		h.Command, h.Source, h.Destination = CommandProxy, source, destination
+	}
+	return h
+}
+
+// ReadHeader reads a header of either version from r.
+//
+// It returns [ErrNoHeader] without consuming anything if r does not start
+// with a header.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != v1Prefix {
+		return nil, ErrNoHeader
+	}
+
+	// the line is read byte by byte, not to read past its maximum length
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, ErrInvalidHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+	h := &Header{Version: 1, Command: CommandProxy}
+	switch fields[0] {
+	case "UNKNOWN":
+		h.Command = CommandLocal
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(fields) != 5 {
+		return nil, ErrInvalidHeader
+	}
+
+	src, err1 := netip.ParseAddr(fields[1])
+	dst, err2 := netip.ParseAddr(fields[2])
+	srcPort, err3 := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, err4 := strconv.ParseUint(fields[4], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if src.Is4() != (fields[0] == "TCP4") || dst.Is4() != (fields[0] == "TCP4") {
+		return nil, ErrInvalidHeader
+	}
+	h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(srcPort)))
+	h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(dstPort)))
+	return h, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(len(v2Signature) + 4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix[:len(v2Signature)], v2Signature) {
+		return nil, ErrNoHeader
+	}
+	versionCommand, family := prefix[12], prefix[13]
+	length := int(binary.BigEndian.Uint16(prefix[14:16]))
+	if versionCommand&0xf0 != v2VersionCommand {
+		return nil, ErrInvalidHeader
+	}
+
+	buf := make([]byte, len(prefix)+length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	addrs := buf[len(prefix):]
+
+	h := &Header{Version: 2, Command: Command(versionCommand & 0x0f)}
+	switch h.Command {
+	case CommandLocal:
+		return h, nil // the addresses, if any, are ignored
+	case CommandProxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var src, dst netip.Addr
+	var ports []byte
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(addrs) < v2AddrLengthIPv4 {
+			return nil, ErrInvalidHeader
+		}
+		src, dst = netip.AddrFrom4([4]byte(addrs[0:4])), netip.AddrFrom4([4]byte(addrs[4:8]))
+		ports = addrs[8:12]
+	case 0x2: // AF_INET6
+		if len(addrs) < v2AddrLengthIPv6 {
+			return nil, ErrInvalidHeader
+		}
+		src, dst = netip.AddrFrom16([16]byte(addrs[0:16])), netip.AddrFrom16([16]byte(addrs[16:32]))
+		ports = addrs[32:36]
+	case 0x0, 0x3: // AF_UNSPEC, AF_UNIX: the addresses are ignored
+		if family>>4 == 0x3 && len(addrs) < v2AddrLengthUnix {
+			return nil, ErrInvalidHeader
+		}
+		return h, nil
+	default:
+		return nil, ErrInvalidHeader
+	}
+	source := netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports[0:2]))
+	destination := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:4]))
+
+	switch family & 0x0f {
+	case 0x1: // STREAM
+		h.Source, h.Destination = net.TCPAddrFromAddrPort(source), net.TCPAddrFromAddrPort(destination)
+	case 0x2: // DGRAM
+		h.Source, h.Destination = net.UDPAddrFromAddrPort(source), net.UDPAddrFromAddrPort(destination)
+	default:
+		return nil, ErrInvalidHeader
+	}
+	// the TLVs following the addresses, if any, are ignored
+	return h, nil
+}
+
+// MarshalBinary encodes the header in its version. Version 1 headers can
+// only carry TCP addresses.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	var source, destination netip.AddrPort
+	proxied := false
+	if h.Command == CommandProxy {
+		var ok bool
+		if source, destination, ok = addrPorts(h.Source, h.Destination); !ok {
+			return nil, fmt.Errorf("proxyproto: cannot encode addresses %v and %v", h.Source, h.Destination)
+		}
+		proxied = true
+	}
+
+	switch h.Version {
+	case 1:
+		if !proxied {
+			return []byte(v1Prefix + "UNKNOWN\r\n"), nil
+		}
+		if _, ok := h.Source.(*net.UDPAddr); ok {
+			return nil, errors.New("proxyproto: version 1 cannot carry UDP addresses")
+		}
+		family := "TCP4"
+		if source.Addr().Is6() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("%s%s %s %s %d %d\r\n", v1Prefix, family,
+			source.Addr(), destination.Addr(), source.Port(), destination.Port())), nil
+	case 2:
+		b := append([]byte{}, v2Signature...)
+		if !proxied {
+			return append(b, v2VersionCommand|byte(CommandLocal), 0x00, 0, 0), nil
+		}
+
+		family := byte(0x11) // AF_INET, STREAM
+		if source.Addr().Is6() {
+			family = 0x21 // AF_INET6, STREAM
+		}
+		if _, ok := h.Source.(*net.UDPAddr); ok {
+			family++ // DGRAM
+		}
+		src, dst := source.Addr().AsSlice(), destination.Addr().AsSlice()
+		b = append(b, v2VersionCommand|byte(CommandProxy), family)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(src)+len(dst)+4))
+		b = append(append(b, src...), dst...)
+		b = binary.BigEndian.AppendUint16(b, source.Port())
+		return binary.BigEndian.AppendUint16(b, destination.Port()), nil
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", h.Version)
+	}
+}
+
+// WriteTo writes the encoded header to w.
+//
+// Implements [io.WriterTo].
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// addrPorts returns source and destination as addresses of the same
+// family, if both are IP addresses.
+func addrPorts(source, destination net.Addr) (src, dst netip.AddrPort, ok bool) {
+	if src, ok = addrPort(source); !ok {
+		return src, dst, false
+	}
+	if dst, ok = addrPort(destination); !ok {
+		return src, dst, false
+	}
+	if src.Addr().Is4() != dst.Addr().Is4() { // map both to IPv6
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	return src, dst, true
+}
+
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var addrPort netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		addrPort = addr.AddrPort()
+	case *net.UDPAddr:
+		addrPort = addr.AddrPort()
+	default:
+		return netip.AddrPort{}, false
+	}
+	if !addrPort.IsValid() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+}
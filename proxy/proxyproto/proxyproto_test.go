@@ -0,0 +1,329 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water/proxy/proxyproto"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func udpAddr(s string) *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestHeader(t *testing.T) {
+	t.Run("round trip", testHeaderRoundTrip)
+	t.Run("version 1", testHeaderV1)
+	t.Run("version 2", testHeaderV2)
+	t.Run("no header", testHeaderNoHeader)
+	t.Run("invalid", testHeaderInvalid)
+}
+
+func testHeaderRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		version             byte
+		source, destination net.Addr
+	}{
+		{1, tcpAddr("192.0.2.1:1234"), tcpAddr("198.51.100.1:443")},
+		{1, tcpAddr("[2001:db8::1]:1234"), tcpAddr("[2001:db8::2]:443")},
+		{2, tcpAddr("192.0.2.1:1234"), tcpAddr("198.51.100.1:443")},
+		{2, tcpAddr("[2001:db8::1]:1234"), tcpAddr("[2001:db8::2]:443")},
+		{2, udpAddr("192.0.2.1:1234"), udpAddr("198.51.100.1:53")},
+		{1, nil, nil},
+		{2, nil, nil},
+	} {
+		header := proxyproto.NewHeader(tc.version, tc.source, tc.destination)
+		b, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("data")))
+		got, err := proxyproto.ReadHeader(r)
+		if err != nil {
+			t.Fatalf("v%d %v: %v", tc.version, tc.source, err)
+		}
+		if got.Version != tc.version || got.Command != header.Command {
+			t.Errorf("read version %d command %d, want %d %d", got.Version, got.Command, tc.version, header.Command)
+		}
+		if tc.source == nil {
+			if got.Command != proxyproto.CommandLocal || got.Source != nil {
+				t.Errorf("read %+v, want a local header", got)
+			}
+		} else if got.Source.String() != tc.source.String() || got.Destination.String() != tc.destination.String() ||
+			got.Source.Network() != tc.source.Network() {
+			t.Errorf("read %v -> %v, want %v -> %v", got.Source, got.Destination, tc.source, tc.destination)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "data" {
+			t.Errorf("data after the header = %q, want %q", rest, "data")
+		}
+	}
+}
+
+func testHeaderV1(t *testing.T) {
+	header, err := proxyproto.ReadHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Source.String() != "192.0.2.1:56324" || header.Destination.String() != "198.51.100.1:443" {
+		t.Errorf("read %v -> %v", header.Source, header.Destination)
+	}
+
+	b, err := proxyproto.NewHeader(1, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.1:443")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"; string(b) != want {
+		t.Errorf("MarshalBinary() = %q, want %q", b, want)
+	}
+
+	if _, err := proxyproto.NewHeader(1, udpAddr("192.0.2.1:1"), udpAddr("192.0.2.2:2")).MarshalBinary(); err == nil {
+		t.Error("version 1 header with UDP addresses encoded")
+	}
+}
+
+func testHeaderV2(t *testing.T) {
+	// addresses followed by a TLV, which is skipped
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x10")
+	b = append(b, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb)
+	b = append(b, 0x04, 0x00, 0x01, 0xff) // PP2_TYPE_NOOP
+	b = append(b, "data"...)
+
+	r := bufio.NewReader(bytes.NewReader(b))
+	header, err := proxyproto.ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Source.String() != "192.0.2.1:56324" || header.Destination.String() != "198.51.100.1:443" {
+		t.Errorf("read %v -> %v", header.Source, header.Destination)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "data" {
+		t.Errorf("data after the header = %q, want %q", rest, "data")
+	}
+}
+
+func testHeaderNoHeader(t *testing.T) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "\r\n\r\nhello, world"} {
+		r := bufio.NewReader(strings.NewReader(data))
+		if _, err := proxyproto.ReadHeader(r); !errors.Is(err, proxyproto.ErrNoHeader) {
+			t.Errorf("%q: err = %v, want %v", data, err, proxyproto.ErrNoHeader)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != data {
+			t.Errorf("%q consumed", data)
+		}
+	}
+}
+
+func testHeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP5 192.0.2.1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 65536\r\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",                 // version 3
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x00\x00\x00\x00", // addresses too short
+	} {
+		if _, err := proxyproto.ReadHeader(bufio.NewReader(strings.NewReader(data))); !errors.Is(err, proxyproto.ErrInvalidHeader) {
+			t.Errorf("%q: err = %v, want %v", data, err, proxyproto.ErrInvalidHeader)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyLis := proxyproto.NewListener(lis, 200*time.Millisecond)
+	defer proxyLis.Close() // skipcq: GO-S2307
+
+	dial := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// connections without a header, or too slow to send it, do not hold
+	// back the others and are closed
+	noHeader := dial("GET / HTTP/1.1\r\n")
+	slow := dial("PROXY TCP4 ")
+	header, err := proxyproto.NewHeader(2, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.1:443")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial(string(header) + "hello")
+
+	conn, err := proxyLis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr() = %s, want 192.0.2.1:56324", got)
+	}
+	if got := conn.LocalAddr().String(); got != "198.51.100.1:443" {
+		t.Errorf("LocalAddr() = %s, want 198.51.100.1:443", got)
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v, want %q", data, err, "hello")
+	}
+
+	for _, conn := range []net.Conn{noHeader, slow} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("connection without a header not closed")
+		}
+	}
+
+	if err := proxyLis.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxyLis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close: err = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestListener_TrustedNetworks(t *testing.T) {
+	header, err := proxyproto.NewHeader(2, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.1:443")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listen returns the address of a listener trusting network, and its
+	// accepted connections
+	listen := func(t *testing.T, network string) (string, <-chan net.Conn) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyLis := proxyproto.NewListener(lis, 0)
+		proxyLis.TrustedNetworks = []netip.Prefix{netip.MustParsePrefix(network)}
+		t.Cleanup(func() { _ = proxyLis.Close() })
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := proxyLis.Accept(); err == nil {
+				t.Cleanup(func() { _ = conn.Close() })
+				accepted <- conn
+			}
+		}()
+		return lis.Addr().String(), accepted
+	}
+
+	dial := func(t *testing.T, address string) net.Conn {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		if _, err := conn.Write(header); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		address, accepted := listen(t, "127.0.0.0/8")
+		dial(t, address)
+		select {
+		case conn := <-accepted:
+			if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+				t.Errorf("RemoteAddr() = %s, want 192.0.2.1:56324", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection from a trusted network not accepted")
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		// a header from 127.0.0.1 could spoof any client
+		address, accepted := listen(t, "192.0.2.0/24")
+		conn := dial(t, address)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("connection from an untrusted network not closed: %v", err)
+		}
+		select {
+		case <-accepted:
+			t.Error("connection from an untrusted network accepted")
+		default:
+		}
+	})
+}
+
+// temporaryError is an error of Accept worth retrying, like EMFILE.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first Accepts with a temporaryError.
+type flakyListener struct {
+	net.Listener
+	fails atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestListener_TemporaryError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyListener{Listener: lis}
+	flaky.fails.Store(3)
+	proxyLis := proxyproto.NewListener(flaky, 0)
+	defer proxyLis.Close() // skipcq: GO-S2307
+
+	header, err := proxyproto.NewHeader(1, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.1:443")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := proxyLis.Accept()
+	if err != nil {
+		t.Fatalf("Accept() after temporary errors: %v", err)
+	}
+	_ = accepted.Close()
+
+	// other errors are permanent
+	_ = lis.Close()
+	if _, err := proxyLis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after closing the underlying listener: err = %v, want %v", err, net.ErrClosed)
+	}
+}
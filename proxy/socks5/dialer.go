@@ -0,0 +1,164 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ReplyError is a reply code other than ReplySucceeded, sent by a proxy
+// refusing a request.
+type ReplyError byte
+
+// Error implements [error].
+func (e ReplyError) Error() string {
+	switch byte(e) {
+	case ReplyGeneralFailure:
+		return "socks5: general SOCKS server failure"
+	case ReplyNotAllowed:
+		return "socks5: connection not allowed by ruleset"
+	case ReplyNetworkUnreachable:
+		return "socks5: network unreachable"
+	case ReplyHostUnreachable:
+		return "socks5: host unreachable"
+	case ReplyConnectionRefused:
+		return "socks5: connection refused"
+	case ReplyTTLExpired:
+		return "socks5: TTL expired"
+	case ReplyCmdNotSupported:
+		return "socks5: command not supported"
+	case ReplyAddrTypeUnsupported:
+		return "socks5: address type not supported"
+	default:
+		return fmt.Sprintf("socks5: unknown reply %d", byte(e))
+	}
+}
+
+// Dialer dials addresses through a SOCKS5 proxy with the CONNECT command.
+// Domain names are resolved by the proxy.
+type Dialer struct {
+	// ProxyAddress is the address of the proxy, as host:port.
+	ProxyAddress string
+
+	// Username and Password, if Username is set, authenticate with the
+	// proxy.
+	Username, Password string
+
+	// Forward, if set, dials the proxy instead of a [net.Dialer].
+	Forward func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dial dials address through the proxy.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext dials address through the proxy. The context bounds the
+// dial and the handshake with the proxy.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+	req, err := appendAddr([]byte{socksVersion, socksCmdConnect, 0x00}, address)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		var nd net.Dialer
+		forward = nd.DialContext
+	}
+	conn, err := forward(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: dialing proxy: %w", err)
+	}
+
+	if err := withContext(ctx, conn, func() error { return d.handshake(conn, req) }); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, req []byte) error {
+	methods := []byte{socksVersion, 1, socksNoAuth}
+	if d.Username != "" {
+		methods = []byte{socksVersion, 1, socksUserPassAuth}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion {
+		return errors.New("socks5: not a SOCKS5 proxy")
+	}
+	switch choice[1] {
+	case methods[2]:
+	case socksNoAcceptable:
+		return ErrNoMethod
+	default:
+		return fmt.Errorf("socks5: proxy picked unoffered method %d", choice[1])
+	}
+
+	if choice[1] == socksUserPassAuth {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		auth := append([]byte{userPassVersion, byte(len(d.Username))}, d.Username...)
+		auth = append(append(auth, byte(len(d.Password))), d.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return err
+		}
+		if status[1] != userPassSuccess {
+			return ErrAuthFailed
+		}
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("socks5: not a SOCKS5 proxy")
+	}
+	if _, err := readAddr(conn); err != nil { // the bound address is not needed
+		return err
+	}
+	if reply[1] != ReplySucceeded {
+		return ReplyError(reply[1])
+	}
+	return nil
+}
+
+// withContext runs f, interrupting I/O on conn once ctx is done.
+func withContext(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := f()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,274 @@
+package socks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/refraction-networking/water/internal/log"
+)
+
+const defaultHandshakeTimeout = 30 * time.Second
+
+// Server is a SOCKS5 server.
+type Server struct {
+	// Dial dials the destination of a CONNECT request, given as
+	// host:port. The context bounds the lifetime of the connection, as
+	// for a water.Dialer. It must be set.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// ListenPacket, if set, creates the packet connection to which the
+	// datagrams of a UDP ASSOCIATE request are relayed. Datagrams to IP
+	// addresses are written to a [*net.UDPAddr], those to domain names to
+	// an [*Addr]. If not set, UDP ASSOCIATE requests are refused.
+	ListenPacket func(ctx context.Context, network string) (net.PacketConn, error)
+
+	// Credentials, if set, requires clients to authenticate with one of
+	// its username: password pairs.
+	Credentials map[string]string
+
+	// AddressValidator, if set, checks the destination of every request,
+	// as for water.Config.DialedAddressValidator. CONNECT requests to a
+	// denied destination are refused and datagrams to one dropped.
+	AddressValidator func(network, address string) error
+
+	// HandshakeTimeout bounds the negotiation of a client up to its
+	// request. Zero means 30s.
+	HandshakeTimeout time.Duration
+
+	// Logger, if set, is used instead of the default logger.
+	Logger *log.Logger
+}
+
+// Serve accepts connections from lis and serves each of them in its own
+// goroutine, until lis fails to accept one.
+func (s *Server) Serve(lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				s.debugf("socks5: serving %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single client and closes conn once done.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close() // skipcq: GO-S2307
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return err
+	}
+	if req[0] != socksVersion {
+		return ErrVersion
+	}
+	address, err := readAddr(conn)
+	if err != nil {
+		if errors.Is(err, ErrAddrType) {
+			_ = writeReply(conn, ReplyAddrTypeUnsupported, "")
+		}
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch req[1] {
+	case socksCmdConnect:
+		return s.connect(ctx, conn, address)
+	case socksCmdUDPAssociate:
+		if s.ListenPacket != nil {
+			return s.associate(ctx, conn, address)
+		}
+	}
+	_ = writeReply(conn, ReplyCmdNotSupported, "")
+	return fmt.Errorf("%w %d", ErrNotSupported, req[1])
+}
+
+// negotiate picks the authentication method and authenticates the
+// client.
+func (s *Server) negotiate(conn net.Conn) error {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socksVersion {
+		return ErrVersion
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksNoAuth)
+	if len(s.Credentials) > 0 {
+		want = socksUserPassAuth
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+
+	switch method {
+	case socksNoAcceptable:
+		return ErrNoMethod
+	case socksUserPassAuth:
+		return s.authenticate(conn)
+	}
+	return nil
+}
+
+// authenticate runs the username/password authentication of RFC 1929.
+func (s *Server) authenticate(conn net.Conn) error {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != userPassVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrAuthFailed, head[0])
+	}
+	username := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return err
+	}
+	password := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	want, ok := s.Credentials[string(username)]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), password) != 1 {
+		_, _ = conn.Write([]byte{userPassVersion, userPassFailure})
+		return ErrAuthFailed
+	}
+	_, err := conn.Write([]byte{userPassVersion, userPassSuccess})
+	return err
+}
+
+// validate checks a destination with the AddressValidator.
+func (s *Server) validate(network, address string) error {
+	if s.AddressValidator == nil {
+		return nil
+	}
+	if err := s.AddressValidator(network, address); err != nil {
+		return fmt.Errorf("socks5: %s %s: %w", network, address, err)
+	}
+	return nil
+}
+
+func (s *Server) connect(ctx context.Context, conn net.Conn, address string) error {
+	if err := s.validate("tcp", address); err != nil {
+		_ = writeReply(conn, ReplyNotAllowed, "")
+		return err
+	}
+
+	remote, err := s.Dial(ctx, "tcp", address)
+	if err != nil {
+		_ = writeReply(conn, replyCode(err), "")
+		return fmt.Errorf("socks5: dialing %s: %w", address, err)
+	}
+	defer remote.Close() // skipcq: GO-S2307
+
+	// the bound address is not meaningful through a WATM
+	if err := writeReply(conn, ReplySucceeded, ""); err != nil {
+		return err
+	}
+	pipe(conn, remote)
+	return nil
+}
+
+// replyCode returns the reply code best describing a dial error.
+func replyCode(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ReplyHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReplyTTLExpired
+	default:
+		return ReplyGeneralFailure
+	}
+}
+
+// writeReply sends a reply with the bound address, or 0.0.0.0:0 if
+// empty.
+func writeReply(conn net.Conn, rep byte, bound string) error {
+	if bound == "" {
+		bound = "0.0.0.0:0"
+	}
+	b, err := appendAddr([]byte{socksVersion, rep, 0x00}, bound)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+func (s *Server) debugf(format string, args ...any) {
+	if s.Logger != nil {
+		log.LDebugf(s.Logger, format, args...)
+	} else {
+		log.Debugf(format, args...)
+	}
+}
+
+// pipe copies data between a and b in both directions until both are
+// done.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(b, a)
+	}()
+	wg.Wait()
+}
+
+func copyAndCloseWrite(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
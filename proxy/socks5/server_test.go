@@ -0,0 +1,288 @@
+package socks5_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/proxy/socks5"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+// startServer serves s on a local address and returns it.
+func startServer(t *testing.T, s *socks5.Server) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String()
+}
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// request negotiates with the server at proxy, authenticating with
+// username and password if username is set, and sends a request. It
+// returns the connection, the reply code and the bound address.
+func request(t *testing.T, proxy, username, password string, cmd byte, address string) (net.Conn, byte, netip.AddrPort) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	method := byte(0x00)
+	if username != "" {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 1, method}); err != nil {
+		t.Fatal(err)
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		t.Fatal(err)
+	}
+	if choice[1] != method {
+		return conn, choice[1], netip.AddrPort{}
+	}
+
+	if username != "" {
+		auth := append([]byte{0x01, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			t.Fatal(err)
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			t.Fatal(err)
+		}
+		if status[1] != 0x00 {
+			return conn, 0xff, netip.AddrPort{}
+		}
+	}
+
+	addrPort := netip.MustParseAddrPort(address)
+	ip := addrPort.Addr().As4()
+	req := append([]byte{0x05, cmd, 0x00, 0x01}, ip[:]...)
+	req = binary.BigEndian.AppendUint16(req, addrPort.Port())
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply [10]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	bound := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), binary.BigEndian.Uint16(reply[8:10]))
+	return conn, reply[1], bound
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != msg {
+		t.Errorf("echoed %q, want %q", echoed, msg)
+	}
+}
+
+func directDial(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func TestServer(t *testing.T) {
+	t.Run("connect through WATM", testConnectWATM)
+	t.Run("authentication", testAuthentication)
+	t.Run("address validator", testAddressValidator)
+	t.Run("connection refused", testConnectionRefused)
+	t.Run("unsupported command", testUnsupportedCommand)
+	t.Run("UDP associate", testUDPAssociate)
+}
+
+func testConnectWATM(t *testing.T) {
+	wasmPlain, err := os.ReadFile("../../transport/v1/testdata/plain.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{TransportModuleBin: wasmPlain})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startServer(t, &socks5.Server{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	})
+	conn, rep, _ := request(t, proxy, "", "", 0x01, echoServer(t))
+	if rep != socks5.ReplySucceeded {
+		t.Fatalf("reply = %d, want %d", rep, socks5.ReplySucceeded)
+	}
+	roundTrip(t, conn, "hello, socks")
+	roundTrip(t, conn, string(bytes.Repeat([]byte{'x'}, 1<<16)))
+}
+
+func testAuthentication(t *testing.T) {
+	proxy := startServer(t, &socks5.Server{
+		Dial:        directDial,
+		Credentials: map[string]string{"user": "secret"},
+	})
+	target := echoServer(t)
+
+	if _, rep, _ := request(t, proxy, "", "", 0x01, target); rep != 0xff {
+		t.Errorf("unauthenticated client: method = %d, want no acceptable method", rep)
+	}
+	if _, rep, _ := request(t, proxy, "user", "wrong", 0x01, target); rep != 0xff {
+		t.Errorf("wrong password accepted")
+	}
+
+	conn, rep, _ := request(t, proxy, "user", "secret", 0x01, target)
+	if rep != socks5.ReplySucceeded {
+		t.Fatalf("reply = %d, want %d", rep, socks5.ReplySucceeded)
+	}
+	roundTrip(t, conn, "hello, socks")
+}
+
+func testAddressValidator(t *testing.T) {
+	allowed := echoServer(t)
+	proxy := startServer(t, &socks5.Server{
+		Dial: directDial,
+		AddressValidator: func(network, address string) error {
+			if network == "tcp" && address == allowed {
+				return nil
+			}
+			return errors.New("denied")
+		},
+	})
+
+	if _, rep, _ := request(t, proxy, "", "", 0x01, echoServer(t)); rep != socks5.ReplyNotAllowed {
+		t.Errorf("reply = %d, want %d", rep, socks5.ReplyNotAllowed)
+	}
+	conn, rep, _ := request(t, proxy, "", "", 0x01, allowed)
+	if rep != socks5.ReplySucceeded {
+		t.Fatalf("reply = %d, want %d", rep, socks5.ReplySucceeded)
+	}
+	roundTrip(t, conn, "hello, socks")
+}
+
+func testConnectionRefused(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = lis.Close()
+
+	proxy := startServer(t, &socks5.Server{Dial: directDial})
+	if _, rep, _ := request(t, proxy, "", "", 0x01, lis.Addr().String()); rep != socks5.ReplyConnectionRefused {
+		t.Errorf("reply = %d, want %d", rep, socks5.ReplyConnectionRefused)
+	}
+}
+
+func testUnsupportedCommand(t *testing.T) {
+	proxy := startServer(t, &socks5.Server{Dial: directDial})
+	target := echoServer(t)
+
+	for _, cmd := range []byte{0x02, 0x03} { // BIND, and UDP ASSOCIATE without ListenPacket
+		if _, rep, _ := request(t, proxy, "", "", cmd, target); rep != socks5.ReplyCmdNotSupported {
+			t.Errorf("command %d: reply = %d, want %d", cmd, rep, socks5.ReplyCmdNotSupported)
+		}
+	}
+}
+
+func testUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close() // skipcq: GO-S2307
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	proxy := startServer(t, &socks5.Server{
+		Dial: directDial,
+		ListenPacket: func(_ context.Context, network string) (net.PacketConn, error) {
+			return net.ListenPacket(network, "127.0.0.1:0")
+		},
+	})
+	_, rep, relay := request(t, proxy, "", "", 0x03, "0.0.0.0:0")
+	if rep != socks5.ReplySucceeded {
+		t.Fatalf("reply = %d, want %d", rep, socks5.ReplySucceeded)
+	}
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // skipcq: GO-S2307
+	_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	echoAddr := netip.MustParseAddrPort(echo.LocalAddr().String())
+	ip := echoAddr.Addr().As4()
+	header := append([]byte{0, 0, 0, 0x01}, ip[:]...)
+	header = binary.BigEndian.AppendUint16(header, echoAddr.Port())
+	datagram := append(header, "hello, udp"...)
+	if _, err := client.WriteTo(datagram, net.UDPAddrFromAddrPort(relay)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], datagram) {
+		t.Errorf("received %x, want %x", buf[:n], datagram)
+	}
+}
@@ -0,0 +1,141 @@
+// Package socks5 implements a SOCKS5 server, as defined in RFC 1928, with
+// the username/password authentication of RFC 1929, serving CONNECT and
+// UDP ASSOCIATE requests through arbitrary dialers, e.g., a water.Dialer.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	socksVersion         = 0x05
+	socksNoAuth          = 0x00
+	socksUserPassAuth    = 0x02
+	socksNoAcceptable    = 0xff
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+	socksAddrIPv4        = 0x01
+	socksAddrDomainName  = 0x03
+	socksAddrIPv6        = 0x04
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+)
+
+// Reply codes sent to the client in response to a request.
+const (
+	ReplySucceeded           byte = 0x00
+	ReplyGeneralFailure      byte = 0x01
+	ReplyNotAllowed          byte = 0x02
+	ReplyNetworkUnreachable  byte = 0x03
+	ReplyHostUnreachable     byte = 0x04
+	ReplyConnectionRefused   byte = 0x05
+	ReplyTTLExpired          byte = 0x06
+	ReplyCmdNotSupported     byte = 0x07
+	ReplyAddrTypeUnsupported byte = 0x08
+)
+
+var (
+	ErrVersion      = errors.New("socks5: not a SOCKS5 client")
+	ErrNoMethod     = errors.New("socks5: no acceptable authentication method")
+	ErrAuthFailed   = errors.New("socks5: authentication failed")
+	ErrAddrType     = errors.New("socks5: unsupported address type")
+	ErrNotSupported = errors.New("socks5: unsupported command")
+)
+
+// Addr is a SOCKS5 address given as a domain name, which is left to the
+// dialer to resolve.
+//
+// Implements [net.Addr].
+type Addr struct {
+	Name string
+	Port uint16
+}
+
+// Network implements [net.Addr].
+func (a *Addr) Network() string {
+	return "udp"
+}
+
+// String implements [net.Addr].
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Name, strconv.Itoa(int(a.Port)))
+}
+
+// readAddr reads an address as ATYP, DST.ADDR and DST.PORT, and returns
+// it as host:port.
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socksAddrDomainName:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("%w %d", ErrAddrType, atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendAddr appends address, as host:port, encoded as ATYP, ADDR and
+// PORT.
+func appendAddr(b []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			b = append(b, socksAddrIPv4)
+		} else {
+			b = append(b, socksAddrIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: domain name %q too long", host)
+		}
+		b = append(b, socksAddrDomainName, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
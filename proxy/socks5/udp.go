@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+// maxDatagram is the size of the buffers datagrams are read into.
+const maxDatagram = 64 << 10
+
+// association relays the datagrams of a UDP ASSOCIATE request between the
+// client, over a UDP socket bound by the server, and the remote packet
+// connection.
+type association struct {
+	server *Server
+	relay  net.PacketConn
+	remote net.PacketConn
+
+	// client is the address the client sends datagrams from: its IP is
+	// the one of the TCP connection and its port, if zero in the request,
+	// is learnt from the first datagram.
+	clientMutex sync.Mutex
+	client      netip.AddrPort
+}
+
+// associate serves a UDP ASSOCIATE request until conn is closed.
+func (s *Server) associate(ctx context.Context, conn net.Conn, address string) error {
+	a := &association{server: s}
+
+	clientIP := addrPortOf(conn.RemoteAddr()).Addr()
+	var clientPort uint16
+	if requested, err := netip.ParseAddrPort(address); err == nil {
+		clientPort = requested.Port()
+	}
+	a.client = netip.AddrPortFrom(clientIP, clientPort)
+
+	// the relay is bound on the address the client reached us on
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, "")
+		return fmt.Errorf("socks5: binding UDP relay: %w", err)
+	}
+	a.relay = relay
+	defer relay.Close() // skipcq: GO-S2307
+
+	remote, err := s.ListenPacket(ctx, "udp")
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, "")
+		return fmt.Errorf("socks5: listening for packets: %w", err)
+	}
+	a.remote = remote
+	defer remote.Close() // skipcq: GO-S2307
+
+	if err := writeReply(conn, ReplySucceeded, relay.LocalAddr().String()); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.fromClient()
+	}()
+	go func() {
+		defer wg.Done()
+		a.toClient()
+	}()
+
+	// the association ends with the TCP connection
+	_, _ = io.Copy(io.Discard, conn)
+	_ = relay.Close()
+	_ = remote.Close()
+	wg.Wait()
+	return nil
+}
+
+// fromClient relays datagrams from the client to their destination.
+func (a *association) fromClient() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !a.isClient(addrPortOf(from)) {
+			continue
+		}
+
+		address, payload, err := parseDatagram(buf[:n])
+		if err != nil {
+			a.server.debugf("socks5: dropping datagram from %s: %v", from, err)
+			continue
+		}
+		if err := a.server.validate("udp", address); err != nil {
+			a.server.debugf("%v", err)
+			continue
+		}
+		if _, err := a.remote.WriteTo(payload, packetAddr(address)); err != nil {
+			a.server.debugf("socks5: relaying datagram to %s: %v", address, err)
+		}
+	}
+}
+
+// toClient relays datagrams from the remote packet connection to the
+// client.
+func (a *association) toClient() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := a.remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		a.clientMutex.Lock()
+		client := a.client
+		a.clientMutex.Unlock()
+		if client.Port() == 0 { // the client has not sent anything yet
+			continue
+		}
+
+		datagram, err := appendAddr([]byte{0, 0, 0}, from.String())
+		if err != nil {
+			continue
+		}
+		datagram = append(datagram, buf[:n]...)
+		_, _ = a.relay.WriteTo(datagram, net.UDPAddrFromAddrPort(client))
+	}
+}
+
+// isClient tells whether a datagram from from comes from the client,
+// learning its port from the first one if needed.
+func (a *association) isClient(from netip.AddrPort) bool {
+	a.clientMutex.Lock()
+	defer a.clientMutex.Unlock()
+
+	if from.Addr() != a.client.Addr() {
+		return false
+	}
+	if a.client.Port() == 0 {
+		a.client = from
+	}
+	return from.Port() == a.client.Port()
+}
+
+// parseDatagram parses the header of a datagram from the client and
+// returns its destination and payload. Fragments are not supported.
+func parseDatagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("socks5: datagram of %d bytes too short", len(b))
+	}
+	if b[2] != 0 {
+		return "", nil, fmt.Errorf("socks5: fragment %d not supported", b[2])
+	}
+
+	r := bytes.NewReader(b[3:])
+	address, err := readAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return address, b[len(b)-r.Len():], nil
+}
+
+// packetAddr returns address as a [*net.UDPAddr] if it is an IP address,
+// or an [*Addr] otherwise.
+func packetAddr(address string) net.Addr {
+	if addrPort, err := netip.ParseAddrPort(address); err == nil {
+		return net.UDPAddrFromAddrPort(addrPort)
+	}
+	host, portStr, _ := net.SplitHostPort(address)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return &Addr{Name: host, Port: uint16(port)}
+}
+
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
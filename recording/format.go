@@ -0,0 +1,290 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A recording file is laid out as follows (multi-byte integers are
+// big-endian unless noted as uvarint/varint):
+//
+//	header:
+//	  magic        8B  "WATERREC"
+//	  version      1B
+//	  role         1B
+//	  start time   8B  unix nanoseconds
+//	  module hash 32B  SHA-256 of the WATM binary
+//	  config len   uvarint
+//	  config       the TransportModuleConfig bytes
+//	events, repeated until EOF:
+//	  type         1B
+//	  stream       1B
+//	  offset       uvarint, nanoseconds since start time
+//	  payload len  uvarint
+//	  payload
+var fileMagic = []byte("WATERREC")
+
+const fileVersion byte = 0x01
+
+// Role is the role of the WATM in the recorded session.
+type Role uint8
+
+const (
+	RoleDialer Role = iota + 1
+	RoleFixedDialer
+	RoleListener
+	RoleRelay
+)
+
+// String implements fmt.Stringer.
+func (r Role) String() string {
+	switch r {
+	case RoleDialer:
+		return "dialer"
+	case RoleFixedDialer:
+		return "fixed_dialer"
+	case RoleListener:
+		return "listener"
+	case RoleRelay:
+		return "relay"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(r))
+	}
+}
+
+// EventType identifies what a recorded Event is about.
+type EventType uint8
+
+const (
+	// EventOpen marks a new stream. The payload is "network address" for
+	// network streams and empty for the caller stream.
+	EventOpen EventType = iota + 1
+
+	// EventIn is data flowing into the WATM: written by the caller on the
+	// caller stream, or read from the network on a network stream.
+	EventIn
+
+	// EventOut is data flowing out of the WATM: read by the caller on the
+	// caller stream, or written to the network on a network stream.
+	EventOut
+
+	// EventClose marks the end of a stream.
+	EventClose
+
+	// EventRand is random bytes served to the WATM.
+	EventRand
+
+	// EventWalltime is a wall clock reading served to the WATM. The payload
+	// is the seconds and nanoseconds as varints.
+	EventWalltime
+
+	// EventNanotime is a monotonic clock reading served to the WATM. The
+	// payload is the nanoseconds as a varint.
+	EventNanotime
+)
+
+// String implements fmt.Stringer.
+func (t EventType) String() string {
+	switch t {
+	case EventOpen:
+		return "open"
+	case EventIn:
+		return "in"
+	case EventOut:
+		return "out"
+	case EventClose:
+		return "close"
+	case EventRand:
+		return "rand"
+	case EventWalltime:
+		return "walltime"
+	case EventNanotime:
+		return "nanotime"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// StreamCaller is the stream between the caller and the WATM. Network
+// streams are numbered from 1 in the order they were opened. Events not
+// bound to a connection, e.g., EventRand, use StreamCaller as well.
+const StreamCaller uint8 = 0
+
+// Header is the header of a recording.
+type Header struct {
+	Role       Role
+	Start      time.Time
+	ModuleHash [32]byte
+	Config     []byte
+}
+
+// Event is a single recorded event.
+type Event struct {
+	Type    EventType
+	Stream  uint8
+	Offset  time.Duration // since Header.Start
+	Payload []byte
+}
+
+// Walltime decodes the payload of an EventWalltime.
+func (e *Event) Walltime() (sec int64, nsec int32, err error) {
+	r := bytes.NewReader(e.Payload)
+	if sec, err = binary.ReadVarint(r); err != nil {
+		return 0, 0, err
+	}
+	n, err := binary.ReadVarint(r)
+	return sec, int32(n), err
+}
+
+// Nanotime decodes the payload of an EventNanotime.
+func (e *Event) Nanotime() (int64, error) {
+	return binary.ReadVarint(bytes.NewReader(e.Payload))
+}
+
+// Recording is a fully loaded recording file.
+type Recording struct {
+	Header Header
+	Events []Event
+}
+
+var ErrBadRecording = errors.New("water: not a valid recording")
+
+// MaxRecordSize bounds the size of the TransportModuleConfig and of the
+// payload of every event in a recording. Larger payloads are recorded as
+// several events.
+const MaxRecordSize = 16 << 20
+
+// Open reads the recording file at path.
+func Open(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
+
+// Read reads a recording from r until EOF. A truncated trailing event, as
+// left by a process that died while recording, is silently dropped.
+func Read(r io.Reader) (*Recording, error) {
+	br := bufio.NewReader(r)
+
+	var fixed [8 + 1 + 1 + 8 + 32]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRecording, err)
+	}
+
+	if !bytes.Equal(fixed[:8], fileMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrBadRecording)
+	}
+
+	if fixed[8] != fileVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadRecording, fixed[8])
+	}
+
+	rec := &Recording{}
+	rec.Header.Role = Role(fixed[9])
+	rec.Header.Start = time.Unix(0, int64(binary.BigEndian.Uint64(fixed[10:18])))
+	copy(rec.Header.ModuleHash[:], fixed[18:])
+
+	configLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRecording, err)
+	}
+	if configLen > MaxRecordSize {
+		return nil, fmt.Errorf("%w: config of %d bytes exceeds %d", ErrBadRecording, configLen, MaxRecordSize)
+	}
+	rec.Header.Config = make([]byte, configLen)
+	if _, err := io.ReadFull(br, rec.Header.Config); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRecording, err)
+	}
+
+	for {
+		var evtHdr [2]byte
+		if _, err := io.ReadFull(br, evtHdr[:]); err != nil {
+			break // EOF or truncated
+		}
+
+		offset, err := binary.ReadUvarint(br)
+		if err != nil {
+			break
+		}
+
+		payloadLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			break
+		}
+
+		if payloadLen > MaxRecordSize {
+			return nil, fmt.Errorf("%w: event %d payload of %d bytes exceeds %d", ErrBadRecording, len(rec.Events), payloadLen, MaxRecordSize)
+		}
+		payload := make([]byte, payloadLen)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			break
+		}
+
+		rec.Events = append(rec.Events, Event{
+			Type:    EventType(evtHdr[0]),
+			Stream:  evtHdr[1],
+			Offset:  time.Duration(offset),
+			Payload: payload,
+		})
+	}
+
+	return rec, nil
+}
+
+// Stream returns the concatenated payloads of all events of the given type
+// on the given stream.
+func (r *Recording) Stream(stream uint8, typ EventType) []byte {
+	var buf bytes.Buffer
+	for _, e := range r.Events {
+		if e.Stream == stream && e.Type == typ {
+			buf.Write(e.Payload)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Streams returns the network streams opened in the recording, mapped to
+// the "network address" payload of their EventOpen.
+func (r *Recording) Streams() map[uint8]string {
+	streams := make(map[uint8]string)
+	for _, e := range r.Events {
+		if e.Type == EventOpen && e.Stream != StreamCaller {
+			streams[e.Stream] = string(e.Payload)
+		}
+	}
+	return streams
+}
+
+func writeHeader(w io.Writer, h *Header) error {
+	if len(h.Config) > MaxRecordSize {
+		return fmt.Errorf("water: config of %d bytes exceeds %d", len(h.Config), MaxRecordSize)
+	}
+
+	buf := make([]byte, 0, 8+1+1+8+32+binary.MaxVarintLen64+len(h.Config))
+	buf = append(buf, fileMagic...)
+	buf = append(buf, fileVersion, byte(h.Role))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Start.UnixNano()))
+	buf = append(buf, h.ModuleHash[:]...)
+	buf = binary.AppendUvarint(buf, uint64(len(h.Config)))
+	buf = append(buf, h.Config...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendEvent(buf []byte, e *Event) []byte {
+	buf = append(buf, byte(e.Type), e.Stream)
+	buf = binary.AppendUvarint(buf, uint64(e.Offset))
+	buf = binary.AppendUvarint(buf, uint64(len(e.Payload)))
+	return append(buf, e.Payload...)
+}
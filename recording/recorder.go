@@ -0,0 +1,232 @@
+package recording
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recorder writes one recording file per session into a directory.
+//
+// A session covers the lifetime of a single WATM instance: the bytes
+// crossing the caller connection and every network connection, the
+// TransportModuleConfig, and the random bytes and clock readings served
+// to the WATM. It is meant for debugging misbehaving WATMs and will
+// happily write sensitive plaintext to disk.
+type Recorder struct {
+	dir      string
+	sessions atomic.Uint64
+}
+
+// NewRecorder creates a Recorder writing into dir, which is created if
+// it does not exist.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("water: creating recording directory: %w", err)
+	}
+
+	return &Recorder{dir: dir}, nil
+}
+
+// Dir returns the directory the Recorder writes into.
+func (r *Recorder) Dir() string {
+	return r.dir
+}
+
+// NewSession starts recording a new session into a new file.
+func (r *Recorder) NewSession(role Role, moduleBin, config []byte) (*Session, error) {
+	start := time.Now()
+	name := fmt.Sprintf("%s-%d-%s.waterrec", start.UTC().Format("20060102T150405.000000000"), r.sessions.Add(1), role)
+	path := filepath.Join(r.dir, name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("water: creating recording file: %w", err)
+	}
+
+	hdr := &Header{
+		Role:       role,
+		Start:      start,
+		ModuleHash: sha256.Sum256(moduleBin),
+		Config:     config,
+	}
+	if err := writeHeader(f, hdr); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("water: writing recording header: %w", err)
+	}
+
+	return &Session{
+		f:     f,
+		path:  path,
+		start: start,
+	}, nil
+}
+
+// Session records a single session. All methods are safe for concurrent use.
+type Session struct {
+	mutex      sync.Mutex
+	f          *os.File
+	path       string
+	start      time.Time
+	nextStream uint8
+	buf        []byte
+	closed     bool
+}
+
+// Path returns the path of the recording file.
+func (s *Session) Path() string {
+	return s.path
+}
+
+// record appends an event to the file. Events are written out immediately
+// so that the recording survives a crash.
+func (s *Session) record(typ EventType, stream uint8, payload []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	offset := time.Since(s.start)
+	for {
+		chunk := payload
+		if len(chunk) > MaxRecordSize {
+			chunk = chunk[:MaxRecordSize]
+		}
+		s.buf = appendEvent(s.buf[:0], &Event{
+			Type:    typ,
+			Stream:  stream,
+			Offset:  offset,
+			Payload: chunk,
+		})
+		_, _ = s.f.Write(s.buf) // best effort: a recording must never break the session
+
+		payload = payload[len(chunk):]
+		if len(payload) == 0 {
+			return
+		}
+	}
+}
+
+// Close stops recording and closes the file. Events recorded afterwards
+// are dropped.
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	return s.f.Close()
+}
+
+// RandSource wraps r so that every byte read from it is recorded.
+func (s *Session) RandSource(r io.Reader) io.Reader {
+	return &randRecorder{r: r, s: s}
+}
+
+// Walltime wraps a wall clock so that every reading is recorded.
+func (s *Session) Walltime(walltime func() (sec int64, nsec int32)) func() (sec int64, nsec int32) {
+	return func() (int64, int32) {
+		sec, nsec := walltime()
+		payload := binary.AppendVarint(nil, sec)
+		payload = binary.AppendVarint(payload, int64(nsec))
+		s.record(EventWalltime, StreamCaller, payload)
+		return sec, nsec
+	}
+}
+
+// Nanotime wraps a monotonic clock so that every reading is recorded.
+func (s *Session) Nanotime(nanotime func() int64) func() int64 {
+	return func() int64 {
+		ns := nanotime()
+		s.record(EventNanotime, StreamCaller, binary.AppendVarint(nil, ns))
+		return ns
+	}
+}
+
+// CallerConn wraps the connection handed to the caller so that all data
+// written and read by the caller is recorded.
+func (s *Session) CallerConn(c net.Conn) net.Conn {
+	s.record(EventOpen, StreamCaller, nil)
+	return &connRecorder{Conn: c, s: s, stream: StreamCaller}
+}
+
+// NetworkConn wraps a network connection dialed or accepted for the WATM
+// so that all data read and written by the WATM is recorded.
+func (s *Session) NetworkConn(c net.Conn, network, address string) net.Conn {
+	s.mutex.Lock()
+	s.nextStream++
+	stream := s.nextStream
+	s.mutex.Unlock()
+
+	s.record(EventOpen, stream, []byte(network+" "+address))
+	return &connRecorder{Conn: c, s: s, stream: stream}
+}
+
+type randRecorder struct {
+	r io.Reader
+	s *Session
+}
+
+func (rr *randRecorder) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	if n > 0 {
+		rr.s.record(EventRand, StreamCaller, b[:n])
+	}
+	return n, err
+}
+
+// connRecorder records the data crossing a net.Conn.
+//
+// For the caller stream, Write is data into the WATM and Read is data out
+// of it. For network streams it is the other way around, since the WATM
+// reads from and writes to the network.
+type connRecorder struct {
+	net.Conn
+	s      *Session
+	stream uint8
+
+	closeOnce sync.Once
+}
+
+func (c *connRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		typ := EventIn
+		if c.stream == StreamCaller {
+			typ = EventOut
+		}
+		c.s.record(typ, c.stream, b[:n])
+	}
+	return n, err
+}
+
+func (c *connRecorder) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		typ := EventOut
+		if c.stream == StreamCaller {
+			typ = EventIn
+		}
+		c.s.record(typ, c.stream, b[:n])
+	}
+	return n, err
+}
+
+func (c *connRecorder) Close() error {
+	c.closeOnce.Do(func() {
+		c.s.record(EventClose, c.stream, nil)
+	})
+	return c.Conn.Close()
+}
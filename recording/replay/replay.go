@@ -0,0 +1,577 @@
+// Package replay re-runs a WATM against a session captured by a
+// [recording.Recorder] and reports where its behavior diverges from the
+// recording.
+//
+// During a replay the WATM sees the recorded random bytes and clock
+// readings, the recorded caller input and the recorded network input.
+// Everything it writes to the caller and to the network is compared
+// against what was recorded.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/socket"
+	"github.com/refraction-networking/water/recording"
+	_ "github.com/refraction-networking/water/transport/v1" // register WATMv1
+)
+
+// DefaultIdleTimeout is used when Replayer.IdleTimeout is not set.
+const DefaultIdleTimeout = time.Second
+
+var (
+	ErrUnsupportedRole = errors.New("water: replaying this role is not supported")
+	ErrNoNetworkStream = errors.New("water: recording contains no network stream")
+)
+
+// Replayer replays recordings against a WATM binary.
+type Replayer struct {
+	// ModuleBin is the WATM to replay. It does not need to be the binary
+	// the session was recorded with, which allows checking whether a
+	// modified WATM behaves the same.
+	ModuleBin []byte
+
+	// IdleTimeout is how long a stream may stay silent before the
+	// replay considers it done. Defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// ModuleConfigFactory, if set, is used as the base of the module
+	// config, e.g. to inherit stdout/stderr. Its random source and clocks
+	// are always replaced.
+	ModuleConfigFactory *water.WazeroModuleConfigFactory
+}
+
+// Report describes how a replay compares to its recording.
+type Report struct {
+	// ModuleMatches is true if the replayed WATM is the one recorded.
+	ModuleMatches bool
+
+	// Streams has one entry for the caller stream followed by one entry
+	// per network stream, in the order they were opened.
+	Streams []*StreamReport
+
+	// UnexpectedDials counts network connections requested by the WATM
+	// that have no counterpart in the recording.
+	UnexpectedDials int
+
+	RandRecorded, RandReplayed         int // bytes
+	WalltimeRecorded, WalltimeReplayed int // readings
+	NanotimeRecorded, NanotimeReplayed int // readings
+}
+
+// StreamReport compares the output of a single stream.
+type StreamReport struct {
+	Stream uint8
+	Name   string // "caller" or the recorded "network address"
+
+	// ReplayedName is the "network address" requested during the replay,
+	// empty for the caller stream or if it was never opened.
+	ReplayedName string
+
+	Expected int // bytes of output recorded
+	Replayed int // bytes of output produced during the replay
+
+	// DivergedAt is the offset of the first byte that differs from the
+	// recording, or -1 if the replayed output matches.
+	DivergedAt int
+}
+
+// Diverged reports whether the stream output differs from the recording.
+func (s *StreamReport) Diverged() bool {
+	return s.DivergedAt >= 0
+}
+
+// Diverged reports whether any part of the replay differs from the
+// recording.
+func (r *Report) Diverged() bool {
+	for _, s := range r.Streams {
+		if s.Diverged() {
+			return true
+		}
+	}
+	return r.UnexpectedDials > 0 ||
+		r.RandReplayed > r.RandRecorded ||
+		r.WalltimeReplayed > r.WalltimeRecorded ||
+		r.NanotimeReplayed > r.NanotimeRecorded
+}
+
+// String implements fmt.Stringer.
+func (r *Report) String() string {
+	var sb strings.Builder
+	if !r.ModuleMatches {
+		sb.WriteString("module: differs from the recorded one\n")
+	}
+	for _, s := range r.Streams {
+		fmt.Fprintf(&sb, "stream %d (%s): %d/%d bytes", s.Stream, s.Name, s.Replayed, s.Expected)
+		if s.ReplayedName != "" && s.ReplayedName != s.Name {
+			fmt.Fprintf(&sb, ", opened as %s", s.ReplayedName)
+		}
+		if s.Diverged() {
+			fmt.Fprintf(&sb, ", diverged at offset %d", s.DivergedAt)
+		}
+		sb.WriteByte('\n')
+	}
+	if r.UnexpectedDials > 0 {
+		fmt.Fprintf(&sb, "unexpected dials: %d\n", r.UnexpectedDials)
+	}
+	fmt.Fprintf(&sb, "rand: %d/%d bytes\n", r.RandReplayed, r.RandRecorded)
+	fmt.Fprintf(&sb, "walltime: %d/%d readings\n", r.WalltimeReplayed, r.WalltimeRecorded)
+	fmt.Fprintf(&sb, "nanotime: %d/%d readings\n", r.NanotimeReplayed, r.NanotimeRecorded)
+	return sb.String()
+}
+
+// Run replays rec against r.ModuleBin.
+//
+// Sessions recorded by a Dialer, FixedDialer, Listener or Relay can be
+// replayed. A Relay session has no caller stream: its first network stream
+// is the accepted connection, and the others are dialed.
+func (r *Replayer) Run(ctx context.Context, rec *recording.Recording) (*Report, error) {
+	idleTimeout := r.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	report := &Report{
+		ModuleMatches: sha256.Sum256(r.ModuleBin) == rec.Header.ModuleHash,
+	}
+
+	config := &water.Config{
+		TransportModuleBin: r.ModuleBin,
+		ModuleConfigFactory: func() *water.WazeroModuleConfigFactory {
+			if r.ModuleConfigFactory != nil {
+				return r.ModuleConfigFactory.Clone()
+			}
+			return water.NewWazeroModuleConfigFactory()
+		}(),
+	}
+	if len(rec.Header.Config) > 0 {
+		config.TransportModuleConfig = water.TransportModuleConfigFromBytes(rec.Header.Config)
+	}
+
+	clocks, err := newReplayedClocks(rec, report)
+	if err != nil {
+		return nil, err
+	}
+	mc := config.ModuleConfig()
+	mc.SetRandSource(clocks.rand())
+	mc.SetWalltime(clocks.walltime)
+	mc.SetNanotime(clocks.nanotime)
+
+	network := newReplayedNetwork(rec, report, idleTimeout)
+	defer network.close()
+
+	var callerConn net.Conn
+	switch rec.Header.Role {
+	case recording.RoleDialer:
+		if len(network.streams) == 0 {
+			return nil, ErrNoNetworkStream
+		}
+		config.NetworkDialerFunc = network.dial
+
+		dialer, err := water.NewDialerWithContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		netw, addr, _ := strings.Cut(network.streams[0].Name, " ")
+		callerConn, err = dialer.DialContext(ctx, netw, addr)
+		if err != nil {
+			return nil, fmt.Errorf("water: replaying dial: %w", err)
+		}
+	case recording.RoleFixedDialer:
+		config.NetworkDialerFunc = network.dial
+		config.DialedAddressValidator = func(string, string) error { return nil }
+
+		dialer, err := water.NewFixedDialerWithContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		callerConn, err = dialer.DialFixedContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("water: replaying dial: %w", err)
+		}
+	case recording.RoleListener:
+		config.NetworkListener = network.listener()
+
+		listener, err := water.NewListenerWithContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close() // skipcq: GO-S2307
+
+		callerConn, err = listener.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("water: replaying accept: %w", err)
+		}
+	case recording.RoleRelay:
+		if len(network.streams) < 2 {
+			return nil, ErrNoNetworkStream
+		}
+		config.NetworkListener = network.acceptOnce()
+		config.NetworkDialerFunc = network.dial
+		config.DialedAddressValidator = func(string, string) error { return nil }
+
+		relay, err := water.NewRelayWithContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		netw, addr, _ := strings.Cut(network.streams[1].Name, " ")
+		relayed := make(chan error, 1)
+		go func() {
+			relayed <- relay.RelayTo(netw, addr)
+		}()
+
+		network.waitOpened(len(network.streams))
+		network.wait()
+		shutdownCtx, cancel := context.WithTimeout(ctx, idleTimeout)
+		_ = relay.Shutdown(shutdownCtx) // the WATMs need not return once the streams are done
+		cancel()
+		if err := <-relayed; err != nil {
+			return nil, fmt.Errorf("water: replaying relay: %w", err)
+		}
+
+		report.Streams = append([]*StreamReport{{
+			Stream:     recording.StreamCaller,
+			Name:       "caller",
+			DivergedAt: -1,
+		}}, report.Streams...)
+		return report, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedRole, rec.Header.Role)
+	}
+	defer callerConn.Close() // skipcq: GO-S2307
+
+	caller := &StreamReport{
+		Stream:     recording.StreamCaller,
+		Name:       "caller",
+		DivergedAt: -1,
+	}
+	report.Streams = append([]*StreamReport{caller}, report.Streams...)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		drive(callerConn, rec.Stream(recording.StreamCaller, recording.EventIn),
+			rec.Stream(recording.StreamCaller, recording.EventOut), caller, idleTimeout)
+	}()
+	wg.Wait()
+	network.wait()
+
+	return report, nil
+}
+
+// drive writes input into conn and compares everything read from conn
+// with expected until conn stays idle for idleTimeout or fails.
+func drive(conn net.Conn, input, expected []byte, report *StreamReport, idleTimeout time.Duration) {
+	report.Expected = len(expected)
+
+	go func() {
+		_, _ = conn.Write(input) // unsafe: error is ignored, divergence shows in the output
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			break
+		}
+		n, err := conn.Read(buf)
+		if n > 0 {
+			report.compare(buf[:n], expected)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if report.DivergedAt < 0 && report.Replayed != report.Expected {
+		report.DivergedAt = report.Replayed
+	}
+}
+
+// compare appends output to the replayed stream and records the first
+// divergence from expected.
+func (s *StreamReport) compare(output, expected []byte) {
+	if s.DivergedAt < 0 {
+		off := s.Replayed
+		switch {
+		case off >= len(expected):
+			s.DivergedAt = off
+		default:
+			want := expected[off:]
+			for i := range output {
+				if i >= len(want) || output[i] != want[i] {
+					s.DivergedAt = off + i
+					break
+				}
+			}
+		}
+	}
+	s.Replayed += len(output)
+}
+
+// replayedNetwork stands in for the network of the recorded session.
+type replayedNetwork struct {
+	rec         *recording.Recording
+	report      *Report
+	idleTimeout time.Duration
+
+	mutex   sync.Mutex
+	streams []*StreamReport
+	next    int
+	conns   []net.Conn
+	wg      sync.WaitGroup
+
+	accepted chan net.Conn
+	opened   chan struct{} // one value per stream opened
+	closed   chan struct{}
+}
+
+func newReplayedNetwork(rec *recording.Recording, report *Report, idleTimeout time.Duration) *replayedNetwork {
+	n := &replayedNetwork{
+		rec:         rec,
+		report:      report,
+		idleTimeout: idleTimeout,
+		closed:      make(chan struct{}),
+	}
+
+	recorded := rec.Streams()
+	ids := make([]int, 0, len(recorded))
+	for id := range recorded {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		s := &StreamReport{
+			Stream:     uint8(id),
+			Name:       recorded[uint8(id)],
+			Expected:   len(rec.Stream(uint8(id), recording.EventOut)),
+			DivergedAt: -1,
+		}
+		n.streams = append(n.streams, s)
+	}
+	report.Streams = n.streams
+	n.opened = make(chan struct{}, len(n.streams))
+
+	return n
+}
+
+// open hands out a connection standing in for the next recorded stream.
+func (n *replayedNetwork) open(name string) (net.Conn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.next >= len(n.streams) {
+		n.report.UnexpectedDials++
+		return nil, fmt.Errorf("water: no recorded stream left for %s", name)
+	}
+	s := n.streams[n.next]
+	n.next++
+	s.ReplayedName = name
+	n.opened <- struct{}{}
+
+	watmConn, hostConn, err := socket.TCPConnPair()
+	if err != nil && (watmConn == nil || hostConn == nil) {
+		return nil, err
+	}
+	n.conns = append(n.conns, watmConn, hostConn)
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		drive(hostConn, n.rec.Stream(s.Stream, recording.EventIn),
+			n.rec.Stream(s.Stream, recording.EventOut), s, n.idleTimeout)
+	}()
+
+	return watmConn, nil
+}
+
+func (n *replayedNetwork) dial(network, address string) (net.Conn, error) {
+	return n.open(network + " " + address)
+}
+
+// listener returns a net.Listener accepting one connection per recorded
+// stream, then blocking until closed.
+func (n *replayedNetwork) listener() net.Listener {
+	return &replayedListener{n: n}
+}
+
+// acceptOnce returns a net.Listener accepting the first recorded stream,
+// then blocking until closed, as a Relay accepts one connection per WATM.
+func (n *replayedNetwork) acceptOnce() net.Listener {
+	return &replayedListener{n: n, once: true}
+}
+
+// waitOpened blocks until count streams were opened, or none was for
+// the idle timeout.
+func (n *replayedNetwork) waitOpened(count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-n.opened:
+		case <-time.After(n.idleTimeout):
+			return
+		}
+	}
+}
+
+// wait blocks until all network streams are done.
+func (n *replayedNetwork) wait() {
+	n.wg.Wait()
+
+	// streams never opened are reported as diverged at offset 0
+	for _, s := range n.streams {
+		if s.ReplayedName == "" && s.DivergedAt < 0 {
+			s.DivergedAt = 0
+		}
+	}
+}
+
+func (n *replayedNetwork) close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	select {
+	case <-n.closed:
+	default:
+		close(n.closed)
+	}
+	for _, c := range n.conns {
+		c.Close()
+	}
+}
+
+type replayedListener struct {
+	n    *replayedNetwork
+	once bool // accept only the first stream
+}
+
+func (l *replayedListener) Accept() (net.Conn, error) {
+	l.n.mutex.Lock()
+	remaining := l.n.next < len(l.n.streams) && (!l.once || l.n.next == 0)
+	var name string
+	if remaining {
+		name = l.n.streams[l.n.next].Name
+	}
+	l.n.mutex.Unlock()
+
+	if !remaining {
+		<-l.n.closed
+		return nil, net.ErrClosed
+	}
+
+	return l.n.open(name)
+}
+
+func (l *replayedListener) Close() error {
+	l.n.close()
+	return nil
+}
+
+func (*replayedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// replayedClocks serves the recorded random bytes and clock readings.
+type replayedClocks struct {
+	report *Report
+
+	mutex     sync.Mutex
+	randBytes *bytes.Reader
+	walltimes [][2]int64
+	nanotimes []int64
+}
+
+func newReplayedClocks(rec *recording.Recording, report *Report) (*replayedClocks, error) {
+	c := &replayedClocks{
+		report:    report,
+		randBytes: bytes.NewReader(rec.Stream(recording.StreamCaller, recording.EventRand)),
+	}
+	report.RandRecorded = c.randBytes.Len()
+
+	for i := range rec.Events {
+		e := &rec.Events[i]
+		switch e.Type {
+		case recording.EventWalltime:
+			sec, nsec, err := e.Walltime()
+			if err != nil {
+				return nil, err
+			}
+			c.walltimes = append(c.walltimes, [2]int64{sec, int64(nsec)})
+		case recording.EventNanotime:
+			ns, err := e.Nanotime()
+			if err != nil {
+				return nil, err
+			}
+			c.nanotimes = append(c.nanotimes, ns)
+		}
+	}
+	report.WalltimeRecorded = len(c.walltimes)
+	report.NanotimeRecorded = len(c.nanotimes)
+
+	return c, nil
+}
+
+func (c *replayedClocks) rand() io.Reader {
+	return readerFunc(func(b []byte) (int, error) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		n, _ := c.randBytes.Read(b)
+		clear(b[n:]) // zeroes once the recording is exhausted
+		c.report.RandReplayed += len(b)
+		return len(b), nil
+	})
+}
+
+// walltime replays the recorded readings, then keeps returning the last.
+func (c *replayedClocks) walltime() (sec int64, nsec int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	i := c.report.WalltimeReplayed
+	c.report.WalltimeReplayed++
+	switch {
+	case i < len(c.walltimes):
+		return c.walltimes[i][0], int32(c.walltimes[i][1])
+	case len(c.walltimes) > 0:
+		last := c.walltimes[len(c.walltimes)-1]
+		return last[0], int32(last[1])
+	default:
+		return 0, 0
+	}
+}
+
+// nanotime replays the recorded readings, then keeps ticking a
+// nanosecond per reading so that the clock stays monotonic.
+func (c *replayedClocks) nanotime() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	i := c.report.NanotimeReplayed
+	c.report.NanotimeReplayed++
+	switch {
+	case i < len(c.nanotimes):
+		return c.nanotimes[i]
+	case len(c.nanotimes) > 0:
+		return c.nanotimes[len(c.nanotimes)-1] + int64(i-len(c.nanotimes)+1)
+	default:
+		return int64(i)
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
@@ -0,0 +1,276 @@
+package replay_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
+	"github.com/refraction-networking/water/recording/replay"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+func TestReplayer_Run(t *testing.T) {
+	wasmReverse, err := os.ReadFile("../../transport/v1/testdata/reverse.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wasmPlain, err := os.ReadFile("../../transport/v1/testdata/plain.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := recordDialerSession(t, wasmReverse)
+
+	t.Run("recording", func(t *testing.T) {
+		if rec.Header.Role != recording.RoleDialer {
+			t.Errorf("role = %s, want %s", rec.Header.Role, recording.RoleDialer)
+		}
+		if got := rec.Stream(recording.StreamCaller, recording.EventIn); !bytes.Equal(got, []byte("hello")) {
+			t.Errorf("caller input = %q, want %q", got, "hello")
+		}
+		if got := rec.Stream(1, recording.EventOut); !bytes.Equal(got, []byte("olleh")) {
+			t.Errorf("network output = %q, want %q", got, "olleh")
+		}
+		if got := rec.Stream(recording.StreamCaller, recording.EventOut); !bytes.Equal(got, []byte("hello")) {
+			t.Errorf("caller output = %q, want %q", got, "hello")
+		}
+	})
+
+	t.Run("same module", func(t *testing.T) {
+		r := &replay.Replayer{ModuleBin: wasmReverse, IdleTimeout: 200 * time.Millisecond}
+		report, err := r.Run(context.Background(), rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("report:\n%s", report)
+
+		if !report.ModuleMatches {
+			t.Errorf("module should match")
+		}
+		for _, s := range report.Streams {
+			if s.Diverged() {
+				t.Errorf("stream %d (%s) diverged at %d", s.Stream, s.Name, s.DivergedAt)
+			}
+		}
+	})
+
+	t.Run("different module", func(t *testing.T) {
+		r := &replay.Replayer{ModuleBin: wasmPlain, IdleTimeout: 200 * time.Millisecond}
+		report, err := r.Run(context.Background(), rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("report:\n%s", report)
+
+		if report.ModuleMatches {
+			t.Errorf("module should not match")
+		}
+		if !report.Diverged() {
+			t.Fatalf("replay with a different module should diverge")
+		}
+		if network := report.Streams[1]; network.DivergedAt != 0 {
+			t.Errorf("network stream diverged at %d, want 0", network.DivergedAt)
+		}
+	})
+}
+
+// recordDialerSession records a session of a Dialer sending "hello" to an
+// echo server through wasm.
+func recordDialerSession(t *testing.T, wasm []byte) *recording.Recording {
+	t.Helper()
+
+	tcpLis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLis.Close() // skipcq: GO-S2307
+
+	go func() {
+		conn, err := tcpLis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	recorder, err := recording.NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := v1.NewDialerWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasm,
+		SessionRecorder:    recorder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", tcpLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(recorder.Dir(), "*.waterrec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d recordings, want 1", len(files))
+	}
+
+	rec, err := recording.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestReplayer_RunRelay(t *testing.T) {
+	wasmReverse, err := os.ReadFile("../../transport/v1/testdata/reverse.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := recordRelaySession(t, wasmReverse)
+	if rec.Header.Role != recording.RoleRelay {
+		t.Fatalf("role = %s, want %s", rec.Header.Role, recording.RoleRelay)
+	}
+
+	r := &replay.Replayer{ModuleBin: wasmReverse, IdleTimeout: 200 * time.Millisecond}
+	report, err := r.Run(context.Background(), rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("report:\n%s", report)
+
+	if len(report.Streams) != 3 {
+		t.Fatalf("got %d streams, want caller, accepted and dialed", len(report.Streams))
+	}
+	for _, s := range report.Streams {
+		if s.Diverged() {
+			t.Errorf("stream %d (%s) diverged at %d", s.Stream, s.Name, s.DivergedAt)
+		}
+	}
+	if dialed := report.Streams[2]; dialed.Expected != 5 || dialed.Replayed != 5 {
+		t.Errorf("dialed stream replayed %d/%d bytes, want 5/5", dialed.Replayed, dialed.Expected)
+	}
+}
+
+// recordRelaySession records a session of a Relay relaying "hello" from a
+// client to a server through wasm.
+func recordRelaySession(t *testing.T, wasm []byte) *recording.Recording {
+	t.Helper()
+
+	backend, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close() // skipcq: GO-S2307
+
+	recorder, err := recording.NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := v1.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasm,
+		NetworkListener:    lis,
+		SessionRecorder:    recorder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = relay.RelayTo("tcp", backend.Addr().String())
+	}()
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // skipcq: GO-S2307
+	server, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close() // skipcq: GO-S2307
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = relay.Shutdown(ctx) // closes the session, finishing its recording
+
+	files, err := filepath.Glob(filepath.Join(recorder.Dir(), "*.waterrec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		rec, err := recording.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Streams()) > 0 { // the next WATM, waiting to accept, has none
+			return rec
+		}
+	}
+	t.Fatalf("no recording of the relayed session among %d", len(files))
+	return nil
+}
+
+func TestRead_Corrupt(t *testing.T) {
+	wasmPlain, err := os.ReadFile("../../transport/v1/testdata/plain.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := recording.NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := recorder.NewSession(recording.RoleDialer, wasmPlain, []byte("config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+	valid, err := os.ReadFile(session.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an event claiming a payload of 2^62 bytes
+	corrupt := append(valid, byte(recording.EventIn), 1, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3f)
+
+	if _, err := recording.Read(bytes.NewReader(corrupt)); !errors.Is(err, recording.ErrBadRecording) {
+		t.Errorf("Read() = %v, want %v", err, recording.ErrBadRecording)
+	}
+}
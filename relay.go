@@ -41,9 +41,30 @@ type Relay interface {
 	// If no address is available, instead of panicking it returns nil.
 	Addr() net.Addr
 
+	// UpdateTransportConfig replaces the TransportModuleConfig used for
+	// connections relayed from now on, and pushes the new config to the
+	// live connections so WATMs that opt in can apply it in place.
+	UpdateTransportConfig(config []byte) error
+
+	// Shutdown closes the relay like Close, then waits for its live
+	// sessions to end, and closes them. If ctx is done first, the
+	// remaining sessions are closed and the error of ctx is returned.
+	Shutdown(ctx context.Context) error
+
+	// Sessions returns the live sessions of the relay.
+	Sessions() []RelaySession
+
 	mustEmbedUnimplementedRelay()
 }
 
+// RelaySession describes a live session of a [Relay], i.e., a connection
+// accepted and being relayed.
+type RelaySession struct {
+	ID         uint64 `json:"id"`          // session number, as logged
+	LocalAddr  string `json:"local_addr"`  // address the connection was accepted on
+	RemoteAddr string `json:"remote_addr"` // address of the client
+}
+
 type newRelayFunc func(context.Context, *Config) (Relay, error)
 
 var (
@@ -82,6 +103,21 @@ func (*UnimplementedRelay) Addr() net.Addr {
 	return nil
 }
 
+// UpdateTransportConfig implements Relay.UpdateTransportConfig().
+func (*UnimplementedRelay) UpdateTransportConfig(_ []byte) error {
+	return ErrUnimplementedRelay
+}
+
+// Shutdown implements Relay.Shutdown().
+func (*UnimplementedRelay) Shutdown(_ context.Context) error {
+	return ErrUnimplementedRelay
+}
+
+// Sessions implements Relay.Sessions().
+func (*UnimplementedRelay) Sessions() []RelaySession {
+	return nil
+}
+
 // mustEmbedUnimplementedRelay is a function that developers cannot
 // manually implement. It is used to ensure forward compatibility of
 // the Relay interface.
@@ -115,7 +151,8 @@ func NewRelay(c *Config) (Relay, error) {
 // the given [context.Context].
 //
 // It automatically detects the version of the WebAssembly Transport
-// Module specified in the config.
+// Module specified in the config, unless [Config.NativeTransport] selects
+// a native transport or [Config.Chain] stacks several transports.
 //
 // The context is passed to [NewCoreWithContext] and the registered versioned
 // relay creation function to control the lifetime of the call to function
@@ -125,6 +162,17 @@ func NewRelay(c *Config) (Relay, error) {
 // Call [WazeroRuntimeConfigFactory.SetCloseOnContextDone] with false to disable
 // this behavior.
 func NewRelayWithContext(ctx context.Context, c *Config) (Relay, error) {
+	if c != nil && len(c.Chain) > 0 {
+		return newChainRelay(ctx, c)
+	}
+
+	if c != nil && c.NativeTransport != "" {
+		if f, ok := knownRelayVersions[NativeVersion]; ok {
+			return f(ctx, c)
+		}
+		return nil, ErrRelayVersionNotFound
+	}
+
 	core, err := NewCoreWithContext(ctx, c)
 	if err != nil {
 		return nil, err
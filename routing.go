@@ -0,0 +1,392 @@
+package water
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/refraction-networking/water/configbuilder"
+)
+
+// RouteDirect is the name of the route dialing destinations directly,
+// without any transport, in the "routing" section of a JSON or protobuf
+// config.
+const RouteDirect = "direct"
+
+// RoutingTable maps destinations to the transport used to reach them.
+type RoutingTable struct {
+	// Rules are matched in order, the first matching rule wins.
+	Rules []RoutingRule
+
+	// Default is the Config of the transport used when no rule matches.
+	// If nil, such destinations are dialed directly.
+	Default *Config
+
+	// DirectDialerFunc dials the destinations routed directly. If nil, a
+	// zero [net.Dialer] is used.
+	DirectDialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// RoutingRule routes the destinations matching all of its non-empty
+// criteria to a transport.
+type RoutingRule struct {
+	// DomainSuffixes matches addresses whose host is one of the domains,
+	// or a subdomain of one of them. Matching is case-insensitive.
+	DomainSuffixes []string
+
+	// CIDRs matches addresses whose host is an IP address within one of
+	// the prefixes. Domain names are not resolved for matching.
+	CIDRs []netip.Prefix
+
+	// Ports matches addresses with one of the ports.
+	Ports []uint16
+
+	// Networks matches the named networks. A network also matches its
+	// IPv4-only and IPv6-only variants, e.g., "tcp" matches "tcp4".
+	Networks []string
+
+	// Config is the Config of the transport used for matching
+	// destinations. If nil, they are dialed directly.
+	Config *Config
+}
+
+// Clone creates a deep copy of the RoutingTable. Rules routed to the same
+// Config are still routed to the same Config in the copy.
+func (t *RoutingTable) Clone() *RoutingTable {
+	if t == nil {
+		return nil
+	}
+
+	configs := make(map[*Config]*Config)
+	clone := func(c *Config) *Config {
+		if c == nil {
+			return nil
+		}
+		if cloned, ok := configs[c]; ok {
+			return cloned
+		}
+		configs[c] = c.Clone()
+		return configs[c]
+	}
+
+	table := &RoutingTable{
+		Default:          clone(t.Default),
+		DirectDialerFunc: t.DirectDialerFunc,
+	}
+	for _, rule := range t.Rules {
+		table.Rules = append(table.Rules, RoutingRule{
+			DomainSuffixes: slices.Clone(rule.DomainSuffixes),
+			CIDRs:          slices.Clone(rule.CIDRs),
+			Ports:          slices.Clone(rule.Ports),
+			Networks:       slices.Clone(rule.Networks),
+			Config:         clone(rule.Config),
+		})
+	}
+	return table
+}
+
+// Match returns the Config of the transport to reach address on the named
+// network through, or nil if it is to be dialed directly.
+func (t *RoutingTable) Match(network, address string) (*Config, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("water: invalid port %q: %w", portStr, err)
+	}
+
+	dst := routingDestination{
+		network: network,
+		host:    strings.ToLower(strings.TrimSuffix(host, ".")),
+		port:    uint16(port),
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		dst.ip = ip.Unmap()
+	}
+
+	for i := range t.Rules {
+		if t.Rules[i].matches(&dst) {
+			return t.Rules[i].Config, nil
+		}
+	}
+	return t.Default, nil
+}
+
+type routingDestination struct {
+	network string
+	host    string
+	ip      netip.Addr // invalid if host is a domain
+	port    uint16
+}
+
+func (r *RoutingRule) matches(dst *routingDestination) bool {
+	if len(r.Networks) > 0 && !matchesAny(r.Networks, func(network string) bool {
+		return dst.network == network || dst.network == network+"4" || dst.network == network+"6"
+	}) {
+		return false
+	}
+
+	if len(r.Ports) > 0 && !matchesAny(r.Ports, func(port uint16) bool {
+		return dst.port == port
+	}) {
+		return false
+	}
+
+	if len(r.DomainSuffixes) > 0 && (dst.ip.IsValid() || !matchesAny(r.DomainSuffixes, func(suffix string) bool {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		return dst.host == suffix || strings.HasSuffix(dst.host, "."+suffix)
+	})) {
+		return false
+	}
+
+	if len(r.CIDRs) > 0 && (!dst.ip.IsValid() || !matchesAny(r.CIDRs, func(prefix netip.Prefix) bool {
+		return prefix.Contains(dst.ip)
+	})) {
+		return false
+	}
+
+	return true
+}
+
+func matchesAny[T any](criteria []T, match func(T) bool) bool {
+	for _, c := range criteria {
+		if match(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingDialer is a [Dialer] picking a transport per destination
+// following a [RoutingTable].
+//
+// The Dialer of every transport is created on first use and reused for
+// later destinations routed to the same Config.
+type RoutingDialer struct {
+	table *RoutingTable
+	ctx   context.Context
+
+	dialersMutex sync.Mutex
+	dialers      map[*Config]Dialer
+
+	UnimplementedDialer // embedded to ensure forward compatibility
+}
+
+var (
+	ErrRoutingTableNotSet = errors.New("water: routing table is not set")
+
+	_ Dialer = (*RoutingDialer)(nil) // type guard
+)
+
+// NewRoutingDialerWithContext creates a new [RoutingDialer] following
+// table.
+//
+// The context is passed to [NewDialerWithContext] when creating the Dialer
+// of a transport. The context SHOULD be used as the default context for
+// call to [RoutingDialer.Dial].
+func NewRoutingDialerWithContext(ctx context.Context, table *RoutingTable) (*RoutingDialer, error) {
+	if table == nil {
+		return nil, ErrRoutingTableNotSet
+	}
+
+	return &RoutingDialer{
+		table:   table,
+		ctx:     ctx,
+		dialers: make(map[*Config]Dialer),
+	}, nil
+}
+
+// Dial implements [Dialer].
+func (d *RoutingDialer) Dial(network, address string) (Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+// DialContext dials address on the named network through the transport
+// the routing table picks for it, or directly.
+//
+// Implements [Dialer].
+func (d *RoutingDialer) DialContext(ctx context.Context, network, address string) (Conn, error) {
+	config, err := d.table.Match(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		dial := d.table.DirectDialerFunc
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &directConn{Conn: conn}, nil
+	}
+
+	dialer, err := d.dialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// UpdateTransportConfig is not supported by a RoutingDialer since every
+// transport expects a config of its own.
+//
+// Implements [Dialer].
+func (*RoutingDialer) UpdateTransportConfig(_ []byte) error {
+	return fmt.Errorf("water: routing dialer routes to several transports: %w", ErrUnimplementedDialer)
+}
+
+func (d *RoutingDialer) dialer(config *Config) (Dialer, error) {
+	d.dialersMutex.Lock()
+	defer d.dialersMutex.Unlock()
+
+	if dialer, ok := d.dialers[config]; ok {
+		return dialer, nil
+	}
+
+	dialer, err := NewDialerWithContext(d.ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	d.dialers[config] = dialer
+	return dialer, nil
+}
+
+// directConn is a connection dialed directly by a RoutingDialer.
+type directConn struct {
+	net.Conn
+
+	UnimplementedConn // embedded to ensure forward compatibility
+}
+
+func hasRoutingJSON(confJson *configbuilder.ConfigJSON) bool {
+	r := &confJson.Routing
+	return len(r.Routes) > 0 || len(r.Rules) > 0 || r.DefaultRoute != ""
+}
+
+func routingTableFromJSON(confJson *configbuilder.ConfigJSON) (*RoutingTable, error) {
+	routes := make(map[string]*Config, len(confJson.Routing.Routes))
+	for name, routeJson := range confJson.Routing.Routes {
+		if name == RouteDirect {
+			return nil, fmt.Errorf("water: route name %q is reserved", RouteDirect)
+		}
+
+		route := &Config{}
+		if err := route.unmarshalConfigJSON(&routeJson); err != nil {
+			return nil, fmt.Errorf("water: route %q: %w", name, err)
+		}
+		routes[name] = route
+	}
+
+	table := &RoutingTable{}
+	for i, ruleJson := range confJson.Routing.Rules {
+		config, err := lookupRoute(routes, ruleJson.Route)
+		if err != nil {
+			return nil, fmt.Errorf("water: routing rule %d: %w", i, err)
+		}
+		rule := RoutingRule{
+			DomainSuffixes: ruleJson.DomainSuffixes,
+			Ports:          ruleJson.Ports,
+			Networks:       ruleJson.Networks,
+			Config:         config,
+		}
+		rule.CIDRs, err = parsePrefixes(ruleJson.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("water: routing rule %d: %w", i, err)
+		}
+		table.Rules = append(table.Rules, rule)
+	}
+
+	var err error
+	table.Default, err = lookupRoute(routes, confJson.Routing.DefaultRoute)
+	if err != nil {
+		return nil, fmt.Errorf("water: default route: %w", err)
+	}
+	return table, nil
+}
+
+func hasRoutingProto(confProto *configbuilder.ConfigProtoBuf) bool {
+	return confProto.GetRouting() != nil
+}
+
+func routingTableFromProto(confProto *configbuilder.ConfigProtoBuf) (*RoutingTable, error) {
+	routes := make(map[string]*Config, len(confProto.GetRouting().GetRoutes()))
+	for name, routeProto := range confProto.GetRouting().GetRoutes() {
+		if name == RouteDirect {
+			return nil, fmt.Errorf("water: route name %q is reserved", RouteDirect)
+		}
+
+		route := &Config{}
+		if err := route.unmarshalConfigProto(routeProto); err != nil {
+			return nil, fmt.Errorf("water: route %q: %w", name, err)
+		}
+		routes[name] = route
+	}
+
+	table := &RoutingTable{}
+	for i, ruleProto := range confProto.GetRouting().GetRules() {
+		config, err := lookupRoute(routes, ruleProto.GetRoute())
+		if err != nil {
+			return nil, fmt.Errorf("water: routing rule %d: %w", i, err)
+		}
+		rule := RoutingRule{
+			DomainSuffixes: ruleProto.GetDomainSuffixes(),
+			Networks:       ruleProto.GetNetworks(),
+			Config:         config,
+		}
+		for _, port := range ruleProto.GetPorts() {
+			if port > 0xFFFF {
+				return nil, fmt.Errorf("water: routing rule %d: invalid port %d", i, port)
+			}
+			rule.Ports = append(rule.Ports, uint16(port))
+		}
+		rule.CIDRs, err = parsePrefixes(ruleProto.GetCidrs())
+		if err != nil {
+			return nil, fmt.Errorf("water: routing rule %d: %w", i, err)
+		}
+		table.Rules = append(table.Rules, rule)
+	}
+
+	var err error
+	table.Default, err = lookupRoute(routes, confProto.GetRouting().GetDefaultRoute())
+	if err != nil {
+		return nil, fmt.Errorf("water: default route: %w", err)
+	}
+	return table, nil
+}
+
+// lookupRoute returns the Config of the named route, or nil for the
+// direct route, which is also the default if name is empty.
+func lookupRoute(routes map[string]*Config, name string) (*Config, error) {
+	if name == "" || name == RouteDirect {
+		return nil, nil
+	}
+
+	config, ok := routes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown route %q", name)
+	}
+	return config, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
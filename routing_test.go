@@ -0,0 +1,189 @@
+package water_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/configbuilder/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRoutingTable_Match(t *testing.T) {
+	a := &water.Config{NativeTransport: "multi-ok"}
+	b := &water.Config{NativeTransport: "multi-ok"}
+	table := &water.RoutingTable{
+		Rules: []water.RoutingRule{
+			{DomainSuffixes: []string{".example.com"}, Config: a},
+			{CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Ports: []uint16{443}, Config: b},
+			{Networks: []string{"udp"}, Config: nil},
+			{Ports: []uint16{53}, Config: a},
+		},
+		Default: b,
+	}
+
+	for _, tc := range []struct {
+		network, address string
+		want             *water.Config
+	}{
+		{"tcp", "example.com:80", a},
+		{"tcp", "WWW.Example.COM.:80", a},
+		{"tcp", "notexample.com:80", b},
+		{"tcp", "10.1.2.3:443", b},
+		{"tcp", "[::ffff:10.1.2.3]:443", b},
+		{"udp", "10.1.2.3:53", nil},
+		{"udp6", "[2001:db8::1]:53", nil},
+		{"tcp4", "192.0.2.1:53", a},
+		{"tcp", "192.0.2.1:80", b},
+	} {
+		got, err := table.Match(tc.network, tc.address)
+		if err != nil {
+			t.Errorf("Match(%s, %s): %v", tc.network, tc.address, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Match(%s, %s) = %p, want %p", tc.network, tc.address, got, tc.want)
+		}
+	}
+
+	if _, err := table.Match("tcp", "example.com"); err == nil {
+		t.Error("Match succeeded without a port")
+	}
+}
+
+func TestRoutingDialer(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	table := &water.RoutingTable{
+		Rules: []water.RoutingRule{
+			{DomainSuffixes: []string{"blocked.test"}, Config: &water.Config{NativeTransport: "multi-fail"}},
+			{DomainSuffixes: []string{"localhost"}, Config: &water.Config{NativeTransport: "multi-ok"}},
+		},
+		DirectDialerFunc: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, lis.Addr().String())
+		},
+	}
+	d, err := water.NewRoutingDialerWithContext(context.Background(), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{
+		net.JoinHostPort("localhost", port),   // through multi-ok
+		net.JoinHostPort("127.0.0.1", port),   // direct
+		net.JoinHostPort("direct.test", port), // direct, to lis whatever the address
+	} {
+		conn, err := d.DialContext(context.Background(), "tcp", address)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", address, err)
+		}
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := conn.Read(buf); err != nil || string(buf) != "ping" {
+			t.Errorf("dialing %s: echoed %q, %v", address, buf, err)
+		}
+		_ = conn.Close()
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("www.blocked.test", port)); err == nil {
+		t.Error("routed to multi-fail but succeeded")
+	}
+
+	if _, err := water.NewRoutingDialerWithContext(context.Background(), nil); err != water.ErrRoutingTableNotSet {
+		t.Errorf("nil table: err = %v, want %v", err, water.ErrRoutingTableNotSet)
+	}
+}
+
+func TestConfig_Routing(t *testing.T) {
+	t.Run("JSON", testConfigRoutingJSON)
+	t.Run("Protobuf", testConfigRoutingProto)
+}
+
+func checkRoutingTable(t *testing.T, table *water.RoutingTable) {
+	t.Helper()
+
+	if table == nil {
+		t.Fatal("Routing is not set")
+	}
+	if len(table.Rules) != 2 {
+		t.Fatalf("%d rules, want 2", len(table.Rules))
+	}
+	if table.Rules[0].Config == nil || table.Rules[0].Config.NativeTransport != "multi-ok" {
+		t.Errorf("rule 0 does not route to A")
+	}
+	if table.Rules[0].Config != table.Default {
+		t.Errorf("rule 0 and the default route A to different Configs")
+	}
+	if table.Rules[1].Config != nil {
+		t.Errorf("rule 1 is not direct")
+	}
+
+	for _, tc := range []struct {
+		address string
+		direct  bool
+	}{
+		{"www.example.com:443", false},
+		{"10.0.0.1:22", true},
+		{"10.0.0.1:23", false},
+	} {
+		config, err := table.Match("tcp", tc.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (config == nil) != tc.direct {
+			t.Errorf("Match(%s) = %v, want direct = %v", tc.address, config, tc.direct)
+		}
+	}
+}
+
+func testConfigRoutingJSON(t *testing.T) {
+	var c water.Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {},
+		"routing": {
+			"routes": {"a": {"transport_module": {"native": "multi-ok"}}},
+			"rules": [
+				{"domain_suffixes": ["example.com"], "route": "a"},
+				{"cidrs": ["10.0.0.0/8"], "ports": [22], "networks": ["tcp"], "route": "direct"}
+			],
+			"default_route": "a"
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoutingTable(t, c.Routing)
+
+	err = (&water.Config{}).UnmarshalJSON([]byte(`{"transport_module": {}, "routing": {"rules": [{"route": "missing"}]}}`))
+	if err == nil {
+		t.Error("unknown route accepted")
+	}
+}
+
+func testConfigRoutingProto(t *testing.T) {
+	b, err := proto.Marshal(&pb.Config{
+		Routing: &pb.Routing{
+			Routes: map[string]*pb.Config{
+				"a": {TransportModule: &pb.TransportModule{Native: "multi-ok"}},
+			},
+			Rules: []*pb.RoutingRule{
+				{DomainSuffixes: []string{"example.com"}, Route: "a"},
+				{Cidrs: []string{"10.0.0.0/8"}, Ports: []uint32{22}, Networks: []string{"tcp"}, Route: "direct"},
+			},
+			DefaultRoute: "a",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c water.Config
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	checkRoutingTable(t, c.Routing)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+
+	"github.com/refraction-networking/water/internal/socket"
 )
 
 // InsertConn implements Core.
@@ -12,20 +14,26 @@ func (c *core) InsertConn(conn net.Conn) (fd int32, err error) {
 		return 0, fmt.Errorf("water: cannot insert TCPConn before instantiation")
 	}
 
-	switch conn := conn.(type) {
-	case *net.TCPConn:
-		key, ok := c.instance.InsertTCPConn(conn)
-		if !ok {
-			return 0, fmt.Errorf("water: (*wazero.Module).InsertTCPConn returned false")
-		}
-		if key <= 0 {
-			return key, fmt.Errorf("water: (*wazero.Module).InsertTCPConn returned invalid key")
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		// Only TCPConns can be inserted, so any other connection (e.g., a
+		// Conn of another WATM) is bridged through a pair of TCPConns.
+		// Closing either end closes the other.
+		var err error
+		tcpConn, _, err = socket.TCPConnWrap(conn)
+		if err != nil {
+			return 0, fmt.Errorf("water: bridging %T to a TCPConn: %w", conn, err)
 		}
-		return key, nil
-	default:
-		// TODO: support other types of connections as much as possible
-		return 0, fmt.Errorf("water: unsupported connection type: %T", conn)
 	}
+
+	key, ok := c.instance.InsertTCPConn(tcpConn)
+	if !ok {
+		return 0, fmt.Errorf("water: (*wazero.Module).InsertTCPConn returned false")
+	}
+	if key <= 0 {
+		return key, fmt.Errorf("water: (*wazero.Module).InsertTCPConn returned invalid key")
+	}
+	return key, nil
 }
 
 // InsertListener implements Core.
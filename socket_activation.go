@@ -0,0 +1,183 @@
+package water
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation, SD_LISTEN_FDS_START.
+var listenFdsStart = 3
+
+var ErrNoSystemdListeners = errors.New("water: no listener passed by systemd socket activation")
+
+// inheritedFiles keeps the inherited file descriptors turned into
+// listeners open, so that they can be turned into listeners again, e.g.,
+// by every route of a config.
+var inheritedFiles struct {
+	mutex sync.Mutex
+	files map[int]*os.File
+}
+
+// ListenerFromFd returns a listener on the socket of the file descriptor
+// fd inherited from the parent process, e.g., bound to a privileged port
+// before dropping privileges. Every call returns a new listener, which
+// can be closed independently. On Unix, fd is no longer inherited by the
+// processes started from then on.
+func ListenerFromFd(fd int) (net.Listener, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("water: invalid file descriptor %d", fd)
+	}
+
+	inheritedFiles.mutex.Lock()
+	f, ok := inheritedFiles.files[fd]
+	if !ok {
+		// kept even if not a listener, not to be closed by its finalizer
+		// once the descriptor is reused
+		closeOnExec(fd)
+		f = os.NewFile(uintptr(fd), "water-inherited-"+strconv.Itoa(fd))
+		if inheritedFiles.files == nil {
+			inheritedFiles.files = make(map[int]*os.File)
+		}
+		inheritedFiles.files[fd] = f
+	}
+	inheritedFiles.mutex.Unlock()
+
+	lis, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("water: file descriptor %d: %w", fd, err)
+	}
+	return lis, nil
+}
+
+// systemdFdsTaken keeps the file descriptors passed by systemd socket
+// activation, once taken from the environment.
+var systemdFdsTaken struct {
+	mutex sync.Mutex
+	fds   []systemdFd
+}
+
+// SystemdListeners returns the listeners passed to this process by systemd
+// socket activation, following LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES,
+// by the FileDescriptorName of their socket units. Sockets without a
+// name, including all of them unless LISTEN_FDNAMES names every one, are
+// under "unknown". These variables are unset once the sockets are taken,
+// so that child processes do not inherit them.
+//
+// It returns ErrNoSystemdListeners if none was passed to this process.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	fds, err := systemdFds()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make(map[string][]net.Listener)
+	for _, fd := range fds {
+		lis, err := ListenerFromFd(fd.fd)
+		if err != nil {
+			for _, named := range listeners {
+				for _, lis := range named {
+					_ = lis.Close()
+				}
+			}
+			return nil, err
+		}
+		listeners[fd.name] = append(listeners[fd.name], lis)
+	}
+	return listeners, nil
+}
+
+// systemdListener returns the listener passed by systemd socket activation
+// under name, or the only one passed if name is empty.
+func systemdListener(name string) (net.Listener, error) {
+	fds, err := systemdFds()
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		if len(fds) != 1 {
+			return nil, fmt.Errorf("water: %d listeners passed by systemd socket activation, select one by name", len(fds))
+		}
+		return ListenerFromFd(fds[0].fd)
+	}
+
+	for _, fd := range fds {
+		if fd.name == name {
+			return ListenerFromFd(fd.fd)
+		}
+	}
+	return nil, fmt.Errorf("%w: no socket named %q", ErrNoSystemdListeners, name)
+}
+
+type systemdFd struct {
+	fd   int
+	name string
+}
+
+// systemdFds returns the file descriptors passed by systemd socket
+// activation. Like sd_listen_fds with unset_environment, the first call
+// taking them unsets LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, and keeps
+// the file descriptors from being inherited further.
+func systemdFds() ([]systemdFd, error) {
+	systemdFdsTaken.mutex.Lock()
+	defer systemdFdsTaken.mutex.Unlock()
+	if systemdFdsTaken.fds != nil {
+		return systemdFdsTaken.fds, nil
+	}
+
+	fds, err := parseSystemdFds()
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(env)
+	}
+	systemdFdsTaken.fds = fds
+	return fds, nil
+}
+
+// parseSystemdFds parses the environment set by systemd socket activation.
+func parseSystemdFds() ([]systemdFd, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() { // unset, or meant for another process
+		return nil, ErrNoSystemdListeners
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, ErrNoSystemdListeners
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	fds := make([]systemdFd, n)
+	for i := range fds {
+		closeOnExec(listenFdsStart + i)
+		fds[i] = systemdFd{fd: listenFdsStart + i, name: "unknown"}
+		if len(names) == n && names[i] != "" {
+			fds[i].name = names[i]
+		}
+	}
+	return fds, nil
+}
+
+// listen returns the listener selected by the listener of a JSON or
+// protobuf config: the socket passed by systemd under systemdName if
+// systemd is set, the inherited file descriptor fd if not nil, even 0,
+// or else a new listener on network and address, if set.
+func listen(network, address string, fd *uint32, systemd bool, systemdName string) (net.Listener, error) {
+	switch {
+	case systemd || systemdName != "":
+		return systemdListener(systemdName)
+	case fd != nil:
+		return ListenerFromFd(int(*fd))
+	case len(network) > 0 && len(address) > 0:
+		return net.Listen(network, address)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,223 @@
+//go:build linux
+
+package water
+
+// package water instead of water_test to move listenFdsStart, as the file
+// descriptors from 3 on are already taken in a test process
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	pb "github.com/refraction-networking/water/configbuilder/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// inheritFd duplicates the file descriptor of a new TCP listener to fd, as
+// if inherited, and returns the address of the listener.
+func inheritFd(t *testing.T, fd int) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	f, err := lis.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() // skipcq: GO-S2307
+
+	dup, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_DUPFD, uintptr(fd))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if int(dup) != fd {
+		_ = syscall.Close(int(dup))
+		t.Fatalf("file descriptor %d is taken", fd)
+	}
+
+	t.Cleanup(func() {
+		inheritedFiles.mutex.Lock()
+		defer inheritedFiles.mutex.Unlock()
+		if f, ok := inheritedFiles.files[fd]; ok {
+			delete(inheritedFiles.files, fd)
+			_ = f.Close()
+		} else {
+			_ = syscall.Close(fd)
+		}
+	})
+	return lis.Addr().String()
+}
+
+// checkCloseOnExec checks that fd is not inherited by exec.
+func checkCloseOnExec(t *testing.T, fd int) {
+	t.Helper()
+
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if flags&syscall.FD_CLOEXEC == 0 {
+		t.Errorf("file descriptor %d inherited by exec", fd)
+	}
+}
+
+// checkListener checks that lis listens on address.
+func checkListener(t *testing.T, lis net.Listener, address string) {
+	t.Helper()
+
+	if lis == nil {
+		t.Fatal("no listener")
+	}
+	if lis.Addr().String() != address {
+		t.Fatalf("listening on %s, want %s", lis.Addr(), address)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	accepted, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = accepted.Close()
+}
+
+func TestListenerFromFd(t *testing.T) {
+	address := inheritFd(t, 900)
+
+	var c Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"listener": {"fd": 900}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.NetworkListener.Close() // skipcq: GO-S2307
+	checkListener(t, c.NetworkListener, address)
+	checkCloseOnExec(t, 900)
+
+	// the file descriptor stays usable
+	lis, err := ListenerFromFd(900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	checkListener(t, lis, address)
+
+	if _, err := ListenerFromFd(901); err == nil {
+		t.Error("listener from a closed file descriptor")
+	}
+}
+
+// setSystemdEnv sets the environment of systemd socket activation passing
+// n file descriptors named names to this process, not taken yet.
+func setSystemdEnv(t *testing.T, pid, n int, names string) {
+	t.Helper()
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(pid))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(n))
+	t.Setenv("LISTEN_FDNAMES", names)
+	resetSystemdFds := func() {
+		systemdFdsTaken.mutex.Lock()
+		systemdFdsTaken.fds = nil
+		systemdFdsTaken.mutex.Unlock()
+	}
+	resetSystemdFds()
+	t.Cleanup(resetSystemdFds)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = 910
+	relayAddress := inheritFd(t, 910)
+	adminAddress := inheritFd(t, 911)
+
+	t.Run("SystemdListeners", func(t *testing.T) {
+		setSystemdEnv(t, os.Getpid(), 2, "relay:admin")
+		listeners, err := SystemdListeners()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listeners["relay"]) != 1 || len(listeners["admin"]) != 1 {
+			t.Fatalf("SystemdListeners() = %v", listeners)
+		}
+		defer listeners["relay"][0].Close() // skipcq: GO-S2307
+		defer listeners["admin"][0].Close() // skipcq: GO-S2307
+		checkListener(t, listeners["relay"][0], relayAddress)
+		checkListener(t, listeners["admin"][0], adminAddress)
+		checkCloseOnExec(t, 910)
+		checkCloseOnExec(t, 911)
+
+		// not inherited by child processes, but still taken by this one
+		for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			if value, ok := os.LookupEnv(env); ok {
+				t.Errorf("%s=%s still set", env, value)
+			}
+		}
+		lis, err := systemdListener("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close() // skipcq: GO-S2307
+		checkListener(t, lis, adminAddress)
+	})
+
+	t.Run("named listener from protobuf", func(t *testing.T) {
+		setSystemdEnv(t, os.Getpid(), 2, "relay:admin")
+		b, err := proto.Marshal(&pb.Config{
+			TransportModule: &pb.TransportModule{Native: "plain"},
+			Network:         &pb.Network{Listener: &pb.Listener{SystemdName: "admin"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c Config
+		if err := c.UnmarshalProto(b); err != nil {
+			t.Fatal(err)
+		}
+		defer c.NetworkListener.Close() // skipcq: GO-S2307
+		checkListener(t, c.NetworkListener, adminAddress)
+	})
+
+	t.Run("unnamed listener among several", func(t *testing.T) {
+		setSystemdEnv(t, os.Getpid(), 2, "relay:admin")
+		err := (&Config{}).UnmarshalJSON([]byte(`{
+			"transport_module": {"native": "plain"},
+			"network": {"listener": {"systemd": true}}
+		}`))
+		if err == nil {
+			t.Error("picked one of several listeners")
+		}
+	})
+
+	t.Run("unnamed listener", func(t *testing.T) {
+		setSystemdEnv(t, os.Getpid(), 1, "")
+		var c Config
+		err := c.UnmarshalJSON([]byte(`{
+			"transport_module": {"native": "plain"},
+			"network": {"listener": {"systemd": true}}
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.NetworkListener.Close() // skipcq: GO-S2307
+		checkListener(t, c.NetworkListener, relayAddress)
+	})
+
+	t.Run("listeners of another process", func(t *testing.T) {
+		setSystemdEnv(t, os.Getppid(), 2, "relay:admin")
+		if _, err := SystemdListeners(); !errors.Is(err, ErrNoSystemdListeners) {
+			t.Errorf("SystemdListeners() = %v, want %v", err, ErrNoSystemdListeners)
+		}
+	})
+}
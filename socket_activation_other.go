@@ -0,0 +1,6 @@
+//go:build !unix
+
+package water
+
+// closeOnExec is a no-op where file descriptors are not inherited by exec.
+func closeOnExec(int) {}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package water
+
+import "syscall"
+
+// closeOnExec keeps the inherited file descriptor fd from leaking to the
+// processes this one starts, as sd_listen_fds does.
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
@@ -0,0 +1,149 @@
+package native
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/pcapng"
+)
+
+// ErrRecordingUnsupported is returned when a Config with a SessionRecorder
+// selects a native transport. Recordings can only be replayed against a
+// WATM.
+var ErrRecordingUnsupported = errors.New("water: session recording is not supported by native transports")
+
+// Conn is a connection wrapped by a [water.NativeTransport].
+//
+// Implements [water.Conn].
+type Conn struct {
+	net.Conn
+
+	transport water.NativeTransport
+	session   *pcapng.Session
+
+	closeOnce sync.Once
+	closeErr  error
+
+	untrackMutex sync.Mutex
+	untrack      func()
+	closed       bool
+
+	water.UnimplementedConn // embedded to ensure forward compatibility
+}
+
+// newTransport creates the native transport selected by config, checking
+// first that config can be used with it, and the capture session for it if
+// config.PacketCapture is set.
+func newTransport(config *water.Config) (water.NativeTransport, *pcapng.Session, error) {
+	if config.SessionRecorder != nil {
+		return nil, nil, ErrRecordingUnsupported
+	}
+
+	var tmConfig []byte
+	if config.TransportModuleConfig != nil {
+		tmConfig = config.TransportModuleConfig.AsBytes()
+	}
+
+	transport, err := water.NewNativeTransport(config.NativeTransport, tmConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("water: creating native transport %q: %w", config.NativeTransport, err)
+	}
+
+	if config.PacketCapture == nil {
+		return transport, nil, nil
+	}
+
+	session, err := config.PacketCapture.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	return transport, session, nil
+}
+
+// wrap wraps netConn with transport into a Conn. netConn is closed if it
+// fails.
+func wrap(transport water.NativeTransport, session *pcapng.Session, netConn net.Conn, role water.NativeRole) (*Conn, error) {
+	if session != nil {
+		if role == water.NativeRoleServer {
+			netConn = session.AcceptedConn(netConn)
+		} else {
+			netConn = session.DialedConn(netConn)
+		}
+	}
+
+	wrapped, err := transport.Wrap(netConn, role)
+	if err != nil {
+		_ = netConn.Close()
+		if session != nil {
+			_ = session.Close()
+		}
+		return nil, fmt.Errorf("water: native transport failed to wrap conn: %w", err)
+	}
+
+	if session != nil {
+		wrapped = session.CallerConn(wrapped)
+	}
+
+	return &Conn{
+		Conn:      wrapped,
+		transport: transport,
+		session:   session,
+	}, nil
+}
+
+// Close closes the connection.
+//
+// Implements [net.Conn].
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		if c.session != nil {
+			_ = c.session.Close() // unsafe: error is ignored
+		}
+
+		c.untrackMutex.Lock()
+		c.closed = true
+		untrack := c.untrack
+		c.untrackMutex.Unlock()
+		if untrack != nil {
+			untrack()
+		}
+	})
+	return c.closeErr
+}
+
+// setUntrack sets the func removing c from its connTracker once closed. It
+// returns false if c is already closed.
+func (c *Conn) setUntrack(untrack func()) bool {
+	c.untrackMutex.Lock()
+	defer c.untrackMutex.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.untrack = untrack
+	return true
+}
+
+// Transport returns the [water.NativeTransport] wrapping this connection.
+func (c *Conn) Transport() water.NativeTransport {
+	return c.transport
+}
+
+// updateTransportConfig passes the config to the transport if it accepts
+// live updates.
+func (c *Conn) updateTransportConfig(config water.TransportModuleConfig) error {
+	ct, ok := c.transport.(water.NativeConfigurableTransport)
+	if !ok {
+		return nil
+	}
+
+	var b []byte
+	if config != nil {
+		b = config.AsBytes()
+	}
+	return ct.Configure(b)
+}
@@ -0,0 +1,23 @@
+package native
+
+import (
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/conntrack"
+)
+
+// connTracker keeps track of the Conns handed out by a Dialer, FixedDialer,
+// Listener or Relay which are not yet closed.
+type connTracker struct {
+	conntrack.Tracker[*Conn]
+}
+
+func (ct *connTracker) track(c *Conn) {
+	ct.Track(c, c.setUntrack)
+}
+
+// updateTransportConfig pushes the config to every tracked Conn.
+func (ct *connTracker) updateTransportConfig(config water.TransportModuleConfig) error {
+	return ct.Each(func(c *Conn) error {
+		return c.updateTransportConfig(config)
+	})
+}
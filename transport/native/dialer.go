@@ -0,0 +1,137 @@
+package native
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/refraction-networking/water"
+)
+
+func init() {
+	err := water.RegisterWATMDialer(water.NativeVersion, NewDialerWithContext)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Dialer implements [water.Dialer] utilizing a [water.NativeTransport].
+type Dialer struct {
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
+
+	conns connTracker
+
+	water.UnimplementedDialer // embedded to ensure forward compatibility
+}
+
+// NewDialerWithContext creates a new [water.Dialer] from the given [water.Config]
+// with the given [context.Context].
+//
+// The context is used as the default context for call to [Dialer.Dial].
+func NewDialerWithContext(ctx context.Context, c *water.Config) (water.Dialer, error) {
+	return &Dialer{
+		config: c.Clone(),
+		ctx:    ctx,
+	}, nil
+}
+
+// Dial dials the network address using the dialerFunc specified in config.
+//
+// Implements [water.Dialer].
+func (d *Dialer) Dial(network, address string) (water.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+// DialContext dials the network address using the dialerFunc specified in
+// config and wraps the connection with the native transport.
+//
+// Unlike a WATM, the connection is not closed once the context is done:
+// the context only bounds the dial and the handshake of the transport.
+//
+// Implements [water.Dialer].
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (water.Conn, error) {
+	config := d.loadConfig()
+	if config == nil {
+		return nil, fmt.Errorf("water: dialing with nil config is not allowed")
+	}
+
+	return dialContext(ctx, func() (*Conn, error) {
+		transport, session, err := newTransport(config)
+		if err != nil {
+			return nil, err
+		}
+
+		netConn, err := config.NetworkDialerFuncOrDefault()(network, address)
+		if err != nil {
+			if session != nil {
+				_ = session.Close()
+			}
+			return nil, err
+		}
+
+		conn, err := wrap(transport, session, netConn, water.NativeRoleClient)
+		if err != nil {
+			return nil, err
+		}
+		d.conns.track(conn)
+		return conn, nil
+	})
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for new
+// connections and passes it to all live connections dialed by this Dialer
+// whose transport implements [water.NativeConfigurableTransport].
+//
+// Implements [water.Dialer].
+func (d *Dialer) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	d.configMutex.Lock()
+	if d.config == nil {
+		d.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := d.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	d.config = newConfig
+	d.configMutex.Unlock()
+
+	return d.conns.updateTransportConfig(tmConfig)
+}
+
+func (d *Dialer) loadConfig() *water.Config {
+	d.configMutex.RLock()
+	defer d.configMutex.RUnlock()
+	return d.config
+}
+
+// dialContext runs dial until it returns or ctx is done. A Conn dialed
+// after ctx is done is closed.
+func dialContext(ctx context.Context, dial func() (*Conn, error)) (water.Conn, error) {
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.conn, nil
+	}
+}
@@ -0,0 +1,124 @@
+package native
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/refraction-networking/water"
+)
+
+func init() {
+	err := water.RegisterWATMFixedDialer(water.NativeVersion, NewFixedDialerWithContext)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// FixedDialer implements [water.FixedDialer] utilizing a
+// [water.NativeFixedDialingTransport].
+type FixedDialer struct {
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
+
+	conns connTracker
+
+	water.UnimplementedFixedDialer // embedded to ensure forward compatibility
+}
+
+// NewFixedDialerWithContext creates a new [water.FixedDialer] from the given
+// [water.Config] with the given [context.Context].
+func NewFixedDialerWithContext(ctx context.Context, c *water.Config) (water.FixedDialer, error) {
+	return &FixedDialer{
+		config: c.Clone(),
+		ctx:    ctx,
+	}, nil
+}
+
+// DialFixed implements [water.FixedDialer].
+func (f *FixedDialer) DialFixed() (water.Conn, error) {
+	return f.DialFixedContext(f.ctx)
+}
+
+// DialFixedContext dials the address picked by the native transport, once
+// validated by the DialedAddressValidator of the config.
+//
+// Implements [water.FixedDialer].
+func (f *FixedDialer) DialFixedContext(ctx context.Context) (water.Conn, error) {
+	config := f.loadConfig()
+	if config == nil {
+		return nil, fmt.Errorf("water: dialing with nil config is not allowed")
+	}
+
+	return dialContext(ctx, func() (*Conn, error) {
+		transport, session, err := newTransport(config)
+		if err != nil {
+			return nil, err
+		}
+
+		netConn, err := dialFixed(config, transport)
+		if err != nil {
+			if session != nil {
+				_ = session.Close()
+			}
+			return nil, err
+		}
+
+		conn, err := wrap(transport, session, netConn, water.NativeRoleClient)
+		if err != nil {
+			return nil, err
+		}
+		f.conns.track(conn)
+		return conn, nil
+	})
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for new
+// connections and passes it to all live connections dialed by this
+// FixedDialer whose transport implements
+// [water.NativeConfigurableTransport].
+//
+// Implements [water.FixedDialer].
+func (f *FixedDialer) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	f.configMutex.Lock()
+	if f.config == nil {
+		f.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := f.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	f.config = newConfig
+	f.configMutex.Unlock()
+
+	return f.conns.updateTransportConfig(tmConfig)
+}
+
+func (f *FixedDialer) loadConfig() *water.Config {
+	f.configMutex.RLock()
+	defer f.configMutex.RUnlock()
+	return f.config
+}
+
+// dialFixed dials the address picked by transport. As for WATMs, the
+// address must pass the DialedAddressValidator of config, and is refused
+// if none is set.
+func dialFixed(config *water.Config, transport water.NativeTransport) (net.Conn, error) {
+	fdt, ok := transport.(water.NativeFixedDialingTransport)
+	if !ok {
+		return nil, water.ErrUnimplementedFixedDialer
+	}
+
+	network, address := fdt.FixedAddress()
+	if config.DialedAddressValidator == nil { // foolproof: not set == not allowed
+		return nil, fmt.Errorf("water: address validator is not set")
+	}
+	if err := config.DialedAddressValidator(network, address); err != nil {
+		return nil, fmt.Errorf("water: address validation: %w", err)
+	}
+
+	return config.NetworkDialerFuncOrDefault()(network, address)
+}
@@ -0,0 +1,128 @@
+package native
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/refraction-networking/water"
+)
+
+func init() {
+	err := water.RegisterWATMListener(water.NativeVersion, NewListenerWithContext)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Listener implements [water.Listener] utilizing a [water.NativeTransport].
+type Listener struct {
+	config      *water.Config
+	configMutex sync.RWMutex
+	closed      *atomic.Bool
+
+	conns connTracker
+
+	water.UnimplementedListener // embedded to ensure forward compatibility
+}
+
+// NewListenerWithContext creates a new [water.Listener] from the [water.Config] with
+// the given [context.Context].
+//
+// The context is unused: connections accepted by the Listener are not
+// bound to it.
+func NewListenerWithContext(_ context.Context, c *water.Config) (water.Listener, error) {
+	return &Listener{
+		config: c.Clone(),
+		closed: new(atomic.Bool),
+	}, nil
+}
+
+// Accept waits for and returns the next connection after wrapping it with
+// the native transport.
+//
+// Implements [net.Listener].
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptWATER()
+}
+
+// Close closes the listener.
+//
+// Implements [net.Listener].
+func (l *Listener) Close() error {
+	if l.closed.CompareAndSwap(false, true) {
+		return l.loadConfig().NetworkListener.Close()
+	}
+	return nil
+}
+
+// Addr returns the listener's network address.
+//
+// Implements [net.Listener].
+func (l *Listener) Addr() net.Addr {
+	return l.loadConfig().NetworkListener.Addr()
+}
+
+// AcceptWATER waits for and returns the next connection to the listener
+// as a water.Conn.
+//
+// Implements [water.Listener].
+func (l *Listener) AcceptWATER() (water.Conn, error) {
+	if l.closed.Load() {
+		return nil, fmt.Errorf("water: listener is closed: %w", net.ErrClosed)
+	}
+
+	config := l.loadConfig()
+	if config == nil {
+		return nil, fmt.Errorf("water: accept with nil config is not allowed")
+	}
+
+	netConn, err := config.NetworkListenerOrPanic().Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	transport, session, err := newTransport(config)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+
+	conn, err := wrap(transport, session, netConn, water.NativeRoleServer)
+	if err != nil {
+		return nil, err
+	}
+	l.conns.track(conn)
+
+	return conn, nil
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// connections accepted from now on and passes it to all live connections
+// accepted by this Listener whose transport implements
+// [water.NativeConfigurableTransport].
+//
+// Implements [water.Listener].
+func (l *Listener) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	l.configMutex.Lock()
+	if l.config == nil {
+		l.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := l.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	l.config = newConfig
+	l.configMutex.Unlock()
+
+	return l.conns.updateTransportConfig(tmConfig)
+}
+
+func (l *Listener) loadConfig() *water.Config {
+	l.configMutex.RLock()
+	defer l.configMutex.RUnlock()
+	return l.config
+}
@@ -0,0 +1,384 @@
+package native_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
+	"github.com/refraction-networking/water/transport/native"
+)
+
+func init() {
+	err := water.RegisterNativeTransport("xor", newXorTransport)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// xorTransport XORs every byte on the wire with a key taken from its
+// config, 0xFF if none is set. If the config is longer than one byte, the
+// rest is the address dialed by a FixedDialer.
+type xorTransport struct {
+	mutex   sync.Mutex
+	key     byte
+	address string
+}
+
+func newXorTransport(config []byte) (water.NativeTransport, error) {
+	t := &xorTransport{}
+	return t, t.Configure(config)
+}
+
+func (t *xorTransport) Configure(config []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(config) == 0 {
+		t.key = 0xFF
+		return nil
+	}
+	t.key = config[0]
+	t.address = string(config[1:])
+	return nil
+}
+
+func (t *xorTransport) FixedAddress() (network, address string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return "tcp", t.address
+}
+
+func (t *xorTransport) Wrap(conn net.Conn, _ water.NativeRole) (net.Conn, error) {
+	return &xorConn{Conn: conn, t: t}, nil
+}
+
+func (t *xorTransport) xor(b []byte) {
+	t.mutex.Lock()
+	key := t.key
+	t.mutex.Unlock()
+	for i := range b {
+		b[i] ^= key
+	}
+}
+
+type xorConn struct {
+	net.Conn
+	t *xorTransport
+}
+
+func (c *xorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.t.xor(b[:n])
+	return n, err
+}
+
+func (c *xorConn) Write(b []byte) (int, error) {
+	buf := bytes.Clone(b)
+	c.t.xor(buf)
+	return c.Conn.Write(buf)
+}
+
+func (c *xorConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func TestNative(t *testing.T) {
+	t.Run("dialer and listener", testDialerListener)
+	t.Run("xor on the wire", testXorOnTheWire)
+	t.Run("fixed dialer", testFixedDialer)
+	t.Run("relay", testRelay)
+	t.Run("update transport config", testUpdateTransportConfig)
+	t.Run("unknown transport", testUnknownTransport)
+	t.Run("session recording unsupported", testSessionRecorder)
+	t.Run("json config", testJSONConfig)
+}
+
+func echoServer(t *testing.T, lis net.Listener) {
+	t.Helper()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, msg) {
+		t.Fatalf("echoed %q, want %q", echoed, msg)
+	}
+}
+
+// readWire accepts one connection from lis and sends the first n bytes
+// received on it.
+func readWire(lis net.Listener, n int) <-chan []byte {
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // skipcq: GO-S2307
+		buf := make([]byte, n)
+		_, _ = io.ReadFull(conn, buf)
+		received <- buf
+	}()
+	return received
+}
+
+func testDialerListener(t *testing.T) {
+	config := &water.Config{NativeTransport: "xor"}
+
+	lis, err := config.ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	if _, ok := lis.(*native.Listener); !ok {
+		t.Fatalf("listener is %T, want *native.Listener", lis)
+	}
+	echoServer(t, lis)
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if _, ok := conn.(*native.Conn); !ok {
+		t.Fatalf("conn is %T, want *native.Conn", conn)
+	}
+	roundTrip(t, conn, []byte("hello, native"))
+	roundTrip(t, conn, bytes.Repeat([]byte{0xAB}, 1<<16))
+}
+
+func testXorOnTheWire(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	msg := []byte("hello, xor")
+	received := readWire(lis, len(msg))
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{
+		NativeTransport:       "xor",
+		TransportModuleConfig: water.TransportModuleConfigFromBytes([]byte{0x42}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wire := <-received:
+		for i := range wire {
+			if wire[i] != msg[i]^0x42 {
+				t.Fatalf("wire = %x, want %q XORed with 0x42", wire, msg)
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func testFixedDialer(t *testing.T) {
+	lis, err := (&water.Config{NativeTransport: "xor"}).ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	echoServer(t, lis)
+
+	config := &water.Config{
+		NativeTransport:       "xor",
+		TransportModuleConfig: water.TransportModuleConfigFromBytes(append([]byte{0xFF}, lis.Addr().String()...)),
+	}
+
+	t.Run("refused without validator", func(t *testing.T) {
+		fixedDialer, err := water.NewFixedDialerWithContext(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := fixedDialer.DialFixed(); err == nil {
+			_ = conn.Close()
+			t.Fatal("DialFixed succeeded without DialedAddressValidator")
+		}
+	})
+
+	t.Run("validated", func(t *testing.T) {
+		dialed := make(chan string, 1)
+		config := config.Clone()
+		config.DialedAddressValidator = func(network, address string) error {
+			dialed <- address
+			return nil
+		}
+
+		fixedDialer, err := water.NewFixedDialerWithContext(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := fixedDialer.DialFixed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() // skipcq: GO-S2307
+
+		if address := <-dialed; address != lis.Addr().String() {
+			t.Errorf("transport dialed %s, want %s", address, lis.Addr())
+		}
+		roundTrip(t, conn, []byte("hello, fixed"))
+	})
+}
+
+func testRelay(t *testing.T) {
+	// the relay wraps its connections to a native listener
+	lis, err := (&water.Config{NativeTransport: "xor"}).ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	echoServer(t, lis)
+
+	relayLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := water.NewRelayWithContext(context.Background(), &water.Config{
+		NativeTransport: "xor",
+		NetworkListener: relayLis,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close() // skipcq: GO-S2307
+
+	relayed := make(chan error, 1)
+	go func() {
+		relayed <- relay.RelayTo("tcp", lis.Addr().String())
+	}()
+
+	conn, err := net.Dial("tcp", relayLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	roundTrip(t, conn, []byte("hello, relay"))
+
+	if err := relay.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-relayed; err != nil {
+		t.Errorf("RelayTo: %v", err)
+	}
+}
+
+func testUpdateTransportConfig(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	msg := []byte("hello, update")
+	received := readWire(lis, len(msg))
+
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{NativeTransport: "xor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if err := dialer.UpdateTransportConfig([]byte{0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wire := <-received:
+		if !bytes.Equal(wire, msg) {
+			t.Fatalf("wire = %x, want %q unchanged by the updated key", wire, msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func testUnknownTransport(t *testing.T) {
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{NativeTransport: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1"); !errors.Is(err, water.ErrNativeTransportNotFound) {
+		t.Errorf("err = %v, want %v", err, water.ErrNativeTransportNotFound)
+	}
+}
+
+func testSessionRecorder(t *testing.T) {
+	dialer, err := water.NewDialerWithContext(context.Background(), &water.Config{
+		NativeTransport: "xor",
+		SessionRecorder: new(recording.Recorder),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1"); !errors.Is(err, native.ErrRecordingUnsupported) {
+		t.Errorf("err = %v, want %v", err, native.ErrRecordingUnsupported)
+	}
+}
+
+func testJSONConfig(t *testing.T) {
+	var config water.Config
+	if err := config.UnmarshalJSON([]byte(`{"transport_module":{"native":"xor"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if config.NativeTransport != "xor" {
+		t.Errorf("NativeTransport = %q, want %q", config.NativeTransport, "xor")
+	}
+	if config.TransportModuleBin != nil {
+		t.Errorf("TransportModuleBin is set with a native transport")
+	}
+}
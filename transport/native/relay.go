@@ -0,0 +1,206 @@
+package native
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/refraction-networking/water"
+)
+
+func init() {
+	err := water.RegisterWATMRelay(water.NativeVersion, NewRelayWithContext)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Relay implements [water.Relay] utilizing a [water.NativeTransport].
+//
+// Every accepted connection is relayed as-is to the remote address, over a
+// connection wrapped by the native transport with [water.NativeRoleClient].
+type Relay struct {
+	config      *water.Config
+	configMutex sync.RWMutex
+	running     *atomic.Bool
+
+	conns connTracker
+
+	water.UnimplementedRelay // embedded to ensure forward compatibility
+}
+
+// NewRelayWithContext creates a new [water.Relay] from the [water.Config] with the given
+// [context.Context] without starting it. To start the relay, call [Relay.RelayTo]
+// or [Relay.ListenAndRelayTo].
+//
+// The context is unused: relayed connections are not bound to it.
+func NewRelayWithContext(_ context.Context, c *water.Config) (water.Relay, error) {
+	return &Relay{
+		config:  c.Clone(),
+		running: new(atomic.Bool),
+	}, nil
+}
+
+// RelayTo implements [water.Relay].
+func (r *Relay) RelayTo(network, address string) error {
+	if !r.running.CompareAndSwap(false, true) {
+		return water.ErrRelayAlreadyStarted
+	}
+
+	if r.loadConfig() == nil {
+		return fmt.Errorf("water: relaying with nil config is not allowed")
+	}
+
+	return r.relayTo(network, address)
+}
+
+// ListenAndRelayTo implements [water.Relay].
+func (r *Relay) ListenAndRelayTo(lnetwork, laddress, rnetwork, raddress string) error {
+	if !r.running.CompareAndSwap(false, true) {
+		return water.ErrRelayAlreadyStarted
+	}
+	defer r.running.CompareAndSwap(true, false)
+
+	lis, err := net.Listen(lnetwork, laddress)
+	if err != nil {
+		return err
+	}
+
+	r.configMutex.Lock()
+	config := r.config.Clone()
+	config.NetworkListener = lis
+	r.config = config
+	r.configMutex.Unlock()
+
+	return r.relayTo(rnetwork, raddress)
+}
+
+// relayTo accepts and relays connections until the Relay is closed. As
+// with WATMs, failing to dial the remote address stops the Relay.
+func (r *Relay) relayTo(network, address string) error {
+	for r.running.Load() {
+		config := r.loadConfig()
+
+		src, err := config.NetworkListenerOrPanic().Accept()
+		if err != nil {
+			if r.running.Load() { // errored before closing
+				return err
+			}
+			break
+		}
+
+		dst, err := r.dial(config, network, address)
+		if err != nil {
+			_ = src.Close()
+			return err
+		}
+		r.conns.track(dst)
+
+		go pipe(src, dst)
+	}
+
+	return nil
+}
+
+func (r *Relay) dial(config *water.Config, network, address string) (*Conn, error) {
+	transport, session, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, err := config.NetworkDialerFuncOrDefault()(network, address)
+	if err != nil {
+		if session != nil {
+			_ = session.Close()
+		}
+		return nil, err
+	}
+
+	return wrap(transport, session, netConn, water.NativeRoleClient)
+}
+
+// Close implements [water.Relay].
+func (r *Relay) Close() error {
+	if !r.running.CompareAndSwap(true, false) {
+		return nil
+	}
+
+	if config := r.loadConfig(); config != nil {
+		return config.NetworkListener.Close()
+	}
+
+	return fmt.Errorf("water: relay is not configured")
+}
+
+// Addr implements [water.Relay].
+func (r *Relay) Addr() net.Addr {
+	config := r.loadConfig()
+	if config == nil {
+		return nil
+	}
+
+	return config.NetworkListener.Addr()
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// connections relayed from now on and passes it to all live connections
+// relayed by this Relay whose transport implements
+// [water.NativeConfigurableTransport].
+//
+// Implements [water.Relay].
+func (r *Relay) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	r.configMutex.Lock()
+	if r.config == nil {
+		r.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := r.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	r.config = newConfig
+	r.configMutex.Unlock()
+
+	return r.conns.updateTransportConfig(tmConfig)
+}
+
+func (r *Relay) loadConfig() *water.Config {
+	r.configMutex.RLock()
+	defer r.configMutex.RUnlock()
+	return r.config
+}
+
+// pipe copies data between src and dst in both directions until both are
+// done, then closes them.
+func pipe(src net.Conn, dst *Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		closeWrite(dst.Conn)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(src, dst)
+		closeWrite(src)
+	}()
+	wg.Wait()
+
+	_ = src.Close()
+	_ = dst.Close()
+}
+
+// closeWrite closes the write side of conn so that the peer sees the end
+// of the stream, or conn entirely if it can't be half closed.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+	_ = conn.Close()
+}
@@ -172,6 +172,10 @@ func (c *Conn) closeOnWorkerError() {
 	}
 	c.tmMutex.Unlock()
 
+	if tm == nil { // already closed
+		return
+	}
+
 	<-tm.WorkerErrored()
 	log.LDebugf(core.Logger(), "water: WATMv0: worker thread returned")
 	c.Close()
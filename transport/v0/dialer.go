@@ -3,6 +3,7 @@ package v0
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/refraction-networking/water"
 )
@@ -16,8 +17,9 @@ func init() {
 
 // Dialer implements water.Dialer utilizing Water WATM API v0.
 type Dialer struct {
-	config *water.Config
-	ctx    context.Context
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
 
 	water.UnimplementedDialer // embedded to ensure forward compatibility
 }
@@ -58,7 +60,8 @@ func (d *Dialer) Dial(network, address string) (conn water.Conn, err error) {
 //
 // Implements [water.Dialer].
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn water.Conn, err error) {
-	if d.config == nil {
+	config := d.loadConfig()
+	if config == nil {
 		return nil, fmt.Errorf("water: dialing with nil config is not allowed")
 	}
 
@@ -66,7 +69,7 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn
 	go func() {
 		defer dialReady()
 		var core water.Core
-		core, err = water.NewCoreWithContext(ctx, d.config)
+		core, err = water.NewCoreWithContext(ctx, config)
 		if err != nil {
 			return
 		}
@@ -81,3 +84,30 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn
 		return conn, err
 	}
 }
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// new connections from now on.
+//
+// WATMv0 pulls its config only once during initialization, so live
+// connections are not affected.
+//
+// Implements [water.Dialer].
+func (d *Dialer) UpdateTransportConfig(config []byte) error {
+	d.configMutex.Lock()
+	defer d.configMutex.Unlock()
+
+	if d.config == nil {
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := d.config.Clone()
+	newConfig.TransportModuleConfig = water.TransportModuleConfigFromBytes(config)
+	d.config = newConfig
+
+	return nil
+}
+
+func (d *Dialer) loadConfig() *water.Config {
+	d.configMutex.RLock()
+	defer d.configMutex.RUnlock()
+	return d.config
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 
 	"github.com/refraction-networking/water"
@@ -18,9 +19,10 @@ func init() {
 
 // Listener implements water.Listener utilizing Water WATM API v0.
 type Listener struct {
-	config *water.Config
-	closed *atomic.Bool
-	ctx    context.Context
+	config      *water.Config
+	configMutex sync.RWMutex
+	closed      *atomic.Bool
+	ctx         context.Context
 
 	water.UnimplementedListener // embedded to ensure forward compatibility
 }
@@ -69,7 +71,7 @@ func (l *Listener) Accept() (net.Conn, error) {
 // Implements [net.Listener].
 func (l *Listener) Close() error {
 	if l.closed.CompareAndSwap(false, true) {
-		return l.config.NetworkListener.Close()
+		return l.loadConfig().NetworkListener.Close()
 	}
 	return nil
 }
@@ -78,7 +80,7 @@ func (l *Listener) Close() error {
 //
 // Implements [net.Listener].
 func (l *Listener) Addr() net.Addr {
-	return l.config.NetworkListener.Addr()
+	return l.loadConfig().NetworkListener.Addr()
 }
 
 // AcceptWATER waits for and returns the next connection to the listener
@@ -90,16 +92,44 @@ func (l *Listener) AcceptWATER() (water.Conn, error) {
 		return nil, fmt.Errorf("water: listener is closed")
 	}
 
-	if l.config == nil {
+	config := l.loadConfig()
+	if config == nil {
 		return nil, fmt.Errorf("water: accept with nil config is not allowed")
 	}
 
 	var core water.Core
 	var err error
-	core, err = water.NewCoreWithContext(l.ctx, l.config)
+	core, err = water.NewCoreWithContext(l.ctx, config)
 	if err != nil {
 		return nil, err
 	}
 
 	return accept(core)
 }
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// connections accepted from now on.
+//
+// WATMv0 pulls its config only once during initialization, so live
+// connections are not affected.
+//
+// Implements [water.Listener].
+func (l *Listener) UpdateTransportConfig(config []byte) error {
+	l.configMutex.Lock()
+	defer l.configMutex.Unlock()
+
+	if l.config == nil {
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := l.config.Clone()
+	newConfig.TransportModuleConfig = water.TransportModuleConfigFromBytes(config)
+	l.config = newConfig
+
+	return nil
+}
+
+func (l *Listener) loadConfig() *water.Config {
+	l.configMutex.RLock()
+	defer l.configMutex.RUnlock()
+	return l.config
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 
 	"github.com/refraction-networking/water"
@@ -18,9 +19,10 @@ func init() {
 
 // Relay implements water.Relay utilizing Water WATM API v0.
 type Relay struct {
-	config  *water.Config
-	ctx     context.Context
-	running *atomic.Bool
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
+	running     *atomic.Bool
 
 	dialNetwork, dialAddress string
 
@@ -59,7 +61,7 @@ func (r *Relay) RelayTo(network, address string) error {
 		return water.ErrRelayAlreadyStarted
 	}
 
-	if r.config == nil {
+	if r.loadConfig() == nil {
 		return fmt.Errorf("water: relaying with nil config is not allowed")
 	}
 
@@ -69,7 +71,7 @@ func (r *Relay) RelayTo(network, address string) error {
 	var core water.Core
 	var err error
 	for r.running.Load() {
-		core, err = water.NewCoreWithContext(r.ctx, r.config)
+		core, err = water.NewCoreWithContext(r.ctx, r.loadConfig())
 		if err != nil {
 			return err
 		}
@@ -98,11 +100,13 @@ func (r *Relay) ListenAndRelayTo(lnetwork, laddress, rnetwork, raddress string)
 		return err
 	}
 
+	r.configMutex.Lock()
 	config := r.config.Clone()
 	config.NetworkListener = lis
 	r.config = config
+	r.configMutex.Unlock()
 
-	if r.config == nil {
+	if config == nil {
 		return fmt.Errorf("water: relaying with nil config is not allowed")
 	}
 
@@ -111,7 +115,7 @@ func (r *Relay) ListenAndRelayTo(lnetwork, laddress, rnetwork, raddress string)
 
 	var core water.Core
 	for r.running.Load() {
-		core, err = water.NewCoreWithContext(r.ctx, r.config)
+		core, err = water.NewCoreWithContext(r.ctx, r.loadConfig())
 		if err != nil {
 			return err
 		}
@@ -134,8 +138,8 @@ func (r *Relay) Close() error {
 		return nil
 	}
 
-	if r.config != nil {
-		return r.config.NetworkListener.Close()
+	if config := r.loadConfig(); config != nil {
+		return config.NetworkListener.Close()
 	}
 
 	return fmt.Errorf("water: relay is not configured")
@@ -143,9 +147,37 @@ func (r *Relay) Close() error {
 
 // Addr implements [water.Relay].
 func (r *Relay) Addr() net.Addr {
-	if r.config == nil {
+	config := r.loadConfig()
+	if config == nil {
 		return nil
 	}
 
-	return r.config.NetworkListener.Addr()
+	return config.NetworkListener.Addr()
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// connections relayed from now on.
+//
+// WATMv0 pulls its config only once during initialization, so live
+// connections are not affected.
+//
+// Implements [water.Relay].
+func (r *Relay) UpdateTransportConfig(config []byte) error {
+	r.configMutex.Lock()
+	defer r.configMutex.Unlock()
+
+	if r.config == nil {
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := r.config.Clone()
+	newConfig.TransportModuleConfig = water.TransportModuleConfigFromBytes(config)
+	r.config = newConfig
+
+	return nil
+}
+
+func (r *Relay) loadConfig() *water.Config {
+	r.configMutex.RLock()
+	defer r.configMutex.RUnlock()
+	return r.config
 }
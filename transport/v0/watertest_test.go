@@ -0,0 +1,176 @@
+package v0_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	v0 "github.com/refraction-networking/water/transport/v0"
+	"github.com/refraction-networking/water/watertest"
+)
+
+// adverseConditions are used to run the v0 transports over a network that
+// is slow, jittery and fragments writes.
+var adverseConditions = watertest.Conditions{
+	Latency:        2 * time.Millisecond,
+	Jitter:         2 * time.Millisecond,
+	Bandwidth:      4 << 20,
+	MaxSegmentSize: 100,
+}
+
+// exchangeMessages sends messages in both directions, tolerating
+// fragmented reads.
+func exchangeMessages(a, b net.Conn) error {
+	sendBuf := make([]byte, 1024)
+	recvBuf := make([]byte, 1024)
+	for i := 0; i < 10; i++ {
+		for _, dir := range [][2]net.Conn{{a, b}, {b, a}} {
+			if _, err := rand.Read(sendBuf); err != nil {
+				return err
+			}
+			if _, err := dir[0].Write(sendBuf); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(dir[1], recvBuf); err != nil {
+				return err
+			}
+			if !bytes.Equal(sendBuf, recvBuf) {
+				return errors.New("read content mismatch")
+			}
+		}
+	}
+	return nil
+}
+
+func TestWatertest(t *testing.T) {
+	t.Run("Dialer", testWatertestDialer)
+	t.Run("Listener", testWatertestListener)
+	t.Run("Relay", testWatertestRelay)
+}
+
+func testWatertestDialer(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(adverseConditions)
+
+	lis, err := network.Listen("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	dialer, err := v0.NewDialerWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkDialerFunc:  network.NetworkDialerFunc(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	peerConn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close() // skipcq: GO-S2307
+
+	if err := exchangeMessages(conn, peerConn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testWatertestListener(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(adverseConditions)
+
+	netLis, err := network.NetworkListener("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := v0.NewListenerWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    netLis,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	peerConn, err := network.Dial("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close() // skipcq: GO-S2307
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if err := exchangeMessages(peerConn, conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testWatertestRelay(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(adverseConditions)
+
+	serverLis, err := network.Listen("tcp", "10.0.0.2:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverLis.Close() // skipcq: GO-S2307
+
+	relayLis, err := network.NetworkListener("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay, err := v0.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkDialerFunc:  network.NetworkDialerFunc(),
+		NetworkListener:    relayLis,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = relay.RelayTo("tcp", "10.0.0.2:443")
+	}()
+	defer wg.Wait()
+	defer relay.Close() // skipcq: GO-S2307
+
+	clientConn, err := network.Dial("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close() // skipcq: GO-S2307
+
+	serverConn, err := serverLis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close() // skipcq: GO-S2307
+
+	if err := exchangeMessages(clientConn, serverConn); err != nil {
+		t.Fatal(err)
+	}
+}
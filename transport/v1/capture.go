@@ -0,0 +1,61 @@
+package v1
+
+import (
+	"net"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/pcapng"
+)
+
+// captureSession prepares a config for a new WATM instance to be captured
+// if config.PacketCapture is set. Otherwise config and a nil session are
+// returned unchanged.
+//
+// The returned config is a clone with the network wrapped so that all
+// network traffic of the WATM is written to the session. The observed
+// conns are bridged to the WATM by [water.Core.InsertConn].
+func captureSession(config *water.Config) (*water.Config, *pcapng.Session, error) {
+	if config.PacketCapture == nil {
+		return config, nil, nil
+	}
+
+	session, err := config.PacketCapture.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config = config.Clone()
+
+	dialerFunc := config.NetworkDialerFuncOrDefault()
+	config.NetworkDialerFunc = func(network, address string) (net.Conn, error) {
+		conn, err := dialerFunc(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return session.DialedConn(conn), nil
+	}
+
+	if config.NetworkListener != nil {
+		config.NetworkListener = &capturingListener{
+			Listener: config.NetworkListener,
+			session:  session,
+		}
+	}
+
+	return config, session, nil
+}
+
+// capturingListener captures every connection it accepts.
+type capturingListener struct {
+	net.Listener
+	session *pcapng.Session
+}
+
+func (l *capturingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.session.AcceptedConn(conn), nil
+}
@@ -33,6 +33,11 @@ type Conn struct {
 
 	closeOnce sync.Once
 	closed    atomic.Bool
+	untrack   func() // set by connTracker, protected by tmMutex
+
+	observers []observer // protected by tmMutex
+
+	session uint64 // number of the relay session, for Relay mode
 
 	water.UnimplementedConn // embedded to ensure forward compatibility
 }
@@ -78,7 +83,7 @@ func dialFixed(core water.Core) (c water.Conn, err error) {
 	// and we need to close this connection in that case.
 	go conn.closeOnWorkerError()
 
-	if err := conn.tm.StartWorker(); err != nil {
+	if err = conn.tm.StartWorker(); err != nil {
 		return nil, err
 	}
 
@@ -185,7 +190,13 @@ func accept(core water.Core) (c water.Conn, err error) {
 	return conn, nil
 }
 
-func relay(core water.Core, network, address string) (c water.Conn, err error) {
+// errRelaySession wraps the errors of relay once a connection was accepted,
+// failing that session only.
+var errRelaySession = errors.New("water: relay session failed")
+
+// relay relays the next connection accepted from the network listener of
+// core, as the relay session numbered session.
+func relay(core water.Core, network, address string, session uint64) (c water.Conn, err error) {
 	tm := UpgradeCore(core)
 	conn := &Conn{
 		tm: tm,
@@ -201,8 +212,31 @@ func relay(core water.Core, network, address string) (c water.Conn, err error) {
 			address: address,
 		},
 	}
+	if core.Config().DynamicRelay { // the WATM dials the destinations it picks
+		dialer.addressValidator = sessionAddressValidator(core.Logger(), session, core.Config().DialedAddressValidator)
+	}
+
+	source := &sourceListener{Listener: core.Config().NetworkListenerOrPanic()}
+	if version := core.Config().SendProxyProtocol; version != 0 {
+		dialer.dialerFunc = source.proxyProtocolDialerFunc(version, dialer.dialerFunc)
+	}
+	if pool := core.Config().UpstreamPool; pool != nil { // the pool picks the address dialed by water_dial_fixed
+		dialer.upstreamPool = pool
+		dialer.client = source.remoteAddr
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		if src := source.accepted(); src != nil {
+			_ = src.Close()
+			err = fmt.Errorf("%w: %w", errRelaySession, err)
+		}
+		_ = core.Close()
+	}()
 
-	if err = conn.tm.LinkNetworkInterface(dialer, core.Config().NetworkListenerOrPanic()); err != nil {
+	if err = conn.tm.LinkNetworkInterface(dialer, source); err != nil {
 		return nil, err
 	}
 
@@ -210,9 +244,11 @@ func relay(core water.Core, network, address string) (c water.Conn, err error) {
 		return nil, err
 	}
 
-	if err := conn.tm.Associate(); err != nil {
+	if err = conn.tm.Associate(); err != nil {
 		return nil, err
 	}
+	conn.srcConn = source.accepted() // the WATM accepts while associating
+	conn.session = session
 
 	// safety: we need to watch for the blocking worker thread's status.
 	// If it returns, no further data can be processed by the WASM module
@@ -237,6 +273,10 @@ func (c *Conn) closeOnWorkerError() {
 	}
 	c.tmMutex.Unlock()
 
+	if tm == nil { // already closed
+		return
+	}
+
 	if err := tm.WaitWorker(); err != nil { // block until worker thread returns
 		log.LErrorf(core.Logger(), "water: WATMv1: worker thread returned with error: %v", err)
 		c.Close()
@@ -245,6 +285,78 @@ func (c *Conn) closeOnWorkerError() {
 	}
 }
 
+// waitWorker blocks until the worker thread of the WATM returns, if it was
+// started and the connection is not closed.
+func (c *Conn) waitWorker() {
+	_ = c.WaitWorker()
+}
+
+// WaitWorker blocks until the worker thread of the WATM returns, and
+// returns its error. The connection carries no more data afterwards, even
+// if not closed. It returns right away once the connection is closed.
+func (c *Conn) WaitWorker() error {
+	if tm := c.TransportModule(); tm != nil {
+		return tm.WaitWorker()
+	}
+	return net.ErrClosed
+}
+
+// workerRunning reports whether the worker thread of the WATM was started
+// and has not returned yet.
+func (c *Conn) workerRunning() bool {
+	tm := c.TransportModule()
+	if tm == nil || tm.backgroundWorker == nil || tm.backgroundWorker.exited == nil {
+		return false
+	}
+
+	select {
+	case <-tm.backgroundWorker.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// TransportModule returns the [TransportModule] driving this connection, which
+// can be used to exchange control messages with the WATM. It returns nil once
+// the connection is closed.
+func (c *Conn) TransportModule() *TransportModule {
+	c.tmMutex.Lock()
+	defer c.tmMutex.Unlock()
+	return c.tm
+}
+
+// updateTransportConfig pushes an updated transport config to the live WATM
+// instance. The config file mounted at /conf/watm.cfg is rewritten and, if the
+// WATM speaks the framed control protocol, a [CtrlMsgConfigUpdate] is sent.
+func (c *Conn) updateTransportConfig(config water.TransportModuleConfig) error {
+	tm := c.TransportModule()
+	if tm == nil { // closed in the meantime
+		return nil
+	}
+
+	core := tm.Core()
+	if core == nil {
+		return nil
+	}
+
+	fileErr := fmt.Errorf("water: %T cannot update the TransportModuleConfig file", core)
+	if updater, ok := core.(water.TransportModuleConfigUpdater); ok {
+		fileErr = updater.UpdateTransportModuleConfig(config)
+	}
+
+	ctrlErr := tm.SendCtrlMessage(&CtrlMessage{
+		Type:    CtrlMsgConfigUpdate,
+		Payload: config.AsBytes(),
+	})
+	if errors.Is(ctrlErr, ErrCtrlPipeNotFramed) {
+		// the WATM may only learn about the update by re-reading the file
+		return fileErr
+	}
+
+	return ctrlErr
+}
+
 // Read implements the net.Conn interface.
 //
 // It calls to the underlying user-oriented connection's [net.Conn.Read] method.
@@ -294,12 +406,35 @@ func (c *Conn) Close() (err error) {
 			err = c.tm.Close()
 			c.tm = nil
 		}
+		untrack := c.untrack
+		c.untrack = nil
+		observers := c.observers
+		c.observers = nil
 		c.tmMutex.Unlock()
+
+		closeObservers(observers)
+
+		if untrack != nil {
+			untrack()
+		}
 	})
 
 	return err
 }
 
+// setUntrack sets the func removing c from its connTracker once closed. It
+// returns false if c is already closed.
+func (c *Conn) setUntrack(untrack func()) bool {
+	c.tmMutex.Lock()
+	defer c.tmMutex.Unlock()
+
+	if c.tm == nil {
+		return false
+	}
+	c.untrack = untrack
+	return true
+}
+
 // LocalAddr implements the net.Conn interface.
 //
 // It calls to the underlying network connection's [net.Conn.LocalAddr] method.
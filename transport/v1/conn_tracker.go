@@ -0,0 +1,55 @@
+package v1
+
+import (
+	"context"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/conntrack"
+)
+
+// connTracker keeps track of the Conns handed out by a Dialer, FixedDialer,
+// Listener or Relay which are not yet closed.
+type connTracker struct {
+	conntrack.Tracker[*Conn]
+}
+
+func (ct *connTracker) track(c *Conn) {
+	ct.Track(c, c.setUntrack)
+}
+
+// tracked returns the tracked Conns.
+func (ct *connTracker) tracked() []*Conn {
+	return ct.Tracked()
+}
+
+// updateTransportConfig pushes the config to every tracked Conn.
+func (ct *connTracker) updateTransportConfig(config water.TransportModuleConfig) error {
+	return ct.Each(func(c *Conn) error {
+		return c.updateTransportConfig(config)
+	})
+}
+
+// drain waits for the worker of every tracked Conn to return, then closes
+// it. If ctx is done first, the remaining Conns are closed right away.
+func (ct *connTracker) drain(ctx context.Context) error {
+	conns := ct.tracked()
+	drained := make(chan struct{})
+	go func() {
+		for _, c := range conns {
+			c.waitWorker()
+		}
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	return err
+}
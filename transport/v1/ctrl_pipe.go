@@ -1,9 +1,41 @@
 package v1
 
-import "net"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
 
+// CtrlPipe is the host end of the control pipe pushed into the WATM via
+// watm_ctrlpipe_v1.
+//
+// Historically the control pipe carried exactly one message: a single
+// byte _CTRLPIPE_EXIT written by the host to stop the worker thread.
+// This is still how exit is signalled, so WATMs that only watch the pipe
+// for readability keep working unmodified.
+//
+// WATMs that wish to exchange richer messages with the host announce
+// themselves by writing a [CtrlMsgHello] frame to the pipe. Only after
+// that does the host send framed messages other than exit to the WATM.
+//
+// A frame is laid out as follows (multi-byte integers are big-endian):
+//
+//	+-------+---------+------+----------------+-----------------+
+//	| magic | version | type | payload length |     payload     |
+//	|  1B   |   1B    |  1B  |       4B       | 0..MaxPayload B |
+//	+-------+---------+------+----------------+-----------------+
+//
+// The magic byte is never 0x00, so a WATM reading frames can always tell
+// a legacy exit byte apart from the start of a frame.
 type CtrlPipe struct {
 	net.Conn
+
+	writeMutex sync.Mutex
+	framed     atomic.Bool // set once the WATM sent a CtrlMsgHello
 }
 
 // CONTROL MESSAGE
@@ -11,7 +43,227 @@ var (
 	_CTRLPIPE_EXIT = []byte{0x00}
 )
 
+const (
+	ctrlFrameMagic     byte = 0xCE
+	ctrlFrameHeaderLen      = 7
+
+	// CtrlProtocolVersion is the version of the framed control protocol
+	// spoken by this host.
+	CtrlProtocolVersion byte = 0x01
+
+	// CtrlMaxPayloadLen is the largest payload a single control frame
+	// may carry.
+	CtrlMaxPayloadLen = 1 << 20
+)
+
+// CtrlMsgType identifies the kind of a [CtrlMessage].
+//
+// Types below 0x80 are sent from the host to the WATM, types from 0x80
+// upwards are sent from the WATM to the host.
+type CtrlMsgType uint8
+
+// Host-to-WATM messages.
+const (
+	// CtrlMsgExit asks the worker thread to exit. It is always sent as
+	// the legacy single byte, never as a frame.
+	CtrlMsgExit CtrlMsgType = 0x00
+
+	// CtrlMsgDrain asks the WATM to stop taking on new work and flush
+	// what it has, in preparation for an exit.
+	CtrlMsgDrain CtrlMsgType = 0x01
+
+	// CtrlMsgConfigUpdate carries a new transport module config as its
+	// payload.
+	CtrlMsgConfigUpdate CtrlMsgType = 0x02
+
+	// CtrlMsgStatsRequest asks the WATM to reply with a CtrlMsgStatsReply.
+	CtrlMsgStatsRequest CtrlMsgType = 0x03
+)
+
+// WATM-to-host messages.
+const (
+	// CtrlMsgHello announces that the WATM understands framed control
+	// messages. The payload is a single byte: the highest protocol
+	// version supported by the WATM.
+	CtrlMsgHello CtrlMsgType = 0x80
+
+	// CtrlMsgHandshakeComplete reports that the transport handshake has
+	// finished and application data is flowing.
+	CtrlMsgHandshakeComplete CtrlMsgType = 0x81
+
+	// CtrlMsgFatalError reports an unrecoverable error. The payload is a
+	// human-readable reason.
+	CtrlMsgFatalError CtrlMsgType = 0x82
+
+	// CtrlMsgStatsReply answers a CtrlMsgStatsRequest. The payload format
+	// is defined by the WATM.
+	CtrlMsgStatsReply CtrlMsgType = 0x83
+
+	// CtrlMsgLog carries a log event. The first byte of the payload is a
+	// CtrlLogLevel and the rest is the message.
+	CtrlMsgLog CtrlMsgType = 0x84
+)
+
+// String implements fmt.Stringer.
+func (t CtrlMsgType) String() string {
+	switch t {
+	case CtrlMsgExit:
+		return "exit"
+	case CtrlMsgDrain:
+		return "drain"
+	case CtrlMsgConfigUpdate:
+		return "config_update"
+	case CtrlMsgStatsRequest:
+		return "stats_request"
+	case CtrlMsgHello:
+		return "hello"
+	case CtrlMsgHandshakeComplete:
+		return "handshake_complete"
+	case CtrlMsgFatalError:
+		return "fatal_error"
+	case CtrlMsgStatsReply:
+		return "stats_reply"
+	case CtrlMsgLog:
+		return "log"
+	default:
+		return fmt.Sprintf("unknown(0x%02x)", uint8(t))
+	}
+}
+
+// CtrlLogLevel is the severity of a CtrlMsgLog event.
+type CtrlLogLevel uint8
+
+const (
+	CtrlLogDebug CtrlLogLevel = iota
+	CtrlLogInfo
+	CtrlLogWarn
+	CtrlLogError
+)
+
+var (
+	ErrCtrlPipeNotFramed      = errors.New("water: WATM does not support framed control messages")
+	ErrCtrlFrameBadMagic      = errors.New("water: bad control frame magic")
+	ErrCtrlFrameBadVersion    = errors.New("water: unsupported control frame version")
+	ErrCtrlFramePayloadTooBig = errors.New("water: control frame payload too large")
+)
+
+// CtrlMessage is a single message exchanged over the control pipe.
+type CtrlMessage struct {
+	Type    CtrlMsgType
+	Payload []byte
+}
+
+// MarshalBinary encodes the message as a control frame.
+//
+// Implements [encoding.BinaryMarshaler].
+func (m *CtrlMessage) MarshalBinary() ([]byte, error) {
+	if len(m.Payload) > CtrlMaxPayloadLen {
+		return nil, ErrCtrlFramePayloadTooBig
+	}
+
+	buf := make([]byte, ctrlFrameHeaderLen+len(m.Payload))
+	buf[0] = ctrlFrameMagic
+	buf[1] = CtrlProtocolVersion
+	buf[2] = byte(m.Type)
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(m.Payload)))
+	copy(buf[ctrlFrameHeaderLen:], m.Payload)
+
+	return buf, nil
+}
+
+// LogEvent splits the payload of a CtrlMsgLog message into its level and
+// message. It returns false if the message is not a well-formed log event.
+func (m *CtrlMessage) LogEvent() (level CtrlLogLevel, msg string, ok bool) {
+	if m.Type != CtrlMsgLog || len(m.Payload) == 0 {
+		return 0, "", false
+	}
+
+	return CtrlLogLevel(m.Payload[0]), string(m.Payload[1:]), true
+}
+
+// ReadCtrlMessage reads exactly one control frame from r.
+func ReadCtrlMessage(r io.Reader) (*CtrlMessage, error) {
+	var hdr [ctrlFrameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[0] != ctrlFrameMagic {
+		return nil, ErrCtrlFrameBadMagic
+	}
+
+	if hdr[1] == 0 || hdr[1] > CtrlProtocolVersion {
+		return nil, fmt.Errorf("%w: %d", ErrCtrlFrameBadVersion, hdr[1])
+	}
+
+	payloadLen := binary.BigEndian.Uint32(hdr[3:])
+	if payloadLen > CtrlMaxPayloadLen {
+		return nil, ErrCtrlFramePayloadTooBig
+	}
+
+	msg := &CtrlMessage{
+		Type:    CtrlMsgType(hdr[2]),
+		Payload: make([]byte, payloadLen),
+	}
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// WriteExit writes the legacy single-byte exit message to the pipe.
 func (c *CtrlPipe) WriteExit() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
 	_, err := c.Conn.Write(_CTRLPIPE_EXIT)
 	return err
 }
+
+// WriteMessage writes a control message to the WATM.
+//
+// CtrlMsgExit is always written as the legacy exit byte. All other
+// messages are written as frames and fail with ErrCtrlPipeNotFramed
+// unless the WATM announced itself with a CtrlMsgHello first.
+func (c *CtrlPipe) WriteMessage(msg *CtrlMessage) error {
+	if msg.Type == CtrlMsgExit {
+		return c.WriteExit()
+	}
+
+	if !c.framed.Load() {
+		return ErrCtrlPipeNotFramed
+	}
+
+	frame, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_, err = c.Conn.Write(frame)
+	return err
+}
+
+// ReadMessage reads the next control message sent by the WATM. A
+// CtrlMsgHello switches the pipe into framed mode.
+func (c *CtrlPipe) ReadMessage() (*CtrlMessage, error) {
+	msg, err := ReadCtrlMessage(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Type == CtrlMsgHello {
+		c.framed.Store(true)
+	}
+
+	return msg, nil
+}
+
+// Framed reports whether the WATM announced support for framed control
+// messages.
+func (c *CtrlPipe) Framed() bool {
+	return c.framed.Load()
+}
@@ -0,0 +1,132 @@
+package v1_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+func TestCtrlPipe(t *testing.T) {
+	t.Run("exit is a single byte", testCtrlPipeExit)
+	t.Run("framed messages need hello", testCtrlPipeNotFramed)
+	t.Run("framed messages after hello", testCtrlPipeFramed)
+	t.Run("bad frame must fail", testCtrlPipeBadFrame)
+}
+
+func testCtrlPipeExit(t *testing.T) {
+	hostConn, watmConn := net.Pipe()
+	defer hostConn.Close() // skipcq: GO-S2307
+	defer watmConn.Close() // skipcq: GO-S2307
+
+	pipe := &v1.CtrlPipe{Conn: hostConn}
+
+	go func() {
+		_ = pipe.WriteMessage(&v1.CtrlMessage{Type: v1.CtrlMsgExit})
+	}()
+
+	buf := make([]byte, 16)
+	n, err := watmConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf[:n], []byte{0x00}) {
+		t.Fatalf("exit message = %x, want 00", buf[:n])
+	}
+}
+
+func testCtrlPipeNotFramed(t *testing.T) {
+	hostConn, watmConn := net.Pipe()
+	defer hostConn.Close() // skipcq: GO-S2307
+	defer watmConn.Close() // skipcq: GO-S2307
+
+	pipe := &v1.CtrlPipe{Conn: hostConn}
+
+	err := pipe.WriteMessage(&v1.CtrlMessage{Type: v1.CtrlMsgDrain})
+	if !errors.Is(err, v1.ErrCtrlPipeNotFramed) {
+		t.Fatalf("WriteMessage error = %v, want %v", err, v1.ErrCtrlPipeNotFramed)
+	}
+}
+
+func testCtrlPipeFramed(t *testing.T) {
+	hostConn, watmConn := net.Pipe()
+	defer hostConn.Close() // skipcq: GO-S2307
+	defer watmConn.Close() // skipcq: GO-S2307
+
+	pipe := &v1.CtrlPipe{Conn: hostConn}
+
+	// WATM -> host: hello
+	hello, err := (&v1.CtrlMessage{Type: v1.CtrlMsgHello, Payload: []byte{v1.CtrlProtocolVersion}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = watmConn.Write(hello)
+	}()
+
+	msg, err := pipe.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != v1.CtrlMsgHello {
+		t.Fatalf("message type = %s, want %s", msg.Type, v1.CtrlMsgHello)
+	}
+	if !pipe.Framed() {
+		t.Fatalf("pipe must be framed after hello")
+	}
+
+	// host -> WATM: config update
+	newConfig := []byte(`{"padding":16}`)
+	go func() {
+		_ = pipe.WriteMessage(&v1.CtrlMessage{Type: v1.CtrlMsgConfigUpdate, Payload: newConfig})
+	}()
+
+	msg, err = v1.ReadCtrlMessage(watmConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != v1.CtrlMsgConfigUpdate {
+		t.Fatalf("message type = %s, want %s", msg.Type, v1.CtrlMsgConfigUpdate)
+	}
+	if !bytes.Equal(msg.Payload, newConfig) {
+		t.Fatalf("payload = %q, want %q", msg.Payload, newConfig)
+	}
+
+	// WATM -> host: log event
+	logEvent, err := (&v1.CtrlMessage{Type: v1.CtrlMsgLog, Payload: append([]byte{byte(v1.CtrlLogWarn)}, "hi"...)}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = watmConn.Write(logEvent)
+	}()
+
+	msg, err = pipe.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level, text, ok := msg.LogEvent()
+	if !ok || level != v1.CtrlLogWarn || text != "hi" {
+		t.Fatalf("LogEvent() = %d, %q, %t, want %d, %q, true", level, text, ok, v1.CtrlLogWarn, "hi")
+	}
+}
+
+func testCtrlPipeBadFrame(t *testing.T) {
+	_, err := v1.ReadCtrlMessage(bytes.NewReader([]byte{0x00, 0x01, 0x80, 0, 0, 0, 0}))
+	if !errors.Is(err, v1.ErrCtrlFrameBadMagic) {
+		t.Fatalf("ReadCtrlMessage error = %v, want %v", err, v1.ErrCtrlFrameBadMagic)
+	}
+
+	_, err = v1.ReadCtrlMessage(bytes.NewReader([]byte{0xCE, 0x7F, 0x80, 0, 0, 0, 0}))
+	if !errors.Is(err, v1.ErrCtrlFrameBadVersion) {
+		t.Fatalf("ReadCtrlMessage error = %v, want %v", err, v1.ErrCtrlFrameBadVersion)
+	}
+
+	_, err = v1.ReadCtrlMessage(bytes.NewReader([]byte{0xCE, 0x01, 0x80, 0xFF, 0xFF, 0xFF, 0xFF}))
+	if !errors.Is(err, v1.ErrCtrlFramePayloadTooBig) {
+		t.Fatalf("ReadCtrlMessage error = %v, want %v", err, v1.ErrCtrlFramePayloadTooBig)
+	}
+}
@@ -3,8 +3,10 @@ package v1
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
 )
 
 func init() {
@@ -16,8 +18,11 @@ func init() {
 
 // Dialer implements [water.Dialer] utilizing Water WATM API v1.
 type Dialer struct {
-	config *water.Config
-	ctx    context.Context
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
+
+	conns connTracker
 
 	water.UnimplementedDialer // embedded to ensure forward compatibility
 }
@@ -58,7 +63,11 @@ func (d *Dialer) Dial(network, address string) (conn water.Conn, err error) {
 //
 // Implements [water.Dialer].
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn water.Conn, err error) {
-	if d.config == nil {
+	d.configMutex.RLock()
+	config := d.config
+	d.configMutex.RUnlock()
+
+	if config == nil {
 		return nil, fmt.Errorf("water: dialing with nil config is not allowed")
 	}
 
@@ -66,12 +75,19 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn
 	go func() {
 		defer dialReady()
 		var core water.Core
-		core, err = water.NewCoreWithContext(ctx, d.config)
+		var observers []observer
+		core, observers, err = newCore(ctx, config, recording.RoleDialer)
 		if err != nil {
 			return
 		}
 
 		conn, err = dial(core, network, address)
+		if err == nil {
+			conn.(*Conn).attachObservers(observers)
+			d.conns.track(conn.(*Conn))
+		} else {
+			closeObservers(observers)
+		}
 	}()
 
 	select {
@@ -81,3 +97,26 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn
 		return conn, err
 	}
 }
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for new
+// connections and pushes it to all live connections dialed by this Dialer.
+//
+// Live WATM instances see the new config at /conf/watm.cfg, and WATMs
+// speaking the framed control protocol also receive a [CtrlMsgConfigUpdate].
+//
+// Implements [water.Dialer].
+func (d *Dialer) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	d.configMutex.Lock()
+	if d.config == nil {
+		d.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := d.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	d.config = newConfig
+	d.configMutex.Unlock()
+
+	return d.conns.updateTransportConfig(tmConfig)
+}
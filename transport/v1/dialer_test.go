@@ -365,6 +365,71 @@ func testDialerReverse(t *testing.T) { // skipcq: GO-R1005
 	tripleGC(100 * time.Microsecond)
 }
 
+// TestDialer_UpdateTransportConfig covers the following cases:
+//  1. Updating the config of a Dialer whose live connections were
+//     started with a config must succeed and keep the connections working.
+//  2. Updating the config of a Dialer whose live connections were
+//     started without a config must fail, since there is no config
+//     file to rewrite and the WATM does not speak the control protocol.
+func TestDialer_UpdateTransportConfig(t *testing.T) {
+	tcpLis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLis.Close() // skipcq: GO-S2307
+
+	for _, tc := range []struct {
+		name    string
+		config  water.TransportModuleConfig
+		wantErr bool
+	}{
+		{"with config", water.TransportModuleConfigFromBytes([]byte("old")), false},
+		{"without config", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &water.Config{
+				TransportModuleBin:    wasmReverse,
+				TransportModuleConfig: tc.config,
+				ModuleConfigFactory:   water.NewWazeroModuleConfigFactory(),
+			}
+			dialer, err := v1.NewDialerWithContext(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := dialer.DialContext(context.Background(), "tcp", tcpLis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close() // skipcq: GO-S2307
+
+			peerConn, err := tcpLis.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peerConn.Close() // skipcq: GO-S2307
+
+			err = dialer.UpdateTransportConfig([]byte("new"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("UpdateTransportConfig() error = %v, wantErr %t", err, tc.wantErr)
+			}
+
+			if err = sanityCheckConn(conn, peerConn, []byte("hello"), []byte("olleh")); err != nil {
+				t.Fatal(err)
+			}
+
+			// closed connections are no longer updated
+			if err := conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = dialer.UpdateTransportConfig([]byte("newer")); err != nil {
+				t.Fatalf("UpdateTransportConfig() error = %v after closing all connections", err)
+			}
+		})
+	}
+}
+
 func testDialerPartialWATM(t *testing.T) {
 	t.Skip("skipping [testDialerPartialWATM]...") // TODO: implement this with a few WebAssembly Transport Modules which partially implement the v1 dialer spec
 }
@@ -3,8 +3,10 @@ package v1
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
 )
 
 func init() {
@@ -15,8 +17,11 @@ func init() {
 }
 
 type FixedDialer struct {
-	config *water.Config
-	ctx    context.Context
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
+
+	conns connTracker
 
 	water.UnimplementedFixedDialer // embedded to ensure forward compatibility
 }
@@ -33,7 +38,11 @@ func (f *FixedDialer) DialFixed() (conn water.Conn, err error) {
 }
 
 func (f *FixedDialer) DialFixedContext(ctx context.Context) (conn water.Conn, err error) {
-	if f.config == nil {
+	f.configMutex.RLock()
+	config := f.config
+	f.configMutex.RUnlock()
+
+	if config == nil {
 		return nil, fmt.Errorf("water: dialing with nil config is not allowed")
 	}
 
@@ -41,12 +50,19 @@ func (f *FixedDialer) DialFixedContext(ctx context.Context) (conn water.Conn, er
 	go func() {
 		defer dialFixedReady()
 		var core water.Core
-		core, err = water.NewCoreWithContext(ctx, f.config)
+		var observers []observer
+		core, observers, err = newCore(ctx, config, recording.RoleFixedDialer)
 		if err != nil {
 			return
 		}
 
 		conn, err = dialFixed(core)
+		if err == nil {
+			conn.(*Conn).attachObservers(observers)
+			f.conns.track(conn.(*Conn))
+		} else {
+			closeObservers(observers)
+		}
 	}()
 
 	select {
@@ -56,3 +72,23 @@ func (f *FixedDialer) DialFixedContext(ctx context.Context) (conn water.Conn, er
 		return conn, err
 	}
 }
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for new
+// connections and pushes it to all live connections dialed by this FixedDialer.
+//
+// Implements [water.FixedDialer].
+func (f *FixedDialer) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	f.configMutex.Lock()
+	if f.config == nil {
+		f.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := f.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	f.config = newConfig
+	f.configMutex.Unlock()
+
+	return f.conns.updateTransportConfig(tmConfig)
+}
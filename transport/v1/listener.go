@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 
 	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
 )
 
 func init() {
@@ -18,9 +20,12 @@ func init() {
 
 // Listener implements [water.Listener] utilizing Water WATM API v1.
 type Listener struct {
-	config *water.Config
-	closed *atomic.Bool
-	ctx    context.Context
+	config      *water.Config
+	configMutex sync.RWMutex
+	closed      *atomic.Bool
+	ctx         context.Context
+
+	conns connTracker
 
 	water.UnimplementedListener // embedded to ensure forward compatibility
 }
@@ -29,8 +34,10 @@ type Listener struct {
 //
 // Deprecated: use [NewListenerWithContext] instead.
 func NewListener(c *water.Config) (water.Listener, error) {
+	config := c.Clone()
+	listenProxyProtocol(config)
 	return &Listener{
-		config: c.Clone(),
+		config: config,
 		closed: new(atomic.Bool),
 	}, nil
 }
@@ -45,8 +52,10 @@ func NewListener(c *water.Config) (water.Listener, error) {
 // Call [water.WazeroRuntimeConfigFactory.SetCloseOnContextDone] with false to
 // disable this behavior.
 func NewListenerWithContext(ctx context.Context, c *water.Config) (water.Listener, error) {
+	config := c.Clone()
+	listenProxyProtocol(config)
 	return &Listener{
-		config: c.Clone(),
+		config: config,
 		closed: new(atomic.Bool),
 		ctx:    ctx,
 	}, nil
@@ -69,7 +78,7 @@ func (l *Listener) Accept() (net.Conn, error) {
 // Implements [net.Listener].
 func (l *Listener) Close() error {
 	if l.closed.CompareAndSwap(false, true) {
-		return l.config.NetworkListener.Close()
+		return l.loadConfig().NetworkListener.Close()
 	}
 	return nil
 }
@@ -78,7 +87,7 @@ func (l *Listener) Close() error {
 //
 // Implements [net.Listener].
 func (l *Listener) Addr() net.Addr {
-	return l.config.NetworkListener.Addr()
+	return l.loadConfig().NetworkListener.Addr()
 }
 
 // AcceptWATER waits for and returns the next connection to the listener
@@ -87,19 +96,56 @@ func (l *Listener) Addr() net.Addr {
 // Implements [water.Listener].
 func (l *Listener) AcceptWATER() (water.Conn, error) {
 	if l.closed.Load() {
-		return nil, fmt.Errorf("water: listener is closed")
+		return nil, fmt.Errorf("water: listener is closed: %w", net.ErrClosed)
 	}
 
-	if l.config == nil {
+	config := l.loadConfig()
+	if config == nil {
 		return nil, fmt.Errorf("water: accept with nil config is not allowed")
 	}
 
-	var core water.Core
-	var err error
-	core, err = water.NewCoreWithContext(l.ctx, l.config)
+	core, observers, err := newCore(l.ctx, config, recording.RoleListener)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := accept(core)
 	if err != nil {
+		closeObservers(observers)
+		if l.closed.Load() { // errored by closing
+			return nil, fmt.Errorf("water: listener is closed: %w", net.ErrClosed)
+		}
 		return nil, err
 	}
+	conn.(*Conn).attachObservers(observers)
+	l.conns.track(conn.(*Conn))
+
+	return conn, nil
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// connections accepted from now on and pushes it to all live connections
+// accepted by this Listener.
+//
+// Implements [water.Listener].
+func (l *Listener) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	l.configMutex.Lock()
+	if l.config == nil {
+		l.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := l.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	l.config = newConfig
+	l.configMutex.Unlock()
+
+	return l.conns.updateTransportConfig(tmConfig)
+}
 
-	return accept(core)
+func (l *Listener) loadConfig() *water.Config {
+	l.configMutex.RLock()
+	defer l.configMutex.RUnlock()
+	return l.config
 }
@@ -1,8 +1,12 @@
 package v1
 
 import (
+	"errors"
 	"fmt"
 	"net"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/log"
 )
 
 // networkDialer is a dialer used to dial remote network addresses.
@@ -16,6 +20,9 @@ type networkDialer struct {
 	} // used by DialAny. If not set, DialAny will fail. This address is not checked by addressValidator.
 
 	addressValidator func(network, address string) error // used by Dial, if set. Otherwise all addresses are considered invalid.
+
+	upstreamPool *water.UpstreamPool // used by DialFixed instead of overrideAddress, if set.
+	client       func() net.Addr     // the client upstreamPool picks an upstream for, if set.
 }
 
 // Dial dials the network address using the dialerFunc of the networkDialer.
@@ -43,9 +50,36 @@ func (nd *networkDialer) Dial(network, address string) (net.Conn, error) {
 //
 // It should be used only when the caller is not aware of the address to dial.
 func (nd *networkDialer) DialFixed() (net.Conn, error) {
+	if nd.upstreamPool != nil {
+		var client net.Addr
+		if nd.client != nil {
+			client = nd.client()
+		}
+		return nd.upstreamPool.DialUpstream(nd.dialerFunc, client)
+	}
+
 	return nd.dialerFunc(nd.overrideAddress.network, nd.overrideAddress.address)
 }
 
+// sessionAddressValidator returns a func validating addresses with
+// validator, logging every address dialed in the relay session numbered
+// session, and whether it was allowed.
+func sessionAddressValidator(logger *log.Logger, session uint64, validator func(network, address string) error) func(network, address string) error {
+	return func(network, address string) error {
+		err := errors.New("address validator is not set") // foolproof: not set == not allowed
+		if validator != nil {
+			err = validator(network, address)
+		}
+
+		if err != nil {
+			log.LWarnf(logger, "water: relay session %d: dialing %s %s denied: %v", session, network, address, err)
+		} else {
+			log.LInfof(logger, "water: relay session %d: dialing %s %s", session, network, address)
+		}
+		return err
+	}
+}
+
 func (nd *networkDialer) HasOverrideAddress() bool {
 	return nd.overrideAddress.network != "" && nd.overrideAddress.address != ""
 }
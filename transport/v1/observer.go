@@ -0,0 +1,76 @@
+package v1
+
+import (
+	"context"
+	"net"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
+)
+
+// observer watches the traffic of a WATM instance, e.g. to record or
+// capture it. It is attached to the resulting Conn and closed with it.
+type observer interface {
+	// CallerConn wraps the connection handed to the caller.
+	CallerConn(callerConn net.Conn) net.Conn
+
+	Close() error
+}
+
+// newCore creates a new [water.Core] from config, with the observers
+// configured in config set up. The returned observers must be either
+// attached to the resulting Conn or closed with closeObservers.
+func newCore(ctx context.Context, config *water.Config, role recording.Role) (water.Core, []observer, error) {
+	var observers []observer
+
+	// the capture wraps the network conns first to see their real addresses
+	config, capture, err := captureSession(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if capture != nil {
+		observers = append(observers, capture)
+	}
+
+	config, session, err := recordSession(config, role)
+	if err != nil {
+		closeObservers(observers)
+		return nil, nil, err
+	}
+	if session != nil {
+		observers = append(observers, session)
+	}
+
+	core, err := water.NewCoreWithContext(ctx, config)
+	if err != nil {
+		closeObservers(observers)
+		return nil, nil, err
+	}
+
+	return core, observers, nil
+}
+
+// closeObservers closes observers that never got attached to a Conn.
+func closeObservers(observers []observer) {
+	for _, o := range observers {
+		_ = o.Close() // unsafe: error is ignored
+	}
+}
+
+// attachObservers makes observers watch the caller connection of the Conn
+// and closes them once the Conn is closed.
+func (c *Conn) attachObservers(observers []observer) {
+	if len(observers) == 0 {
+		return
+	}
+
+	c.tmMutex.Lock()
+	defer c.tmMutex.Unlock()
+
+	if c.callerConn != nil {
+		for _, o := range observers {
+			c.callerConn = o.CallerConn(c.callerConn)
+		}
+	}
+	c.observers = observers
+}
@@ -0,0 +1,92 @@
+package v1
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/proxy/proxyproto"
+)
+
+// listenProxyProtocol wraps the NetworkListener of config to read PROXY
+// protocol headers if config.AcceptProxyProtocol is set, only from
+// config.TrustedProxyNetworks if any.
+//
+// config must not be shared, e.g., a clone.
+func listenProxyProtocol(config *water.Config) {
+	if !config.AcceptProxyProtocol || config.NetworkListener == nil {
+		return
+	}
+	if _, ok := config.NetworkListener.(*proxyproto.Listener); ok { // already wrapped
+		return
+	}
+	lis := proxyproto.NewListener(config.NetworkListener, 0)
+	lis.TrustedNetworks = config.TrustedProxyNetworks
+	config.NetworkListener = lis
+}
+
+// sourceListener remembers the connection accepted by a relaying WATM,
+// e.g., to send its addresses in a PROXY protocol header on, or to pick an
+// upstream for, the connection the WATM dials next.
+type sourceListener struct {
+	net.Listener
+
+	mutex  sync.Mutex
+	source net.Conn
+}
+
+func (l *sourceListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mutex.Lock()
+		l.source = conn
+		l.mutex.Unlock()
+	}
+	return conn, err
+}
+
+// accepted returns the accepted connection, or nil if none was accepted
+// yet.
+func (l *sourceListener) accepted() net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.source
+}
+
+// remoteAddr returns the remote address of the accepted connection, or nil
+// if none was accepted yet.
+func (l *sourceListener) remoteAddr() net.Addr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.source == nil {
+		return nil
+	}
+	return l.source.RemoteAddr()
+}
+
+// proxyProtocolDialerFunc returns a func dialing with dialerFunc, then
+// sending a PROXY protocol header of the given version with the addresses
+// of the accepted connection, or a local header if none was accepted yet.
+func (l *sourceListener) proxyProtocolDialerFunc(version byte, dialerFunc func(network, address string) (net.Conn, error)) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		conn, err := dialerFunc(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		l.mutex.Lock()
+		source := l.source
+		l.mutex.Unlock()
+		header := proxyproto.NewHeader(version, nil, nil)
+		if source != nil {
+			header = proxyproto.NewHeader(version, source.RemoteAddr(), source.LocalAddr())
+		}
+
+		if _, err := header.WriteTo(conn); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("water: sending PROXY protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,172 @@
+package v1_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/proxy/proxyproto"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	t.Run("Listener accepts header", testProxyProtocolListener)
+	t.Run("Relay accepts and sends header", testProxyProtocolRelay)
+	t.Run("Relay sends header of client", testProxyProtocolRelayClient)
+}
+
+// dialWithHeader dials address and sends a PROXY protocol header from
+// source, followed by msg.
+func dialWithHeader(t *testing.T, address, source, msg string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	header := proxyproto.NewHeader(1,
+		net.TCPAddrFromAddrPort(netip.MustParseAddrPort(source)),
+		net.TCPAddrFromAddrPort(netip.MustParseAddrPort("198.51.100.1:443")))
+	if _, err := header.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func testProxyProtocolListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := v1.NewListenerWithContext(context.Background(), &water.Config{
+		TransportModuleBin:  wasmPlain,
+		NetworkListener:     lis,
+		AcceptProxyProtocol: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // skipcq: GO-S2307
+
+	dialWithHeader(t, listener.Addr().String(), "192.0.2.1:56324", "hello")
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr() = %s, want 192.0.2.1:56324", got)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q, want %q", buf, "hello")
+	}
+}
+
+// startProxyProtocolRelay starts a Relay from config to a local server,
+// and returns the Relay and the server.
+func startProxyProtocolRelay(t *testing.T, config *water.Config) (water.Relay, net.Listener) {
+	t.Helper()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.NetworkListener = lis
+	relay, err := v1.NewRelayWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = relay.Close() })
+	go func() {
+		_ = relay.RelayTo("tcp", backend.Addr().String())
+	}()
+	return relay, backend
+}
+
+// acceptHeader accepts a connection on backend and reads its PROXY
+// protocol header and msg.
+func acceptHeader(t *testing.T, backend net.Listener, msg string) *proxyproto.Header {
+	t.Helper()
+
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	r := bufio.NewReader(conn)
+	header, err := proxyproto.ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("read %q, want %q", buf, msg)
+	}
+	return header
+}
+
+func testProxyProtocolRelay(t *testing.T) {
+	relay, backend := startProxyProtocolRelay(t, &water.Config{
+		TransportModuleBin:  wasmPlain,
+		AcceptProxyProtocol: true,
+		SendProxyProtocol:   2,
+	})
+
+	dialWithHeader(t, relay.Addr().String(), "192.0.2.1:56324", "hello")
+	header := acceptHeader(t, backend, "hello")
+	if header.Version != 2 || header.Command != proxyproto.CommandProxy {
+		t.Errorf("header version %d command %d, want a version 2 PROXY header", header.Version, header.Command)
+	}
+	if header.Source.String() != "192.0.2.1:56324" || header.Destination.String() != "198.51.100.1:443" {
+		t.Errorf("header %v -> %v, want 192.0.2.1:56324 -> 198.51.100.1:443", header.Source, header.Destination)
+	}
+}
+
+func testProxyProtocolRelayClient(t *testing.T) {
+	relay, backend := startProxyProtocolRelay(t, &water.Config{
+		TransportModuleBin: wasmPlain,
+		SendProxyProtocol:  1,
+	})
+
+	conn, err := net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	header := acceptHeader(t, backend, "hello")
+	if header.Version != 1 || header.Source.String() != conn.LocalAddr().String() {
+		t.Errorf("header version %d from %v, want version 1 from %v", header.Version, header.Source, conn.LocalAddr())
+	}
+}
@@ -0,0 +1,72 @@
+package v1
+
+import (
+	"net"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/recording"
+)
+
+// recordSession prepares a config for a new WATM instance to be recorded
+// if config.SessionRecorder is set. Otherwise config and a nil session are
+// returned unchanged.
+//
+// The returned config is a clone with the random source, clocks and
+// network wrapped so that everything the WATM consumes is written to the
+// session. The recorded conns are bridged to the WATM by
+// [water.Core.InsertConn].
+func recordSession(config *water.Config, role recording.Role) (*water.Config, *recording.Session, error) {
+	if config.SessionRecorder == nil {
+		return config, nil, nil
+	}
+
+	var tmConfig []byte
+	if config.TransportModuleConfig != nil {
+		tmConfig = config.TransportModuleConfig.AsBytes()
+	}
+
+	session, err := config.SessionRecorder.NewSession(role, config.TransportModuleBin, tmConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config = config.Clone()
+
+	mc := config.ModuleConfig()
+	mc.SetRandSource(session.RandSource(mc.RandSource()))
+	mc.SetWalltime(session.Walltime(mc.Walltime()))
+	mc.SetNanotime(session.Nanotime(mc.Nanotime()))
+
+	dialerFunc := config.NetworkDialerFuncOrDefault()
+	config.NetworkDialerFunc = func(network, address string) (net.Conn, error) {
+		conn, err := dialerFunc(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return session.NetworkConn(conn, network, address), nil
+	}
+
+	if config.NetworkListener != nil {
+		config.NetworkListener = &recordingListener{
+			Listener: config.NetworkListener,
+			session:  session,
+		}
+	}
+
+	return config, session, nil
+}
+
+// recordingListener records every connection it accepts.
+type recordingListener struct {
+	net.Listener
+	session *recording.Session
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.session.NetworkConn(conn, conn.RemoteAddr().Network(), conn.RemoteAddr().String()), nil
+}
@@ -2,11 +2,16 @@ package v1
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
 
 	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/log"
+	"github.com/refraction-networking/water/recording"
 )
 
 func init() {
@@ -18,11 +23,18 @@ func init() {
 
 // Relay implements [water.Relay] utilizing Water WATM API v1.
 type Relay struct {
-	config  *water.Config
-	ctx     context.Context
-	running *atomic.Bool
+	config      *water.Config
+	configMutex sync.RWMutex
+	ctx         context.Context
+	running     *atomic.Bool
+
+	conns connTracker
+
+	loopMutex sync.Mutex
+	loopDone  chan struct{} // closed once the loop of RelayTo or ListenAndRelayTo exits
 
 	dialNetwork, dialAddress string
+	sessions                 atomic.Uint64 // numbers relay sessions for logging
 
 	water.UnimplementedRelay // embedded to ensure forward compatibility
 }
@@ -58,32 +70,22 @@ func (r *Relay) RelayTo(network, address string) error {
 	if !r.running.CompareAndSwap(false, true) {
 		return water.ErrRelayAlreadyStarted
 	}
+	defer close(r.startLoop())
 
+	r.configMutex.Lock()
 	if r.config == nil {
+		r.configMutex.Unlock()
 		return fmt.Errorf("water: relaying with nil config is not allowed")
 	}
+	config := r.config.Clone()
+	listenProxyProtocol(config)
+	r.config = config
+	r.configMutex.Unlock()
 
 	r.dialNetwork = network
 	r.dialAddress = address
 
-	var core water.Core
-	var err error
-	for r.running.Load() {
-		core, err = water.NewCoreWithContext(r.ctx, r.config)
-		if err != nil {
-			return err
-		}
-
-		_, err = relay(core, network, address)
-		if err != nil {
-			if r.running.Load() { // errored before closing
-				return err
-			}
-			break
-		}
-	}
-
-	return nil
+	return r.relayLoop(network, address)
 }
 
 // ListenAndRelayTo implements [water.Relay].
@@ -92,36 +94,61 @@ func (r *Relay) ListenAndRelayTo(lnetwork, laddress, rnetwork, raddress string)
 		return water.ErrRelayAlreadyStarted
 	}
 	defer r.running.CompareAndSwap(true, false)
+	defer close(r.startLoop())
 
 	lis, err := net.Listen(lnetwork, laddress)
 	if err != nil {
 		return err
 	}
 
+	r.configMutex.Lock()
 	config := r.config.Clone()
 	config.NetworkListener = lis
+	listenProxyProtocol(config)
 	r.config = config
+	r.configMutex.Unlock()
 
-	if r.config == nil {
+	if config == nil {
 		return fmt.Errorf("water: relaying with nil config is not allowed")
 	}
 
 	r.dialNetwork = rnetwork
 	r.dialAddress = raddress
 
-	var core water.Core
+	return r.relayLoop(rnetwork, raddress)
+}
+
+// relayLoop relays every connection accepted to network and address until
+// the relay is closed. A session failing, e.g., as no upstream could be
+// dialed, is logged and closed, without stopping the relay.
+func (r *Relay) relayLoop(network, address string) error {
+	// health checks dial without the wrappers of any session
+	if config := r.loadConfig(); config.UpstreamPool != nil {
+		config.UpstreamPool.SetHealthCheckDialerFunc(config.NetworkDialerFuncOrDefault())
+	}
+
 	for r.running.Load() {
-		core, err = water.NewCoreWithContext(r.ctx, r.config)
+		core, observers, err := newCore(r.ctx, r.loadConfig(), recording.RoleRelay)
 		if err != nil {
 			return err
 		}
 
-		_, err = relay(core, rnetwork, raddress)
-		if err != nil {
-			if r.running.Load() { // errored before closing
-				return err
-			}
-			break
+		session := r.sessions.Add(1)
+		conn, err := relay(core, network, address, session)
+		if err == nil {
+			conn.(*Conn).attachObservers(observers)
+			r.conns.track(conn.(*Conn))
+			continue
+		}
+
+		closeObservers(observers)
+		switch {
+		case !r.running.Load(): // errored by closing
+			return nil
+		case errors.Is(err, errRelaySession):
+			log.LWarnf(core.Logger(), "water: relay session %d: %v", session, err)
+		default:
+			return err
 		}
 	}
 
@@ -134,18 +161,105 @@ func (r *Relay) Close() error {
 		return nil
 	}
 
-	if r.config != nil {
-		return r.config.NetworkListener.Close()
+	if config := r.loadConfig(); config != nil {
+		return config.NetworkListener.Close()
 	}
 
 	return fmt.Errorf("water: relay is not configured")
 }
 
+// Shutdown implements [water.Relay].
+func (r *Relay) Shutdown(ctx context.Context) error {
+	err := r.Close()
+	// a connection accepted before Close may still be associating, to be
+	// tracked once done
+	if waitErr := r.waitLoop(ctx); waitErr != nil {
+		r.conns.drain(ctx) //nolint:errcheck // ctx is done, so this closes all
+		return waitErr
+	}
+	if drainErr := r.conns.drain(ctx); drainErr != nil {
+		return drainErr
+	}
+	return err
+}
+
+// startLoop returns a new channel to close once the loop of RelayTo or
+// ListenAndRelayTo exits.
+func (r *Relay) startLoop() chan struct{} {
+	r.loopMutex.Lock()
+	defer r.loopMutex.Unlock()
+	r.loopDone = make(chan struct{})
+	return r.loopDone
+}
+
+// waitLoop waits for the loop of RelayTo or ListenAndRelayTo to exit, if
+// started, or for ctx to be done.
+func (r *Relay) waitLoop(ctx context.Context) error {
+	r.loopMutex.Lock()
+	done := r.loopDone
+	r.loopMutex.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sessions implements [water.Relay].
+func (r *Relay) Sessions() []water.RelaySession {
+	var sessions []water.RelaySession
+	for _, c := range r.conns.tracked() {
+		if c.srcConn == nil || !c.workerRunning() {
+			continue
+		}
+		sessions = append(sessions, water.RelaySession{
+			ID:         c.session,
+			LocalAddr:  c.srcConn.LocalAddr().String(),
+			RemoteAddr: c.srcConn.RemoteAddr().String(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
 // Addr implements [water.Relay].
 func (r *Relay) Addr() net.Addr {
-	if r.config == nil {
+	config := r.loadConfig()
+	if config == nil {
 		return nil
 	}
 
-	return r.config.NetworkListener.Addr()
+	return config.NetworkListener.Addr()
+}
+
+// UpdateTransportConfig replaces the TransportModuleConfig used for
+// connections relayed from now on and pushes it to all live connections
+// relayed by this Relay.
+//
+// Implements [water.Relay].
+func (r *Relay) UpdateTransportConfig(config []byte) error {
+	tmConfig := water.TransportModuleConfigFromBytes(config)
+
+	r.configMutex.Lock()
+	if r.config == nil {
+		r.configMutex.Unlock()
+		return fmt.Errorf("water: updating nil config is not allowed")
+	}
+	newConfig := r.config.Clone()
+	newConfig.TransportModuleConfig = tmConfig
+	r.config = newConfig
+	r.configMutex.Unlock()
+
+	return r.conns.updateTransportConfig(tmConfig)
+}
+
+func (r *Relay) loadConfig() *water.Config {
+	r.configMutex.RLock()
+	defer r.configMutex.RUnlock()
+	return r.config
 }
@@ -367,3 +367,72 @@ func testRelayReverse(t *testing.T) { // skipcq: GO-R1005
 		t.Fatalf("serverRecvBuf != \"olleh\"")
 	}
 }
+
+func TestRelayShutdown(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close() // skipcq: GO-S2307
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := v1.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    lis,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := make(chan error, 1)
+	go func() {
+		relayed <- relay.RelayTo("tcp", backend.Addr().String())
+	}()
+
+	clientConn, err := net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close() // skipcq: GO-S2307
+	serverConn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close() // skipcq: GO-S2307
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(relay.Sessions()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sessions() = %v", relay.Sessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the live session outlives the context, so it is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := relay.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case err := <-relayed:
+		if err != nil {
+			t.Errorf("RelayTo() = %v", err)
+		}
+	default:
+		t.Error("RelayTo still relaying after Shutdown")
+	}
+	if sessions := relay.Sessions(); len(sessions) != 0 {
+		t.Errorf("Sessions() = %v after Shutdown", sessions)
+	}
+	if _, err := net.DialTimeout("tcp", lis.Addr().String(), time.Second); err == nil {
+		t.Error("relay still listening after Shutdown")
+	}
+
+	_ = serverConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := serverConn.Read(make([]byte, 1)); err == nil {
+		t.Error("relayed connection still open after Shutdown")
+	}
+}
@@ -1,6 +1,7 @@
 package v1
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -79,9 +80,9 @@ type TransportModule struct {
 		//  - Listener: callerConn + sourceConn
 		//  - Relay: sourceConn + remoteConn
 		//
-		// The worker thread should exit and return when the cancellation pipe is available
-		// for reading. For the current design, the content read from the pipe does not
-		// include meaningful data.
+		// The worker thread should exit and return when the exit byte is read from the
+		// control pipe. WATMs speaking the framed control protocol may also receive other
+		// messages on the pipe, see [CtrlPipe].
 		_start func() (int32, error) // watm_start_v1() (err int32)
 
 		// When the worker thread exits, this channel will be closed after the error
@@ -99,6 +100,14 @@ type TransportModule struct {
 	managedConns      map[int32]net.Conn // the conn we want to keep alive
 	managedConnsMutex sync.RWMutex
 
+	// ctrlHandlers are called for every message the WATM sends over the
+	// control pipe. See [TransportModule.SubscribeCtrlMessages].
+	ctrlHandlers       map[uint64]func(*CtrlMessage)
+	ctrlHandlersNextID uint64
+	ctrlHandlersMutex  sync.Mutex
+
+	fatalReason atomic.Value // string, set when the WATM reports CtrlMsgFatalError
+
 	deferOnce     sync.Once
 	deferredFuncs []func()
 
@@ -110,6 +119,7 @@ func UpgradeCore(core water.Core) *TransportModule {
 	watm := &TransportModule{
 		core:          core,
 		managedConns:  make(map[int32]net.Conn),
+		ctrlHandlers:  make(map[uint64]func(*CtrlMessage)),
 		deferredFuncs: make([]func(), 0),
 	}
 
@@ -345,6 +355,16 @@ func (tm *TransportModule) DialFrom(reverseCallerConn net.Conn) (destConn net.Co
 	}
 }
 
+// Drain asks the WATM to stop taking on new work and flush what it has
+// buffered. The WATM decides how to honor it and is still expected to
+// watch for the exit message afterwards.
+//
+// It returns [ErrCtrlPipeNotFramed] if the WATM does not support framed
+// control messages.
+func (tm *TransportModule) Drain() error {
+	return tm.SendCtrlMessage(&CtrlMessage{Type: CtrlMsgDrain})
+}
+
 // ExitedWith returns the error that the worker thread exited with.
 //
 // It is recommended to use [TransportModule.WaitWorker] to wait for the worker
@@ -760,6 +780,61 @@ func (tm *TransportModule) PushConn(conn net.Conn) (fd int32, err error) {
 	return fd, nil
 }
 
+// RequestStats asks the WATM for its statistics and blocks until the WATM
+// replies or ctx is done. The format of the returned payload is defined by
+// the WATM.
+//
+// It returns [ErrCtrlPipeNotFramed] if the WATM does not support framed
+// control messages.
+func (tm *TransportModule) RequestStats(ctx context.Context) ([]byte, error) {
+	reply := make(chan []byte, 1)
+	unsubscribe := tm.SubscribeCtrlMessages(func(msg *CtrlMessage) {
+		if msg.Type == CtrlMsgStatsReply {
+			select {
+			case reply <- msg.Payload:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	if err := tm.SendCtrlMessage(&CtrlMessage{Type: CtrlMsgStatsRequest}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case stats := <-reply:
+		return stats, nil
+	}
+}
+
+// SendCtrlMessage sends a message to the WATM over the control pipe.
+//
+// Except for [CtrlMsgExit], messages can only be sent once the WATM
+// has announced support for framed control messages, otherwise
+// [ErrCtrlPipeNotFramed] is returned.
+func (tm *TransportModule) SendCtrlMessage(msg *CtrlMessage) error {
+	if tm.backgroundWorker == nil {
+		return fmt.Errorf("water: Transport Module is not initialized")
+	}
+
+	ctrlPipe := tm.backgroundWorker.controlPipe
+	if ctrlPipe == nil {
+		return fmt.Errorf("water: control pipe is not available")
+	}
+
+	if err := ctrlPipe.WriteMessage(msg); err != nil {
+		if errors.Is(err, ErrCtrlPipeNotFramed) {
+			return err
+		}
+		return fmt.Errorf("water: writing to control pipe failed: %w", err)
+	}
+
+	return nil
+}
+
 // Worker spins up a worker thread for the WATM to run a blocking function, which is
 // expected to be the mainloop.
 //
@@ -781,6 +856,9 @@ func (tm *TransportModule) StartWorker() error {
 		Conn: ctrlConnW,
 	} // host will Write to this pipe to cancel the worker
 
+	// the WATM may talk back on the same pipe
+	go tm.serveCtrlPipe(tm.backgroundWorker.controlPipe, tm.Core().Logger())
+
 	// push cancel pipe
 	ctrlPipeFd, err := tm.PushConn(ctrlConnR)
 	if err != nil {
@@ -800,6 +878,9 @@ func (tm *TransportModule) StartWorker() error {
 		defer close(tm.backgroundWorker.exited)
 		_, err := tm.backgroundWorker._start()
 		if err != nil && !errors.Is(err, syscall.ECANCELED) {
+			if reason, ok := tm.fatalReason.Load().(string); ok {
+				err = fmt.Errorf("%w (WATM reported: %s)", err, reason)
+			}
 			log.LErrorf(tm.Core().Logger(), "water: WATM worker thread exited with error: %v", err)
 			tm.backgroundWorker.exitedWith.Store(err)
 		} else {
@@ -818,6 +899,75 @@ func (tm *TransportModule) StartWorker() error {
 	return nil
 }
 
+// SubscribeCtrlMessages registers a handler to be called with every message
+// the WATM sends over the control pipe, until the returned function is
+// called.
+//
+// Handlers are called sequentially from a single goroutine and should not
+// block. Messages received before a handler is registered are not replayed.
+func (tm *TransportModule) SubscribeCtrlMessages(handler func(*CtrlMessage)) (unsubscribe func()) {
+	tm.ctrlHandlersMutex.Lock()
+	id := tm.ctrlHandlersNextID
+	tm.ctrlHandlersNextID++
+	tm.ctrlHandlers[id] = handler
+	tm.ctrlHandlersMutex.Unlock()
+
+	return func() {
+		tm.ctrlHandlersMutex.Lock()
+		delete(tm.ctrlHandlers, id)
+		tm.ctrlHandlersMutex.Unlock()
+	}
+}
+
+// serveCtrlPipe reads messages sent by the WATM over the control pipe
+// until the pipe is closed, and dispatches them to the subscribers.
+//
+// WATMs not speaking the framed protocol never write to the pipe, so for
+// them this simply blocks until the pipe is closed.
+func (tm *TransportModule) serveCtrlPipe(ctrlPipe *CtrlPipe, logger *log.Logger) {
+	for {
+		msg, err := ctrlPipe.ReadMessage()
+		if err != nil {
+			if errors.Is(err, ErrCtrlFrameBadMagic) || errors.Is(err, ErrCtrlFrameBadVersion) || errors.Is(err, ErrCtrlFramePayloadTooBig) {
+				log.LWarnf(logger, "water: WATM sent malformed control message, ignoring the rest: %v", err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case CtrlMsgHello:
+			log.LDebugf(logger, "water: WATM speaks control protocol version %v", msg.Payload)
+		case CtrlMsgFatalError:
+			tm.fatalReason.Store(string(msg.Payload))
+			log.LErrorf(logger, "water: WATM reported fatal error: %s", msg.Payload)
+		case CtrlMsgLog:
+			if level, text, ok := msg.LogEvent(); ok {
+				switch level {
+				case CtrlLogDebug:
+					log.LDebugf(logger, "water: WATM: %s", text)
+				case CtrlLogInfo:
+					log.LInfof(logger, "water: WATM: %s", text)
+				case CtrlLogWarn:
+					log.LWarnf(logger, "water: WATM: %s", text)
+				default:
+					log.LErrorf(logger, "water: WATM: %s", text)
+				}
+			}
+		}
+
+		tm.ctrlHandlersMutex.Lock()
+		handlers := make([]func(*CtrlMessage), 0, len(tm.ctrlHandlers))
+		for _, h := range tm.ctrlHandlers {
+			handlers = append(handlers, h)
+		}
+		tm.ctrlHandlersMutex.Unlock()
+
+		for _, h := range handlers {
+			h(msg)
+		}
+	}
+}
+
 // WaitWorker waits for the worker thread to exit and returns the error
 // if any.
 func (tm *TransportModule) WaitWorker() error {
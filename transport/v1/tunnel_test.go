@@ -0,0 +1,80 @@
+package v1_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+// TestTunnelWorkerExit checks that a Tunnel dials again once the WATM
+// worker of its connection exits, even while the connection is idle and
+// without health checks.
+func TestTunnelWorkerExit(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:7700") // dialed by the WATM
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // skipcq: GO-S2307
+		}
+	}()
+
+	lost := make(chan error, 1)
+	tunnel, err := water.NewTunnelWithContext(context.Background(), &water.Config{
+		TransportModuleBin:     wasmPlain,
+		DialedAddressValidator: func(string, string) error { return nil },
+	}, water.TunnelOptions{
+		MinBackoff: 10 * time.Millisecond,
+		OnStateChange: func(state water.TunnelState, err error) {
+			if state == water.TunnelDisconnected {
+				select {
+				case lost <- err:
+				default:
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close() // skipcq: GO-S2307
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := tunnel.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker exits cleanly, leaving the connection open but dead
+	if err := conn.Unwrap().(*v1.Conn).TransportModule().Cancel(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-lost:
+		if !errors.Is(err, water.ErrTunnelWorkerExited) {
+			t.Errorf("lost with %v, want %v", err, water.ErrTunnelWorkerExited)
+		}
+	case <-ctx.Done():
+		t.Fatal("tunnel still connected after its worker exited")
+	}
+
+	newConn, err := tunnel.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newConn == conn {
+		t.Error("tunnel returned the lost connection")
+	}
+}
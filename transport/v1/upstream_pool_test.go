@@ -0,0 +1,225 @@
+package v1_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+func TestRelayUpstreamPool(t *testing.T) {
+	// one upstream down, two echoing their name
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = down.Close()
+	pool := water.NewUpstreamPool(water.UpstreamPoolOptions{}, water.Upstream{Network: "tcp", Address: down.Addr().String()})
+	for _, name := range []string{"a", "b"} {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = backend.Close() })
+		go func(name string) {
+			for {
+				conn, err := backend.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(name))
+				_ = conn.Close()
+			}
+		}(name)
+		pool.Add(water.Upstream{Network: "tcp", Address: backend.Addr().String()})
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := v1.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    lis,
+		UpstreamPool:       pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close() // skipcq: GO-S2307
+	go func() {
+		_ = relay.RelayTo("", "") // the pool picks the upstreams
+	}()
+
+	reached := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", relay.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		name := make([]byte, 1)
+		if _, err := io.ReadFull(conn, name); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		_ = conn.Close()
+		reached[string(name)]++
+	}
+	if reached["a"] != 2 || reached["b"] != 2 {
+		t.Errorf("upstreams reached %v, want both twice", reached)
+	}
+}
+
+func TestRelayUpstreamPoolDown(t *testing.T) {
+	// the only upstream is down for the first client, then up
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := upstream.Addr().String()
+	_ = upstream.Close()
+	pool := water.NewUpstreamPool(water.UpstreamPoolOptions{}, water.Upstream{Network: "tcp", Address: address})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := v1.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    lis,
+		UpstreamPool:       pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close() // skipcq: GO-S2307
+	relayed := make(chan error, 1)
+	go func() {
+		relayed <- relay.RelayTo("", "")
+	}()
+
+	conn, err := net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("session without upstream not closed: %v", err)
+	}
+
+	upstream, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("upstream address taken meanwhile: %v", err)
+	}
+	defer upstream.Close() // skipcq: GO-S2307
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("up"))
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err = net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "up" {
+		t.Errorf("read %q, %v once the upstream is up", reply, err)
+	}
+
+	select {
+	case err := <-relayed:
+		t.Errorf("RelayTo() = %v after a session failed", err)
+	default:
+	}
+}
+
+func TestRelayUpstreamPoolHealthCheck(t *testing.T) {
+	// the upstream reports what every connection carried
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close() // skipcq: GO-S2307
+	received := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				data, _ := io.ReadAll(conn)
+				received <- string(data)
+			}()
+		}
+	}()
+
+	pool := water.NewUpstreamPool(water.UpstreamPoolOptions{
+		HealthCheckInterval: 20 * time.Millisecond,
+	}, water.Upstream{Network: "tcp", Address: upstream.Addr().String()})
+	defer pool.Close() // skipcq: GO-S2307
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := v1.NewRelayWithContext(context.Background(), &water.Config{
+		TransportModuleBin: wasmPlain,
+		NetworkListener:    lis,
+		UpstreamPool:       pool,
+		SendProxyProtocol:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close() // skipcq: GO-S2307
+	go func() {
+		_ = relay.RelayTo("", "")
+	}()
+
+	conn, err := net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session carries a header and its data, probes nothing at all
+	var sessions, probes int
+	timeout := time.After(10 * time.Second)
+	for sessions == 0 || probes < 2 {
+		select {
+		case data := <-received:
+			switch {
+			case data == "":
+				probes++
+			case strings.HasSuffix(data, "hello") && len(data) > len("hello"):
+				sessions++
+			default:
+				t.Fatalf("upstream received %q", data)
+			}
+		case <-timeout:
+			t.Fatalf("%d sessions and %d probes received", sessions, probes)
+		}
+	}
+}
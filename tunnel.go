@@ -0,0 +1,505 @@
+package water
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// FallbackAddress is an address of the remote end of a [Tunnel], dialed
+// with a [Dialer] when the [FixedDialer] fails.
+type FallbackAddress struct {
+	Network string // e.g. "tcp"
+	Address string // e.g. "192.0.2.1:443"
+}
+
+// TunnelState is the state of a [Tunnel].
+type TunnelState int
+
+const (
+	// TunnelConnecting is the state of a Tunnel dialing a connection.
+	TunnelConnecting TunnelState = iota
+
+	// TunnelConnected is the state of a Tunnel with a live connection.
+	TunnelConnected
+
+	// TunnelDisconnected is the state of a Tunnel waiting to dial again
+	// after failing to dial or losing its connection.
+	TunnelDisconnected
+
+	// TunnelClosed is the state of a closed Tunnel. It is final.
+	TunnelClosed
+)
+
+// String implements [fmt.Stringer].
+func (s TunnelState) String() string {
+	switch s {
+	case TunnelConnecting:
+		return "connecting"
+	case TunnelConnected:
+		return "connected"
+	case TunnelDisconnected:
+		return "disconnected"
+	case TunnelClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("TunnelState(%d)", int(s))
+	}
+}
+
+// TunnelOptions configures a [Tunnel].
+type TunnelOptions struct {
+	// MinBackoff is the delay before dialing again after a failure. It is
+	// doubled after every consecutive failure. Zero means 500ms.
+	MinBackoff time.Duration
+
+	// MaxBackoff caps the delay between dials. A connection living
+	// longer than MaxBackoff resets the delay, and its loss is followed
+	// by an immediate dial. Zero means 30s.
+	MaxBackoff time.Duration
+
+	// Jitter randomizes every delay by up to this fraction of it, in
+	// either direction, so that clients losing a bridge at once do not
+	// dial it again in lockstep. Zero means 0.2, a negative value
+	// disables it.
+	Jitter float64
+
+	// DialTimeout, if set, bounds every attempt to dial an address.
+	DialTimeout time.Duration
+
+	// HealthCheck, if set, is called on the live connection every
+	// HealthCheckInterval and by [Tunnel.HealthCheck]. The connection is
+	// closed and dialed again if it returns an error.
+	HealthCheck func(ctx context.Context, conn Conn) error
+
+	// HealthCheckInterval is the interval between health checks. Zero
+	// disables periodic health checks.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout bounds every health check. Zero means
+	// HealthCheckInterval, or no limit if it is not set either.
+	HealthCheckTimeout time.Duration
+
+	// OnStateChange, if set, is called on every change of state, with the
+	// error that caused it, if any. Calls are made in order from the
+	// goroutine supervising the tunnel and must not block.
+	OnStateChange func(state TunnelState, err error)
+}
+
+const (
+	defaultTunnelMinBackoff = 500 * time.Millisecond
+	defaultTunnelMaxBackoff = 30 * time.Second
+	defaultTunnelJitter     = 0.2
+)
+
+var (
+	ErrTunnelClosed       = errors.New("water: tunnel closed")
+	ErrTunnelNotConnected = errors.New("water: tunnel not connected")
+	ErrTunnelWorkerExited = errors.New("water: tunnel connection worker exited")
+)
+
+// Tunnel keeps one long-lived connection to a fixed remote end, dialed
+// with a [FixedDialer] and, if it fails, the [Config.FallbackAddresses]
+// in order. The connection is dialed again with exponential backoff
+// whenever it is lost: the WATM worker carrying it exits, even while it
+// is idle, a read or write on it fails, a health check fails or the
+// caller closes it.
+//
+// Connections are obtained with [Tunnel.Conn] and must be obtained again
+// once lost. Data in flight on a lost connection is not carried over.
+type Tunnel struct {
+	fixedDialer FixedDialer
+	dialer      Dialer // nil without fallback addresses
+	fallbacks   []FallbackAddress
+	opts        TunnelOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex   sync.Mutex
+	state   TunnelState
+	conn    *TunnelConn
+	changed chan struct{} // closed on every change of state
+}
+
+// NewTunnelWithContext creates a new [Tunnel] from config and starts
+// dialing.
+//
+// The context bounds the lifetime of the Tunnel: once it is done, the
+// Tunnel is closed.
+func NewTunnelWithContext(ctx context.Context, config *Config, opts TunnelOptions) (*Tunnel, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultTunnelMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultTunnelMaxBackoff
+	}
+	opts.MaxBackoff = max(opts.MaxBackoff, opts.MinBackoff)
+	if opts.Jitter == 0 {
+		opts.Jitter = defaultTunnelJitter
+	}
+	opts.Jitter = min(opts.Jitter, 1)
+	if opts.HealthCheckTimeout == 0 {
+		opts.HealthCheckTimeout = opts.HealthCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	t := &Tunnel{
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+
+	var err error
+	t.fixedDialer, err = NewFixedDialerWithContext(ctx, config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if len(config.FallbackAddresses) > 0 {
+		t.fallbacks = append(t.fallbacks, config.FallbackAddresses...)
+		t.dialer, err = NewDialerWithContext(ctx, config)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	go t.run()
+	return t, nil
+}
+
+// State returns the current state of the Tunnel.
+func (t *Tunnel) State() TunnelState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+// Conn waits for and returns the live connection of the Tunnel.
+//
+// It returns ErrTunnelClosed once the Tunnel is closed.
+func (t *Tunnel) Conn(ctx context.Context) (*TunnelConn, error) {
+	for {
+		t.mutex.Lock()
+		state, conn, changed := t.state, t.conn, t.changed
+		t.mutex.Unlock()
+
+		switch state {
+		case TunnelConnected:
+			if !conn.lost() {
+				return conn, nil
+			}
+		case TunnelClosed:
+			return nil, ErrTunnelClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// HealthCheck runs TunnelOptions.HealthCheck on the live connection now,
+// closing it to dial again if it fails. Without a HealthCheck, it only
+// checks that the Tunnel is connected.
+func (t *Tunnel) HealthCheck(ctx context.Context) error {
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+
+	if conn == nil {
+		return ErrTunnelNotConnected
+	}
+	return t.checkHealth(ctx, conn)
+}
+
+// Close closes the Tunnel and its connection.
+func (t *Tunnel) Close() error {
+	t.cancel()
+	<-t.done
+	return nil
+}
+
+func (t *Tunnel) setState(state TunnelState, conn *TunnelConn, err error) {
+	t.mutex.Lock()
+	t.state, t.conn = state, conn
+	close(t.changed)
+	t.changed = make(chan struct{})
+	t.mutex.Unlock()
+
+	if t.opts.OnStateChange != nil {
+		t.opts.OnStateChange(state, err)
+	}
+}
+
+// run dials and supervises connections until the Tunnel is closed.
+func (t *Tunnel) run() {
+	defer close(t.done)
+	defer t.setState(TunnelClosed, nil, nil)
+
+	var failures int
+	for {
+		t.setState(TunnelConnecting, nil, nil)
+		conn, err := t.dial()
+		var longLived bool
+		if err == nil {
+			t.setState(TunnelConnected, conn, nil)
+			connected := time.Now()
+			err = t.supervise(conn)
+			longLived = time.Since(connected) >= t.opts.MaxBackoff
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+		t.setState(TunnelDisconnected, nil, err)
+
+		if longLived { // dialed again right away
+			failures = 0
+			continue
+		}
+		if !t.sleep(t.backoff(failures)) {
+			return
+		}
+		failures++
+	}
+}
+
+// dial dials with the FixedDialer, then the fallback addresses in order.
+func (t *Tunnel) dial() (*TunnelConn, error) {
+	conn, cancel, err := t.attempt(func(ctx context.Context) (Conn, error) {
+		return t.fixedDialer.DialFixedContext(ctx)
+	})
+	if err == nil {
+		return newTunnelConn(conn, cancel, -1), nil
+	}
+	errs := []error{fmt.Errorf("water: fixed dialer: %w", err)}
+
+	for i, fallback := range t.fallbacks {
+		if t.ctx.Err() != nil {
+			break
+		}
+
+		conn, cancel, err := t.attempt(func(ctx context.Context) (Conn, error) {
+			return t.dialer.DialContext(ctx, fallback.Network, fallback.Address)
+		})
+		if err == nil {
+			return newTunnelConn(conn, cancel, i), nil
+		}
+		errs = append(errs, fmt.Errorf("water: fallback address %d: %w", i, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// attempt dials within DialTimeout. The context of a successful attempt is
+// left alive as it bounds the lifetime of the connection, and must be
+// canceled once it is closed.
+func (t *Tunnel) attempt(dial func(ctx context.Context) (Conn, error)) (Conn, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(t.ctx)
+
+	var timer *time.Timer
+	if t.opts.DialTimeout > 0 {
+		timer = time.AfterFunc(t.opts.DialTimeout, cancel)
+	}
+
+	conn, err := dial(ctx)
+	if timer != nil && !timer.Stop() { // timed out, conn is bound to a canceled context
+		if err == nil {
+			_ = conn.Close()
+		}
+		err = fmt.Errorf("attempt timed out after %v", t.opts.DialTimeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return conn, cancel, nil
+}
+
+// workerConn is implemented by Conns carried by a worker which may return
+// while they are idle, e.g., the WATM worker thread of a v1 Conn.
+type workerConn interface {
+	WaitWorker() error
+}
+
+// supervise blocks until conn is lost or the Tunnel is closed, running
+// periodic health checks, and returns why.
+func (t *Tunnel) supervise(conn *TunnelConn) error {
+	defer conn.fail(ErrTunnelClosed)
+
+	workerDone := make(chan error, 1)
+	if worker, ok := conn.Conn.(workerConn); ok {
+		go func() {
+			workerDone <- worker.WaitWorker() // returns once conn is closed at the latest
+		}()
+	}
+
+	var ticks <-chan time.Time
+	if t.opts.HealthCheck != nil && t.opts.HealthCheckInterval > 0 {
+		ticker := time.NewTicker(t.opts.HealthCheckInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-conn.dead:
+			return conn.err
+		case err := <-workerDone:
+			if err == nil {
+				err = ErrTunnelWorkerExited
+			} else {
+				err = fmt.Errorf("%w: %w", ErrTunnelWorkerExited, err)
+			}
+			conn.fail(err)
+			return conn.err
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		case <-ticks:
+			_ = t.checkHealth(t.ctx, conn)
+		}
+	}
+}
+
+func (t *Tunnel) checkHealth(ctx context.Context, conn *TunnelConn) error {
+	if t.opts.HealthCheck == nil {
+		return nil
+	}
+
+	if t.opts.HealthCheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.opts.HealthCheckTimeout)
+		defer cancel()
+	}
+
+	if err := t.opts.HealthCheck(ctx, conn.Conn); err != nil {
+		err = fmt.Errorf("water: tunnel health check: %w", err)
+		conn.fail(err)
+		return err
+	}
+	return nil
+}
+
+// backoff returns the delay before dialing again after failures
+// consecutive failures.
+func (t *Tunnel) backoff(failures int) time.Duration {
+	d := t.opts.MinBackoff
+	for i := 0; i < failures && d < t.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, t.opts.MaxBackoff)
+
+	if t.opts.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * t.opts.Jitter * float64(d)) // skipcq: GSC-G404
+	}
+	return d
+}
+
+// sleep waits for d, or returns false if the Tunnel is closed first.
+func (t *Tunnel) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// TunnelConn is a connection of a [Tunnel]. The Tunnel dials again once
+// a read or write on it fails, other than by a timeout, or it is closed.
+type TunnelConn struct {
+	Conn
+
+	fallback int
+	cancel   context.CancelFunc
+
+	dead     chan struct{}
+	failOnce sync.Once
+	err      error // set before dead is closed
+	closeErr error
+}
+
+func newTunnelConn(conn Conn, cancel context.CancelFunc, fallback int) *TunnelConn {
+	return &TunnelConn{
+		Conn:     conn,
+		fallback: fallback,
+		cancel:   cancel,
+		dead:     make(chan struct{}),
+	}
+}
+
+// FallbackIndex returns the index in Config.FallbackAddresses of the
+// address of the connection, or -1 if it was dialed by the FixedDialer.
+func (c *TunnelConn) FallbackIndex() int {
+	return c.fallback
+}
+
+// Unwrap returns the connection created by the FixedDialer or Dialer.
+func (c *TunnelConn) Unwrap() Conn {
+	return c.Conn
+}
+
+// Read implements [net.Conn].
+func (c *TunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.failOnError(err)
+	}
+	return n, err
+}
+
+// Write implements [net.Conn].
+func (c *TunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.failOnError(err)
+	}
+	return n, err
+}
+
+// Close closes the connection. The Tunnel then dials a new one.
+//
+// Implements [net.Conn].
+func (c *TunnelConn) Close() error {
+	c.fail(net.ErrClosed)
+	return c.closeErr
+}
+
+func (c *TunnelConn) lost() bool {
+	select {
+	case <-c.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *TunnelConn) failOnError(err error) {
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+	c.fail(err)
+}
+
+// fail closes the connection, recording err as the reason it was lost.
+func (c *TunnelConn) fail(err error) {
+	c.failOnce.Do(func() {
+		c.err = err
+		c.closeErr = c.Conn.Close()
+		c.cancel()
+		close(c.dead)
+	})
+}
@@ -0,0 +1,290 @@
+package water_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/configbuilder/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+var tunnelBlocked atomic.Bool
+
+func init() {
+	err := water.RegisterNativeTransport("tunnel-fixed", func(config []byte) (water.NativeTransport, error) {
+		return tunnelTransport(config), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// tunnelTransport dials the address given as config with a FixedDialer,
+// failing while tunnelBlocked is set.
+type tunnelTransport string
+
+func (tunnelTransport) Wrap(conn net.Conn, _ water.NativeRole) (net.Conn, error) {
+	if tunnelBlocked.Load() {
+		return nil, errors.New("blocked")
+	}
+	return conn, nil
+}
+
+func (t tunnelTransport) FixedAddress() (network, address string) {
+	return "tcp", string(t)
+}
+
+func tunnelConfig(address string, fallbacks ...string) *water.Config {
+	config := &water.Config{
+		NativeTransport:        "tunnel-fixed",
+		TransportModuleConfig:  water.TransportModuleConfigFromBytes([]byte(address)),
+		DialedAddressValidator: func(string, string) error { return nil },
+	}
+	for _, fallback := range fallbacks {
+		config.FallbackAddresses = append(config.FallbackAddresses, water.FallbackAddress{Network: "tcp", Address: fallback})
+	}
+	return config
+}
+
+// tunnelStates records the states of a Tunnel.
+type tunnelStates struct {
+	mutex  sync.Mutex
+	states []water.TunnelState
+}
+
+func (s *tunnelStates) record(state water.TunnelState, _ error) {
+	s.mutex.Lock()
+	s.states = append(s.states, state)
+	s.mutex.Unlock()
+}
+
+func (s *tunnelStates) count(state water.TunnelState) (n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, recorded := range s.states {
+		if recorded == state {
+			n++
+		}
+	}
+	return n
+}
+
+func tunnelConn(t *testing.T, tunnel *water.Tunnel) *water.TunnelConn {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := tunnel.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := muxRoundTrip(t, conn, "hello, tunnel"); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// closedAddress returns an address nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = lis.Close()
+	return lis.Addr().String()
+}
+
+func TestTunnel(t *testing.T) {
+	t.Run("reconnect", testTunnelReconnect)
+	t.Run("fallback", testTunnelFallback)
+	t.Run("backoff", testTunnelBackoff)
+	t.Run("health check", testTunnelHealthCheck)
+	t.Run("close", testTunnelClose)
+	t.Run("JSON", testTunnelJSON)
+	t.Run("proto", testTunnelProto)
+}
+
+func testTunnelReconnect(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	states := &tunnelStates{}
+	tunnel, err := water.NewTunnelWithContext(context.Background(), tunnelConfig(lis.Addr().String()), water.TunnelOptions{
+		MinBackoff:    10 * time.Millisecond,
+		OnStateChange: states.record,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close() // skipcq: GO-S2307
+
+	conn := tunnelConn(t, tunnel)
+	if index := conn.FallbackIndex(); index != -1 {
+		t.Errorf("FallbackIndex() = %d, want -1", index)
+	}
+
+	// losing the connection dials a new one
+	_ = conn.Unwrap().Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Read on a closed connection succeeded")
+	}
+	if newConn := tunnelConn(t, tunnel); newConn == conn {
+		t.Error("tunnel returned the lost connection")
+	}
+	if n := states.count(water.TunnelConnected); n != 2 {
+		t.Errorf("connected %d times, want 2", n)
+	}
+	if n := states.count(water.TunnelDisconnected); n != 1 {
+		t.Errorf("disconnected %d times, want 1", n)
+	}
+}
+
+func testTunnelFallback(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	config := tunnelConfig(closedAddress(t), closedAddress(t), lis.Addr().String())
+	tunnel, err := water.NewTunnelWithContext(context.Background(), config, water.TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close() // skipcq: GO-S2307
+
+	if index := tunnelConn(t, tunnel).FallbackIndex(); index != 1 {
+		t.Errorf("FallbackIndex() = %d, want 1", index)
+	}
+}
+
+func testTunnelBackoff(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	tunnelBlocked.Store(true)
+	defer tunnelBlocked.Store(false)
+
+	states := &tunnelStates{}
+	tunnel, err := water.NewTunnelWithContext(context.Background(), tunnelConfig(lis.Addr().String()), water.TunnelOptions{
+		MinBackoff:    10 * time.Millisecond,
+		MaxBackoff:    40 * time.Millisecond,
+		OnStateChange: states.record,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close() // skipcq: GO-S2307
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := tunnel.Conn(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Conn() err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// 10, 20, 40, 40... ms apart, give or take the jitter
+	if n := states.count(water.TunnelDisconnected); n < 3 || n > 12 {
+		t.Errorf("failed %d times in 300ms", n)
+	}
+
+	tunnelBlocked.Store(false)
+	tunnelConn(t, tunnel)
+}
+
+func testTunnelHealthCheck(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	var unhealthy atomic.Bool
+	tunnel, err := water.NewTunnelWithContext(context.Background(), tunnelConfig(lis.Addr().String()), water.TunnelOptions{
+		MinBackoff: 10 * time.Millisecond,
+		HealthCheck: func(context.Context, water.Conn) error {
+			if unhealthy.Load() {
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close() // skipcq: GO-S2307
+
+	conn := tunnelConn(t, tunnel)
+	if err := tunnel.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	unhealthy.Store(true)
+	if err := tunnel.HealthCheck(context.Background()); err == nil {
+		t.Fatal("HealthCheck succeeded")
+	}
+	unhealthy.Store(false)
+	if newConn := tunnelConn(t, tunnel); newConn == conn {
+		t.Error("tunnel kept the unhealthy connection")
+	}
+}
+
+func testTunnelClose(t *testing.T) {
+	lis := multiEchoServer(t)
+	defer lis.Close() // skipcq: GO-S2307
+
+	tunnel, err := water.NewTunnelWithContext(context.Background(), tunnelConfig(lis.Addr().String()), water.TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tunnelConn(t, tunnel)
+
+	if err := tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if state := tunnel.State(); state != water.TunnelClosed {
+		t.Errorf("State() = %v, want %v", state, water.TunnelClosed)
+	}
+	if _, err := tunnel.Conn(context.Background()); err != water.ErrTunnelClosed {
+		t.Errorf("Conn() err = %v, want %v", err, water.ErrTunnelClosed)
+	}
+	if _, err := conn.Write([]byte("hello")); err == nil {
+		t.Error("connection still open")
+	}
+}
+
+func testTunnelJSON(t *testing.T) {
+	var c water.Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "tunnel-fixed"},
+		"network": {"fallback_addresses": [{"network": "tcp", "address": "192.0.2.1:443"}]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []water.FallbackAddress{{Network: "tcp", Address: "192.0.2.1:443"}}
+	if len(c.FallbackAddresses) != 1 || c.FallbackAddresses[0] != want[0] {
+		t.Errorf("FallbackAddresses = %v, want %v", c.FallbackAddresses, want)
+	}
+}
+
+func testTunnelProto(t *testing.T) {
+	b, err := proto.Marshal(&pb.Config{
+		TransportModule: &pb.TransportModule{Native: "tunnel-fixed"},
+		Network: &pb.Network{
+			FallbackAddresses: []*pb.FallbackAddress{{Network: "tcp", Address: "192.0.2.1:443"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c water.Config
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	want := []water.FallbackAddress{{Network: "tcp", Address: "192.0.2.1:443"}}
+	if len(c.FallbackAddresses) != 1 || c.FallbackAddresses[0] != want[0] {
+		t.Errorf("FallbackAddresses = %v, want %v", c.FallbackAddresses, want)
+	}
+}
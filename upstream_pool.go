@@ -0,0 +1,533 @@
+package water
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water/configbuilder"
+)
+
+// UpstreamPoolStrategy selects the upstream of an [UpstreamPool] each
+// connection goes to.
+type UpstreamPoolStrategy int
+
+const (
+	// UpstreamRoundRobin picks the upstreams in turn.
+	UpstreamRoundRobin UpstreamPoolStrategy = iota
+
+	// UpstreamLeastConnections picks the upstream with the fewest live
+	// connections.
+	UpstreamLeastConnections
+
+	// UpstreamClientIPHash picks the upstream by consistent hashing of the
+	// IP address of the client, so that a client keeps going to the same
+	// upstream as long as it is available, and adding or removing an
+	// upstream only moves the clients of few others.
+	UpstreamClientIPHash
+)
+
+// String implements [fmt.Stringer]. The names are the ones used in JSON
+// and protobuf configs.
+func (s UpstreamPoolStrategy) String() string {
+	switch s {
+	case UpstreamRoundRobin:
+		return "round_robin"
+	case UpstreamLeastConnections:
+		return "least_connections"
+	case UpstreamClientIPHash:
+		return "client_ip_hash"
+	default:
+		return fmt.Sprintf("UpstreamPoolStrategy(%d)", int(s))
+	}
+}
+
+// parseUpstreamPoolStrategy returns the strategy named name, or
+// UpstreamRoundRobin if name is empty.
+func parseUpstreamPoolStrategy(name string) (UpstreamPoolStrategy, error) {
+	for _, s := range []UpstreamPoolStrategy{UpstreamRoundRobin, UpstreamLeastConnections, UpstreamClientIPHash} {
+		if name == s.String() {
+			return s, nil
+		}
+	}
+	if name == "" {
+		return UpstreamRoundRobin, nil
+	}
+	return 0, fmt.Errorf("water: unknown upstream pool strategy %q", name)
+}
+
+// ErrNoUpstream is returned by [UpstreamPool.DialUpstream] when no
+// upstream is available or all of them failed to be dialed.
+var ErrNoUpstream = errors.New("water: no upstream available")
+
+// UpstreamPoolOptions configures an [UpstreamPool].
+type UpstreamPoolOptions struct {
+	// Strategy picks the upstream of every connection.
+	Strategy UpstreamPoolStrategy
+
+	// HealthCheckInterval, if set, is the interval between active health
+	// checks, connecting to every upstream with the func set by
+	// [UpstreamPool.SetHealthCheckDialerFunc]. Upstreams failing it are not
+	// picked until they pass it again. Health checks run from a dial until
+	// the pool is closed or not dialed for 10 intervals.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout bounds every health check. Zero means 2s.
+	HealthCheckTimeout time.Duration
+
+	// MaxFails is the number of consecutive dial failures after which an
+	// upstream is ejected. Zero means 3.
+	MaxFails int
+
+	// EjectDuration is the time an ejected upstream is not picked. Zero
+	// means 30s.
+	EjectDuration time.Duration
+}
+
+// Upstream is an address of an [UpstreamPool].
+type Upstream struct {
+	Network string // e.g. "tcp"
+	Address string // e.g. "192.0.2.1:443"
+}
+
+// UpstreamStatus is the status of an upstream of an [UpstreamPool].
+type UpstreamStatus struct {
+	Upstream
+
+	// Healthy is false if the last active health check failed.
+	Healthy bool
+
+	// Ejected is true if the upstream is ejected after dial failures.
+	Ejected bool
+
+	// Connections is the number of live connections, only counted with
+	// UpstreamLeastConnections.
+	Connections int
+}
+
+// ringReplicas is the number of points of every upstream on the hash
+// ring of UpstreamClientIPHash.
+const ringReplicas = 64
+
+// UpstreamPool is a set of upstream addresses a v1 [Relay] with
+// [Config.UpstreamPool] set relays its connections to, load balanced by
+// a [UpstreamPoolStrategy]. Upstreams failing to be dialed or to pass
+// health checks are skipped, and upstreams can be added and removed at
+// any time.
+type UpstreamPool struct {
+	options UpstreamPoolOptions
+
+	mutex     sync.Mutex
+	upstreams []*upstream
+	ring      []ringPoint // sorted by hash
+	next      int         // next upstream for UpstreamRoundRobin
+	checking  bool        // health checks running
+	lastDial  time.Time
+	probeFunc func(network, address string) (net.Conn, error) // of health checks, net.Dial if nil
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type upstream struct {
+	Upstream
+
+	healthy      bool
+	fails        int // consecutive dial failures
+	ejectedUntil time.Time
+	conns        int
+}
+
+func (u *upstream) available(now time.Time) bool {
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *upstream
+}
+
+// NewUpstreamPool returns a pool of upstreams. Its active health checks,
+// if any, start with the first dial, and stop once it is no longer dialed.
+func NewUpstreamPool(options UpstreamPoolOptions, upstreams ...Upstream) *UpstreamPool {
+	if options.HealthCheckTimeout == 0 {
+		options.HealthCheckTimeout = 2 * time.Second
+	}
+	if options.MaxFails == 0 {
+		options.MaxFails = 3
+	}
+	if options.EjectDuration == 0 {
+		options.EjectDuration = 30 * time.Second
+	}
+
+	p := &UpstreamPool{
+		options: options,
+		closed:  make(chan struct{}),
+	}
+	for _, u := range upstreams {
+		p.Add(u)
+	}
+	return p
+}
+
+// Add adds u to the pool, unless it is already in it.
+func (p *UpstreamPool) Add(u Upstream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.index(u) >= 0 {
+		return
+	}
+	p.upstreams = append(p.upstreams, &upstream{Upstream: u, healthy: true})
+	p.buildRing()
+}
+
+// Remove removes u from the pool, and reports whether it was in it. Live
+// connections to u are left open.
+func (p *UpstreamPool) Remove(u Upstream) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i := p.index(u)
+	if i < 0 {
+		return false
+	}
+	p.upstreams = append(p.upstreams[:i:i], p.upstreams[i+1:]...)
+	p.buildRing()
+	return true
+}
+
+// Upstreams returns the status of every upstream of the pool.
+func (p *UpstreamPool) Upstreams() []UpstreamStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	statuses := make([]UpstreamStatus, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		statuses = append(statuses, UpstreamStatus{
+			Upstream:    u.Upstream,
+			Healthy:     u.healthy,
+			Ejected:     now.Before(u.ejectedUntil),
+			Connections: u.conns,
+		})
+	}
+	return statuses
+}
+
+// DialUpstream dials an upstream picked for a connection from client,
+// which may be nil, with dialerFunc. Upstreams failing to be dialed are
+// skipped, until none is left.
+func (p *UpstreamPool) DialUpstream(dialerFunc func(network, address string) (net.Conn, error), client net.Addr) (net.Conn, error) {
+	p.startHealthChecks()
+
+	tried := make(map[*upstream]bool)
+	errs := []error{ErrNoUpstream}
+	for {
+		u := p.pick(client, tried)
+		if u == nil {
+			return nil, errors.Join(errs...)
+		}
+		tried[u] = true
+
+		conn, err := dialerFunc(u.Network, u.Address)
+		if err != nil {
+			p.dialed(u, err)
+			errs = append(errs, fmt.Errorf("dialing %s %s: %w", u.Network, u.Address, err))
+			continue
+		}
+		p.dialed(u, nil)
+
+		if p.options.Strategy == UpstreamLeastConnections {
+			return &upstreamConn{Conn: conn, pool: p, upstream: u}, nil
+		}
+		return conn, nil
+	}
+}
+
+// Close stops the active health checks of the pool.
+func (p *UpstreamPool) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+// pick returns an available upstream not tried yet, or nil.
+func (p *UpstreamPool) pick(client net.Addr, tried map[*upstream]bool) *upstream {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	candidate := func(u *upstream) bool {
+		return !tried[u] && u.available(now)
+	}
+
+	if p.options.Strategy == UpstreamClientIPHash && client != nil && len(p.ring) > 0 {
+		h := hashKey(clientIP(client))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for i := 0; i < len(p.ring); i++ {
+			if u := p.ring[(start+i)%len(p.ring)].upstream; candidate(u) {
+				return u
+			}
+		}
+		return nil
+	}
+
+	// round robin, also breaking ties between the least connected
+	var picked *upstream
+	pickedIndex := 0
+	for i := 0; i < len(p.upstreams); i++ {
+		index := (p.next + i) % len(p.upstreams)
+		u := p.upstreams[index]
+		if !candidate(u) {
+			continue
+		}
+		if picked == nil || (p.options.Strategy == UpstreamLeastConnections && u.conns < picked.conns) {
+			picked, pickedIndex = u, index
+		}
+		if p.options.Strategy != UpstreamLeastConnections {
+			break
+		}
+	}
+	if picked != nil {
+		p.next = pickedIndex + 1
+	}
+	return picked
+}
+
+// dialed records the result of dialing u, ejecting it after too many
+// consecutive failures.
+func (p *UpstreamPool) dialed(u *upstream, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err == nil {
+		u.fails = 0
+		if p.options.Strategy == UpstreamLeastConnections {
+			u.conns++
+		}
+		return
+	}
+
+	u.fails++
+	if u.fails >= p.options.MaxFails {
+		u.fails = 0
+		u.ejectedUntil = time.Now().Add(p.options.EjectDuration)
+	}
+}
+
+func (p *UpstreamPool) index(u Upstream) int {
+	for i, existing := range p.upstreams {
+		if existing.Upstream == u {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *UpstreamPool) buildRing() {
+	p.ring = p.ring[:0]
+	for _, u := range p.upstreams {
+		for i := 0; i < ringReplicas; i++ {
+			key := u.Network + " " + u.Address + "#" + strconv.Itoa(i)
+			p.ring = append(p.ring, ringPoint{hash: hashKey(key), upstream: u})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+// healthCheckIdleRounds is the number of health check intervals without a
+// dial after which the health checks of an UpstreamPool stop, so that a
+// pool left behind, e.g., with its Config, does not check forever.
+const healthCheckIdleRounds = 10
+
+// SetHealthCheckDialerFunc sets the func active health checks connect to
+// the upstreams with, net.Dial by default. A v1 [Relay] sets the
+// NetworkDialerFunc of its Config, as the funcs given to DialUpstream may
+// be bound to a session, e.g., to send a PROXY protocol header.
+func (p *UpstreamPool) SetHealthCheckDialerFunc(dialerFunc func(network, address string) (net.Conn, error)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.probeFunc = dialerFunc
+}
+
+// startHealthChecks records a dial, and starts the health checks if they
+// are not running.
+func (p *UpstreamPool) startHealthChecks() {
+	if p.options.HealthCheckInterval <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.lastDial = time.Now()
+	if p.checking {
+		return
+	}
+	select {
+	case <-p.closed:
+		return
+	default:
+	}
+	p.checking = true
+
+	go func() {
+		ticker := time.NewTicker(p.options.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			p.checkHealth()
+			select {
+			case <-ticker.C:
+			case <-p.closed:
+				return
+			}
+
+			p.mutex.Lock()
+			if time.Since(p.lastDial) > healthCheckIdleRounds*p.options.HealthCheckInterval {
+				p.checking = false
+				p.mutex.Unlock()
+				return
+			}
+			p.mutex.Unlock()
+		}
+	}()
+}
+
+// checkHealth connects to every upstream concurrently, and records which
+// ones are healthy.
+func (p *UpstreamPool) checkHealth() {
+	p.mutex.Lock()
+	upstreams := append([]*upstream(nil), p.upstreams...)
+	probeFunc := p.probeFunc
+	p.mutex.Unlock()
+	if probeFunc == nil {
+		probeFunc = net.Dial
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			healthy := p.probe(probeFunc, u.Upstream)
+
+			p.mutex.Lock()
+			u.healthy = healthy
+			p.mutex.Unlock()
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe reports whether u can be dialed with dialerFunc within the
+// HealthCheckTimeout. A connection dialed later is closed.
+func (p *UpstreamPool) probe(dialerFunc func(network, address string) (net.Conn, error), u Upstream) bool {
+	done := make(chan error, 1)
+	go func() {
+		conn, err := dialerFunc(u.Network, u.Address)
+		if err == nil {
+			_ = conn.Close()
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(p.options.HealthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+// upstreamConn is a connection to an upstream of an UpstreamPool counting
+// connections.
+type upstreamConn struct {
+	net.Conn
+	pool      *UpstreamPool
+	upstream  *upstream
+	closeOnce sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.pool.mutex.Lock()
+		c.upstream.conns--
+		c.pool.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	// FNV-1a alone spreads keys differing in their last bytes poorly on
+	// the ring, so its sum goes through the finalizer of MurmurHash3.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// clientIP returns the IP address of client without its port, if any.
+func clientIP(client net.Addr) string {
+	switch client := client.(type) {
+	case *net.TCPAddr:
+		return client.IP.String()
+	case *net.UDPAddr:
+		return client.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(client.String()); err == nil {
+		return host
+	}
+	return client.String()
+}
+
+func upstreamPoolFromJSON(confJson *configbuilder.ConfigJSON) (*UpstreamPool, error) {
+	poolJson := &confJson.Network.UpstreamPool
+	strategy, err := parseUpstreamPoolStrategy(poolJson.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := NewUpstreamPool(UpstreamPoolOptions{
+		Strategy:            strategy,
+		HealthCheckInterval: time.Duration(poolJson.HealthCheckIntervalMs) * time.Millisecond,
+		HealthCheckTimeout:  time.Duration(poolJson.HealthCheckTimeoutMs) * time.Millisecond,
+		MaxFails:            int(poolJson.MaxFails),
+		EjectDuration:       time.Duration(poolJson.EjectDurationMs) * time.Millisecond,
+	})
+	for _, u := range poolJson.Upstreams {
+		pool.Add(Upstream{Network: u.Network, Address: u.Address})
+	}
+	return pool, nil
+}
+
+func upstreamPoolFromProto(confProto *configbuilder.ConfigProtoBuf) (*UpstreamPool, error) {
+	poolProto := confProto.GetNetwork().GetUpstreamPool()
+	strategy, err := parseUpstreamPoolStrategy(poolProto.GetStrategy())
+	if err != nil {
+		return nil, err
+	}
+
+	pool := NewUpstreamPool(UpstreamPoolOptions{
+		Strategy:            strategy,
+		HealthCheckInterval: time.Duration(poolProto.GetHealthCheckIntervalMs()) * time.Millisecond,
+		HealthCheckTimeout:  time.Duration(poolProto.GetHealthCheckTimeoutMs()) * time.Millisecond,
+		MaxFails:            int(poolProto.GetMaxFails()),
+		EjectDuration:       time.Duration(poolProto.GetEjectDurationMs()) * time.Millisecond,
+	})
+	for _, u := range poolProto.GetUpstreams() {
+		pool.Add(Upstream{Network: u.GetNetwork(), Address: u.GetAddress()})
+	}
+	return pool, nil
+}
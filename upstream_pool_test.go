@@ -0,0 +1,317 @@
+package water_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	pb "github.com/refraction-networking/water/configbuilder/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeUpstreams is a dialer func for an UpstreamPool, recording the
+// addresses dialed and failing to dial the ones down.
+type fakeUpstreams struct {
+	dialed []string
+	down   map[string]bool
+}
+
+func (f *fakeUpstreams) dial(network, address string) (net.Conn, error) {
+	f.dialed = append(f.dialed, address)
+	if f.down[address] {
+		return nil, fmt.Errorf("%s is down", address)
+	}
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	return c1, nil
+}
+
+func upstreams(addresses ...string) []water.Upstream {
+	var us []water.Upstream
+	for _, address := range addresses {
+		us = append(us, water.Upstream{Network: "tcp", Address: address})
+	}
+	return us
+}
+
+func TestUpstreamPool(t *testing.T) {
+	client := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{}, upstreams("a", "b", "c")...)
+		f := &fakeUpstreams{}
+		for i := 0; i < 6; i++ {
+			if _, err := pool.DialUpstream(f.dial, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := fmt.Sprint(f.dialed); got != "[a b c a b c]" {
+			t.Errorf("dialed %s", got)
+		}
+	})
+
+	t.Run("LeastConnections", func(t *testing.T) {
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{Strategy: water.UpstreamLeastConnections}, upstreams("a", "b")...)
+		f := &fakeUpstreams{}
+		a, err := pool.DialUpstream(f.dial, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.DialUpstream(f.dial, nil); err != nil { // b
+			t.Fatal(err)
+		}
+		_ = a.Close()
+		_ = a.Close()                                             // counted once
+		if _, err := pool.DialUpstream(f.dial, nil); err != nil { // a, with no connection
+			t.Fatal(err)
+		}
+		if _, err := pool.DialUpstream(f.dial, nil); err != nil { // tie, in turn
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(f.dialed); got != "[a b a b]" {
+			t.Errorf("dialed %s", got)
+		}
+		for _, status := range pool.Upstreams() {
+			if status.Connections != 2 && status.Address == "b" || status.Connections != 1 && status.Address == "a" {
+				t.Errorf("%s has %d connections", status.Address, status.Connections)
+			}
+		}
+	})
+
+	t.Run("ClientIPHash", func(t *testing.T) {
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{Strategy: water.UpstreamClientIPHash}, upstreams("a", "b", "c", "d")...)
+		f := &fakeUpstreams{}
+		picked := make(map[string]string)
+		for i := 0; i < 64; i++ {
+			ip := fmt.Sprintf("198.51.100.%d", i)
+			for j := 0; j < 2; j++ {
+				f.dialed = nil
+				if _, err := pool.DialUpstream(f.dial, client(ip)); err != nil {
+					t.Fatal(err)
+				}
+				if previous, ok := picked[ip]; ok && previous != f.dialed[0] {
+					t.Fatalf("%s went to %s, then %s", ip, previous, f.dialed[0])
+				}
+				picked[ip] = f.dialed[0]
+			}
+		}
+		counts := make(map[string]int)
+		for _, address := range picked {
+			counts[address]++
+		}
+		if len(counts) != 4 {
+			t.Errorf("clients spread over %v", counts)
+		}
+
+		// removing an upstream only moves its clients
+		pool.Remove(water.Upstream{Network: "tcp", Address: "d"})
+		for ip, previous := range picked {
+			f.dialed = nil
+			if _, err := pool.DialUpstream(f.dial, client(ip)); err != nil {
+				t.Fatal(err)
+			}
+			if previous != "d" && f.dialed[0] != previous {
+				t.Errorf("%s moved from %s to %s", ip, previous, f.dialed[0])
+			}
+		}
+	})
+
+	t.Run("PassiveEjection", func(t *testing.T) {
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{
+			MaxFails:      2,
+			EjectDuration: 100 * time.Millisecond,
+		}, upstreams("a", "b")...)
+		f := &fakeUpstreams{down: map[string]bool{"a": true}}
+		for i := 0; i < 4; i++ {
+			if _, err := pool.DialUpstream(f.dial, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// a fails twice, then is ejected
+		if got := fmt.Sprint(f.dialed); got != "[a b a b b b]" {
+			t.Errorf("dialed %s", got)
+		}
+		if status := pool.Upstreams()[0]; !status.Ejected {
+			t.Error("a not ejected")
+		}
+
+		f.down["b"] = true
+		if _, err := pool.DialUpstream(f.dial, nil); !errors.Is(err, water.ErrNoUpstream) {
+			t.Errorf("dialing with no upstream up: %v", err)
+		}
+
+		time.Sleep(150 * time.Millisecond)
+		delete(f.down, "a")
+		f.dialed = nil
+		if _, err := pool.DialUpstream(f.dial, nil); err != nil {
+			t.Fatal(err)
+		}
+		if f.dialed[len(f.dialed)-1] != "a" {
+			t.Errorf("dialed %v after ejection", f.dialed)
+		}
+	})
+
+	t.Run("HealthCheck", func(t *testing.T) {
+		up, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer up.Close() // skipcq: GO-S2307
+		down, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = down.Close()
+
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{
+			HealthCheckInterval: 20 * time.Millisecond,
+			MaxFails:            100, // only health checks skip the closed upstream
+		}, upstreams(down.Addr().String(), up.Addr().String())...)
+		defer pool.Close() // skipcq: GO-S2307
+
+		// health checks go through the dialer func set for them only
+		var probes, dials atomic.Int32
+		pool.SetHealthCheckDialerFunc(func(network, address string) (net.Conn, error) {
+			probes.Add(1)
+			return net.Dial(network, address)
+		})
+		dial := func(network, address string) (net.Conn, error) {
+			dials.Add(1)
+			return net.Dial(network, address)
+		}
+		conn, err := pool.DialUpstream(dial, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		dialed := dials.Load()
+		deadline := time.Now().Add(2 * time.Second)
+		for pool.Upstreams()[0].Healthy {
+			if time.Now().After(deadline) {
+				t.Fatal("closed upstream still healthy")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !pool.Upstreams()[1].Healthy {
+			t.Error("listening upstream unhealthy")
+		}
+		if n := probes.Load(); n < 2 {
+			t.Errorf("health check dialer func called %d times", n)
+		}
+		if n := dials.Load(); n != dialed {
+			t.Errorf("dialer func of DialUpstream called %d times by health checks", n-dialed)
+		}
+
+		for i := 0; i < 3; i++ {
+			conn, err := pool.DialUpstream(dial, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.RemoteAddr().String() != up.Addr().String() {
+				t.Errorf("dialed unhealthy upstream %s", conn.RemoteAddr())
+			}
+			_ = conn.Close()
+		}
+	})
+
+	t.Run("HealthCheckIdle", func(t *testing.T) {
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{
+			HealthCheckInterval: time.Millisecond,
+		}, upstreams("a")...)
+		defer pool.Close() // skipcq: GO-S2307
+
+		var probes atomic.Int32
+		pool.SetHealthCheckDialerFunc(func(network, address string) (net.Conn, error) {
+			probes.Add(1)
+			return nil, errors.New("down")
+		})
+		_, _ = pool.DialUpstream(func(network, address string) (net.Conn, error) {
+			return nil, errors.New("down")
+		}, nil)
+
+		// health checks stop once the pool is no longer dialed
+		time.Sleep(200 * time.Millisecond)
+		n := probes.Load()
+		time.Sleep(100 * time.Millisecond)
+		if probes.Load() != n {
+			t.Error("health checks still running in an idle pool")
+		}
+	})
+
+	t.Run("AddRemove", func(t *testing.T) {
+		pool := water.NewUpstreamPool(water.UpstreamPoolOptions{})
+		f := &fakeUpstreams{}
+		if _, err := pool.DialUpstream(f.dial, nil); !errors.Is(err, water.ErrNoUpstream) {
+			t.Errorf("dialing empty pool: %v", err)
+		}
+
+		pool.Add(upstreams("a")[0])
+		pool.Add(upstreams("a")[0]) // no duplicate
+		pool.Add(upstreams("b")[0])
+		if n := len(pool.Upstreams()); n != 2 {
+			t.Fatalf("%d upstreams", n)
+		}
+		if !pool.Remove(upstreams("a")[0]) || pool.Remove(upstreams("a")[0]) {
+			t.Error("removing a")
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := pool.DialUpstream(f.dial, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := fmt.Sprint(f.dialed); got != "[b b]" {
+			t.Errorf("dialed %s", got)
+		}
+	})
+}
+
+func TestConfig_UpstreamPool(t *testing.T) {
+	var c water.Config
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"upstream_pool": {
+			"strategy": "least_connections",
+			"upstreams": [{"network": "tcp", "address": "192.0.2.1:443"}, {"network": "tcp", "address": "192.0.2.2:443"}],
+			"max_fails": 1
+		}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UpstreamPool == nil || len(c.UpstreamPool.Upstreams()) != 2 {
+		t.Fatal("JSON: UpstreamPool not set")
+	}
+
+	b, err := proto.Marshal(&pb.Config{
+		TransportModule: &pb.TransportModule{Native: "plain"},
+		Network: &pb.Network{UpstreamPool: &pb.UpstreamPool{
+			Strategy:              "client_ip_hash",
+			Upstreams:             []*pb.Upstream{{Network: "tcp", Address: "192.0.2.1:443"}},
+			HealthCheckIntervalMs: 1000,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = water.Config{}
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	if c.UpstreamPool == nil || c.UpstreamPool.Upstreams()[0].Address != "192.0.2.1:443" {
+		t.Fatal("protobuf: UpstreamPool not set")
+	}
+
+	err = (&water.Config{}).UnmarshalJSON([]byte(`{
+		"transport_module": {"native": "plain"},
+		"network": {"upstream_pool": {"strategy": "random", "upstreams": [{"network": "tcp", "address": "192.0.2.1:443"}]}}
+	}`))
+	if err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
@@ -0,0 +1,92 @@
+package water
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/refraction-networking/water/proxy/httpproxy"
+	"github.com/refraction-networking/water/proxy/socks5"
+)
+
+// upstreamProxyTimeout bounds dialing an upstream proxy and the handshake
+// with it, so that a stalled proxy does not block a Transport Module.
+const upstreamProxyTimeout = 30 * time.Second
+
+// UpstreamProxyDialerFunc returns a func to be used as
+// [Config.NetworkDialerFunc], dialing every address through the proxy at
+// proxyURL, so that the connections of a Transport Module leave through
+// the proxy.
+//
+// The scheme of proxyURL selects the protocol: "socks5" (or "socks5h")
+// for a SOCKS5 proxy, "http" for an HTTP proxy accepting CONNECT
+// requests. The user info of proxyURL, if any, is used to authenticate
+// with the proxy. Only TCP addresses can be dialed through a proxy.
+//
+// The proxy itself is dialed with forward, or [net.Dial] if forward is
+// nil, which allows to chain proxies. Dialing the proxy and the handshake
+// with it must complete within 30 seconds.
+func UpstreamProxyDialerFunc(proxyURL *url.URL, forward func(network, address string) (net.Conn, error)) (func(network, address string) (net.Conn, error), error) {
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("water: upstream proxy %q has no host", proxyURL.Redacted())
+	}
+	username, password := proxyURL.User.Username(), ""
+	if p, ok := proxyURL.User.Password(); ok {
+		password = p
+	}
+
+	var forwardContext func(ctx context.Context, network, address string) (net.Conn, error)
+	if forward != nil {
+		forwardContext = func(_ context.Context, network, address string) (net.Conn, error) {
+			return forward(network, address)
+		}
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		d := &socks5.Dialer{
+			ProxyAddress: proxyURL.Host,
+			Username:     username,
+			Password:     password,
+			Forward:      forwardContext,
+		}
+		return withUpstreamProxyTimeout(d.DialContext), nil
+	case "http":
+		d := &httpproxy.Dialer{
+			ProxyAddress: proxyURL.Host,
+			Username:     username,
+			Password:     password,
+			Forward:      forwardContext,
+		}
+		return withUpstreamProxyTimeout(d.DialContext), nil
+	default:
+		return nil, fmt.Errorf("water: unsupported upstream proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+// withUpstreamProxyTimeout bounds every call to dial by
+// upstreamProxyTimeout.
+func withUpstreamProxyTimeout(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamProxyTimeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
+
+// upstreamProxyDialerFunc parses rawURL and wraps c.NetworkDialerFunc to
+// dial through the proxy it designates.
+func (c *Config) upstreamProxyDialerFunc(rawURL string) error {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("water: parsing upstream proxy: %w", err)
+	}
+	dialerFunc, err := UpstreamProxyDialerFunc(proxyURL, c.NetworkDialerFunc)
+	if err != nil {
+		return err
+	}
+	c.NetworkDialerFunc = dialerFunc
+	return nil
+}
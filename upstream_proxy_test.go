@@ -0,0 +1,263 @@
+package water_test
+
+import (
+	"context"
+	_ "embed"
+	"io"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	pb "github.com/refraction-networking/water/configbuilder/pb"
+	"github.com/refraction-networking/water/proxy/httpproxy"
+	"github.com/refraction-networking/water/proxy/socks5"
+	_ "github.com/refraction-networking/water/transport/v0"
+	_ "github.com/refraction-networking/water/transport/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:embed transport/v0/testdata/plain.wasm
+var wasmPlainV0 []byte
+
+// wrappedConn hides the concrete type of a connection, so that it is not
+// a [net.TCPConn] when inserted into a Transport Module.
+type wrappedConn struct {
+	net.Conn
+}
+
+// wrappedDialerFunc returns a NetworkDialerFunc returning wrapped
+// connections, and the number of connections it dialed.
+func wrappedDialerFunc() (func(network, address string) (net.Conn, error), *atomic.Int32) {
+	dialed := &atomic.Int32{}
+	return func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		dialed.Add(1)
+		return &wrappedConn{conn}, nil
+	}, dialed
+}
+
+func upstreamEchoServer(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // skipcq: GO-S2307
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// startUpstreamProxy serves a SOCKS5 or HTTP proxy, selected by scheme,
+// accepting username and password, and returns its URL with credentials.
+func startUpstreamProxy(t *testing.T, scheme, username, password string) *url.URL {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+
+	var d net.Dialer
+	credentials := map[string]string{username: password}
+	switch scheme {
+	case "socks5":
+		s := &socks5.Server{Dial: d.DialContext, Credentials: credentials}
+		go func() { _ = s.Serve(lis) }()
+	case "http":
+		s := &httpproxy.Server{Dial: d.DialContext, Credentials: credentials}
+		go func() { _ = s.Serve(lis) }()
+	}
+	return &url.URL{Scheme: scheme, Host: lis.Addr().String(), User: url.UserPassword(username, password)}
+}
+
+func upstreamRoundTrip(t *testing.T, config *water.Config, target string) {
+	t.Helper()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	msg := "hello, upstream proxy"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != msg {
+		t.Errorf("echoed %q, want %q", echoed, msg)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	t.Run("SOCKS5 from JSON", testUpstreamProxySOCKS5JSON)
+	t.Run("HTTP from protobuf", testUpstreamProxyHTTPProto)
+	t.Run("v0 host_dial", testUpstreamProxyV0)
+	t.Run("FixedDialer water_dial_fixed", testUpstreamProxyFixedDialer)
+	t.Run("wrong credentials", testUpstreamProxyWrongCredentials)
+	t.Run("unsupported scheme", testUpstreamProxyUnsupportedScheme)
+}
+
+func testUpstreamProxySOCKS5JSON(t *testing.T) {
+	proxyURL := startUpstreamProxy(t, "socks5", "user", "secret")
+
+	// the proxy is dialed with the NetworkDialerFunc set beforehand, whose
+	// connections, and thus those through the proxy, are not TCP
+	// connections
+	dialerFunc, dialed := wrappedDialerFunc()
+	c := &water.Config{NetworkDialerFunc: dialerFunc}
+	err := c.UnmarshalJSON([]byte(`{
+		"transport_module": {"bin": "transport/v1/testdata/plain.wasm"},
+		"network": {"upstream_proxy": "` + proxyURL.String() + `"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamRoundTrip(t, c, upstreamEchoServer(t))
+	if n := dialed.Load(); n != 1 {
+		t.Errorf("proxy dialed %d times, want 1", n)
+	}
+}
+
+func testUpstreamProxyHTTPProto(t *testing.T) {
+	proxyURL := startUpstreamProxy(t, "http", "user", "secret")
+
+	b, err := proto.Marshal(&pb.Config{
+		TransportModule: &pb.TransportModule{Bin: wasmPlain},
+		Network:         &pb.Network{UpstreamProxy: proxyURL.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialerFunc, dialed := wrappedDialerFunc()
+	c := &water.Config{NetworkDialerFunc: dialerFunc}
+	if err := c.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamRoundTrip(t, c, upstreamEchoServer(t))
+	if n := dialed.Load(); n != 1 {
+		t.Errorf("proxy dialed %d times, want 1", n)
+	}
+}
+
+func testUpstreamProxyV0(t *testing.T) {
+	proxyURL := startUpstreamProxy(t, "socks5", "user", "secret")
+
+	dialerFunc, err := water.UpstreamProxyDialerFunc(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamRoundTrip(t, &water.Config{
+		TransportModuleBin: wasmPlainV0,
+		NetworkDialerFunc:  dialerFunc,
+	}, upstreamEchoServer(t))
+}
+
+func testUpstreamProxyFixedDialer(t *testing.T) {
+	// the proxy reaches the echo server whatever the fixed address of the
+	// WATM, and reports it
+	echo := upstreamEchoServer(t)
+	requested := make(chan string, 1)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	s := &socks5.Server{Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		select {
+		case requested <- address:
+		default:
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, echo)
+	}}
+	go func() { _ = s.Serve(lis) }()
+
+	dialerFunc, err := water.UpstreamProxyDialerFunc(&url.URL{Scheme: "socks5", Host: lis.Addr().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixedDialer, err := water.NewFixedDialerWithContext(context.Background(), &water.Config{
+		TransportModuleBin:     wasmPlain,
+		NetworkDialerFunc:      dialerFunc,
+		DialedAddressValidator: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := fixedDialer.DialFixedContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	msg := "hello, upstream proxy"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != msg {
+		t.Fatalf("echoed %q, %v, want %q", echoed, err, msg)
+	}
+	if address := <-requested; address != "localhost:7700" {
+		t.Errorf("proxy asked for %s, want the fixed address localhost:7700", address)
+	}
+}
+
+func testUpstreamProxyWrongCredentials(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		proxyURL := startUpstreamProxy(t, scheme, "user", "secret")
+		proxyURL.User = url.UserPassword("user", "wrong")
+
+		dialerFunc, err := water.UpstreamProxyDialerFunc(proxyURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := dialerFunc("tcp", upstreamEchoServer(t)); err == nil {
+			_ = conn.Close()
+			t.Errorf("%s: dialed with wrong credentials", scheme)
+		}
+	}
+}
+
+func testUpstreamProxyUnsupportedScheme(t *testing.T) {
+	err := (&water.Config{}).UnmarshalJSON([]byte(`{
+		"transport_module": {"bin": "transport/v1/testdata/plain.wasm"},
+		"network": {"upstream_proxy": "ftp://192.0.2.1:21"}
+	}`))
+	if err == nil {
+		t.Error("unsupported scheme accepted")
+	}
+}
@@ -0,0 +1,324 @@
+// Package censor emulates a DPI middlebox for evaluating how well a WATM
+// evades simple censorship.
+//
+// A [Censor] wraps the NetworkDialerFunc of a [water.Config] and sits on
+// every connection dialed through it, inspecting the first bytes in each
+// direction against a list of rules. The first matching rule decides the
+// fate of the connection: it is reset, throttled or silently dropped. A
+// [Verdict] is recorded for every connection once it closes.
+//
+//	c := &censor.Censor{
+//		Rules: []censor.Rule{{
+//			Name:    "plain HTTP",
+//			Matcher: censor.IsProtocol(censor.ProtocolHTTP),
+//			Action:  censor.ActionReset,
+//		}},
+//	}
+//	config.NetworkDialerFunc = c.Wrap(net.Dial)
+package censor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water/internal/socket"
+)
+
+// DefaultInspectBytes is used when Censor.InspectBytes is not set.
+const DefaultInspectBytes = 4096
+
+// Action is what the Censor does with a connection matching a Rule.
+type Action uint8
+
+const (
+	// ActionNone lets the connection through.
+	ActionNone Action = iota
+
+	// ActionReset resets the connection towards both ends.
+	ActionReset
+
+	// ActionThrottle limits the bandwidth of the connection to
+	// Rule.ThrottleBandwidth for the rest of its lifetime.
+	ActionThrottle
+
+	// ActionDrop silently drops all further data in both directions,
+	// leaving the connection open.
+	ActionDrop
+)
+
+// String implements fmt.Stringer.
+func (a Action) String() string {
+	switch a {
+	case ActionNone:
+		return "none"
+	case ActionReset:
+		return "reset"
+	case ActionThrottle:
+		return "throttle"
+	case ActionDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(a))
+	}
+}
+
+// Rule is a censorship rule.
+type Rule struct {
+	Name    string
+	Matcher Matcher
+	Action  Action
+
+	// ThrottleBandwidth is the bandwidth in bytes per second allowed
+	// by ActionThrottle, per direction.
+	ThrottleBandwidth int
+}
+
+// Verdict is the outcome of the inspection of a single connection.
+type Verdict struct {
+	ID       int
+	Network  string
+	Address  string
+	Start    time.Time
+	End      time.Time
+	Protocol Protocol // as classified from the inspected bytes
+	Entropy  float64  // of the inspected client bytes, in bits per byte
+
+	Bytes   [2]int64 // forwarded, by Direction
+	Packets [2]int   // seen, by Direction
+
+	Rule   string // name of the matching rule, empty if none matched
+	Action Action
+}
+
+// Blocked reports whether a rule matched the connection.
+func (v *Verdict) Blocked() bool {
+	return v.Rule != ""
+}
+
+// String implements fmt.Stringer.
+func (v *Verdict) String() string {
+	protocol := v.Protocol
+	if protocol == ProtocolUnknown {
+		protocol = "unknown"
+	}
+	s := fmt.Sprintf("#%d %s %s: protocol=%s entropy=%.2f c2s=%dB/%dpkt s2c=%dB/%dpkt",
+		v.ID, v.Network, v.Address, protocol, v.Entropy,
+		v.Bytes[ClientToServer], v.Packets[ClientToServer], v.Bytes[ServerToClient], v.Packets[ServerToClient])
+	if v.Blocked() {
+		s += fmt.Sprintf(" => %s by %q", v.Action, v.Rule)
+	} else {
+		s += " => allowed"
+	}
+	return s
+}
+
+// Censor is an emulated DPI middlebox. Its fields must not be changed
+// once it is in use.
+type Censor struct {
+	// Rules are evaluated in order, the first match wins.
+	Rules []Rule
+
+	// InspectBytes is the number of bytes inspected in each direction,
+	// after which the connection is no longer inspected. Defaults to
+	// DefaultInspectBytes.
+	InspectBytes int
+
+	// OnVerdict, if set, is called with the verdict of every connection
+	// once it closes.
+	OnVerdict func(*Verdict)
+
+	mutex    sync.Mutex
+	nextID   int
+	verdicts []*Verdict
+}
+
+// Verdicts returns the verdicts of all connections closed so far.
+func (c *Censor) Verdicts() []*Verdict {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Verdict(nil), c.verdicts...)
+}
+
+// Wrap returns a NetworkDialerFunc that puts the Censor on every
+// connection dialed with dialerFunc.
+//
+// The returned connections are *net.TCPConn, so that a reset is delivered
+// to the dialing side as a TCP RST, which the bridge of
+// water.Core.InsertConn would turn into a close.
+func (c *Censor) Wrap(dialerFunc func(network, address string) (net.Conn, error)) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		upstream, err := dialerFunc(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		outer, inner, err := socket.TCPConnPair()
+		if err != nil && (outer == nil || inner == nil) {
+			upstream.Close()
+			return nil, err
+		}
+
+		c.mutex.Lock()
+		c.nextID++
+		id := c.nextID
+		c.mutex.Unlock()
+
+		s := &session{
+			censor:   c,
+			inner:    inner,
+			upstream: upstream,
+			verdict: &Verdict{
+				ID:      id,
+				Network: network,
+				Address: address,
+				Start:   time.Now(),
+			},
+			inspecting: true,
+		}
+		s.wg.Add(2)
+		go s.forward(inner, upstream, ClientToServer)
+		go s.forward(upstream, inner, ServerToClient)
+		go s.finish()
+
+		return outer, nil
+	}
+}
+
+// session is a connection the Censor sits on.
+type session struct {
+	censor   *Censor
+	inner    *net.TCPConn // towards the WATER Dialer
+	upstream net.Conn     // towards the server
+
+	mutex      sync.Mutex
+	flow       Flow
+	verdict    *Verdict
+	inspecting bool
+	rule       *Rule
+
+	wg sync.WaitGroup
+}
+
+func (s *session) forward(src, dst net.Conn, dir Direction) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			rule := s.observe(dir, buf[:n])
+
+			switch {
+			case rule == nil:
+			case rule.Action == ActionReset:
+				s.reset()
+				return
+			case rule.Action == ActionDrop:
+				continue
+			case rule.Action == ActionThrottle && rule.ThrottleBandwidth > 0:
+				time.Sleep(time.Duration(int64(n) * int64(time.Second) / int64(rule.ThrottleBandwidth)))
+			}
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				s.closeBoth()
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			closeWrite(dst)
+			return
+		}
+		if err != nil {
+			s.closeBoth()
+			return
+		}
+	}
+}
+
+// observe accounts for b and inspects it. It returns the matching rule,
+// if any.
+func (s *session) observe(dir Direction, b []byte) *Rule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.verdict.Bytes[dir] += int64(len(b))
+	s.verdict.Packets[dir]++
+
+	if !s.inspecting {
+		return s.rule
+	}
+
+	window := s.censor.InspectBytes
+	if window <= 0 {
+		window = DefaultInspectBytes
+	}
+
+	if room := window - len(s.flow.Prefix[dir]); room > 0 {
+		s.flow.Prefix[dir] = append(s.flow.Prefix[dir], b[:min(room, len(b))]...)
+	}
+	s.flow.Packets[dir] = append(s.flow.Packets[dir], len(b))
+
+	for i := range s.censor.Rules {
+		r := &s.censor.Rules[i]
+		if r.Matcher != nil && r.Matcher.Match(&s.flow) {
+			s.rule = r
+			s.verdict.Rule = r.Name
+			s.verdict.Action = r.Action
+			s.inspecting = false
+			return r
+		}
+	}
+
+	if len(s.flow.Prefix[ClientToServer]) >= window && len(s.flow.Prefix[ServerToClient]) >= window {
+		s.inspecting = false
+	}
+	return nil
+}
+
+// reset closes both ends with a TCP RST where possible.
+func (s *session) reset() {
+	for _, c := range []net.Conn{s.inner, s.upstream} {
+		if tc, ok := c.(*net.TCPConn); ok {
+			_ = tc.SetLinger(0)
+		}
+		_ = c.Close()
+	}
+}
+
+func (s *session) closeBoth() {
+	_ = s.inner.Close()
+	_ = s.upstream.Close()
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
+
+// finish records the verdict once both directions are done.
+func (s *session) finish() {
+	s.wg.Wait()
+	s.closeBoth()
+
+	s.mutex.Lock()
+	v := s.verdict
+	v.End = time.Now()
+	v.Protocol = Classify(&s.flow)
+	v.Entropy = ShannonEntropy(s.flow.Prefix[ClientToServer])
+	s.mutex.Unlock()
+
+	s.censor.mutex.Lock()
+	s.censor.verdicts = append(s.censor.verdicts, v)
+	s.censor.mutex.Unlock()
+
+	if s.censor.OnVerdict != nil {
+		s.censor.OnVerdict(v)
+	}
+}
@@ -0,0 +1,195 @@
+package censor_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/watmbuild"
+	_ "github.com/refraction-networking/water/transport/v1"
+	"github.com/refraction-networking/water/watertest/censor"
+)
+
+var httpRequest = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+// runThroughCensor sends msg from a WATER Dialer to a WATER Listener, both
+// running wasm, through c. The Listener side echoes what it receives. It
+// returns what the Dialer side read back and the verdict.
+func runThroughCensor(t *testing.T, c *censor.Censor, wasm, msg []byte) ([]byte, *censor.Verdict) {
+	t.Helper()
+
+	verdicts := make(chan *censor.Verdict, 1)
+	c.OnVerdict = func(v *censor.Verdict) { verdicts <- v }
+
+	config := &water.Config{
+		TransportModuleBin: wasm,
+		NetworkDialerFunc:  c.Wrap(net.Dial),
+	}
+
+	lis, err := config.ListenContext(context.Background(), "tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	clientDone := make(chan struct{})
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()              // skipcq: GO-S2307
+		defer func() { <-clientDone }() // closing early could discard the echo
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write(buf)
+	}()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echoed := make([]byte, len(msg))
+	n, _ := io.ReadFull(conn, echoed)
+	conn.Close()
+	close(clientDone)
+
+	select {
+	case v := <-verdicts:
+		return echoed[:n], v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no verdict")
+		return nil, nil
+	}
+}
+
+func TestCensor(t *testing.T) {
+	t.Run("plain HTTP is reset", testCensorPlainHTTP)
+	t.Run("reverse evades HTTP classifier", testCensorReverseHTTP)
+	t.Run("random bytes fail entropy test", testCensorEntropy)
+}
+
+func httpRule() []censor.Rule {
+	return []censor.Rule{{
+		Name:    "http",
+		Matcher: censor.IsProtocol(censor.ProtocolHTTP),
+		Action:  censor.ActionReset,
+	}}
+}
+
+func testCensorPlainHTTP(t *testing.T) {
+	c := &censor.Censor{Rules: httpRule()}
+	echoed, v := runThroughCensor(t, c, watmbuild.Require(t, watmbuild.Plain), httpRequest)
+	t.Log(v)
+
+	if bytes.Equal(echoed, httpRequest) {
+		t.Errorf("request went through")
+	}
+	if !v.Blocked() || v.Action != censor.ActionReset || v.Protocol != censor.ProtocolHTTP {
+		t.Errorf("verdict = %s, want reset as http", v)
+	}
+}
+
+func testCensorReverseHTTP(t *testing.T) {
+	c := &censor.Censor{Rules: httpRule()}
+	echoed, v := runThroughCensor(t, c, watmbuild.Require(t, watmbuild.Reverse), httpRequest)
+	t.Log(v)
+
+	if !bytes.Equal(echoed, httpRequest) {
+		t.Errorf("echoed %q, want %q", echoed, httpRequest)
+	}
+	if v.Blocked() || v.Protocol != censor.ProtocolUnknown {
+		t.Errorf("verdict = %s, want allowed as unknown", v)
+	}
+}
+
+func testCensorEntropy(t *testing.T) {
+	rules := []censor.Rule{{
+		Name:    "fully encrypted",
+		Matcher: censor.Entropy(7.0, censor.ClientToServer, 256, 0),
+		Action:  censor.ActionReset,
+	}}
+
+	random := make([]byte, 1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	_, v := runThroughCensor(t, &censor.Censor{Rules: rules}, watmbuild.Require(t, watmbuild.Plain), random)
+	t.Log(v)
+	if !v.Blocked() {
+		t.Errorf("random bytes were not blocked: %s", v)
+	}
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 24)
+	_, v = runThroughCensor(t, &censor.Censor{Rules: rules}, watmbuild.Require(t, watmbuild.Plain), text)
+	t.Log(v)
+	if v.Blocked() {
+		t.Errorf("text was blocked: %s", v)
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	clientHello := recordClientHello(t, "blocked.example.com")
+
+	for _, tc := range []struct {
+		name    string
+		matcher censor.Matcher
+		flow    censor.Flow
+		want    bool
+	}{
+		{"TLS", censor.IsProtocol(censor.ProtocolTLS), censor.Flow{Prefix: [2][]byte{clientHello}}, true},
+		{"TLS on HTTP", censor.IsProtocol(censor.ProtocolTLS), censor.Flow{Prefix: [2][]byte{httpRequest}}, false},
+		{"SNI", censor.TLSServerName(regexp.MustCompile(`^blocked\.`)), censor.Flow{Prefix: [2][]byte{clientHello}}, true},
+		{"other SNI", censor.TLSServerName(regexp.MustCompile(`^allowed\.`)), censor.Flow{Prefix: [2][]byte{clientHello}}, false},
+		{"truncated ClientHello", censor.TLSServerName(regexp.MustCompile(`.`)), censor.Flow{Prefix: [2][]byte{clientHello[:40]}}, false},
+		{"HTTP host", censor.HTTPHost(regexp.MustCompile(`example\.com`)), censor.Flow{Prefix: [2][]byte{httpRequest}}, true},
+		{"pattern", censor.Pattern(regexp.MustCompile(`^GET`), censor.ClientToServer, 3), censor.Flow{Prefix: [2][]byte{httpRequest}}, true},
+		{"bytes beyond window", censor.Bytes([]byte("Host"), censor.ClientToServer, 8), censor.Flow{Prefix: [2][]byte{httpRequest}}, false},
+		{"packet lengths", censor.PacketLengths(censor.ClientToServer, 517, -1), censor.Flow{Packets: [2][]int{{517, 64}}}, true},
+		{"packet lengths mismatch", censor.PacketLengths(censor.ClientToServer, 517, -1), censor.Flow{Packets: [2][]int{{516, 64}}}, false},
+		{"not TLS", censor.All(censor.MinBytes(censor.ClientToServer, 6), censor.Not(censor.IsProtocol(censor.ProtocolTLS))), censor.Flow{Prefix: [2][]byte{httpRequest}}, true},
+	} {
+		if got := tc.matcher.Match(&tc.flow); got != tc.want {
+			t.Errorf("%s: Match = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// recordClientHello returns the first flight of a TLS client.
+func recordClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close() // skipcq: GO-S2307
+
+	go func() {
+		_ = tls.Client(c1, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	return buf[:n]
+}
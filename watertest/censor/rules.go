@@ -0,0 +1,292 @@
+package censor
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+)
+
+// Direction of the traffic inspected by a Matcher.
+type Direction uint8
+
+const (
+	// ClientToServer is the traffic sent by the WATER Dialer.
+	ClientToServer Direction = iota
+
+	// ServerToClient is the traffic sent back by the server.
+	ServerToClient
+)
+
+// String implements fmt.Stringer.
+func (d Direction) String() string {
+	if d == ServerToClient {
+		return "s2c"
+	}
+	return "c2s"
+}
+
+// Flow is what the censor knows about a connection while inspecting it.
+type Flow struct {
+	// Prefix holds the first bytes sent in each direction, up to the
+	// inspection window of the Censor.
+	Prefix [2][]byte
+
+	// Packets holds the lengths of the segments seen in each direction,
+	// in order. A segment is whatever a single read from the connection
+	// returned, which approximates a packet on loopback.
+	Packets [2][]int
+}
+
+// Matcher decides whether a flow matches a rule. Matchers are evaluated
+// every time the flow grows while it is inspected.
+type Matcher interface {
+	Match(f *Flow) bool
+}
+
+// MatcherFunc adapts a func to a Matcher.
+type MatcherFunc func(f *Flow) bool
+
+// Match implements Matcher.
+func (fn MatcherFunc) Match(f *Flow) bool {
+	return fn(f)
+}
+
+func prefix(f *Flow, dir Direction, firstN int) []byte {
+	p := f.Prefix[dir]
+	if firstN > 0 && len(p) > firstN {
+		p = p[:firstN]
+	}
+	return p
+}
+
+// Pattern matches if re matches the first firstN bytes sent in dir. Zero
+// firstN inspects the whole inspection window.
+func Pattern(re *regexp.Regexp, dir Direction, firstN int) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		return re.Match(prefix(f, dir, firstN))
+	})
+}
+
+// Bytes matches if pattern appears within the first firstN bytes sent in
+// dir. Zero firstN inspects the whole inspection window.
+func Bytes(pattern []byte, dir Direction, firstN int) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		return bytes.Contains(prefix(f, dir, firstN), pattern)
+	})
+}
+
+// Entropy matches once at least minBytes were sent in dir and the Shannon
+// entropy of the first firstN of them, in bits per byte, is at least
+// threshold. Fully encrypted traffic is close to 8, text is around 4-5.
+func Entropy(threshold float64, dir Direction, minBytes, firstN int) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		p := prefix(f, dir, firstN)
+		if len(p) < minBytes || len(p) == 0 {
+			return false
+		}
+		return ShannonEntropy(p) >= threshold
+	})
+}
+
+// ShannonEntropy returns the Shannon entropy of b in bits per byte.
+func ShannonEntropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var h float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// PacketLengths matches if the first packets sent in dir have exactly the
+// given lengths. A negative length matches any length.
+func PacketLengths(dir Direction, lengths ...int) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		seen := f.Packets[dir]
+		if len(seen) < len(lengths) {
+			return false
+		}
+		for i, l := range lengths {
+			if l >= 0 && seen[i] != l {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Protocol is a protocol recognized by the classifiers.
+type Protocol string
+
+const (
+	ProtocolUnknown Protocol = ""
+	ProtocolTLS     Protocol = "tls"
+	ProtocolHTTP    Protocol = "http"
+)
+
+var httpRequestLine = regexp.MustCompile(`^[A-Z]{3,7} [^ \r\n]+ HTTP/1\.[01]\r\n`)
+
+// Classify returns the protocol the client speaks, judging by the first
+// bytes it sent.
+func Classify(f *Flow) Protocol {
+	p := f.Prefix[ClientToServer]
+	switch {
+	case isTLSClientHello(p):
+		return ProtocolTLS
+	case httpRequestLine.Match(p):
+		return ProtocolHTTP
+	default:
+		return ProtocolUnknown
+	}
+}
+
+// isTLSClientHello reports whether b starts with a TLS handshake record
+// carrying a ClientHello.
+func isTLSClientHello(b []byte) bool {
+	return len(b) >= 6 &&
+		b[0] == 0x16 && // handshake
+		b[1] == 0x03 && b[2] <= 0x04 && // TLS 1.0 - 1.3 record versions
+		b[5] == 0x01 // ClientHello
+}
+
+// IsProtocol matches flows classified as p.
+func IsProtocol(p Protocol) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		return Classify(f) == p
+	})
+}
+
+// TLSServerName matches TLS ClientHellos with a server name matching re.
+func TLSServerName(re *regexp.Regexp) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		sni, ok := serverName(f.Prefix[ClientToServer])
+		return ok && re.MatchString(sni)
+	})
+}
+
+// HTTPHost matches HTTP requests with a Host header matching re.
+func HTTPHost(re *regexp.Regexp) Matcher {
+	hostHeader := regexp.MustCompile(`(?i)\r\nhost:[ \t]*([^\r\n]*)\r\n`)
+	return MatcherFunc(func(f *Flow) bool {
+		p := f.Prefix[ClientToServer]
+		if !httpRequestLine.Match(p) {
+			return false
+		}
+		m := hostHeader.FindSubmatch(p)
+		return m != nil && re.Match(m[1])
+	})
+}
+
+// serverName extracts the SNI from a ClientHello. It returns false if the
+// ClientHello is incomplete or carries no SNI.
+func serverName(b []byte) (string, bool) {
+	if !isTLSClientHello(b) {
+		return "", false
+	}
+
+	// record header (5) + handshake header (4) + version (2) + random (32)
+	p := b[5+4:]
+	if len(p) < 2+32+1 {
+		return "", false
+	}
+	p = p[2+32:]
+
+	skip := func(lenBytes int) bool {
+		if len(p) < lenBytes {
+			return false
+		}
+		n := 0
+		for i := 0; i < lenBytes; i++ {
+			n = n<<8 | int(p[i])
+		}
+		if len(p) < lenBytes+n {
+			return false
+		}
+		p = p[lenBytes+n:]
+		return true
+	}
+
+	if !skip(1) || !skip(2) || !skip(1) { // session id, cipher suites, compression methods
+		return "", false
+	}
+	if len(p) < 2 {
+		return "", false
+	}
+	p = p[2:] // extensions length
+
+	for len(p) >= 4 {
+		extType := int(p[0])<<8 | int(p[1])
+		extLen := int(p[2])<<8 | int(p[3])
+		if len(p) < 4+extLen {
+			return "", false
+		}
+		ext := p[4 : 4+extLen]
+		p = p[4+extLen:]
+
+		if extType != 0 { // server_name
+			continue
+		}
+		// server name list length (2), name type (1), name length (2)
+		if len(ext) < 5 || ext[2] != 0 {
+			return "", false
+		}
+		nameLen := int(ext[3])<<8 | int(ext[4])
+		if len(ext) < 5+nameLen {
+			return "", false
+		}
+		return string(ext[5 : 5+nameLen]), true
+	}
+	return "", false
+}
+
+// Not matches if m does not. Note that Not is evaluated on incomplete
+// flows too, so it is best combined with a matcher requiring some data,
+// e.g. All(MinBytes(ClientToServer, 16), Not(IsProtocol(ProtocolTLS))).
+func Not(m Matcher) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		return !m.Match(f)
+	})
+}
+
+// All matches if all of ms match.
+func All(ms ...Matcher) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		for _, m := range ms {
+			if !m.Match(f) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Any matches if any of ms match.
+func Any(ms ...Matcher) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		for _, m := range ms {
+			if m.Match(f) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MinBytes matches once at least n bytes were sent in dir.
+func MinBytes(dir Direction, n int) Matcher {
+	return MatcherFunc(func(f *Flow) bool {
+		return len(f.Prefix[dir]) >= n
+	})
+}
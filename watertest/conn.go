@@ -0,0 +1,409 @@
+package watertest
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxBuffered is the number of bytes a direction buffers before writes
+// block, roughly a socket buffer.
+const maxBuffered = 4 << 20
+
+type segment struct {
+	data []byte
+	at   time.Time // delivery time
+}
+
+// stream is one direction of a connection.
+type stream struct {
+	mutex    sync.Mutex
+	segments []segment
+	buffered int
+	lastAt   time.Time
+	notify   chan struct{} // closed and replaced on every change
+
+	writerClosed bool // FIN: the reader gets EOF once drained
+	readerClosed bool // writes fail with EPIPE
+	reset        bool
+	stalled      bool
+}
+
+func newStream() *stream {
+	return &stream{notify: make(chan struct{})}
+}
+
+// broadcast wakes up everyone waiting on s. s.mutex must be held.
+func (s *stream) broadcast() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Conn is a connection on a Network. It implements net.Conn.
+type Conn struct {
+	local, remote netip.AddrPort
+	in, out       *stream
+
+	conditions Conditions
+	faults     *faults // shared with the peer
+
+	readDeadline, writeDeadline *deadline
+
+	writeMutex sync.Mutex // serializes writes to keep segments in order
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// faults tracks the scripted faults of a connection.
+type faults struct {
+	mutex   sync.Mutex
+	sent    int64 // bytes sent in both directions
+	pending []Fault
+}
+
+// take returns the first pending fault that triggers within the next n
+// bytes sent, and how many of them are sent before it does. The fault
+// is no longer pending afterwards. If none triggers, n bytes are
+// accounted as sent.
+func (f *faults) take(n int64) (*Fault, int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i, fault := range f.pending {
+		if fault.AfterBytes < f.sent+n {
+			f.pending = append(f.pending[:i:i], f.pending[i+1:]...)
+			cut := max(fault.AfterBytes-f.sent, 0)
+			f.sent += cut
+			return &fault, cut
+		}
+	}
+
+	f.sent += n
+	return nil, 0
+}
+
+func newConnPair(client, server netip.AddrPort, conditions Conditions, scripted []Fault) (*Conn, *Conn) {
+	c2s, s2c := newStream(), newStream()
+	f := &faults{}
+	for _, fault := range scripted {
+		if fault.Kind != FaultRefuse {
+			f.pending = append(f.pending, fault)
+		}
+	}
+
+	c := &Conn{
+		local: client, remote: server,
+		in: s2c, out: c2s,
+		conditions: conditions, faults: f,
+		readDeadline: newDeadline(), writeDeadline: newDeadline(),
+		done: make(chan struct{}),
+	}
+	s := &Conn{
+		local: server, remote: client,
+		in: c2s, out: s2c,
+		conditions: conditions, faults: f,
+		readDeadline: newDeadline(), writeDeadline: newDeadline(),
+		done: make(chan struct{}),
+	}
+
+	return c, s
+}
+
+// Read implements net.Conn. Every Read returns data from at most one
+// segment, so that fragmented writes are visible to the reader.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.done:
+			return 0, opError("read", c, net.ErrClosed)
+		case <-c.readDeadline.wait():
+			return 0, opError("read", c, os.ErrDeadlineExceeded)
+		default:
+		}
+
+		c.in.mutex.Lock()
+		if c.in.reset {
+			c.in.mutex.Unlock()
+			return 0, opError("read", c, errReset)
+		}
+
+		var timer <-chan time.Time
+		if len(c.in.segments) > 0 && !c.in.stalled {
+			seg := &c.in.segments[0]
+			wait := time.Until(seg.at)
+			if wait <= 0 {
+				n := copy(b, seg.data)
+				seg.data = seg.data[n:]
+				if len(seg.data) == 0 {
+					c.in.segments = c.in.segments[1:]
+				}
+				c.in.buffered -= n
+				c.in.broadcast()
+				c.in.mutex.Unlock()
+				return n, nil
+			}
+			timer = time.After(wait)
+		} else if len(c.in.segments) == 0 && c.in.writerClosed {
+			c.in.mutex.Unlock()
+			return 0, io.EOF
+		}
+		notify := c.in.notify
+		c.in.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer:
+		case <-c.done:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if mss := c.conditions.MaxSegmentSize; mss > 0 && n > mss {
+			n = mss
+		}
+
+		// a fault triggering within this segment cuts it short
+		fault, cut := c.faults.take(int64(n))
+		if fault != nil {
+			n = int(cut)
+		}
+
+		if n > 0 {
+			if err := c.send(b[:n]); err != nil {
+				return written, err
+			}
+			written += n
+			b = b[n:]
+		}
+
+		if fault != nil {
+			c.trigger(fault.Kind)
+			if fault.Kind == FaultReset {
+				return written, opError("write", c, errReset)
+			}
+			if fault.Kind == FaultClose && len(b) > 0 {
+				return written, opError("write", c, errPipe)
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (c *Conn) trigger(kind FaultKind) {
+	switch kind {
+	case FaultReset:
+		c.Reset()
+	case FaultClose:
+		for _, s := range []*stream{c.in, c.out} {
+			s.mutex.Lock()
+			s.writerClosed = true
+			s.broadcast()
+			s.mutex.Unlock()
+		}
+	case FaultStall:
+		for _, s := range []*stream{c.in, c.out} {
+			s.mutex.Lock()
+			s.stalled = true
+			s.broadcast()
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// send queues data as one segment, blocking for the time it takes to
+// transmit it and while the buffer is full.
+func (c *Conn) send(data []byte) error {
+	if bw := c.conditions.Bandwidth; bw > 0 {
+		txTime := time.Duration(int64(len(data)) * int64(time.Second) / int64(bw))
+		select {
+		case <-time.After(txTime):
+		case <-c.done:
+			return opError("write", c, net.ErrClosed)
+		case <-c.writeDeadline.wait():
+			return opError("write", c, os.ErrDeadlineExceeded)
+		}
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return opError("write", c, net.ErrClosed)
+		case <-c.writeDeadline.wait():
+			return opError("write", c, os.ErrDeadlineExceeded)
+		default:
+		}
+
+		c.out.mutex.Lock()
+		switch {
+		case c.out.reset:
+			c.out.mutex.Unlock()
+			return opError("write", c, errReset)
+		case c.out.readerClosed, c.out.writerClosed:
+			c.out.mutex.Unlock()
+			return opError("write", c, errPipe)
+		}
+
+		if c.out.buffered+len(data) <= maxBuffered || c.out.buffered == 0 {
+			at := time.Now().Add(c.conditions.Latency)
+			if c.conditions.Jitter > 0 {
+				at = at.Add(time.Duration(rand.Int63n(int64(c.conditions.Jitter)))) // skipcq: GSC-G404
+			}
+			if at.Before(c.out.lastAt) {
+				at = c.out.lastAt // keep segments in order
+			}
+			c.out.lastAt = at
+
+			c.out.segments = append(c.out.segments, segment{data: append([]byte(nil), data...), at: at})
+			c.out.buffered += len(data)
+			c.out.broadcast()
+			c.out.mutex.Unlock()
+			return nil
+		}
+		notify := c.out.notify
+		c.out.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-c.done:
+		case <-c.writeDeadline.wait():
+		}
+	}
+}
+
+// Reset resets the connection: undelivered data is dropped and both sides
+// fail with ECONNRESET from now on.
+func (c *Conn) Reset() {
+	for _, s := range []*stream{c.in, c.out} {
+		s.mutex.Lock()
+		s.reset = true
+		s.segments = nil
+		s.buffered = 0
+		s.broadcast()
+		s.mutex.Unlock()
+	}
+}
+
+// Close implements net.Conn. Data already written is still delivered to
+// the peer, followed by EOF.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.out.mutex.Lock()
+		c.out.writerClosed = true
+		c.out.broadcast()
+		c.out.mutex.Unlock()
+
+		c.in.mutex.Lock()
+		c.in.readerClosed = true
+		c.in.broadcast()
+		c.in.mutex.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.local)
+}
+
+// RemoteAddr implements net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.remote)
+}
+
+// SetDeadline implements net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is an abstraction for handling timeouts, modeled after the one
+// used by net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline expires
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out. The zero
+// value disables the deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
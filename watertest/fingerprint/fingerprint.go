@@ -0,0 +1,250 @@
+// Package fingerprint reports what the traffic produced by a WATM looks
+// like to an on-path observer.
+//
+// A [Runner] drives a WATER Dialer and a WATER Listener running the WATM
+// with a configurable [Workload] and taps the network connection between
+// them. The resulting [Report] summarizes Shannon entropy per write, write
+// size histograms, inter-arrival timing, first packet prefix statistics
+// and direction ratios. It marshals to JSON so that reports of two WATM
+// versions can be diffed, or compared with [Report.Diff] to catch
+// fingerprint regressions in CI.
+//
+//	r := &fingerprint.Runner{
+//		DialerConfig: &water.Config{TransportModuleBin: wasm},
+//		Workload:     fingerprint.Workload{Connections: 8, Echo: true},
+//	}
+//	report, err := r.Run(ctx)
+package fingerprint
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water"
+)
+
+// Payload is the kind of data sent by a Workload.
+type Payload string
+
+const (
+	// PayloadRandom is uniformly random bytes.
+	PayloadRandom Payload = "random"
+
+	// PayloadText is printable ASCII text.
+	PayloadText Payload = "text"
+
+	// PayloadZero is all zero bytes.
+	PayloadZero Payload = "zero"
+)
+
+// Workload is the traffic the Runner sends through the WATM.
+type Workload struct {
+	// Connections is the number of connections dialed one after the
+	// other. Defaults to 1.
+	Connections int `json:"connections"`
+
+	// Messages is the number of messages written on each connection.
+	// Defaults to 16.
+	Messages int `json:"messages"`
+
+	// Sizes are the message sizes, used in turn. Defaults to
+	// DefaultSizes.
+	Sizes []int `json:"sizes"`
+
+	// Interval is the pause between two messages on a connection.
+	Interval time.Duration `json:"interval"`
+
+	// Echo makes the server write every message back, and the client
+	// wait for it before sending the next one.
+	Echo bool `json:"echo"`
+
+	// Payload is the kind of data sent. Defaults to PayloadRandom.
+	Payload Payload `json:"payload"`
+
+	// Seed seeds the payload generator so that runs are reproducible.
+	Seed int64 `json:"seed"`
+}
+
+// DefaultSizes is used when Workload.Sizes is not set.
+var DefaultSizes = []int{64, 512, 1400, 4096}
+
+func (w Workload) withDefaults() Workload {
+	if w.Connections <= 0 {
+		w.Connections = 1
+	}
+	if w.Messages <= 0 {
+		w.Messages = 16
+	}
+	if len(w.Sizes) == 0 {
+		w.Sizes = DefaultSizes
+	}
+	if w.Payload == "" {
+		w.Payload = PayloadRandom
+	}
+	return w
+}
+
+// ErrUnknownPayload is returned by Runner.Run if Workload.Payload is not
+// one of the defined payloads.
+var ErrUnknownPayload = errors.New("fingerprint: unknown payload")
+
+func (w Workload) message(rng *rand.Rand, size int) ([]byte, error) {
+	msg := make([]byte, size)
+	switch w.Payload {
+	case PayloadRandom:
+		_, _ = rng.Read(msg)
+	case PayloadText:
+		const alphabet = "abcdefghijklmnopqrstuvwxyz ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.,\n"
+		for i := range msg {
+			msg[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+	case PayloadZero:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPayload, w.Payload)
+	}
+	return msg, nil
+}
+
+// Runner runs a Workload through a WATER Dialer and Listener pair and
+// reports what the traffic between them looks like.
+type Runner struct {
+	// DialerConfig configures the Dialer. Its NetworkDialerFunc, if set,
+	// is used to reach the Listener.
+	DialerConfig *water.Config
+
+	// ListenerConfig configures the Listener. Defaults to DialerConfig.
+	// Its NetworkListener is ignored: the Listener always listens on a
+	// random loopback port.
+	ListenerConfig *water.Config
+
+	Workload Workload
+}
+
+// Run runs the Workload and returns the Report once every connection is
+// closed.
+func (r *Runner) Run(ctx context.Context) (*Report, error) {
+	if r.DialerConfig == nil {
+		return nil, fmt.Errorf("fingerprint: dialing with nil config is not allowed")
+	}
+	w := r.Workload.withDefaults()
+
+	lisConfig := r.ListenerConfig
+	if lisConfig == nil {
+		lisConfig = r.DialerConfig
+	}
+	lisConfig = lisConfig.Clone()
+	lisConfig.NetworkListener = nil
+
+	lis, err := lisConfig.ListenContext(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint: failed to listen: %w", err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	var serverWg sync.WaitGroup
+	serverWg.Add(1)
+	go func() {
+		defer serverWg.Done()
+		serve(lis, w.Echo)
+	}()
+
+	t := &tap{}
+	dialConfig := r.DialerConfig.Clone()
+	dialerFunc := dialConfig.NetworkDialerFunc
+	if dialerFunc == nil {
+		dialerFunc = net.Dial
+	}
+	dialConfig.NetworkDialerFunc = t.wrap(dialerFunc)
+
+	dialer, err := water.NewDialerWithContext(ctx, dialConfig)
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint: failed to create dialer: %w", err)
+	}
+
+	rng := rand.New(rand.NewSource(w.Seed)) // skipcq: GSC-G404
+	for i := 0; i < w.Connections; i++ {
+		if err := runConn(ctx, dialer, lis.Addr().String(), w, rng); err != nil {
+			return nil, fmt.Errorf("fingerprint: connection %d: %w", i, err)
+		}
+	}
+
+	flows := t.wait()
+	_ = lis.Close()
+	serverWg.Wait()
+
+	return newReport(w, flows), nil
+}
+
+func runConn(ctx context.Context, dialer water.Dialer, address string, w Workload, rng *rand.Rand) error {
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // skipcq: GO-S2307
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	for i := 0; i < w.Messages; i++ {
+		if i > 0 && w.Interval > 0 {
+			select {
+			case <-time.After(w.Interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		msg, err := w.message(rng, w.Sizes[i%len(w.Sizes)])
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+
+		if w.Echo {
+			echoed := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, echoed); err != nil {
+				return err
+			}
+			if !bytes.Equal(echoed, msg) {
+				return fmt.Errorf("message %d echoed back corrupted", i)
+			}
+		}
+	}
+	return nil
+}
+
+// serve accepts connections until lis is closed, reading everything and
+// writing it back if echo is set.
+func serve(lis net.Listener, echo bool) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close() // skipcq: GO-S2307
+
+			if echo {
+				_, _ = io.Copy(conn, conn)
+			} else {
+				_, _ = io.Copy(io.Discard, conn)
+			}
+		}()
+	}
+}
@@ -0,0 +1,122 @@
+package fingerprint_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	"github.com/refraction-networking/water/internal/watmbuild"
+	_ "github.com/refraction-networking/water/transport/v1"
+	"github.com/refraction-networking/water/watertest/fingerprint"
+)
+
+func run(t *testing.T, wasm []byte, w fingerprint.Workload) *fingerprint.Report {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	r := &fingerprint.Runner{
+		DialerConfig: &water.Config{TransportModuleBin: wasm},
+		Workload:     w,
+	}
+	report, err := r.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestRunner_Run(t *testing.T) {
+	t.Run("zero payload", testRunZeroPayload)
+	t.Run("json round trip", testRunJSON)
+	t.Run("diff between WATMs", testRunDiff)
+}
+
+func testRunZeroPayload(t *testing.T) {
+	w := fingerprint.Workload{
+		Connections: 2,
+		Messages:    4,
+		Sizes:       []int{100, 200},
+		Echo:        true,
+		Payload:     fingerprint.PayloadZero,
+	}
+	report := run(t, watmbuild.Require(t, watmbuild.Plain), w)
+
+	if report.Connections != 2 {
+		t.Errorf("connections = %d, want 2", report.Connections)
+	}
+	for name, d := range map[string]*fingerprint.DirectionReport{
+		"client_to_server": report.ClientToServer,
+		"server_to_client": report.ServerToClient,
+	} {
+		if d.Bytes != 2*(100+200+100+200) {
+			t.Errorf("%s: bytes = %d, want %d", name, d.Bytes, 2*600)
+		}
+		if d.Writes < 8 {
+			t.Errorf("%s: writes = %d, want at least 8", name, d.Writes)
+		}
+		if d.Entropy.Max != 0 {
+			t.Errorf("%s: entropy max = %v, want 0", name, d.Entropy.Max)
+		}
+		if d.FirstPacket.Count != 2 || d.FirstPacket.Lengths.P50 != 100 {
+			t.Errorf("%s: first packet = %+v, want 2 packets of 100 bytes", name, d.FirstPacket)
+		}
+		if d.FirstPacket.CommonPrefix != strings.Repeat("00", 64) {
+			t.Errorf("%s: common prefix = %q, want 64 zero bytes", name, d.FirstPacket.CommonPrefix)
+		}
+		if len(d.FirstPacket.Offsets) == 0 || d.FirstPacket.Offsets[0].Distinct != 1 || d.FirstPacket.Offsets[0].ModeShare != 1 {
+			t.Errorf("%s: offsets = %+v, want a single value", name, d.FirstPacket.Offsets)
+		}
+	}
+	if report.Ratios.Bytes != 1 {
+		t.Errorf("bytes ratio = %v, want 1", report.Ratios.Bytes)
+	}
+}
+
+func testRunJSON(t *testing.T) {
+	w := fingerprint.Workload{Messages: 4, Echo: true, Seed: 1}
+	report := run(t, watmbuild.Require(t, watmbuild.Plain), w)
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded fingerprint.Report
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Workload.Payload != fingerprint.PayloadRandom {
+		t.Errorf("payload = %q, want defaulted to %q", decoded.Workload.Payload, fingerprint.PayloadRandom)
+	}
+	if e := decoded.ClientToServer.Entropy.Mean; e < 5 {
+		t.Errorf("entropy mean of random payload = %v, want at least 5", e)
+	}
+	if diffs := decoded.Diff(report); diffs != nil {
+		t.Errorf("report differs from itself after JSON round trip: %v", diffs)
+	}
+}
+
+func testRunDiff(t *testing.T) {
+	w := fingerprint.Workload{Messages: 4, Echo: true, Payload: fingerprint.PayloadText, Seed: 1}
+	plain := run(t, watmbuild.Require(t, watmbuild.Plain), w)
+	reverse := run(t, watmbuild.Require(t, watmbuild.Reverse), w)
+
+	diffs := reverse.Diff(plain)
+	if len(diffs) == 0 {
+		t.Fatal("reverse reported identical to plain")
+	}
+	found := false
+	for _, d := range diffs {
+		if strings.Contains(d, "common_prefix") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("diffs = %v, want a common_prefix difference", diffs)
+	}
+}
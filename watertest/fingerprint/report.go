@@ -0,0 +1,273 @@
+package fingerprint
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Report summarizes the network-side traffic produced by a WATM.
+//
+// It is meant to be marshaled to JSON and compared across WATM versions,
+// see [Report.Diff]. Timing statistics are in microseconds.
+type Report struct {
+	Workload       Workload         `json:"workload"`
+	Connections    int              `json:"connections"`
+	ClientToServer *DirectionReport `json:"client_to_server"`
+	ServerToClient *DirectionReport `json:"server_to_client"`
+	Ratios         Ratios           `json:"ratios"`
+}
+
+// DirectionReport summarizes the traffic in one direction over all
+// connections.
+type DirectionReport struct {
+	Writes int   `json:"writes"`
+	Bytes  int64 `json:"bytes"`
+
+	// Entropy is the Shannon entropy of each write, in bits per byte.
+	Entropy Summary `json:"entropy"`
+
+	// WriteSizes is a histogram of write sizes in power-of-two buckets.
+	WriteSizes []Bucket `json:"write_sizes"`
+
+	// InterArrival is the time between consecutive writes on the same
+	// connection.
+	InterArrival Summary `json:"inter_arrival_us"`
+
+	FirstPacket FirstPacketReport `json:"first_packet"`
+}
+
+// FirstPacketReport summarizes the first write in a direction of every
+// connection, which is what most classifiers look at.
+type FirstPacketReport struct {
+	Count   int     `json:"count"`
+	Lengths Summary `json:"lengths"`
+	Entropy Summary `json:"entropy"`
+
+	// CommonPrefix is the hex encoded prefix shared by the first packet
+	// of every connection.
+	CommonPrefix string `json:"common_prefix"`
+
+	// Offsets describes each of the leading bytes of the first packet
+	// across connections.
+	Offsets []OffsetStats `json:"offsets"`
+}
+
+// OffsetStats describes the values seen at one offset of the first packet.
+type OffsetStats struct {
+	Offset   int `json:"offset"`
+	Distinct int `json:"distinct"`
+
+	// Mode is the hex encoded most common byte, and ModeShare the fraction
+	// of first packets carrying it.
+	Mode      string  `json:"mode"`
+	ModeShare float64 `json:"mode_share"`
+}
+
+// Ratios compares client-to-server to server-to-client traffic. A ratio is
+// 0 if there was no server-to-client traffic.
+type Ratios struct {
+	Bytes  float64 `json:"bytes"`
+	Writes float64 `json:"writes"`
+}
+
+// prefixOffsets is how many leading bytes of the first packet get an
+// OffsetStats entry.
+const prefixOffsets = 16
+
+func newReport(w Workload, flows []*flow) *Report {
+	r := &Report{
+		Workload:       w,
+		Connections:    len(flows),
+		ClientToServer: newDirectionReport(flows, ClientToServer),
+		ServerToClient: newDirectionReport(flows, ServerToClient),
+	}
+	r.Ratios = Ratios{
+		Bytes:  ratio(float64(r.ClientToServer.Bytes), float64(r.ServerToClient.Bytes)),
+		Writes: ratio(float64(r.ClientToServer.Writes), float64(r.ServerToClient.Writes)),
+	}
+	return r
+}
+
+func newDirectionReport(flows []*flow, dir Direction) *DirectionReport {
+	d := &DirectionReport{}
+
+	var entropies, gaps, firstLengths, firstEntropies []float64
+	var sizes []int
+	var firsts [][]byte
+	for _, f := range flows {
+		var last time.Time
+		seenFirst := false
+		for _, s := range f.segments {
+			if s.dir != dir {
+				continue
+			}
+			d.Writes++
+			d.Bytes += int64(s.size)
+			sizes = append(sizes, s.size)
+			entropies = append(entropies, s.entropy)
+			if !last.IsZero() {
+				gaps = append(gaps, float64(s.at.Sub(last).Microseconds()))
+			}
+			last = s.at
+
+			if !seenFirst {
+				seenFirst = true
+				firstLengths = append(firstLengths, float64(s.size))
+				firstEntropies = append(firstEntropies, s.entropy)
+				firsts = append(firsts, f.first[dir])
+			}
+		}
+	}
+
+	d.Entropy = summarize(entropies)
+	d.WriteSizes = histogram(sizes)
+	d.InterArrival = summarize(gaps)
+	d.FirstPacket = FirstPacketReport{
+		Count:        len(firsts),
+		Lengths:      summarize(firstLengths),
+		Entropy:      summarize(firstEntropies),
+		CommonPrefix: hex.EncodeToString(commonPrefix(firsts)),
+		Offsets:      offsetStats(firsts),
+	}
+	return d
+}
+
+func commonPrefix(packets [][]byte) []byte {
+	if len(packets) == 0 {
+		return nil
+	}
+
+	prefix := packets[0]
+	for _, p := range packets[1:] {
+		n := 0
+		for n < len(prefix) && n < len(p) && prefix[n] == p[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+func offsetStats(packets [][]byte) []OffsetStats {
+	var stats []OffsetStats
+	for off := 0; off < prefixOffsets; off++ {
+		var counts [256]int
+		total := 0
+		for _, p := range packets {
+			if off < len(p) {
+				counts[p[off]]++
+				total++
+			}
+		}
+		if total == 0 {
+			break
+		}
+
+		s := OffsetStats{Offset: off}
+		mode := 0
+		for b, n := range counts {
+			if n > 0 {
+				s.Distinct++
+			}
+			if n > counts[mode] {
+				mode = b
+			}
+		}
+		s.Mode = hex.EncodeToString([]byte{byte(mode)})
+		s.ModeShare = round(float64(counts[mode]) / float64(total))
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return round(a / b)
+}
+
+// Tolerances used by [Report.Diff].
+const (
+	entropyTolerance = 0.25 // bits per byte
+	ratioTolerance   = 0.05 // relative
+)
+
+// Diff compares r against a baseline and describes every difference in
+// traffic shape that an observer could use to tell the two apart. Timing
+// statistics are ignored as they are too noisy to compare across runs.
+//
+// It returns nil if r matches the baseline.
+func (r *Report) Diff(baseline *Report) []string {
+	var diffs []string
+	if r.Connections != baseline.Connections {
+		diffs = append(diffs, fmt.Sprintf("connections: %d, baseline %d", r.Connections, baseline.Connections))
+	}
+	diffs = append(diffs, r.ClientToServer.diff("client_to_server", baseline.ClientToServer)...)
+	diffs = append(diffs, r.ServerToClient.diff("server_to_client", baseline.ServerToClient)...)
+	if !closeRelative(r.Ratios.Bytes, baseline.Ratios.Bytes, ratioTolerance) {
+		diffs = append(diffs, fmt.Sprintf("ratios.bytes: %v, baseline %v", r.Ratios.Bytes, baseline.Ratios.Bytes))
+	}
+	return diffs
+}
+
+func (d *DirectionReport) diff(name string, baseline *DirectionReport) []string {
+	if d == nil || baseline == nil {
+		if d != baseline {
+			return []string{name + ": missing"}
+		}
+		return nil
+	}
+
+	var diffs []string
+	add := func(format string, args ...any) {
+		diffs = append(diffs, name+"."+fmt.Sprintf(format, args...))
+	}
+
+	if !closeRelative(float64(d.Writes), float64(baseline.Writes), ratioTolerance) {
+		add("writes: %d, baseline %d", d.Writes, baseline.Writes)
+	}
+	if d.Bytes != baseline.Bytes {
+		add("bytes: %d, baseline %d", d.Bytes, baseline.Bytes)
+	}
+	if math.Abs(d.Entropy.Mean-baseline.Entropy.Mean) > entropyTolerance {
+		add("entropy.mean: %v, baseline %v", d.Entropy.Mean, baseline.Entropy.Mean)
+	}
+	if !sameBuckets(d.WriteSizes, baseline.WriteSizes) {
+		add("write_sizes: %v, baseline %v", d.WriteSizes, baseline.WriteSizes)
+	}
+	if d.FirstPacket.Lengths.P50 != baseline.FirstPacket.Lengths.P50 {
+		add("first_packet.lengths.p50: %v, baseline %v", d.FirstPacket.Lengths.P50, baseline.FirstPacket.Lengths.P50)
+	}
+	if math.Abs(d.FirstPacket.Entropy.Mean-baseline.FirstPacket.Entropy.Mean) > entropyTolerance {
+		add("first_packet.entropy.mean: %v, baseline %v", d.FirstPacket.Entropy.Mean, baseline.FirstPacket.Entropy.Mean)
+	}
+	if d.FirstPacket.CommonPrefix != baseline.FirstPacket.CommonPrefix {
+		add("first_packet.common_prefix: %q, baseline %q", d.FirstPacket.CommonPrefix, baseline.FirstPacket.CommonPrefix)
+	}
+	return diffs
+}
+
+// sameBuckets reports whether a and b have the same non-empty buckets.
+// Counts are not compared as the kernel may coalesce writes differently
+// from run to run.
+func sameBuckets(a, b []Bucket) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Le != b[i].Le {
+			return false
+		}
+	}
+	return true
+}
+
+func closeRelative(a, b, tolerance float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
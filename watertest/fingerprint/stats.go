@@ -0,0 +1,100 @@
+package fingerprint
+
+import (
+	"math"
+	"sort"
+)
+
+// Summary summarizes a distribution of values.
+type Summary struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+func summarize(values []float64) Summary {
+	if len(values) == 0 {
+		return Summary{}
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	return Summary{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Max:   sorted[len(sorted)-1],
+		Mean:  round(sum / float64(len(sorted))),
+		P50:   percentile(sorted, 0.50),
+		P90:   percentile(sorted, 0.90),
+		P99:   percentile(sorted, 0.99),
+	}
+}
+
+// percentile uses the nearest-rank method on sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// round keeps reports stable to diff across runs.
+func round(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// Bucket is a histogram bucket counting values up to and including Le.
+type Bucket struct {
+	Le    int `json:"le"`
+	Count int `json:"count"`
+}
+
+// histogram counts sizes in power-of-two buckets. Empty buckets are
+// omitted.
+func histogram(sizes []int) []Bucket {
+	counts := make(map[int]int)
+	for _, s := range sizes {
+		le := 1
+		for le < s {
+			le <<= 1
+		}
+		counts[le]++
+	}
+
+	buckets := make([]Bucket, 0, len(counts))
+	for le, n := range counts {
+		buckets = append(buckets, Bucket{Le: le, Count: n})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Le < buckets[j].Le })
+	return buckets
+}
+
+// shannonEntropy returns the Shannon entropy of b in bits per byte.
+func shannonEntropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var h float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		h -= p * math.Log2(p)
+	}
+	return round(h)
+}
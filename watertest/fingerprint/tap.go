@@ -0,0 +1,137 @@
+package fingerprint
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/water/internal/socket"
+)
+
+// maxPrefix is how many bytes of the first packet in each direction are
+// kept for prefix statistics.
+const maxPrefix = 64
+
+// Direction of traffic on a connection.
+type Direction uint8
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+// segment is a single read off one side of a tapped connection, which is
+// the closest to a packet that an on-path observer would see.
+type segment struct {
+	dir     Direction
+	at      time.Time
+	size    int
+	entropy float64
+}
+
+// flow is what the tap saw on a single connection.
+type flow struct {
+	segments []segment
+	first    [2][]byte
+}
+
+// tap sits on every connection dialed through it and records the traffic
+// in both directions.
+type tap struct {
+	mutex sync.Mutex
+	flows []*flow
+	wg    sync.WaitGroup
+}
+
+// wrap returns a NetworkDialerFunc that puts the tap on every connection
+// dialed with dialerFunc. The returned connections are *net.TCPConn
+// forwarded by the tap segment by segment, so that WATER does not bridge
+// them again.
+func (t *tap) wrap(dialerFunc func(network, address string) (net.Conn, error)) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		upstream, err := dialerFunc(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		outer, inner, err := socket.TCPConnPair()
+		if err != nil && (outer == nil || inner == nil) {
+			upstream.Close()
+			return nil, err
+		}
+
+		f := &flow{}
+		t.mutex.Lock()
+		t.flows = append(t.flows, f)
+		t.mutex.Unlock()
+
+		var fwg sync.WaitGroup
+		fwg.Add(2)
+		t.wg.Add(1)
+		go t.forward(f, inner, upstream, ClientToServer, &fwg)
+		go t.forward(f, upstream, inner, ServerToClient, &fwg)
+		go func() {
+			defer t.wg.Done()
+			fwg.Wait()
+			_ = inner.Close()
+			_ = upstream.Close()
+		}()
+
+		return outer, nil
+	}
+}
+
+func (t *tap) forward(f *flow, src, dst net.Conn, dir Direction, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.observe(f, dir, buf[:n])
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				_ = src.Close()
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			} else {
+				_ = dst.Close()
+			}
+			return
+		}
+		if err != nil {
+			_ = dst.Close()
+			return
+		}
+	}
+}
+
+func (t *tap) observe(f *flow, dir Direction, b []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if f.first[dir] == nil {
+		f.first[dir] = append([]byte(nil), b[:min(len(b), maxPrefix)]...)
+	}
+	f.segments = append(f.segments, segment{
+		dir:     dir,
+		at:      time.Now(),
+		size:    len(b),
+		entropy: shannonEntropy(b),
+	})
+}
+
+// wait blocks until every tapped connection is closed in both directions
+// and returns what was seen.
+func (t *tap) wait() []*flow {
+	t.wg.Wait()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*flow(nil), t.flows...)
+}
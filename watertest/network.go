@@ -0,0 +1,290 @@
+// Package watertest provides an in-process network for testing WATER
+// transports under adverse network conditions.
+//
+// A [Network] hands out connections with configurable latency, jitter,
+// bandwidth and write fragmentation, and can be scripted to refuse
+// dials, reset or close connections mid-stream, or stall them.
+//
+// Connections and listeners of a Network can be plugged into a
+// [water.Config] via [Network.NetworkDialerFunc] and
+// [Network.NetworkListener], while the test side uses [Network.Dial] and
+// [Network.Listen] directly:
+//
+//	network := watertest.NewNetwork()
+//	network.SetConditions(watertest.Conditions{Latency: 20 * time.Millisecond})
+//
+//	lis, _ := network.Listen("tcp", "10.0.0.1:443")
+//	config := &water.Config{
+//		TransportModuleBin: wasm,
+//		NetworkDialerFunc:  network.NetworkDialerFunc(),
+//	}
+package watertest
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Conditions describe the behavior of the connections of a Network.
+type Conditions struct {
+	// Latency is the one-way delay of every segment. Dialing takes one
+	// round trip.
+	Latency time.Duration
+
+	// Jitter is the upper bound of a random delay added to every segment
+	// on top of Latency. Segments are still delivered in order.
+	Jitter time.Duration
+
+	// Bandwidth limits every direction of every connection, in bytes per
+	// second. Writes block for the time it takes to send them. Zero means
+	// unlimited.
+	Bandwidth int
+
+	// MaxSegmentSize splits writes into segments of at most this many
+	// bytes, each delivered on its own, so that readers see fragmented
+	// writes. Zero means writes are delivered whole.
+	MaxSegmentSize int
+}
+
+// FaultKind is the kind of a scripted Fault.
+type FaultKind uint8
+
+const (
+	// FaultRefuse fails the dial with ECONNREFUSED.
+	FaultRefuse FaultKind = iota
+
+	// FaultReset resets the connection once AfterBytes bytes were sent
+	// over it, in either direction. Undelivered data is lost and both
+	// sides see ECONNRESET.
+	FaultReset
+
+	// FaultClose closes the connection gracefully once AfterBytes bytes
+	// were sent over it. Both sides read the data already sent, then EOF.
+	FaultClose
+
+	// FaultStall stops delivering data once AfterBytes bytes were sent
+	// over it. Writes still succeed until the buffers fill up.
+	FaultStall
+)
+
+// Fault is a scripted failure.
+type Fault struct {
+	Kind FaultKind
+
+	// Conn is the 1-based index, in dialing order, of the connection the
+	// fault applies to. Zero applies the fault to every connection.
+	Conn int
+
+	// AfterBytes is the number of bytes that are sent over the connection
+	// before a FaultReset, FaultClose or FaultStall triggers.
+	AfterBytes int64
+}
+
+// Network is an in-process network. All methods are safe for concurrent
+// use.
+type Network struct {
+	mutex      sync.Mutex
+	conditions Conditions
+	faults     []Fault
+	listeners  map[netip.AddrPort]*Listener
+	nextPort   uint16
+	dials      int
+}
+
+// NewNetwork creates a Network with perfect conditions.
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[netip.AddrPort]*Listener),
+		nextPort:  49152,
+	}
+}
+
+// SetConditions sets the conditions of connections dialed from now on.
+func (n *Network) SetConditions(c Conditions) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.conditions = c
+}
+
+// Script adds faults to be injected into connections dialed from now on.
+func (n *Network) Script(faults ...Fault) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.faults = append(n.faults, faults...)
+}
+
+// Dials returns the number of dials attempted on the Network.
+func (n *Network) Dials() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.dials
+}
+
+// Listen listens on the Network. Only TCP networks are supported, and the
+// host part of address must be an IP address or "localhost". A zero port
+// picks a free one.
+func (n *Network) Listen(network, address string) (*Listener, error) {
+	addr, err := n.resolve(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if addr.Port() == 0 {
+		addr = netip.AddrPortFrom(addr.Addr(), n.allocPort())
+	}
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: net.TCPAddrFromAddrPort(addr), Err: syscall.EADDRINUSE}
+	}
+
+	l := &Listener{
+		network: n,
+		addr:    addr,
+		backlog: make(chan *Conn, 128),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to a Listener of the Network.
+func (n *Network) Dial(network, address string) (net.Conn, error) {
+	return n.dial(network, address)
+}
+
+func (n *Network) dial(network, address string) (*Conn, error) {
+	raddr, err := n.resolve(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	n.mutex.Lock()
+	n.dials++
+	index := n.dials
+	conditions := n.conditions
+	var faults []Fault
+	for _, f := range n.faults {
+		if f.Conn == 0 || f.Conn == index {
+			faults = append(faults, f)
+		}
+	}
+	l := n.listeners[raddr]
+	laddr := netip.AddrPortFrom(localhostFor(raddr.Addr()), n.allocPort())
+	n.mutex.Unlock()
+
+	refused := &net.OpError{Op: "dial", Net: network, Addr: net.TCPAddrFromAddrPort(raddr), Err: syscall.ECONNREFUSED}
+	for _, f := range faults {
+		if f.Kind == FaultRefuse {
+			return nil, refused
+		}
+	}
+	if l == nil {
+		return nil, refused
+	}
+
+	time.Sleep(2 * conditions.Latency) // SYN, SYN-ACK
+
+	client, server := newConnPair(laddr, raddr, conditions, faults)
+	select {
+	case l.backlog <- server:
+		return client, nil
+	case <-l.done:
+		return nil, refused
+	default: // backlog full
+		return nil, refused
+	}
+}
+
+// allocPort returns the next port. n.mutex must be held.
+func (n *Network) allocPort() uint16 {
+	n.nextPort++
+	if n.nextPort == 0 {
+		n.nextPort = 49152
+	}
+	return n.nextPort
+}
+
+func (*Network) resolve(network, address string) (netip.AddrPort, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return netip.AddrPort{}, net.UnknownNetworkError(network)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if host == "localhost" || host == "" {
+		host = "127.0.0.1"
+	}
+
+	ap, err := netip.ParseAddrPort(net.JoinHostPort(host, port))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("watertest: only IP addresses are supported: %w", err)
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+func localhostFor(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	}
+	return netip.IPv6Loopback()
+}
+
+// Listener is a net.Listener on a Network.
+type Listener struct {
+	network   *Network
+	addr      netip.AddrPort
+	backlog   chan *Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept implements net.Listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.accept()
+}
+
+func (l *Listener) accept() (*Conn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close implements net.Listener.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.network.mutex.Lock()
+		delete(l.network.listeners, l.addr)
+		l.network.mutex.Unlock()
+	})
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *Listener) Addr() net.Addr {
+	return net.TCPAddrFromAddrPort(l.addr)
+}
+
+// errors returned by Conn
+var (
+	errReset = syscall.ECONNRESET
+	errPipe  = syscall.EPIPE
+)
+
+func opError(op string, c *Conn, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
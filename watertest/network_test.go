@@ -0,0 +1,271 @@
+package watertest_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water/watertest"
+)
+
+func pair(t *testing.T, network *watertest.Network) (client, server net.Conn) {
+	t.Helper()
+
+	lis, err := network.Listen("tcp", "10.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	client, err = network.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestNetwork(t *testing.T) {
+	t.Run("echo", testNetworkEcho)
+	t.Run("refused", testNetworkRefused)
+	t.Run("latency", testNetworkLatency)
+	t.Run("bandwidth", testNetworkBandwidth)
+	t.Run("fragmentation", testNetworkFragmentation)
+	t.Run("reset", testNetworkReset)
+	t.Run("close", testNetworkClose)
+	t.Run("stall", testNetworkStall)
+	t.Run("deadline", testNetworkDeadline)
+	t.Run("bridge", testNetworkBridge)
+}
+
+func testNetworkEcho(t *testing.T) {
+	client, server := pair(t, watertest.NewNetwork())
+
+	go func() { _, _ = io.Copy(server, server) }()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("read %q, want %q", buf, "hello")
+	}
+
+	client.Close()
+	if _, err := server.Read(buf); !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("server.Read after close = %v, want EOF", err)
+	}
+}
+
+func testNetworkRefused(t *testing.T) {
+	network := watertest.NewNetwork()
+	if _, err := network.Dial("tcp", "10.0.0.1:1"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("dial without listener = %v, want ECONNREFUSED", err)
+	}
+
+	network = watertest.NewNetwork()
+	lis, err := network.Listen("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	network.Script(watertest.Fault{Kind: watertest.FaultRefuse, Conn: 2})
+	for i := 1; i <= 3; i++ {
+		conn, err := network.Dial("tcp", "10.0.0.1:443")
+		if i == 2 {
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				t.Fatalf("dial %d = %v, want ECONNREFUSED", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Close()
+	}
+}
+
+func testNetworkLatency(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(watertest.Conditions{Latency: 50 * time.Millisecond})
+	client, server := pair(t, network)
+
+	start := time.Now()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("segment delivered after %v, want at least 50ms", elapsed)
+	}
+}
+
+func testNetworkBandwidth(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(watertest.Conditions{Bandwidth: 100 << 10}) // 100 KiB/s
+	client, server := pair(t, network)
+
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	start := time.Now()
+	if _, err := client.Write(make([]byte, 10<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("10 KiB sent in %v at 100 KiB/s", elapsed)
+	}
+}
+
+func testNetworkFragmentation(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(watertest.Conditions{MaxSegmentSize: 3})
+	client, server := pair(t, network)
+
+	if _, err := client.Write([]byte("abcdefgh")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	for _, want := range []string{"abc", "def", "gh"} {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("read %q, want %q", buf[:n], want)
+		}
+	}
+}
+
+func testNetworkReset(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.Script(watertest.Fault{Kind: watertest.FaultReset, AfterBytes: 4})
+	client, server := pair(t, network)
+
+	n, err := client.Write([]byte("abcdefgh"))
+	if n != 4 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Write = %d, %v, want 4, ECONNRESET", n, err)
+	}
+
+	if _, err := server.Read(make([]byte, 16)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("server.Read = %v, want ECONNRESET", err)
+	}
+}
+
+func testNetworkClose(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.Script(watertest.Fault{Kind: watertest.FaultClose, AfterBytes: 4})
+	client, server := pair(t, network)
+
+	if n, err := client.Write([]byte("abcdefgh")); n != 4 || err == nil {
+		t.Fatalf("Write = %d, %v, want 4 and an error", n, err)
+	}
+
+	b, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("abcd")) {
+		t.Fatalf("read %q, want %q", b, "abcd")
+	}
+}
+
+func testNetworkStall(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.Script(watertest.Fault{Kind: watertest.FaultStall, AfterBytes: 0})
+	client, server := pair(t, network)
+
+	if _, err := client.Write([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := server.Read(make([]byte, 4)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("server.Read on a stalled conn = %v, want a timeout", err)
+	}
+}
+
+func testNetworkDeadline(t *testing.T) {
+	client, _ := pair(t, watertest.NewNetwork())
+
+	_ = client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := client.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Read = %v, want a timeout", err)
+	}
+
+	// clearing the deadline makes reads block again
+	_ = client.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		_, _ = client.Read(make([]byte, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Read returned despite the cleared deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+	client.Close()
+	<-done
+}
+
+func testNetworkBridge(t *testing.T) {
+	network := watertest.NewNetwork()
+	network.SetConditions(watertest.Conditions{Latency: 5 * time.Millisecond})
+
+	lis, err := network.Listen("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close() // skipcq: GO-S2307
+
+	conn, err := network.NetworkDialerFunc()("tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // skipcq: GO-S2307
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("NetworkDialerFunc returned %T, want *net.TCPConn", conn)
+	}
+
+	server, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reset on the network is forwarded as a TCP RST
+	server.(*watertest.Conn).Reset()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Read after reset = %v, want ECONNRESET", err)
+	}
+}
@@ -0,0 +1,118 @@
+package watertest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/refraction-networking/water/internal/socket"
+)
+
+// NetworkDialerFunc returns a func dialing the Network, to be used as
+// [water.Config.NetworkDialerFunc].
+//
+// Every connection is bridged through a loopback TCP connection, rather
+// than by water.Core.InsertConn, whose plain copies turn a reset or a
+// half-close into a close. Segments are forwarded one by one, a reset is
+// forwarded as a TCP RST and a close as a FIN.
+func (n *Network) NetworkDialerFunc() func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		conn, err := n.dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return bridge(conn)
+	}
+}
+
+// NetworkListener listens on the Network, returning a listener to be used
+// as [water.Config.NetworkListener]. Accepted connections are bridged
+// like those returned by NetworkDialerFunc.
+func (n *Network) NetworkListener(network, address string) (net.Listener, error) {
+	l, err := n.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &bridgingListener{l}, nil
+}
+
+type bridgingListener struct {
+	*Listener
+}
+
+func (l *bridgingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.accept()
+	if err != nil {
+		return nil, err
+	}
+	return bridge(conn)
+}
+
+// bridge returns a *net.TCPConn forwarding to and from conn.
+func bridge(conn *Conn) (*net.TCPConn, error) {
+	outer, inner, err := socket.TCPConnPair()
+	if err != nil && (outer == nil || inner == nil) {
+		conn.Close()
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// conn -> inner
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if _, werr := inner.Write(buf[:n]); werr != nil {
+					conn.Reset()
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				_ = inner.CloseWrite() // unsafe: error is ignored
+				return
+			}
+			if err != nil {
+				_ = inner.SetLinger(0) // close with RST
+				_ = inner.Close()
+				return
+			}
+		}
+	}()
+
+	// inner -> conn
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := inner.Read(buf)
+			if n > 0 {
+				if _, werr := conn.Write(buf[:n]); werr != nil {
+					_ = inner.SetLinger(0)
+					_ = inner.Close()
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				_ = conn.Close()
+				return
+			}
+			if err != nil {
+				conn.Reset()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		_ = conn.Close()
+		_ = inner.Close()
+	}()
+
+	return outer, nil
+}
@@ -0,0 +1,438 @@
+package watmtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+)
+
+// checkExports verifies the signatures of the exports of the suite's
+// version.
+func checkExports(t *testing.T, env *Env) {
+	for name, sig := range env.Suite.Exports {
+		export := env.Info.Export(name)
+		if export == nil {
+			if !sig.Optional {
+				t.Errorf("required export %s is missing", name)
+			}
+			continue
+		}
+		if export.Type != "func" {
+			t.Errorf("export %s is a %s, want a func", name, export.Type)
+			continue
+		}
+		if !slices.Equal(export.Params, sig.Params) || !slices.Equal(export.Results, sig.Results) {
+			t.Errorf("export %s has signature (%v) -> (%v), want (%v) -> (%v)",
+				name, export.Params, export.Results, sig.Params, sig.Results)
+		}
+	}
+}
+
+// checkImports verifies that WATER provides every function the module
+// imports.
+func checkImports(t *testing.T, env *Env) {
+	for _, imp := range env.Info.Unsatisfied() {
+		t.Errorf("import %s.%s cannot be satisfied: %s", imp.Module, imp.Name, imp.Status)
+	}
+}
+
+// checkDial dials a Listener running the peer module.
+func checkDial(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		lis := startEchoListener(t, env, env.PeerConfig())
+		conn := dial(t, env, env.Config(), lis.Addr().String())
+		exchange(t, env, conn, 4096)
+		closeConn(t, env, conn)
+	}
+}
+
+// checkAccept accepts a connection from a Dialer running the peer
+// module.
+func checkAccept(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		lis := startEchoListener(t, env, env.Config())
+		conn := dial(t, env, env.PeerConfig(), lis.Addr().String())
+		exchange(t, env, conn, 4096)
+		closeConn(t, env, conn)
+	}
+}
+
+// allowAll lets a FixedDialer module dial whatever address it picks.
+func allowAll(_, _ string) error { return nil }
+
+// checkFixedDial dials with a FixedDialer. Whatever address the module
+// dials is redirected to a Listener running the peer module.
+func checkFixedDial(t *testing.T, env *Env) {
+	env.RequireExport(t, "watm_dial_fixed_v1")
+
+	lis := startEchoListener(t, env, env.PeerConfig())
+	config := env.Config()
+	config.NetworkDialerFunc = func(network, _ string) (net.Conn, error) {
+		return net.Dial(network, lis.Addr().String())
+	}
+	config.DialedAddressValidator = allowAll
+
+	fd, err := water.NewFixedDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to create fixed dialer: %v", err)
+	}
+
+	var conn net.Conn
+	withTimeout(t, env, "DialFixed", func() {
+		conn, err = fd.DialFixed()
+	})
+	if err != nil {
+		t.Fatalf("DialFixed: %v", err)
+	}
+	exchange(t, env, conn, 4096)
+	closeConn(t, env, conn)
+}
+
+// checkAssociate relays connections from a Dialer running the peer module
+// to a plain echo server.
+func checkAssociate(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		target := startPlainEcho(t)
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := env.Config()
+		config.NetworkListener = lis
+
+		relay, err := water.NewRelayWithContext(context.Background(), config)
+		if err != nil {
+			t.Fatalf("failed to create relay: %v", err)
+		}
+		relayErr := make(chan error, 1)
+		go func() {
+			relayErr <- relay.RelayTo("tcp", target.Addr().String())
+		}()
+		t.Cleanup(func() {
+			_ = relay.Close()
+			select {
+			case <-relayErr:
+			case <-time.After(env.Options.Timeout):
+				t.Errorf("RelayTo did not return after Close")
+			}
+		})
+
+		conn := dial(t, env, env.PeerConfig(), lis.Addr().String())
+		exchange(t, env, conn, 4096)
+		closeConn(t, env, conn)
+	}
+}
+
+// checkCleanExit closes a connection, which asks the module to exit over
+// the control pipe, and expects the module to exit in time and without
+// error, and the peer to see the connection closed.
+func checkCleanExit(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		peerClosed := make(chan struct{})
+		lis := startListener(t, env, env.PeerConfig(), func(conn net.Conn) {
+			_, _ = io.Copy(io.Discard, conn)
+			close(peerClosed)
+		})
+
+		conn := dial(t, env, env.Config(), lis.Addr().String())
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		closeConn(t, env, conn)
+
+		select {
+		case <-peerClosed:
+		case <-time.After(env.Options.Timeout):
+			t.Errorf("peer did not see the connection closed within %v", env.Options.Timeout)
+		}
+	}
+}
+
+// errDialRefused is returned by the NetworkDialerFunc of the error code
+// checks.
+var errDialRefused = errors.New("watmtest: dial refused")
+
+// checkDialError makes every network dial fail and expects the module to
+// report the error instead of hanging or crashing.
+func checkDialError(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		config := env.Config()
+		config.NetworkDialerFunc = func(_, _ string) (net.Conn, error) {
+			return nil, errDialRefused
+		}
+
+		dialer, err := water.NewDialerWithContext(context.Background(), config)
+		if err != nil {
+			t.Fatalf("failed to create dialer: %v", err)
+		}
+
+		var conn net.Conn
+		withTimeout(t, env, "Dial", func() {
+			conn, err = dialer.DialContext(context.Background(), "tcp", "127.0.0.1:9")
+		})
+		if err == nil {
+			_ = conn.Close()
+			t.Errorf("Dial succeeded although the network dial failed")
+		}
+	}
+}
+
+// checkFixedDialError is checkDialError for FixedDialer.
+func checkFixedDialError(t *testing.T, env *Env) {
+	env.RequireExport(t, "watm_dial_fixed_v1")
+
+	config := env.Config()
+	config.NetworkDialerFunc = func(_, _ string) (net.Conn, error) {
+		return nil, errDialRefused
+	}
+	config.DialedAddressValidator = allowAll
+
+	fd, err := water.NewFixedDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to create fixed dialer: %v", err)
+	}
+
+	var conn net.Conn
+	withTimeout(t, env, "DialFixed", func() {
+		conn, err = fd.DialFixed()
+	})
+	if err == nil {
+		_ = conn.Close()
+		t.Errorf("DialFixed succeeded although the network dial failed")
+	}
+}
+
+// checkLargeTransfer sends Options.TransferSize bytes each way.
+func checkLargeTransfer(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		lis := startEchoListener(t, env, env.PeerConfig())
+		conn := dial(t, env, env.Config(), lis.Addr().String())
+		exchange(t, env, conn, env.Options.TransferSize)
+		closeConn(t, env, conn)
+	}
+}
+
+// checkConcurrency runs Options.Concurrency connections at once.
+func checkConcurrency(export string) func(t *testing.T, env *Env) {
+	return func(t *testing.T, env *Env) {
+		env.RequireExport(t, export)
+
+		lis := startEchoListener(t, env, env.PeerConfig())
+		dialer, err := water.NewDialerWithContext(context.Background(), env.Config())
+		if err != nil {
+			t.Fatalf("failed to create dialer: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, env.Options.Concurrency)
+		for i := 0; i < env.Options.Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := dialer.DialContext(context.Background(), "tcp", lis.Addr().String())
+				if err != nil {
+					errs <- fmt.Errorf("Dial: %w", err)
+					return
+				}
+				defer conn.Close() // skipcq: GO-S2307
+
+				if err := echoRoundTrip(env, conn, 256<<10); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Error(err)
+		}
+	}
+}
+
+// withTimeout runs f and fails t if f does not return in time. f is left
+// running in that case.
+func withTimeout(t *testing.T, env *Env, what string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(env.Options.Timeout):
+		t.Fatalf("%s did not return within %v", what, env.Options.Timeout)
+	}
+}
+
+func dial(t *testing.T, env *Env, config *water.Config, address string) net.Conn {
+	t.Helper()
+
+	dialer, err := water.NewDialerWithContext(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+
+	// The context given to DialContext bounds the lifetime of the module,
+	// so it must not be canceled when the dial returns.
+	var conn net.Conn
+	withTimeout(t, env, "Dial", func() {
+		conn, err = dialer.DialContext(context.Background(), "tcp", address)
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return conn
+}
+
+// closeConn closes conn and expects the module to exit in time and
+// without error.
+func closeConn(t *testing.T, env *Env, conn net.Conn) {
+	t.Helper()
+
+	var err error
+	withTimeout(t, env, "Close", func() {
+		err = conn.Close()
+	})
+	if err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// exchange sends size random bytes through conn, which must be connected
+// to an echo server, and expects them back unaltered.
+func exchange(t *testing.T, env *Env, conn net.Conn, size int) {
+	t.Helper()
+	if err := echoRoundTrip(env, conn, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func echoRoundTrip(env *Env, conn net.Conn, size int) error {
+	if err := conn.SetDeadline(time.Now().Add(env.Options.Timeout)); err != nil {
+		return fmt.Errorf("SetDeadline: %w", err)
+	}
+	defer conn.SetDeadline(time.Time{}) // skipcq: GO-S2307
+
+	msg := make([]byte, size)
+	if _, err := rand.Read(msg); err != nil {
+		return err
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		writeErr <- err
+	}()
+
+	echoed := make([]byte, size)
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		return fmt.Errorf("reading %d bytes back: %w", size, err)
+	}
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("Write: %w", err)
+	}
+
+	if !bytes.Equal(echoed, msg) {
+		want, got := sha256.Sum256(msg), sha256.Sum256(echoed)
+		return fmt.Errorf("%d bytes came back altered: sha256 %x, want %x", size, got, want)
+	}
+	return nil
+}
+
+// startListener starts a water Listener on loopback handing every
+// accepted connection to handle. It is closed when t ends.
+func startListener(t *testing.T, env *Env, config *water.Config, handle func(net.Conn)) net.Listener {
+	t.Helper()
+
+	lis, err := config.ListenContext(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve(t, lis, handle)
+	return lis
+}
+
+func startEchoListener(t *testing.T, env *Env, config *water.Config) net.Listener {
+	t.Helper()
+	return startListener(t, env, config, echo)
+}
+
+func startPlainEcho(t *testing.T) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, lis, echo)
+	return lis
+}
+
+func serve(t *testing.T, lis net.Listener, handle func(net.Conn)) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	conns := make(map[net.Conn]struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns[conn] = struct{}{}
+			mutex.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close() // skipcq: GO-S2307
+				handle(conn)
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		_ = lis.Close()
+		mutex.Lock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+		mutex.Unlock()
+		wg.Wait()
+	})
+}
+
+func echo(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
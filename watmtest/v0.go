@@ -0,0 +1,56 @@
+package watmtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/refraction-networking/water"
+	v0 "github.com/refraction-networking/water/transport/v0"
+)
+
+// SuiteV0 checks modules implementing the v0 WATM API.
+var SuiteV0 = &Suite{
+	Version: "v0",
+	Exports: map[string]Signature{
+		"_water_init":        {Results: []string{"i32"}},
+		"_water_cancel_with": {Params: []string{"i32"}, Results: []string{"i32"}},
+		"_water_worker":      {Results: []string{"i32"}},
+		"_water_dial":        {Params: []string{"i32"}, Results: []string{"i32"}, Optional: true},
+		"_water_accept":      {Params: []string{"i32"}, Results: []string{"i32"}, Optional: true},
+		"_water_associate":   {Results: []string{"i32"}, Optional: true},
+	},
+	Checks: []Check{
+		{"exports", checkExports},
+		{"imports", checkImports},
+		{"init", checkInitV0},
+		{"dial", checkDial("_water_dial")},
+		{"accept", checkAccept("_water_accept")},
+		{"associate", checkAssociate("_water_associate")},
+		{"clean exit", checkCleanExit("_water_dial")},
+		{"dial error", checkDialError("_water_dial")},
+		{"large transfer", checkLargeTransfer("_water_dial")},
+		{"concurrency", checkConcurrency("_water_dial")},
+	},
+}
+
+// checkInitV0 calls _water_init on a fresh instance and expects it to
+// succeed.
+func checkInitV0(t *testing.T, env *Env) {
+	core, err := water.NewCoreWithContext(context.Background(), env.Config())
+	if err != nil {
+		t.Fatalf("failed to create core: %v", err)
+	}
+	defer core.Close() // skipcq: GO-S2307
+
+	tm := v0.UpgradeCore(core)
+	if err := tm.LinkNetworkInterface(nil, nil); err != nil {
+		t.Fatalf("LinkNetworkInterface: %v", err)
+	}
+
+	withTimeout(t, env, "_water_init", func() {
+		err = tm.Initialize()
+	})
+	if err != nil {
+		t.Errorf("_water_init: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package watmtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/refraction-networking/water"
+	v1 "github.com/refraction-networking/water/transport/v1"
+)
+
+// SuiteV1 checks modules implementing the v1 WATM API.
+var SuiteV1 = &Suite{
+	Version: "v1",
+	Exports: map[string]Signature{
+		"watm_init_v1":       {Results: []string{"i32"}},
+		"watm_ctrlpipe_v1":   {Params: []string{"i32"}, Results: []string{"i32"}},
+		"watm_start_v1":      {Results: []string{"i32"}},
+		"watm_dial_v1":       {Params: []string{"i32"}, Results: []string{"i32"}, Optional: true},
+		"watm_dial_fixed_v1": {Params: []string{"i32"}, Results: []string{"i32"}, Optional: true},
+		"watm_accept_v1":     {Params: []string{"i32"}, Results: []string{"i32"}, Optional: true},
+		"watm_associate_v1":  {Results: []string{"i32"}, Optional: true},
+	},
+	Checks: []Check{
+		{"exports", checkExports},
+		{"imports", checkImports},
+		{"init", checkInitV1},
+		{"dial", checkDial("watm_dial_v1")},
+		{"fixed dial", checkFixedDial},
+		{"accept", checkAccept("watm_accept_v1")},
+		{"associate", checkAssociate("watm_associate_v1")},
+		{"clean exit", checkCleanExit("watm_dial_v1")},
+		{"dial error", checkDialError("watm_dial_v1")},
+		{"fixed dial error", checkFixedDialError},
+		{"large transfer", checkLargeTransfer("watm_dial_v1")},
+		{"concurrency", checkConcurrency("watm_dial_v1")},
+	},
+}
+
+// checkInitV1 calls watm_init_v1 on a fresh instance and expects it to
+// succeed.
+func checkInitV1(t *testing.T, env *Env) {
+	core, err := water.NewCoreWithContext(context.Background(), env.Config())
+	if err != nil {
+		t.Fatalf("failed to create core: %v", err)
+	}
+	defer core.Close() // skipcq: GO-S2307
+
+	tm := v1.UpgradeCore(core)
+	if err := tm.LinkNetworkInterface(nil, nil); err != nil {
+		t.Fatalf("LinkNetworkInterface: %v", err)
+	}
+
+	withTimeout(t, env, "watm_init_v1", func() {
+		err = tm.Initialize()
+	})
+	if err != nil {
+		t.Errorf("watm_init_v1: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Package watmtest checks that a WATM implements the WATM API correctly.
+//
+// Module authors call [RunConformance] from a regular Go test:
+//
+//	func TestConformance(t *testing.T) {
+//		bin, _ := os.ReadFile("my_watm.wasm")
+//		watmtest.RunConformance(t, bin)
+//	}
+//
+// The WATM API versions implemented by the module are detected from its
+// exports, and the matching [Suite] runs every [Check] as a subtest. A
+// check exercising an optional export is skipped if the module does not
+// export it.
+//
+// Checks moving data around pair the module with itself: a Dialer running
+// the module talks to a Listener running the module, unless
+// [Options.PeerBin] provides another module for the other end.
+package watmtest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/water"
+	_ "github.com/refraction-networking/water/transport/v0"
+	_ "github.com/refraction-networking/water/transport/v1"
+)
+
+// Defaults used when the corresponding Options field is not set.
+const (
+	DefaultTimeout      = 10 * time.Second
+	DefaultTransferSize = 8 << 20 // 8 MiB
+	DefaultConcurrency  = 8
+)
+
+// Options tunes the conformance checks.
+type Options struct {
+	// TransportModuleConfig is passed to every instance of the module.
+	TransportModuleConfig []byte
+
+	// PeerBin is the module run at the other end of the connections
+	// made by the checks. Defaults to the module under test.
+	PeerBin []byte
+
+	// PeerTransportModuleConfig is passed to every instance of PeerBin.
+	// Defaults to TransportModuleConfig.
+	PeerTransportModuleConfig []byte
+
+	// Timeout bounds every blocking operation of a check.
+	Timeout time.Duration
+
+	// TransferSize is the number of bytes sent each way by the large
+	// transfer check.
+	TransferSize int
+
+	// Concurrency is the number of simultaneous connections made by the
+	// concurrency check.
+	Concurrency int
+}
+
+func (o *Options) withDefaults() *Options {
+	opts := &Options{}
+	if o != nil {
+		*opts = *o
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.TransferSize <= 0 {
+		opts.TransferSize = DefaultTransferSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.PeerTransportModuleConfig == nil {
+		opts.PeerTransportModuleConfig = opts.TransportModuleConfig
+	}
+	return opts
+}
+
+// Status is the outcome of a Check.
+type Status string
+
+const (
+	StatusPass Status = "PASS"
+	StatusFail Status = "FAIL"
+	StatusSkip Status = "SKIP"
+)
+
+// Result is the outcome of running a Check against a module.
+type Result struct {
+	Suite    string
+	Check    string
+	Status   Status
+	Detail   string // why the check was skipped, if it was
+	Duration time.Duration
+}
+
+// Report collects the results of all the checks run against a module.
+type Report struct {
+	Results []Result
+}
+
+// Failed reports whether any check failed.
+func (r *Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// String implements fmt.Stringer.
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, res := range r.Results {
+		fmt.Fprintf(&b, "%s  %s/%-16s %v", res.Status, res.Suite, res.Check, res.Duration.Round(time.Millisecond))
+		if res.Detail != "" {
+			fmt.Fprintf(&b, "  (%s)", res.Detail)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Check is a single conformance check.
+type Check struct {
+	Name string
+	Run  func(t *testing.T, env *Env)
+}
+
+// Suite is the set of checks for a WATM API version.
+type Suite struct {
+	// Version is the WATM API version as reported by
+	// [water.InspectModule], e.g. "v1".
+	Version string
+
+	// Exports are the expected signatures of the exports of the
+	// version, keyed by export name.
+	Exports map[string]Signature
+
+	Checks []Check
+}
+
+// Signature is the expected signature of an exported function.
+type Signature struct {
+	Params   []string
+	Results  []string
+	Optional bool
+}
+
+// Suites are the suites RunConformance picks from.
+var Suites = []*Suite{SuiteV0, SuiteV1}
+
+// RunConformance runs the suite of every WATM API version implemented by
+// bin with the default Options. It fails t if no known version is
+// implemented.
+func RunConformance(t *testing.T, bin []byte) *Report {
+	t.Helper()
+	return RunConformanceWithOptions(t, bin, nil)
+}
+
+// RunConformanceWithOptions is like RunConformance with the given Options.
+func RunConformanceWithOptions(t *testing.T, bin []byte, opts *Options) *Report {
+	t.Helper()
+
+	info, err := water.InspectModule(bin)
+	if err != nil {
+		t.Fatalf("failed to inspect module: %v", err)
+	}
+
+	report := &Report{}
+	for _, v := range info.Versions {
+		for _, s := range Suites {
+			if s.Version == v.Version {
+				report.Results = append(report.Results, s.Run(t, bin, opts).Results...)
+			}
+		}
+	}
+	if len(report.Results) == 0 {
+		t.Fatalf("module implements no known WATM API version")
+	}
+
+	t.Logf("conformance report:\n%s", report)
+	return report
+}
+
+// Run runs every check of the suite against bin as a subtest of t.
+func (s *Suite) Run(t *testing.T, bin []byte, opts *Options) *Report {
+	t.Helper()
+
+	info, err := water.InspectModule(bin)
+	if err != nil {
+		t.Fatalf("failed to inspect module: %v", err)
+	}
+
+	opts = opts.withDefaults()
+	peerBin := opts.PeerBin
+	if peerBin == nil {
+		peerBin = bin
+	}
+
+	report := &Report{}
+	t.Run(s.Version, func(t *testing.T) {
+		for _, c := range s.Checks {
+			env := &Env{
+				Bin:     bin,
+				PeerBin: peerBin,
+				Info:    info,
+				Suite:   s,
+				Options: opts,
+			}
+
+			res := Result{Suite: s.Version, Check: c.Name}
+			start := time.Now()
+			t.Run(c.Name, func(t *testing.T) {
+				defer func() {
+					res.Duration = time.Since(start)
+					switch {
+					case t.Skipped():
+						res.Status = StatusSkip
+						res.Detail = env.skipReason()
+					case t.Failed():
+						res.Status = StatusFail
+					default:
+						res.Status = StatusPass
+					}
+				}()
+				c.Run(t, env)
+			})
+			report.Results = append(report.Results, res)
+		}
+	})
+	return report
+}
+
+// Env is what a Check runs against.
+type Env struct {
+	Bin     []byte
+	PeerBin []byte
+	Info    *water.ModuleInfo
+	Suite   *Suite
+	Options *Options
+
+	mutex  sync.Mutex
+	reason string
+}
+
+// RequireExport skips the check if the module under test does not export
+// name.
+func (e *Env) RequireExport(t *testing.T, name string) {
+	t.Helper()
+	if e.Info.Export(name) == nil {
+		e.mutex.Lock()
+		e.reason = name + " not exported"
+		e.mutex.Unlock()
+		t.Skipf("module does not export %s", name)
+	}
+}
+
+func (e *Env) skipReason() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.reason
+}
+
+// Config returns a new Config running the module under test.
+func (e *Env) Config() *water.Config {
+	return e.config(e.Bin, e.Options.TransportModuleConfig)
+}
+
+// PeerConfig returns a new Config running the peer module.
+func (e *Env) PeerConfig() *water.Config {
+	return e.config(e.PeerBin, e.Options.PeerTransportModuleConfig)
+}
+
+func (e *Env) config(bin, tmConfig []byte) *water.Config {
+	config := &water.Config{
+		TransportModuleBin: bin,
+	}
+	if tmConfig != nil {
+		config.TransportModuleConfig = water.TransportModuleConfigFromBytes(tmConfig)
+	}
+	return config
+}
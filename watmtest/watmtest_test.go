@@ -0,0 +1,40 @@
+package watmtest_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/refraction-networking/water/internal/watmbuild"
+	"github.com/refraction-networking/water/watmtest"
+)
+
+func readWATM(t *testing.T, path string) []byte {
+	t.Helper()
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wasm
+}
+
+func TestRunConformance(t *testing.T) {
+	for name, load := range map[string]func(t *testing.T) []byte{
+		"v0 go": func(t *testing.T) []byte { return readWATM(t, "../examples/v0/watm/plain.go.wasm") },
+		"v1":    func(t *testing.T) []byte { return readWATM(t, "../transport/v1/testdata/plain.wasm") },
+		"v1 go plain": func(t *testing.T) []byte {
+			return watmbuild.Require(t, watmbuild.Plain)
+		},
+		"v1 go reverse": func(t *testing.T) []byte {
+			return watmbuild.Require(t, watmbuild.Reverse)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			report := watmtest.RunConformanceWithOptions(t, load(t), &watmtest.Options{
+				TransferSize: 1 << 20,
+			})
+			if report.Failed() {
+				t.Errorf("report has failures:\n%s", report)
+			}
+		})
+	}
+}
@@ -5,23 +5,34 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	rand "crypto/rand"
 
 	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
 )
 
 // WazeroModuleConfigFactory is used to spawn wazero.ModuleConfig.
 type WazeroModuleConfigFactory struct {
 	moduleConfig wazero.ModuleConfig
 	fsconfig     wazero.FSConfig
+
+	// kept to allow wrapping, since wazero.ModuleConfig does not expose them
+	randSource io.Reader
+	walltime   sys.Walltime // nil for the system clock
+	nanotime   sys.Nanotime // nil for the system clock
 }
 
 // NewWazeroModuleConfigFactory creates a new WazeroModuleConfigFactory.
+//
+// Both WASI commands and WASI reactors are supported: whichever of _start
+// and _initialize is exported is called on instantiation.
 func NewWazeroModuleConfigFactory() *WazeroModuleConfigFactory {
 	return &WazeroModuleConfigFactory{
-		moduleConfig: wazero.NewModuleConfig().WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(rand.Reader),
+		moduleConfig: wazero.NewModuleConfig().WithStartFunctions("_start", "_initialize").WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(rand.Reader),
 		fsconfig:     wazero.NewFSConfig(),
+		randSource:   rand.Reader,
 	}
 }
 
@@ -33,6 +44,9 @@ func (wmcf *WazeroModuleConfigFactory) Clone() *WazeroModuleConfigFactory {
 	return &WazeroModuleConfigFactory{
 		moduleConfig: wmcf.moduleConfig,
 		fsconfig:     wmcf.fsconfig,
+		randSource:   wmcf.randSource,
+		walltime:     wmcf.walltime,
+		nanotime:     wmcf.nanotime,
 	}
 }
 
@@ -141,6 +155,66 @@ func (wmcf *WazeroModuleConfigFactory) SetPreopenDir(path string, guestPath stri
 	wmcf.fsconfig = wmcf.fsconfig.WithDirMount(path, guestPath)
 }
 
+// SetRandSource sets the source of random bytes for the WebAssembly module.
+//
+// By default, crypto/rand.Reader is used. Replacing it with a deterministic
+// source is only useful for testing and debugging purposes.
+func (wmcf *WazeroModuleConfigFactory) SetRandSource(r io.Reader) {
+	wmcf.randSource = r
+	wmcf.moduleConfig = wmcf.moduleConfig.WithRandSource(r)
+}
+
+// RandSource returns the source of random bytes for the WebAssembly module.
+func (wmcf *WazeroModuleConfigFactory) RandSource() io.Reader {
+	if wmcf.randSource == nil {
+		return rand.Reader
+	}
+
+	return wmcf.randSource
+}
+
+// SetWalltime sets the wall clock for the WebAssembly module.
+//
+// By default, the system clock is used. Replacing it is only useful for
+// testing and debugging purposes.
+func (wmcf *WazeroModuleConfigFactory) SetWalltime(walltime sys.Walltime) {
+	wmcf.walltime = walltime
+	wmcf.moduleConfig = wmcf.moduleConfig.WithWalltime(walltime, sys.ClockResolution(time.Microsecond))
+}
+
+// Walltime returns the wall clock for the WebAssembly module.
+func (wmcf *WazeroModuleConfigFactory) Walltime() sys.Walltime {
+	if wmcf.walltime == nil {
+		return func() (sec int64, nsec int32) {
+			t := time.Now()
+			return t.Unix(), int32(t.Nanosecond())
+		}
+	}
+
+	return wmcf.walltime
+}
+
+// SetNanotime sets the monotonic clock for the WebAssembly module.
+//
+// By default, the system clock is used. Replacing it is only useful for
+// testing and debugging purposes.
+func (wmcf *WazeroModuleConfigFactory) SetNanotime(nanotime sys.Nanotime) {
+	wmcf.nanotime = nanotime
+	wmcf.moduleConfig = wmcf.moduleConfig.WithNanotime(nanotime, sys.ClockResolution(1))
+}
+
+// Nanotime returns the monotonic clock for the WebAssembly module.
+func (wmcf *WazeroModuleConfigFactory) Nanotime() sys.Nanotime {
+	if wmcf.nanotime == nil {
+		start := time.Now()
+		return func() int64 {
+			return int64(time.Since(start))
+		}
+	}
+
+	return wmcf.nanotime
+}
+
 // TODO: consider adding SetPreopenReadonlyDir
 // TODO: consider adding SetPreopenFS
 